@@ -23,12 +23,14 @@ import (
 	_ "github.com/nyaruka/mailroom/core/tasks/interrupts"
 	_ "github.com/nyaruka/mailroom/core/tasks/ivr"
 	_ "github.com/nyaruka/mailroom/core/tasks/msgs"
+	_ "github.com/nyaruka/mailroom/core/tasks/retention"
 	_ "github.com/nyaruka/mailroom/core/tasks/schedules"
 	_ "github.com/nyaruka/mailroom/core/tasks/starts"
 	_ "github.com/nyaruka/mailroom/core/tasks/timeouts"
 	_ "github.com/nyaruka/mailroom/services/external/omie"
 	_ "github.com/nyaruka/mailroom/services/external/openai/chatgpt"
 	_ "github.com/nyaruka/mailroom/services/external/weni"
+	_ "github.com/nyaruka/mailroom/services/ivr/callcontrol"
 	_ "github.com/nyaruka/mailroom/services/ivr/twiml"
 	_ "github.com/nyaruka/mailroom/services/ivr/vonage"
 	_ "github.com/nyaruka/mailroom/services/tickets/freshchat"
@@ -40,6 +42,10 @@ import (
 	_ "github.com/nyaruka/mailroom/services/tickets/twilioflex2"
 	_ "github.com/nyaruka/mailroom/services/tickets/wenichats"
 	_ "github.com/nyaruka/mailroom/services/tickets/zendesk"
+	_ "github.com/nyaruka/mailroom/services/transcribers/whisper"
+	_ "github.com/nyaruka/mailroom/web/broadcast"
+	_ "github.com/nyaruka/mailroom/web/campaign"
+	_ "github.com/nyaruka/mailroom/web/channel"
 	_ "github.com/nyaruka/mailroom/web/contact"
 	_ "github.com/nyaruka/mailroom/web/docs"
 	_ "github.com/nyaruka/mailroom/web/expression"
@@ -48,6 +54,7 @@ import (
 	_ "github.com/nyaruka/mailroom/web/msg"
 	_ "github.com/nyaruka/mailroom/web/org"
 	_ "github.com/nyaruka/mailroom/web/po"
+	_ "github.com/nyaruka/mailroom/web/session"
 	_ "github.com/nyaruka/mailroom/web/simulation"
 	_ "github.com/nyaruka/mailroom/web/surveyor"
 	_ "github.com/nyaruka/mailroom/web/ticket"
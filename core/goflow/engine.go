@@ -15,8 +15,8 @@ import (
 	"github.com/shopspring/decimal"
 )
 
-var eng, simulator flows.Engine
-var engInit, simulatorInit sync.Once
+var eng, simulator, replayer flows.Engine
+var engInit, simulatorInit, replayerInit sync.Once
 
 var emailFactory func(*runtime.Config) engine.EmailServiceFactory
 var classificationFactory func(*runtime.Config) engine.ClassificationServiceFactory
@@ -121,6 +121,23 @@ func Simulator(c *runtime.Config) flows.Engine {
 	return simulator
 }
 
+// Replayer returns the global engine instance for use with replays of stored sessions. It has no services which make
+// calls outside of mailroom so that replaying can't repeat webhook calls, classifications etc, which instead fail.
+// Emails, tickets and airtime transfers are faked like in the simulator.
+func Replayer(c *runtime.Config) flows.Engine {
+	replayerInit.Do(func() {
+		replayer = engine.NewBuilder().
+			WithEmailServiceFactory(simulatorEmailServiceFactory).
+			WithTicketServiceFactory(simulatorTicketServiceFactory).
+			WithAirtimeServiceFactory(simulatorAirtimeServiceFactory).
+			WithMaxStepsPerSprint(c.MaxStepsPerSprint).
+			WithMaxResumesPerSession(c.MaxResumesPerSession).
+			Build()
+	})
+
+	return replayer
+}
+
 func simulatorEmailServiceFactory(session flows.Session) (flows.EmailService, error) {
 	return &simulatorEmailService{}, nil
 }
@@ -101,3 +101,28 @@ func TestSimulatorWebhook(t *testing.T) {
 	assert.Equal(t, "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\n", string(call.ResponseTrace))
 	assert.Equal(t, "OK", string(call.ResponseBody))
 }
+
+func TestReplayer(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	// nothing which calls outside of mailroom can be used when replaying
+	_, err := goflow.Replayer(rt.Config).Services().Webhook(nil)
+	assert.Error(t, err)
+
+	_, err = goflow.Replayer(rt.Config).Services().Classification(nil)
+	assert.Error(t, err)
+
+	// but tickets are faked as in the simulator
+	ticketer, err := models.LookupTicketerByUUID(ctx, db, testdata.Mailgun.UUID)
+	require.NoError(t, err)
+
+	svc, err := goflow.Replayer(rt.Config).Services().Ticket(nil, flows.NewTicketer(ticketer))
+	require.NoError(t, err)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	ticket, err := svc.Open(nil, oa.SessionAssets().Topics().FindByName("General"), "Where are my cookies?", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "Where are my cookies?", ticket.Body())
+}
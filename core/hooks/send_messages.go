@@ -3,9 +3,13 @@ package hooks
 import (
 	"context"
 
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/msgio"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -19,6 +23,10 @@ type sendMessagesHook struct{}
 func (h *sendMessagesHook) Apply(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *models.OrgAssets, scenes map[*models.Scene][]interface{}) error {
 	msgs := make([]*models.Msg, 0, 1)
 
+	// contacts which have tripped the loop guard
+	loopingContacts := make([]flows.ContactUUID, 0)
+	loopLogs := make([]*models.HTTPLog, 0)
+
 	// for each scene gather all our messages
 	for s, args := range scenes {
 		sceneMsgs := make([]*models.Msg, 0, 1)
@@ -27,6 +35,17 @@ func (h *sendMessagesHook) Apply(ctx context.Context, rt *runtime.Runtime, tx *s
 			sceneMsgs = append(sceneMsgs, m.(*models.Msg))
 		}
 
+		// if this contact is looping, stop these messages and interrupt their session
+		log, err := guardSceneMsgs(ctx, rt, tx, oa, s, sceneMsgs)
+		if err != nil {
+			return err
+		}
+		if log != nil {
+			loopingContacts = append(loopingContacts, s.ContactUUID())
+			loopLogs = append(loopLogs, log)
+			continue
+		}
+
 		// if our scene has a timeout, set it on our last message
 		if len(sceneMsgs) > 0 && s.Session().Timeout() != nil && s.Session().WaitStartedOn() != nil {
 			sceneMsgs[len(sceneMsgs)-1].SetTimeout(*s.Session().WaitStartedOn(), *s.Session().Timeout())
@@ -35,6 +54,56 @@ func (h *sendMessagesHook) Apply(ctx context.Context, rt *runtime.Runtime, tx *s
 		msgs = append(msgs, sceneMsgs...)
 	}
 
+	if len(loopingContacts) > 0 {
+		if _, err := models.IncidentContactsLooping(ctx, tx, rt.RP, oa, loopingContacts); err != nil {
+			return errors.Wrap(err, "error creating looping contacts incident")
+		}
+		if err := models.InsertHTTPLogs(ctx, tx, loopLogs); err != nil {
+			return errors.Wrap(err, "error inserting loop detected logs")
+		}
+	}
+
 	msgio.SendMessages(ctx, rt, tx, nil, msgs)
 	return nil
 }
+
+// checks the messages of the passed in scene against the loop guard, and if it trips, fails them and interrupts the
+// scene's session, returning the log which records that
+func guardSceneMsgs(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, oa *models.OrgAssets, s *models.Scene, msgs []*models.Msg) (*models.HTTPLog, error) {
+	sending := make([]*models.Msg, 0, len(msgs))
+	for _, m := range msgs {
+		if m.Status() != models.MsgStatusFailed {
+			sending = append(sending, m)
+		}
+	}
+	if len(sending) == 0 {
+		return nil, nil
+	}
+
+	check, err := models.CheckLoopGuard(ctx, rt, s.ContactID(), sending[0].URN(), len(sending))
+	if err != nil {
+		// we'd rather send than block messaging because redis is having problems
+		logrus.WithError(err).WithField("contact_uuid", s.ContactUUID()).Error("error checking loop guard")
+		return nil, nil
+	}
+	if !check.Tripped() {
+		return nil, nil
+	}
+
+	if err := models.FailMessages(ctx, tx, sending, models.MsgFailedLooping); err != nil {
+		return nil, errors.Wrap(err, "error failing looping messages")
+	}
+
+	flowID := models.NilFlowID
+	if s.Session() != nil {
+		flowID = s.Session().CurrentFlowID()
+
+		if err := models.ExitSessions(ctx, tx, []models.SessionID{s.SessionID()}, models.ExitInterrupted); err != nil {
+			return nil, errors.Wrap(err, "error interrupting looping session")
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{"contact_uuid": s.ContactUUID(), "reason": check.Reason, "msgs": len(sending)}).Warn("loop guard tripped, session interrupted")
+
+	return models.NewLoopDetectedLog(oa.OrgID(), flowID, check, len(sending), s.Session(), dates.Now()), nil
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"path"
 	"strconv"
 	"time"
 
@@ -27,6 +26,7 @@ import (
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
 )
 
@@ -95,6 +95,32 @@ type Service interface {
 	CallIDForRequest(r *http.Request) (string, error)
 }
 
+// VoicemailService is implemented by services which can leave a voicemail when a call is answered by a machine
+type VoicemailService interface {
+	// RequestVoicemailCall requests a new outgoing call like RequestCall, but asking the provider to detect answering
+	// machines and to wait for their beep rather than hanging up on them
+	RequestVoicemailCall(number urns.URN, handleURL string, statusURL string) (CallID, *httpx.Trace, error)
+
+	// WriteVoicemailResponse writes a response to a start request which leaves the passed in voicemail and hangs up
+	WriteVoicemailResponse(w http.ResponseWriter, voicemail *models.IVRVoicemail) error
+
+	// LeaveVoicemail replaces whatever is happening on an ongoing call with leaving the passed in voicemail
+	LeaveVoicemail(externalID string, voicemail *models.IVRVoicemail) (*httpx.Trace, error)
+}
+
+// CDRService is implemented by services which include call detail records in their status callbacks
+type CDRService interface {
+	// CDRForRequest returns the call detail record in the passed in status request, or nil if the call hasn't ended
+	CDRForRequest(r *http.Request) *models.CallDetailRecord
+}
+
+// CDRPriceService is implemented by services which can be asked for the price of a call after it has ended, for
+// providers which don't always know the price of a call when they tell us it has ended
+type CDRPriceService interface {
+	// CallPrice returns the price and currency of the call with the passed in ID, or a nil price if it isn't known yet
+	CallPrice(callID string) (*decimal.Decimal, string, *httpx.Trace, error)
+}
+
 // HangupCall hangs up the passed in call also taking care of updating the status of our call in the process
 func HangupCall(ctx context.Context, rt *runtime.Runtime, conn *models.ChannelConnection) error {
 	// no matter what mark our call as failed
@@ -201,13 +227,27 @@ func RequestCallStart(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAs
 		return nil, errors.Wrapf(err, "error creating ivr session")
 	}
 
-	return conn, RequestCallStartForConnection(ctx, rt, channel, telURN, conn)
+	return conn, RequestCallStartForConnection(ctx, rt, oa, channel, telURN, conn)
 }
 
-func RequestCallStartForConnection(ctx context.Context, rt *runtime.Runtime, channel *models.Channel, telURN urns.URN, conn *models.ChannelConnection) error {
+// RequestCallStartForConnection requests the call for the passed in connection, queuing it to be retried later if it
+// falls outside of the channel's call window or the channel is at its concurrent calls limit, and pacing it to respect
+// the channel's calls per second
+func RequestCallStartForConnection(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, channel *models.Channel, telURN urns.URN, conn *models.ChannelConnection) error {
 	// the domain that will be used for callbacks, can be specific for channels due to white labeling
 	domain := channel.ConfigValue(models.ChannelConfigCallbackDomain, rt.Config.Domain)
 
+	// if we're outside of the channel's call window in the contact's timezone, queue this call until it next opens
+	now := dates.Now()
+	if next := channel.Dialer().NextCallWindow(now, models.CallTimezone(oa, telURN)); next.After(now) {
+		logrus.WithField("channel_id", channel.ID()).WithField("next_attempt", next).Info("call being queued, outside of call window")
+		err := conn.MarkQueued(ctx, rt.DB, next)
+		if err != nil {
+			return errors.Wrapf(err, "error marking connection as queued")
+		}
+		return nil
+	}
+
 	// get max concurrent events if any
 	maxCalls := channel.ConfigValue(models.ChannelConfigMaxConcurrentEvents, "")
 	if maxCalls != "" {
@@ -232,6 +272,34 @@ func RequestCallStartForConnection(ctx context.Context, rt *runtime.Runtime, cha
 		}
 	}
 
+	// wait for our slot if the channel paces its calls, or queue this call if that would be too long
+	rc := rt.RP.Get()
+	slot, reserved, err := models.ReserveCallSlot(rc, channel, time.Now())
+	rc.Close()
+	if err != nil {
+		return errors.Wrapf(err, "error reserving call slot")
+	}
+	if !reserved {
+		logrus.WithField("channel_id", channel.ID()).Info("call being queued, calls per second reached")
+		err := conn.MarkQueued(ctx, rt.DB, slot)
+		if err != nil {
+			return errors.Wrapf(err, "error marking connection as queued")
+		}
+		return nil
+	}
+	if wait := time.Until(slot); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// record this attempt before we make it so that attempts which fail on the provider side are counted too
+	if err := conn.MarkAttempted(ctx, rt.DB, dates.Now()); err != nil {
+		return errors.Wrapf(err, "error marking connection as attempted")
+	}
+
 	// create our callback
 	form := url.Values{
 		"connection": []string{fmt.Sprintf("%d", conn.ID())},
@@ -249,8 +317,24 @@ func RequestCallStartForConnection(ctx context.Context, rt *runtime.Runtime, cha
 		return errors.Wrapf(err, "unable to create IVR service")
 	}
 
+	// if the flow leaves voicemails and our service can, request a call which waits for the beep of answering machines
+	var voicemail *models.IVRVoicemail
+	vs, canVoicemail := c.(VoicemailService)
+	if canVoicemail {
+		voicemail, err = flowVoicemail(ctx, rt, oa, conn)
+		if err != nil {
+			return err
+		}
+	}
+
 	// try to request our call start
-	callID, trace, err := c.RequestCall(telURN, resumeURL, statusURL, channel.MachineDetection())
+	var callID CallID
+	var trace *httpx.Trace
+	if voicemail != nil {
+		callID, trace, err = vs.RequestVoicemailCall(telURN, resumeURL, statusURL)
+	} else {
+		callID, trace, err = c.RequestCall(telURN, resumeURL, statusURL, channel.MachineDetection())
+	}
 
 	/// insert an channel log if we have an HTTP trace
 	if trace != nil {
@@ -287,6 +371,65 @@ func RequestCallStartForConnection(ctx context.Context, rt *runtime.Runtime, cha
 	return nil
 }
 
+// gets the voicemail to leave for the passed in connection, which is nil if it isn't for a flow start or that flow
+// doesn't leave voicemails
+func flowVoicemail(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, conn *models.ChannelConnection) (*models.IVRVoicemail, error) {
+	if conn.StartID() == models.NilStartID {
+		return nil, nil
+	}
+
+	start, err := models.GetFlowStartAttributes(ctx, rt.DB, conn.StartID())
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to load start: %d", conn.StartID())
+	}
+	flow, err := oa.FlowByID(start.FlowID())
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to load flow: %d", start.FlowID())
+	}
+
+	return flow.IVRVoicemail(), nil
+}
+
+// leaves the passed in voicemail on an ongoing call, interrupting any flow which had started talking to the machine
+func leaveVoicemail(ctx context.Context, rt *runtime.Runtime, svc VoicemailService, channel *models.Channel, conn *models.ChannelConnection, voicemail *models.IVRVoicemail) error {
+	trace, err := svc.LeaveVoicemail(conn.ExternalID(), voicemail)
+
+	// insert a channel log if we have an HTTP trace
+	if trace != nil {
+		desc := "Voicemail Left"
+		isError := err != nil
+		if isError {
+			desc = "Error Leaving Voicemail"
+		}
+		logErr := models.InsertChannelLogs(ctx, rt.DB, []*models.ChannelLog{models.NewChannelLog(trace, isError, desc, channel, conn)})
+		if logErr != nil {
+			logrus.WithError(logErr).Error("error inserting channel log")
+		}
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "error leaving voicemail")
+	}
+
+	err = models.InterruptContactRuns(ctx, rt.DB, models.FlowTypeVoice, []flows.ContactID{flows.ContactID(conn.ContactID())}, dates.Now())
+	if err != nil {
+		return errors.Wrapf(err, "error interrupting voice sessions")
+	}
+
+	return conn.MarkVoicemailLeft(ctx, rt.DB, dates.Now())
+}
+
+// marks the passed in connection as errored, scheduling a retry according to the channel's retry schedule for the
+// error reason if it has one, otherwise according to the flow's retry settings
+func markErrored(ctx context.Context, rt *runtime.Runtime, channel *models.Channel, flow *models.Flow, conn *models.ChannelConnection, errorReason models.ConnectionError) error {
+	retryWait, maxRetries := flow.IVRRetryWait(), models.ConnectionMaxRetries
+	if channel != nil {
+		retryWait, maxRetries = channel.Dialer().RetryWait(errorReason, conn.ErrorCount(), retryWait)
+	}
+
+	return conn.MarkErroredWithRetries(ctx, rt.DB, dates.Now(), retryWait, maxRetries, errorReason)
+}
+
 // HandleAsFailure marks the passed in connection as errored and writes the appropriate error response to our writer
 func HandleAsFailure(ctx context.Context, db *sqlx.DB, svc Service, conn *models.ChannelConnection, w http.ResponseWriter, rootErr error) error {
 	err := conn.MarkFailed(ctx, db, time.Now())
@@ -319,7 +462,16 @@ func StartIVRFlow(
 
 	// check that call on service side is in the state we need to continue
 	if errorReason := svc.CheckStartRequest(r); errorReason != "" {
-		err := conn.MarkErrored(ctx, rt.DB, dates.Now(), flow.IVRRetryWait(), errorReason)
+		// if a machine answered and our flow leaves voicemails, do that instead of starting the flow
+		if vs, canVoicemail := svc.(VoicemailService); canVoicemail && errorReason == models.ConnectionErrorMachine && flow.IVRVoicemail() != nil {
+			err := conn.MarkVoicemailLeft(ctx, rt.DB, dates.Now())
+			if err != nil {
+				return errors.Wrap(err, "unable to mark connection as voicemail left")
+			}
+			return vs.WriteVoicemailResponse(w, flow.IVRVoicemail())
+		}
+
+		err := markErrored(ctx, rt, channel, flow, conn, errorReason)
 		if err != nil {
 			return errors.Wrap(err, "unable to mark connection as errored")
 		}
@@ -396,7 +548,7 @@ func StartIVRFlow(
 	}
 
 	// have our service output our session status
-	err = svc.WriteSessionResponse(ctx, rt, channel, conn, sessions[0], urn, resumeURL, r, w)
+	err = WriteSessionResponse(ctx, rt, svc, oa, channel, conn, sessions[0], urn, resumeURL, r, w)
 	if err != nil {
 		return errors.Wrapf(err, "error writing ivr response for start")
 	}
@@ -416,7 +568,7 @@ func ResumeIVRFlow(
 		return errors.Wrapf(err, "error creating flow contact")
 	}
 
-	session, err := models.ActiveSessionForContact(ctx, rt.DB, rt.SessionStorage, oa, models.FlowTypeVoice, contact)
+	session, err := models.ActiveSessionForContact(ctx, rt, oa, models.FlowTypeVoice, contact)
 	if err != nil {
 		return errors.Wrapf(err, "error loading session for contact")
 	}
@@ -510,7 +662,7 @@ func ResumeIVRFlow(
 
 	// if still active, write out our response
 	if status == models.ConnectionStatusInProgress {
-		err = svc.WriteSessionResponse(ctx, rt, channel, conn, session, urn, resumeURL, r, w)
+		err = WriteSessionResponse(ctx, rt, svc, oa, channel, conn, session, urn, resumeURL, r, w)
 		if err != nil {
 			return errors.Wrapf(err, "error writing ivr response for resume")
 		}
@@ -563,10 +715,17 @@ func buildMsgResume(
 			return nil, errors.Errorf("unable to download attachment, ending call"), nil
 		}
 
-		// filename is based on our org id and msg UUID
-		filename := string(msgUUID) + path.Ext(resume.Attachment.URL())
+		audio, err := readRecording(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read attachment, ending call"), nil
+		}
+
+		// filename is based on our msg UUID
+		contentType := resume.Attachment.ContentType()
+		filename := string(msgUUID) + recordingExtension(resume.Attachment.URL(), contentType)
 
-		resume.Attachment, err = oa.Org().StoreAttachment(ctx, rt, filename, resume.Attachment.ContentType(), resp.Body)
+		resume.Attachment, err = StoreRecording(ctx, rt, oa, filename, contentType, audio)
 		if err != nil {
 			return nil, errors.Wrapf(err, "unable to download and store attachment, ending call"), nil
 		}
@@ -596,19 +755,47 @@ func buildMsgResume(
 		return nil, nil, errors.Wrapf(err, "error committing new message")
 	}
 
+	// if the channel has a transcriber, the transcription of a recording becomes the text of the message once it's done
+	if resume.Attachment != NilAttachment && resume.Input == "" {
+		rc := rt.RP.Get()
+		err = QueueTranscription(rc, oa.OrgID(), channel, conn, contact, msg.ID(), resume.Attachment)
+		rc.Close()
+		if err != nil {
+			logrus.WithError(err).WithField("msg_id", msg.ID()).Error("error queuing transcription of recording")
+		}
+	}
+
 	// create our msg resume event
 	return resumes.NewMsg(oa.Env(), contact, msgIn), nil, nil
 }
 
+// records the passed in call detail record, logging rather than failing on errors as these shouldn't affect the call
+func recordCDR(ctx context.Context, rt *runtime.Runtime, conn *models.ChannelConnection, cdr *models.CallDetailRecord) {
+	if err := models.RecordCallDetailRecord(ctx, rt.DB, conn, cdr); err != nil {
+		logrus.WithError(err).WithField("connection_id", conn.ID()).Error("error recording call detail record")
+	}
+}
+
 // HandleIVRStatus is called on status callbacks for an IVR call. We let the service decide whether the call has
 // ended for some reason and update the state of the call and session if so
 func HandleIVRStatus(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, svc Service, conn *models.ChannelConnection, r *http.Request, w http.ResponseWriter) error {
 	// read our status and duration from our service
 	status, errorReason, duration := svc.StatusForRequest(r)
 
+	// record the provider's details of the call if it has ended so that voice bills can be reconciled
+	if cs, hasCDRs := svc.(CDRService); hasCDRs {
+		if cdr := cs.CDRForRequest(r); cdr != nil {
+			cdr.Status = status
+			recordCDR(ctx, rt, conn, cdr)
+		}
+	}
+
 	if conn.Status() == models.ConnectionStatusErrored || conn.Status() == models.ConnectionStatusFailed {
 		return svc.WriteEmptyResponse(w, fmt.Sprintf("status %s ignored, already errored", status))
 	}
+	if conn.IsVoicemailLeft() && status == models.ConnectionStatusErrored {
+		return svc.WriteEmptyResponse(w, fmt.Sprintf("status %s ignored, voicemail already left", status))
+	}
 
 	// if we errored schedule a retry if appropriate
 	if status == models.ConnectionStatusErrored {
@@ -630,7 +817,16 @@ func HandleIVRStatus(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAss
 			return errors.Wrapf(err, "unable to load flow: %d", start.FlowID())
 		}
 
-		conn.MarkErrored(ctx, rt.DB, dates.Now(), flow.IVRRetryWait(), errorReason)
+		// if a machine answered and our flow leaves voicemails, do that instead of retrying
+		if vs, canVoicemail := svc.(VoicemailService); canVoicemail && errorReason == models.ConnectionErrorMachine && flow.IVRVoicemail() != nil {
+			err := leaveVoicemail(ctx, rt, vs, oa.ChannelByID(conn.ChannelID()), conn, flow.IVRVoicemail())
+			if err != nil {
+				return errors.Wrapf(err, "unable to leave voicemail")
+			}
+			return svc.WriteEmptyResponse(w, "voicemail left, status updated: D")
+		}
+
+		markErrored(ctx, rt, oa.ChannelByID(conn.ChannelID()), flow, conn, errorReason)
 
 		if conn.Status() == models.ConnectionStatusErrored {
 			return svc.WriteEmptyResponse(w, fmt.Sprintf("status updated: %s, next_attempt: %s", conn.Status(), conn.NextAttempt()))
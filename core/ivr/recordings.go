@@ -0,0 +1,245 @@
+package ivr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// OrgConfigRecordingRetentionDays is the org config key which overrides how many days IVR recordings are kept for
+	OrgConfigRecordingRetentionDays = "ivr_recording_retention_days"
+
+	// ChannelConfigTranscriber is the channel config key of the type of speech-to-text service used to transcribe recordings
+	ChannelConfigTranscriber = "transcriber"
+
+	// MaxRecordingBytes is the maximum size of a recording we'll read into memory to store or transcribe
+	MaxRecordingBytes = 1024 * 1024 * 50
+)
+
+// Transcriber is the interface speech-to-text services must satisfy to transcribe IVR recordings
+type Transcriber interface {
+	// Transcribe transcribes the passed in audio, language being the expected language of the speech if known
+	Transcribe(ctx context.Context, audio []byte, contentType string, language envs.Language) (string, *httpx.Trace, error)
+}
+
+// TranscriberConstructor defines our signature for creating a new transcriber from a channel
+type TranscriberConstructor func(*http.Client, *models.Channel) (Transcriber, error)
+
+// our map of transcriber constructors
+var transcribers = make(map[string]TranscriberConstructor)
+
+// RegisterTranscriber registers the passed in transcriber type with the passed in constructor
+func RegisterTranscriber(name string, constructor TranscriberConstructor) {
+	transcribers[name] = constructor
+}
+
+// GetTranscriber creates the transcriber configured on the passed in channel, returning nil if it has none
+func GetTranscriber(channel *models.Channel) (Transcriber, error) {
+	name := channel.ConfigValue(ChannelConfigTranscriber, "")
+	if name == "" {
+		return nil, nil
+	}
+
+	constructor := transcribers[name]
+	if constructor == nil {
+		return nil, errors.Errorf("no transcriber of type: %s", name)
+	}
+
+	return constructor(http.DefaultClient, channel)
+}
+
+// StoreRecording copies a recording from the IVR provider into our media storage. Recordings are kept under a path
+// prefixed with how many days they should be retained for (e.g. recordings/30d/...) or recordings/keep/ if they should be
+// kept forever, so that the storage can expire them with lifecycle rules.
+func StoreRecording(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, filename string, contentType string, content []byte) (utils.Attachment, error) {
+	if contentType == "" || !strings.Contains(contentType, "/") {
+		contentType = http.DetectContentType(content)
+		contentType, _, _ = mime.ParseMediaType(contentType)
+	}
+
+	storagePath := recordingPath(rt.Config.S3MediaPrefix, oa.OrgID(), RecordingRetentionDays(rt.Config, oa.Org()), filename)
+
+	url, err := rt.MediaStorage.Put(ctx, storagePath, contentType, content)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to store recording")
+	}
+
+	return utils.Attachment(contentType + ":" + url), nil
+}
+
+// RecordingRetentionDays returns how many days the given org keeps IVR recordings for, zero meaning forever
+func RecordingRetentionDays(cfg *runtime.Config, org *models.Org) int {
+	days := org.ConfigIntValue(OrgConfigRecordingRetentionDays, cfg.IVRRecordingRetentionDays)
+	if days < 0 {
+		return cfg.IVRRecordingRetentionDays
+	}
+	return days
+}
+
+func recordingPath(prefix string, orgID models.OrgID, retentionDays int, filename string) string {
+	retention := "keep"
+	if retentionDays > 0 {
+		retention = fmt.Sprintf("%dd", retentionDays)
+	}
+
+	p := filepath.Join(prefix, "recordings", retention, fmt.Sprintf("%d", orgID), filename)
+
+	// ensure path begins with /
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// reads a recording, erroring rather than reading it all into memory if it's larger than MaxRecordingBytes
+func readRecording(r io.Reader) ([]byte, error) {
+	audio, err := io.ReadAll(io.LimitReader(r, MaxRecordingBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(audio) > MaxRecordingBytes {
+		return nil, errors.Errorf("recording is larger than %d bytes", MaxRecordingBytes)
+	}
+	return audio, nil
+}
+
+// TranscribeRecordingTask is our task for transcribing a recording made during an IVR call. The transcription becomes
+// the text of the incoming message the recording was attached to.
+type TranscribeRecordingTask struct {
+	ChannelID    models.ChannelID    `json:"channel_id"    validate:"required"`
+	ConnectionID models.ConnectionID `json:"connection_id" validate:"required"`
+	MsgID        flows.MsgID         `json:"msg_id"        validate:"required"`
+	Recording    utils.Attachment    `json:"recording"     validate:"required"`
+	Language     envs.Language       `json:"language"`
+}
+
+// QueueTranscription queues the passed in recording to be transcribed if the channel has a transcriber. Transcribing
+// happens outside of the call as it can take longer than the IVR provider will wait for our response.
+func QueueTranscription(rc redis.Conn, orgID models.OrgID, channel *models.Channel, conn *models.ChannelConnection, contact *flows.Contact, msgID flows.MsgID, recording utils.Attachment) error {
+	if channel.ConfigValue(ChannelConfigTranscriber, "") == "" {
+		return nil
+	}
+
+	task := &TranscribeRecordingTask{
+		ChannelID:    channel.ID(),
+		ConnectionID: conn.ID(),
+		MsgID:        msgID,
+		Recording:    recording,
+		Language:     contact.Language(),
+	}
+	return queue.AddTask(rc, queue.BatchQueue, queue.TranscribeRecording, int(orgID), task, queue.DefaultPriority)
+}
+
+// TranscribeRecording performs the passed in transcription task, fetching the recording back from our media storage
+func TranscribeRecording(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID, task *TranscribeRecordingTask) error {
+	oa, err := models.GetOrgAssets(ctx, rt, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading org assets")
+	}
+
+	// channel has been deleted since, nothing to do
+	channel := oa.ChannelByID(task.ChannelID)
+	if channel == nil {
+		return nil
+	}
+
+	conn, err := models.SelectChannelConnection(ctx, rt.DB, task.ConnectionID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading connection %d", task.ConnectionID)
+	}
+
+	audio, err := downloadRecording(task.Recording.URL())
+	if err != nil {
+		return errors.Wrapf(err, "error downloading recording %s", task.Recording.URL())
+	}
+
+	text := transcribeRecording(ctx, rt, channel, conn, task.Language, task.Recording.ContentType(), audio)
+	if text == "" {
+		return nil
+	}
+
+	return models.UpdateMessageText(ctx, rt.DB, task.MsgID, text)
+}
+
+// downloads a recording from our media storage, erroring if it's larger than MaxRecordingBytes
+func downloadRecording(url string) ([]byte, error) {
+	req, err := httpx.NewRequest("GET", url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	trace, err := httpx.DoTrace(http.DefaultClient, req, nil, nil, MaxRecordingBytes)
+	if err != nil {
+		return nil, err
+	}
+	if trace.Response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("received non-200 response: %d", trace.Response.StatusCode)
+	}
+	return trace.ResponseBody, nil
+}
+
+// transcribes the passed in recording with the transcriber of the passed in channel, if it has one. Failures are
+// logged to the channel but otherwise ignored as the recording has still been received.
+func transcribeRecording(ctx context.Context, rt *runtime.Runtime, channel *models.Channel, conn *models.ChannelConnection, language envs.Language, contentType string, audio []byte) string {
+	log := logrus.WithField("channel_uuid", channel.UUID()).WithField("connection_id", conn.ID())
+
+	transcriber, err := GetTranscriber(channel)
+	if err != nil {
+		log.WithError(err).Error("error creating transcriber")
+		return ""
+	}
+	if transcriber == nil {
+		return ""
+	}
+
+	text, trace, err := transcriber.Transcribe(ctx, audio, contentType, language)
+
+	// insert a channel log if we have an HTTP trace
+	if trace != nil {
+		desc := "Recording Transcribed"
+		isError := err != nil
+		if isError {
+			desc = "Error Transcribing Recording"
+		}
+		logErr := models.InsertChannelLogs(ctx, rt.DB, []*models.ChannelLog{models.NewChannelLog(trace, isError, desc, channel, conn)})
+		if logErr != nil {
+			log.WithError(logErr).Error("error inserting channel log")
+		}
+	}
+
+	if err != nil {
+		log.WithError(err).Error("error transcribing recording")
+		return ""
+	}
+
+	return strings.TrimSpace(text)
+}
+
+// gets the extension to use for a recording
+func recordingExtension(url string, contentType string) string {
+	ext := path.Ext(strings.SplitN(url, "?", 2)[0])
+	if ext == "" {
+		if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	return ext
+}
@@ -0,0 +1,173 @@
+package ivr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testTranscriber struct {
+	language envs.Language
+}
+
+func (t *testTranscriber) Transcribe(ctx context.Context, audio []byte, contentType string, language envs.Language) (string, *httpx.Trace, error) {
+	t.language = language
+	if string(audio) == "error" {
+		return "", nil, errors.New("boom")
+	}
+	return " I said " + string(audio) + "\n", nil, nil
+}
+
+func TestStoreRecording(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	defer func() { rt.Config.IVRRecordingRetentionDays = 0 }()
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// by default recordings are kept forever
+	assert.Equal(t, 0, RecordingRetentionDays(rt.Config, oa.Org()))
+
+	att, err := StoreRecording(ctx, rt, oa, "5e5b3ec5-2c1f-4f8c-9b5a-2a3e2bd4d0c5.wav", "audio/wav", []byte("RIFF...."))
+	require.NoError(t, err)
+	assert.Equal(t, "audio/wav", att.ContentType())
+	assert.True(t, strings.HasSuffix(att.URL(), "/media/recordings/keep/1/5e5b3ec5-2c1f-4f8c-9b5a-2a3e2bd4d0c5.wav"), "unexpected url: %s", att.URL())
+
+	// default can be set by config
+	rt.Config.IVRRecordingRetentionDays = 30
+	assert.Equal(t, 30, RecordingRetentionDays(rt.Config, oa.Org()))
+
+	// and overridden by orgs
+	db.MustExec(`UPDATE orgs_org SET config = config::jsonb || '{"ivr_recording_retention_days": 7}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+	assert.Equal(t, 7, RecordingRetentionDays(rt.Config, oa.Org()))
+
+	// which changes where new recordings are stored
+	att, err = StoreRecording(ctx, rt, oa, "0a1b2c3d.mp3", "audio", []byte("ID3...."))
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(att.URL(), "/media/recordings/7d/1/0a1b2c3d.mp3"), "unexpected url: %s", att.URL())
+
+	assert.Equal(t, ".wav", recordingExtension("https://api.twilio.com/recordings/RE123.wav?download=true", "audio/wav"))
+	assert.Equal(t, ".mp3", recordingExtension("https://api.twilio.com/recordings/RE123.mp3", "audio/wav"))
+	assert.Equal(t, "", recordingExtension("https://api.nexmo.com/v1/files/aaaaaaaa", "audio"))
+}
+
+func TestTranscribeRecording(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	transcriber := &testTranscriber{}
+	RegisterTranscriber("test", func(*http.Client, *models.Channel) (Transcriber, error) { return transcriber, nil })
+
+	db.MustExec(`UPDATE channels_channel SET config = config::jsonb || '{"transcriber": "test"}'::jsonb WHERE id = $1`, testdata.TwilioChannel.ID)
+	db.MustExec(`UPDATE channels_channel SET config = config::jsonb || '{"transcriber": "xxx"}'::jsonb WHERE id = $1`, testdata.VonageChannel.ID)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	_, contact := testdata.Cathy.Load(db, oa)
+
+	conn, err := models.InsertIVRConnection(ctx, db, testdata.Org1.ID, testdata.TwilioChannel.ID, models.NilStartID, testdata.Cathy.ID, testdata.Cathy.URNID, models.ConnectionDirectionOut, models.ConnectionStatusInProgress, "CA1234")
+	require.NoError(t, err)
+
+	twilio := oa.ChannelByID(testdata.TwilioChannel.ID)
+	vonage := oa.ChannelByID(testdata.VonageChannel.ID)
+
+	assert.Equal(t, "I said hello", transcribeRecording(ctx, rt, twilio, conn, contact.Language(), "audio/wav", []byte("hello")))
+	assert.Equal(t, contact.Language(), transcriber.language)
+
+	// errors from the transcriber don't stop the call but mean no text
+	assert.Equal(t, "", transcribeRecording(ctx, rt, twilio, conn, contact.Language(), "audio/wav", []byte("error")))
+
+	// as do unknown transcribers
+	_, err = GetTranscriber(vonage)
+	assert.EqualError(t, err, "no transcriber of type: xxx")
+	assert.Equal(t, "", transcribeRecording(ctx, rt, vonage, conn, contact.Language(), "audio/wav", []byte("hello")))
+
+	// and channels without transcribers don't transcribe
+	db.MustExec(`UPDATE channels_channel SET config = config::jsonb - 'transcriber' WHERE id = $1`, testdata.TwilioChannel.ID)
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	trans, err := GetTranscriber(oa.ChannelByID(testdata.TwilioChannel.ID))
+	assert.NoError(t, err)
+	assert.Nil(t, trans)
+}
+
+func TestQueueTranscription(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	transcriber := &testTranscriber{}
+	RegisterTranscriber("test", func(*http.Client, *models.Channel) (Transcriber, error) { return transcriber, nil })
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	_, contact := testdata.Cathy.Load(db, oa)
+	twilio := oa.ChannelByID(testdata.TwilioChannel.ID)
+
+	conn, err := models.InsertIVRConnection(ctx, db, testdata.Org1.ID, testdata.TwilioChannel.ID, models.NilStartID, testdata.Cathy.ID, testdata.Cathy.URNID, models.ConnectionDirectionOut, models.ConnectionStatusInProgress, "CA1234")
+	require.NoError(t, err)
+
+	msg := testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "", models.MsgStatusHandled)
+	recording := utils.Attachment("audio/wav:http://mailroom.io/media/recordings/keep/1/recording.wav")
+
+	// nothing is queued for channels without a transcriber
+	err = QueueTranscription(rc, testdata.Org1.ID, twilio, conn, contact, msg.ID(), recording)
+	require.NoError(t, err)
+
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Nil(t, task)
+
+	db.MustExec(`UPDATE channels_channel SET config = config::jsonb || '{"transcriber": "test"}'::jsonb WHERE id = $1`, testdata.TwilioChannel.ID)
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+	twilio = oa.ChannelByID(testdata.TwilioChannel.ID)
+
+	err = QueueTranscription(rc, testdata.Org1.ID, twilio, conn, contact, msg.ID(), recording)
+	require.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+	assert.Equal(t, queue.TranscribeRecording, task.Type)
+
+	transcribe := &TranscribeRecordingTask{}
+	require.NoError(t, json.Unmarshal(task.Task, transcribe))
+	assert.Equal(t, &TranscribeRecordingTask{ChannelID: testdata.TwilioChannel.ID, ConnectionID: conn.ID(), MsgID: msg.ID(), Recording: recording, Language: contact.Language()}, transcribe)
+
+	// performing the task fetches the stored recording and sets the transcription as the text of the message
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"http://mailroom.io/media/recordings/keep/1/recording.wav": {httpx.NewMockResponse(200, nil, "hello")},
+	}))
+
+	err = TranscribeRecording(ctx, rt, testdata.Org1.ID, transcribe)
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT text FROM msgs_msg WHERE id = $1`, msg.ID()).Returns("I said hello")
+}
@@ -0,0 +1,244 @@
+package ivr
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TransferAction is the handle action providers call when a call transferred to an agent ends
+const TransferAction = "transfer"
+
+// TransferService is implemented by services which can bridge a call to an agent destination
+type TransferService interface {
+	// WriteTransferResponse writes a response which plays out the last sprint of the passed in session and then bridges
+	// the call to the passed in destination, with the provider calling statusURL when the bridged call ends
+	WriteTransferResponse(ctx context.Context, rt *runtime.Runtime, channel *models.Channel, session *models.Session, number urns.URN, destination *models.TransferDestination, statusURL string, w http.ResponseWriter) error
+
+	// TransferStatusForRequest returns the status and duration of the bridged call from the passed in request, or an
+	// empty status if the bridged call hasn't ended yet
+	TransferStatusForRequest(r *http.Request) (models.TransferStatus, int)
+}
+
+// WriteSessionResponse writes the response for the passed in session. If the flow has ended by opening a ticket on a
+// ticketer with an agent destination, the call is bridged to that destination instead of being hung up.
+func WriteSessionResponse(ctx context.Context, rt *runtime.Runtime, svc Service, oa *models.OrgAssets, channel *models.Channel, conn *models.ChannelConnection, session *models.Session, number urns.URN, resumeURL string, r *http.Request, w http.ResponseWriter) error {
+	if ts, canTransfer := svc.(TransferService); canTransfer && session.Wait() == nil && session.Sprint() != nil && session.Status() != models.SessionStatusFailed {
+		ticket, destination, err := transferForSession(ctx, rt, oa, session)
+		if err != nil {
+			return errors.Wrapf(err, "error looking up transfer for session")
+		}
+		if ticket != nil {
+			return transferCall(ctx, rt, ts, oa, channel, conn, session, ticket, destination, number, resumeURL, w)
+		}
+	}
+
+	return svc.WriteSessionResponse(ctx, rt, channel, conn, session, number, resumeURL, r, w)
+}
+
+// looks for a ticket opened in the last sprint of the passed in session on a ticketer which transfers calls to agents
+func transferForSession(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, session *models.Session) (*models.Ticket, *models.TransferDestination, error) {
+	for _, e := range session.Sprint().Events() {
+		opened, isOpened := e.(*events.TicketOpenedEvent)
+		if !isOpened {
+			continue
+		}
+
+		ticketer := oa.TicketerByUUID(opened.Ticket.Ticketer.UUID)
+		if ticketer == nil {
+			continue
+		}
+
+		var topic *models.Topic
+		if opened.Ticket.Topic != nil {
+			topic = oa.TopicByUUID(opened.Ticket.Topic.UUID)
+		}
+
+		destination := ticketer.IVRTransferDestination(topic)
+		if destination == nil {
+			continue
+		}
+
+		ticket, err := models.LookupTicketByUUID(ctx, rt.DB, opened.Ticket.UUID)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error loading ticket: %s", opened.Ticket.UUID)
+		}
+		if ticket == nil {
+			continue
+		}
+		return ticket, destination, nil
+	}
+	return nil, nil, nil
+}
+
+// gives the opened ticket the context of the call, records the transfer and writes the response which bridges the call
+func transferCall(ctx context.Context, rt *runtime.Runtime, svc TransferService, oa *models.OrgAssets, channel *models.Channel, conn *models.ChannelConnection, session *models.Session, ticket *models.Ticket, destination *models.TransferDestination, number urns.URN, resumeURL string, w http.ResponseWriter) error {
+	note, err := transferNote(ctx, rt, conn, session)
+	if err != nil {
+		return err
+	}
+
+	_, err = models.TicketsAddNote(ctx, rt.DB, oa, models.NilUserID, []*models.Ticket{ticket}, note)
+	if err != nil {
+		return errors.Wrapf(err, "error adding call details to ticket")
+	}
+
+	err = models.UpdateTicketConfig(ctx, rt.DB, ticket, map[string]string{
+		models.TicketConfigIVRConnectionID:        fmt.Sprintf("%d", conn.ID()),
+		models.TicketConfigIVRTransferDestination: destination.String(),
+		models.TicketConfigIVRTransferStatus:      string(models.TransferStatusBridging),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error updating ticket config")
+	}
+
+	err = conn.SetTransfer(ctx, rt.DB, &models.ConnectionTransfer{
+		TicketID:    ticket.ID(),
+		Destination: destination.String(),
+		Status:      models.TransferStatusBridging,
+		StartedOn:   dates.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.WithField("connection_id", conn.ID()).WithField("ticket_uuid", ticket.UUID()).WithField("destination", destination.String()).Info("transferring call to agent")
+
+	return svc.WriteTransferResponse(ctx, rt, channel, session, number, destination, transferStatusURL(resumeURL, ticket), w)
+}
+
+// the status URL for a transfer is our resume URL with the transfer action and the ticket the transfer is for
+func transferStatusURL(resumeURL string, ticket *models.Ticket) string {
+	u, err := url.Parse(resumeURL)
+	if err != nil {
+		return resumeURL
+	}
+
+	query := u.Query()
+	query.Set("action", TransferAction)
+	query.Set("ticket", string(ticket.UUID()))
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// builds a note with the run results and transcript of the passed in call for the agent taking over the call
+func transferNote(ctx context.Context, rt *runtime.Runtime, conn *models.ChannelConnection, session *models.Session) (string, error) {
+	note := &strings.Builder{}
+	note.WriteString("Call transferred to an agent.\n")
+
+	for _, run := range session.Runs() {
+		results, err := run.Results()
+		if err != nil {
+			return "", err
+		}
+		if len(results) == 0 {
+			continue
+		}
+
+		keys := make([]string, 0, len(results))
+		for key := range results {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		note.WriteString("\nResults:\n")
+		for _, key := range keys {
+			result := results[key]
+			fmt.Fprintf(note, "%s: %s", result.Name, result.Value)
+			if result.Category != "" {
+				fmt.Fprintf(note, " (%s)", result.Category)
+			}
+			note.WriteString("\n")
+		}
+	}
+
+	transcript, err := models.LoadConnectionTranscript(ctx, rt.DB, conn.ID())
+	if err != nil {
+		return "", err
+	}
+	if len(transcript) > 0 {
+		note.WriteString("\nTranscript:\n")
+		for _, line := range transcript {
+			speaker := "Contact"
+			if line.Direction == models.DirectionOut {
+				speaker = "Flow"
+			}
+			fmt.Fprintf(note, "[%s] %s: %s\n", line.CreatedOn.UTC().Format("15:04:05"), speaker, line.Text)
+		}
+	}
+
+	return strings.TrimSuffix(note.String(), "\n"), nil
+}
+
+// HandleTransferStatus is called when a call which was transferred to an agent has been bridged or failed to be, and
+// records the outcome on the connection and on the ticket the transfer was for
+func HandleTransferStatus(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, svc Service, conn *models.ChannelConnection, r *http.Request, w http.ResponseWriter) error {
+	ts, canTransfer := svc.(TransferService)
+	if !canTransfer {
+		return svc.WriteErrorResponse(w, errors.New("channel does not support transfers"))
+	}
+
+	status, duration := ts.TransferStatusForRequest(r)
+	if status == "" {
+		return svc.WriteEmptyResponse(w, "ignoring non final transfer status")
+	}
+
+	ticketUUID := flows.TicketUUID(r.URL.Query().Get("ticket"))
+	ticket, err := models.LookupTicketByUUID(ctx, rt.DB, ticketUUID)
+	if err != nil {
+		return errors.Wrapf(err, "error loading ticket for transfer")
+	}
+	if ticket == nil || ticket.OrgID() != conn.OrgID() {
+		return svc.WriteErrorResponse(w, errors.Errorf("no such ticket: %s", ticketUUID))
+	}
+
+	transfer, err := conn.Transfer(ctx, rt.DB)
+	if err != nil {
+		return err
+	}
+	if transfer == nil || transfer.TicketID != ticket.ID() {
+		return svc.WriteErrorResponse(w, errors.Errorf("connection: %d has no transfer for ticket: %s", conn.ID(), ticket.UUID()))
+	}
+	if transfer.Status != models.TransferStatusBridging {
+		return svc.WriteEmptyResponse(w, fmt.Sprintf("transfer status %s ignored, already %s", status, transfer.Status))
+	}
+
+	transfer.Status = status
+	transfer.Duration = duration
+	if err := conn.SetTransfer(ctx, rt.DB, transfer); err != nil {
+		return err
+	}
+
+	err = models.UpdateTicketConfig(ctx, rt.DB, ticket, map[string]string{
+		models.TicketConfigIVRTransferStatus:   string(status),
+		models.TicketConfigIVRTransferDuration: fmt.Sprintf("%d", duration),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error updating ticket config")
+	}
+
+	note := fmt.Sprintf("Call transfer to %s ended after %d seconds.", transfer.Destination, duration)
+	if status != models.TransferStatusAnswered {
+		note = fmt.Sprintf("Call transfer to %s failed: %s.", transfer.Destination, status)
+	}
+
+	_, err = models.TicketsAddNote(ctx, rt.DB, oa, models.NilUserID, []*models.Ticket{ticket}, note)
+	if err != nil {
+		return errors.Wrapf(err, "error adding transfer status to ticket")
+	}
+
+	return svc.WriteEmptyResponse(w, fmt.Sprintf("transfer status updated: %s", status))
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ABVariantFieldKey is the key of the contact field we write the assigned variant of an A/B split to
+	ABVariantFieldKey = "ab_variant"
+
+	// ABVariantFieldLabel is the label of the contact field created if the org doesn't already have one
+	ABVariantFieldLabel = "A/B Variant"
+
+	// ABVariantMetadataKey is the key in msg metadata where we record the variant a message was sent for
+	ABVariantMetadataKey = "ab_variant"
+)
+
+// ABVariant is a single variant of an A/B split, which receives a share of the recipients proportional to its weight
+type ABVariant struct {
+	Name   string `json:"name"   validate:"required"`
+	Weight int    `json:"weight" validate:"min=0"`
+}
+
+// AssignABVariant deterministically assigns a contact to one of the passed in variants. The seed is the id of the
+// broadcast or start being split so that the same contact always lands in the same cohort of the same send.
+func AssignABVariant(seed int64, contactID ContactID, variants []ABVariant) int {
+	h := fnv.New64a()
+	h.Write([]byte(fmt.Sprintf("%d:%d", seed, contactID)))
+	n := h.Sum64()
+
+	total := 0
+	for _, v := range variants {
+		total += v.Weight
+	}
+
+	// no weights given, split evenly
+	if total == 0 {
+		return int(n % uint64(len(variants)))
+	}
+
+	bucket := int(n % uint64(total))
+	for i, v := range variants {
+		if bucket < v.Weight {
+			return i
+		}
+		bucket -= v.Weight
+	}
+	return len(variants) - 1
+}
+
+// SplitContactsByABVariant splits the passed in contacts into a cohort for each of the passed in variants
+func SplitContactsByABVariant(seed int64, contactIDs []ContactID, variants []ABVariant) [][]ContactID {
+	cohorts := make([][]ContactID, len(variants))
+	for _, id := range contactIDs {
+		v := AssignABVariant(seed, id, variants)
+		cohorts[v] = append(cohorts[v], id)
+	}
+	return cohorts
+}
+
+const updateContactABVariantsSQL = `
+UPDATE
+	contacts_contact
+SET
+	fields = COALESCE(fields, '{}'::jsonb) || jsonb_build_object($3::text, jsonb_build_object('text', $4::text)),
+	modified_on = NOW()
+WHERE
+	id = ANY($1) AND org_id = $2 AND is_active = TRUE
+`
+
+// SetContactABVariants writes the passed in variant name to the A/B variant field of the given contacts, creating
+// that field if necessary. This is done with a single update rather than through modifiers because it happens for
+// every batch of a split send, and the field only exists to report on cohorts, so isn't meant to be used by groups
+// or campaigns.
+func SetContactABVariants(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, contactIDs []ContactID, variant string) error {
+	if len(contactIDs) == 0 {
+		return nil
+	}
+
+	if oa.SessionAssets().Fields().Get(ABVariantFieldKey) == nil {
+		if err := GetOrCreateContactField(ctx, rt.DB, oa.OrgID(), ABVariantFieldKey, ABVariantFieldLabel); err != nil {
+			return errors.Wrap(err, "error creating A/B variant field")
+		}
+
+		var err error
+		oa, err = GetOrgAssetsWithRefresh(ctx, rt, oa.OrgID(), RefreshFields)
+		if err != nil {
+			return errors.Wrap(err, "error refreshing org assets after creating A/B variant field")
+		}
+	}
+
+	field := oa.FieldByKey(ABVariantFieldKey)
+	if field == nil {
+		return errors.Errorf("unable to find A/B variant field for org %d", oa.OrgID())
+	}
+
+	_, err := rt.DB.ExecContext(ctx, updateContactABVariantsSQL, pq.Array(contactIDs), oa.OrgID(), field.UUID(), variant)
+	if err != nil {
+		return errors.Wrap(err, "error setting A/B variant of contacts")
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssignABVariant(t *testing.T) {
+	variants := []models.ABVariant{{Name: "A", Weight: 70}, {Name: "B", Weight: 30}}
+
+	contactIDs := make([]models.ContactID, 1000)
+	for i := range contactIDs {
+		contactIDs[i] = models.ContactID(i + 1)
+	}
+
+	// same seed always gives the same assignments
+	for _, id := range contactIDs[:20] {
+		assert.Equal(t, models.AssignABVariant(123, id, variants), models.AssignABVariant(123, id, variants))
+	}
+
+	// cohorts are roughly proportional to weights
+	cohorts := models.SplitContactsByABVariant(123, contactIDs, variants)
+	assert.Len(t, cohorts, 2)
+	assert.Equal(t, 1000, len(cohorts[0])+len(cohorts[1]))
+	assert.InDelta(t, 700, len(cohorts[0]), 60)
+	assert.InDelta(t, 300, len(cohorts[1]), 60)
+
+	// a different seed gives a different split
+	assert.NotEqual(t, cohorts, models.SplitContactsByABVariant(456, contactIDs, variants))
+
+	// zero weights split evenly
+	cohorts = models.SplitContactsByABVariant(123, contactIDs, []models.ABVariant{{Name: "A"}, {Name: "B"}, {Name: "C"}})
+	for _, c := range cohorts {
+		assert.InDelta(t, 333, len(c), 60)
+	}
+
+	// a variant with zero weight gets nobody
+	cohorts = models.SplitContactsByABVariant(123, contactIDs, []models.ABVariant{{Name: "A", Weight: 1}, {Name: "B", Weight: 0}})
+	assert.Len(t, cohorts[0], 1000)
+	assert.Len(t, cohorts[1], 0)
+}
+
+func TestSetContactABVariants(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	db.MustExec(`UPDATE contacts_contact SET fields = $2::jsonb, modified_on = '2020-01-01T00:00:00Z' WHERE id = $1`, testdata.Cathy.ID, fmt.Sprintf(`{"%s": {"text": "F"}}`, testdata.GenderField.UUID))
+
+	err = models.SetContactABVariants(ctx, rt, oa, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, "B")
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM contacts_contactfield WHERE org_id = $1 AND key = 'ab_variant'`, testdata.Org1.ID).Returns(1)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM contacts_contact WHERE id IN ($1, $2) AND fields::text LIKE '%"text": "B"%'`, testdata.Cathy.ID, testdata.Bob.ID).Returns(2)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND fields::text LIKE '%"text": "B"%'`, testdata.George.ID).Returns(0)
+
+	// existing field values are kept and contacts are marked as modified
+	testsuite.AssertQuery(t, db, `SELECT fields->$2->>'text' FROM contacts_contact WHERE id = $1`, testdata.Cathy.ID, testdata.GenderField.UUID).Returns("F")
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM contacts_contact WHERE id = $1 AND modified_on > '2020-01-01T00:00:00Z'`, testdata.Cathy.ID).Returns(1)
+}
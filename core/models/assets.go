@@ -37,6 +37,10 @@ type OrgAssets struct {
 	flowByID      map[FlowID]assets.Flow
 	flowCacheLock sync.RWMutex
 
+	// clones of these assets with flows on pinned revisions, keyed by those revisions
+	pinnedClones     map[string]*OrgAssets
+	pinnedClonesLock sync.Mutex
+
 	channels       []assets.Channel
 	channelsByID   map[ChannelID]*Channel
 	channelsByUUID map[assets.ChannelUUID]*Channel
@@ -598,6 +602,34 @@ func (a *OrgAssets) CloneForSimulation(ctx context.Context, rt *runtime.Runtime,
 	return clone, err
 }
 
+// CloneWithFlowRevisions returns a clone of these assets where the flows of the passed in revisions use those
+// revisions instead of their latest ones
+func (a *OrgAssets) CloneWithFlowRevisions(ctx context.Context, rt *runtime.Runtime, revisions []*FlowRevision) (*OrgAssets, error) {
+	clone, err := NewOrgAssets(ctx, a.rt, a.OrgID(), a, RefreshFlows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rev := range revisions {
+		flowAsset, err := a.Flow(rev.FlowUUID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to find flow with UUID '%s'", rev.FlowUUID)
+		}
+
+		cf := flowAsset.(*Flow).cloneWithRevision(rev)
+
+		clone.flowByUUID[cf.UUID()] = cf
+		clone.flowByID[cf.ID()] = cf
+	}
+
+	clone.sessionAssets, err = engine.NewSessionAssets(a.Env(), clone, goflow.MigrationConfig(rt.Config))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error build session assets for org: %d", clone.OrgID())
+	}
+
+	return clone, nil
+}
+
 // Flow returns the flow with the passed in UUID
 func (a *OrgAssets) Flow(flowUUID assets.FlowUUID) (assets.Flow, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
@@ -662,6 +694,15 @@ func (a *OrgAssets) Campaigns() []*Campaign {
 	return a.campaigns
 }
 
+func (a *OrgAssets) CampaignByID(campaignID CampaignID) *Campaign {
+	for _, c := range a.campaigns {
+		if c.ID() == campaignID {
+			return c
+		}
+	}
+	return nil
+}
+
 func (a *OrgAssets) CampaignByGroupID(groupID GroupID) []*Campaign {
 	return a.campaignsByGroup[groupID]
 }
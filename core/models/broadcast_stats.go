@@ -0,0 +1,214 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+const (
+	broadcastStatsKey    = "broadcast_stats:%d"
+	broadcastStatsExpire = time.Hour * 24 * 30 // how long we keep the counters of a broadcast around
+)
+
+// BroadcastStats are the progress and delivery counters of a broadcast, maintained as its batches are processed
+type BroadcastStats struct {
+	ContactsResolved int `json:"contacts_resolved" redis:"contacts_resolved"`
+	BatchesTotal     int `json:"batches_total"     redis:"batches_total"`
+	BatchesSent      int `json:"batches_sent"      redis:"batches_sent"`
+	MsgsCreated      int `json:"msgs_created"      redis:"msgs_created"`
+	SkippedOptOut    int `json:"skipped_opt_out"   redis:"skipped_opt_out"`
+	SkippedBlocked   int `json:"skipped_blocked"   redis:"skipped_blocked"`
+	SkippedNoURN     int `json:"skipped_no_urn"    redis:"skipped_no_urn"`
+	Queued           int `json:"queued"            redis:"queued"`
+	Failed           int `json:"failed"            redis:"failed"`
+}
+
+// IsComplete returns whether all the batches of this broadcast have been sent
+func (s *BroadcastStats) IsComplete() bool {
+	return s.BatchesTotal > 0 && s.BatchesSent >= s.BatchesTotal
+}
+
+// counters returns our counters as field/value pairs, omitting any which are zero
+func (s *BroadcastStats) counters() []interface{} {
+	all := []struct {
+		field string
+		value int
+	}{
+		{"contacts_resolved", s.ContactsResolved},
+		{"batches_total", s.BatchesTotal},
+		{"batches_sent", s.BatchesSent},
+		{"msgs_created", s.MsgsCreated},
+		{"skipped_opt_out", s.SkippedOptOut},
+		{"skipped_blocked", s.SkippedBlocked},
+		{"skipped_no_urn", s.SkippedNoURN},
+		{"queued", s.Queued},
+		{"failed", s.Failed},
+	}
+
+	counters := make([]interface{}, 0, len(all)*2)
+	for _, c := range all {
+		if c.value != 0 {
+			counters = append(counters, c.field, c.value)
+		}
+	}
+	return counters
+}
+
+// IncrementBroadcastStats adds the passed in counters to the stats of the given broadcast
+func IncrementBroadcastStats(rc redis.Conn, broadcastID BroadcastID, stats *BroadcastStats) error {
+	// noop if it is a nil id, these are broadcasts which aren't persisted
+	if broadcastID == NilBroadcastID {
+		return nil
+	}
+
+	counters := stats.counters()
+	if len(counters) == 0 {
+		return nil
+	}
+
+	key := fmt.Sprintf(broadcastStatsKey, broadcastID)
+
+	rc.Send("MULTI")
+	for i := 0; i < len(counters); i += 2 {
+		rc.Send("HINCRBY", key, counters[i], counters[i+1])
+	}
+	rc.Send("EXPIRE", key, int(broadcastStatsExpire/time.Second))
+	_, err := rc.Do("EXEC")
+	if err != nil {
+		return errors.Wrapf(err, "error incrementing stats for broadcast %d", broadcastID)
+	}
+	return nil
+}
+
+// GetBroadcastStats gets the current stats of the given broadcast, which will be all zeros if we have none
+func GetBroadcastStats(rc redis.Conn, broadcastID BroadcastID) (*BroadcastStats, error) {
+	values, err := redis.Values(rc.Do("HGETALL", fmt.Sprintf(broadcastStatsKey, broadcastID)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting stats for broadcast %d", broadcastID)
+	}
+
+	stats := &BroadcastStats{}
+	if err := redis.ScanStruct(values, stats); err != nil {
+		return nil, errors.Wrapf(err, "error reading stats for broadcast %d", broadcastID)
+	}
+	return stats, nil
+}
+
+// BroadcastStatsForMsgs calculates the creation and delivery counters for the passed in broadcast messages once
+// they have been handed off for sending
+func BroadcastStatsForMsgs(msgs []*Msg) *BroadcastStats {
+	stats := &BroadcastStats{}
+
+	for _, m := range msgs {
+		stats.MsgsCreated++
+
+		if m.Status() == MsgStatusFailed {
+			if m.FailedReason() == MsgFailedMarketingOptOut {
+				stats.SkippedOptOut++
+			} else {
+				stats.Failed++
+			}
+		} else if m.Channel() != nil {
+			stats.Queued++
+		}
+	}
+
+	return stats
+}
+
+// broadcastSkips tracks the contacts skipped while building the messages of a broadcast batch. A contact can be tried
+// twice, on a URN of the broadcast and on their preferred URN, so is only counted once, and not at all for a missing
+// URN if one of those tries did build them a message.
+type broadcastSkips struct {
+	blocked map[ContactID]bool
+	noURN   map[ContactID]bool
+	sent    map[ContactID]bool
+}
+
+func newBroadcastSkips() *broadcastSkips {
+	return &broadcastSkips{blocked: make(map[ContactID]bool), noURN: make(map[ContactID]bool), sent: make(map[ContactID]bool)}
+}
+
+func (s *broadcastSkips) stats() *BroadcastStats {
+	stats := &BroadcastStats{SkippedBlocked: len(s.blocked)}
+	for id := range s.noURN {
+		if !s.sent[id] {
+			stats.SkippedNoURN++
+		}
+	}
+	return stats
+}
+
+// records the contacts that were skipped while building the messages of a broadcast batch
+func recordBroadcastSkips(rt *runtime.Runtime, broadcastID BroadcastID, skipped *BroadcastStats) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	return IncrementBroadcastStats(rc, broadcastID, skipped)
+}
+
+// BroadcastVariantStats are the delivery and reply counters of a single variant of an A/B split broadcast
+type BroadcastVariantStats struct {
+	Variant      string  `json:"variant"       db:"variant"`
+	Sent         int     `json:"sent"          db:"sent"`
+	Delivered    int     `json:"delivered"     db:"delivered"`
+	Failed       int     `json:"failed"        db:"failed"`
+	Replied      int     `json:"replied"       db:"replied"`
+	DeliveryRate float64 `json:"delivery_rate"`
+	ReplyRate    float64 `json:"reply_rate"`
+}
+
+const selectBroadcastVariantStatsSQL = `
+SELECT
+	m.metadata::jsonb->>'ab_variant' AS variant,
+	COUNT(*) AS sent,
+	COUNT(*) FILTER (WHERE m.status = 'D') AS delivered,
+	COUNT(*) FILTER (WHERE m.status IN ('E', 'F')) AS failed,
+	COUNT(*) FILTER (WHERE EXISTS (
+		SELECT 1 FROM msgs_msg r
+		WHERE r.contact_id = m.contact_id AND r.direction = 'I' AND r.created_on > m.created_on AND r.created_on < m.created_on + INTERVAL '7 days' AND NOT EXISTS (
+			SELECT 1 FROM msgs_msg n
+			WHERE n.contact_id = m.contact_id AND n.direction = 'O' AND n.broadcast_id IS NOT NULL AND n.broadcast_id != m.broadcast_id AND n.created_on > m.created_on AND n.created_on < r.created_on
+		)
+	)) AS replied
+FROM
+	msgs_msg m
+WHERE
+	m.broadcast_id = $1 AND m.org_id = $2 AND m.direction = 'O' AND m.metadata::jsonb ? 'ab_variant'
+GROUP BY
+	variant
+ORDER BY
+	variant
+`
+
+// GetBroadcastVariantStats calculates the delivery and reply rates of each variant of the given broadcast, which will
+// be empty if the broadcast wasn't an A/B split. A contact has replied if they sent a message within 7 days of the
+// broadcast and before they were sent another broadcast.
+func GetBroadcastVariantStats(ctx context.Context, db Queryer, orgID OrgID, broadcastID BroadcastID) ([]*BroadcastVariantStats, error) {
+	rows, err := db.QueryxContext(ctx, selectBroadcastVariantStatsSQL, broadcastID, orgID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying variant stats for broadcast %d", broadcastID)
+	}
+	defer rows.Close()
+
+	variants := make([]*BroadcastVariantStats, 0)
+	for rows.Next() {
+		v := &BroadcastVariantStats{}
+		if err := rows.StructScan(v); err != nil {
+			return nil, errors.Wrapf(err, "error scanning variant stats for broadcast %d", broadcastID)
+		}
+
+		if v.Sent > 0 {
+			v.DeliveryRate = float64(v.Delivered) / float64(v.Sent)
+			v.ReplyRate = float64(v.Replied) / float64(v.Sent)
+		}
+		variants = append(variants, v)
+	}
+
+	return variants, rows.Err()
+}
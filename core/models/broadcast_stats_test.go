@@ -0,0 +1,114 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/redisx/assertredis"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroadcastStats(t *testing.T) {
+	_, _, _, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	// no counters yet, all zeros
+	stats, err := models.GetBroadcastStats(rc, models.BroadcastID(123))
+	require.NoError(t, err)
+	assert.Equal(t, &models.BroadcastStats{}, stats)
+	assert.False(t, stats.IsComplete())
+
+	// broadcasts without ids aren't tracked
+	err = models.IncrementBroadcastStats(rc, models.NilBroadcastID, &models.BroadcastStats{ContactsResolved: 5})
+	require.NoError(t, err)
+	assertredis.Keys(t, rp, []string{})
+
+	err = models.IncrementBroadcastStats(rc, models.BroadcastID(123), &models.BroadcastStats{ContactsResolved: 150, BatchesTotal: 2})
+	require.NoError(t, err)
+	err = models.IncrementBroadcastStats(rc, models.BroadcastID(123), &models.BroadcastStats{BatchesSent: 1, MsgsCreated: 98, SkippedBlocked: 2, Queued: 97, Failed: 1})
+	require.NoError(t, err)
+
+	assertredis.HGetAll(t, rp, "broadcast_stats:123", map[string]string{
+		"contacts_resolved": "150",
+		"batches_total":     "2",
+		"batches_sent":      "1",
+		"msgs_created":      "98",
+		"skipped_blocked":   "2",
+		"queued":            "97",
+		"failed":            "1",
+	})
+
+	stats, err = models.GetBroadcastStats(rc, models.BroadcastID(123))
+	require.NoError(t, err)
+	assert.False(t, stats.IsComplete())
+
+	err = models.IncrementBroadcastStats(rc, models.BroadcastID(123), &models.BroadcastStats{BatchesSent: 1, MsgsCreated: 48, SkippedNoURN: 2, SkippedOptOut: 3, Queued: 45})
+	require.NoError(t, err)
+
+	stats, err = models.GetBroadcastStats(rc, models.BroadcastID(123))
+	require.NoError(t, err)
+	assert.Equal(t, &models.BroadcastStats{
+		ContactsResolved: 150,
+		BatchesTotal:     2,
+		BatchesSent:      2,
+		MsgsCreated:      146,
+		SkippedOptOut:    3,
+		SkippedBlocked:   2,
+		SkippedNoURN:     2,
+		Queued:           142,
+		Failed:           1,
+	}, stats)
+	assert.True(t, stats.IsComplete())
+}
+
+func TestBroadcastSkips(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// George is blocked, and Bob and Cathy have telegram URNs which no channel can send to
+	db.MustExec(`UPDATE contacts_contact SET status = 'B' WHERE id = $1`, testdata.George.ID)
+	testdata.InsertContactURN(db, testdata.Org1, testdata.Bob, urns.URN("telegram:12345"), 100)
+	testdata.InsertContactURN(db, testdata.Org1, testdata.Cathy, urns.URN("telegram:67890"), 100)
+
+	bcastID := testdata.InsertBroadcast(db, testdata.Org1, envs.Language("eng"), map[envs.Language]string{"eng": "hello"}, models.NilScheduleID, nil, nil, events.BroadcastTypeDefault)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	translations := map[envs.Language]*models.BroadcastTranslation{envs.Language("eng"): {Text: "hello"}}
+	bcast := models.NewBroadcast(testdata.Org1.ID, bcastID, translations, models.TemplateStateUnevaluated, envs.Language("eng"), nil, nil, nil, models.NilTicketID, events.BroadcastTypeDefault, models.BroadcastMessageHeader{}, "", models.BroadcastCatalogMessage{})
+
+	// George and Bob are both in the contacts and the URNs of the batch, Cathy only in the URNs
+	batch := bcast.CreateBatch([]models.ContactID{testdata.George.ID, testdata.Bob.ID})
+	batch.SetURNs(map[models.ContactID]urns.URN{
+		testdata.George.ID: testdata.George.URN,
+		testdata.Bob.ID:    urns.URN("telegram:12345"),
+		testdata.Cathy.ID:  urns.URN("telegram:67890"),
+	})
+	batch.SetIsLast(true)
+
+	msgs, err := models.CreateBroadcastMessages(ctx, rt, oa, batch, nil)
+	require.NoError(t, err)
+
+	// Bob can't be sent to on his telegram URN but still gets a message on his preferred URN
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, testdata.Bob.ID, msgs[0].ContactID())
+
+	// George is only counted once even though we tried to send to him twice, and Cathy has no URN we could send to
+	assertredis.HGetAll(t, rp, fmt.Sprintf("broadcast_stats:%d", bcastID), map[string]string{
+		"skipped_blocked": "1",
+		"skipped_no_urn":  "1",
+	})
+}
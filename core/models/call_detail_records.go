@@ -0,0 +1,261 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// ChannelConfigCDRCurrency is the currency of call prices for providers which don't include it in their call records
+const ChannelConfigCDRCurrency = "cdr_currency"
+
+// CDRMaxPriceChecks is how many times we ask a provider for the price of a call which it didn't price when it ended
+const CDRMaxPriceChecks = 5
+
+// CallDetailRecordID is the type for call detail record IDs
+type CallDetailRecordID int64
+
+// CallDetailRecord is the provider's record of an IVR call which has ended, used to reconcile voice bills. There is one
+// per attempt of a connection, i.e. per connection and provider call ID.
+type CallDetailRecord struct {
+	ID           CallDetailRecordID  `json:"-"                      db:"id"`
+	OrgID        OrgID               `json:"-"                      db:"org_id"`
+	ConnectionID ConnectionID        `json:"connection_id"          db:"connection_id"`
+	ChannelID    ChannelID           `json:"channel_id"             db:"channel_id"`
+	Direction    ConnectionDirection `json:"direction"              db:"direction"`
+	ExternalID   string              `json:"external_id"            db:"external_id"`
+	Status       ConnectionStatus    `json:"status"                 db:"status"`
+	Duration     int                 `json:"duration"               db:"duration"`
+	Price        *decimal.Decimal    `json:"price"                  db:"price"`
+	Currency     string              `json:"currency,omitempty"     db:"currency"`
+	HangupCause  string              `json:"hangup_cause,omitempty" db:"hangup_cause"`
+	AnsweredOn   *time.Time          `json:"answered_on"            db:"answered_on"`
+	EndedOn      time.Time           `json:"ended_on"               db:"ended_on"`
+	PriceChecks  int                 `json:"-"                      db:"price_checks"`
+}
+
+// records are unique per connection and provider call ID so that each attempt is recorded once regardless of how many
+// callbacks we receive for it, and a price we already have isn't lost if a repeated callback doesn't include it
+const upsertCallDetailRecordSQL = `
+INSERT INTO
+	channels_channelconnectioncdr(org_id, connection_id, channel_id, direction, external_id, status, duration, price, currency, hangup_cause, answered_on, ended_on, price_checks)
+	VALUES(:org_id, :connection_id, :channel_id, :direction, :external_id, :status, :duration, :price, :currency, :hangup_cause, :answered_on, :ended_on, 0)
+ON CONFLICT (connection_id, external_id) DO UPDATE SET
+	status = EXCLUDED.status,
+	duration = EXCLUDED.duration,
+	price = COALESCE(EXCLUDED.price, channels_channelconnectioncdr.price),
+	currency = CASE WHEN EXCLUDED.price IS NULL THEN channels_channelconnectioncdr.currency ELSE EXCLUDED.currency END,
+	hangup_cause = EXCLUDED.hangup_cause,
+	answered_on = EXCLUDED.answered_on,
+	ended_on = EXCLUDED.ended_on
+`
+
+// RecordCallDetailRecord records the passed in call detail record for the passed in connection
+func RecordCallDetailRecord(ctx context.Context, db Queryer, conn *ChannelConnection, cdr *CallDetailRecord) error {
+	cdr.OrgID = conn.OrgID()
+	cdr.ConnectionID = conn.ID()
+	cdr.ChannelID = conn.ChannelID()
+	cdr.Direction = conn.c.Direction
+	cdr.ExternalID = conn.ExternalID()
+
+	_, err := db.NamedExecContext(ctx, upsertCallDetailRecordSQL, cdr)
+	if err != nil {
+		return errors.Wrapf(err, "error writing call detail record for connection: %d", conn.ID())
+	}
+	return nil
+}
+
+const selectCallDetailRecordsSQL = `
+SELECT
+	id,
+	org_id,
+	connection_id,
+	channel_id,
+	direction,
+	external_id,
+	status,
+	duration,
+	price,
+	currency,
+	hangup_cause,
+	answered_on,
+	ended_on,
+	price_checks
+FROM
+	channels_channelconnectioncdr
+WHERE
+	org_id = $1 AND
+	ended_on >= $2 AND
+	ended_on < $3 AND
+	($4::integer IS NULL OR channel_id = $4)
+ORDER BY
+	ended_on ASC,
+	connection_id ASC
+`
+
+// GetCallDetailRecords gets the call detail records of the given org, optionally limited to a channel, for calls
+// which ended on the days (UTC) from since to until inclusive, ordered by when they ended
+func GetCallDetailRecords(ctx context.Context, db *sqlx.DB, orgID OrgID, channelID ChannelID, since, until time.Time) ([]*CallDetailRecord, error) {
+	start, end := cdrDayRange(since, until)
+
+	cdrs := make([]*CallDetailRecord, 0, 10)
+	err := db.SelectContext(ctx, &cdrs, selectCallDetailRecordsSQL, orgID, start, end, channelID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading call detail records")
+	}
+	return cdrs, nil
+}
+
+// the price of a call might not be known when the call ends, so we ask the provider again later, backing off between
+// each check
+const selectCallDetailRecordsToPriceSQL = `
+SELECT
+	id,
+	org_id,
+	connection_id,
+	channel_id,
+	direction,
+	external_id,
+	status,
+	duration,
+	price,
+	currency,
+	hangup_cause,
+	answered_on,
+	ended_on,
+	price_checks
+FROM
+	channels_channelconnectioncdr
+WHERE
+	price IS NULL AND
+	price_checks < $1 AND
+	ended_on < NOW() - make_interval(mins => power(2, price_checks)::integer)
+ORDER BY
+	ended_on ASC
+LIMIT
+	$2
+`
+
+// LoadCallDetailRecordsToPrice loads up to limit call detail records which don't have a price yet and are due to be
+// checked for one
+func LoadCallDetailRecordsToPrice(ctx context.Context, db *sqlx.DB, limit int) ([]*CallDetailRecord, error) {
+	cdrs := make([]*CallDetailRecord, 0, limit)
+	err := db.SelectContext(ctx, &cdrs, selectCallDetailRecordsToPriceSQL, CDRMaxPriceChecks, limit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading call detail records to price")
+	}
+	return cdrs, nil
+}
+
+// UpdatePrice records the result of checking this call detail record for a price, price being nil if the provider
+// still doesn't have one. If the provider can't price calls then checks should be CDRMaxPriceChecks so that we don't
+// check again.
+func (r *CallDetailRecord) UpdatePrice(ctx context.Context, db Queryer, price *decimal.Decimal, currency string, checks int) error {
+	r.PriceChecks = checks
+	if price != nil {
+		r.Price = price
+		r.Currency = currency
+	}
+
+	_, err := db.ExecContext(ctx, `UPDATE channels_channelconnectioncdr SET price = $2, currency = $3, price_checks = $4 WHERE id = $1`, r.ID, r.Price, r.Currency, r.PriceChecks)
+	if err != nil {
+		return errors.Wrapf(err, "error updating price of call detail record: %d", r.ID)
+	}
+	return nil
+}
+
+// CallCostSummary is the total calls, duration and cost of an org's calls on a channel in a direction on a day
+type CallCostSummary struct {
+	Day       string                     `json:"day"`
+	ChannelID ChannelID                  `json:"channel_id"`
+	Direction ConnectionDirection        `json:"direction"`
+	Calls     int                        `json:"calls"`
+	Answered  int                        `json:"answered"`
+	Duration  int                        `json:"duration"`
+	Costs     map[string]decimal.Decimal `json:"costs"`
+	Unpriced  int                        `json:"unpriced"`
+}
+
+const selectCallCostsSQL = `
+SELECT
+	to_char(ended_on AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day,
+	channel_id,
+	direction,
+	currency,
+	count(*) AS calls,
+	count(answered_on) AS answered,
+	sum(duration) AS duration,
+	sum(price) AS cost,
+	count(*) FILTER (WHERE price IS NULL) AS unpriced
+FROM
+	channels_channelconnectioncdr
+WHERE
+	org_id = $1 AND
+	ended_on >= $2 AND
+	ended_on < $3 AND
+	($4::integer IS NULL OR channel_id = $4)
+GROUP BY
+	1, 2, 3, 4
+ORDER BY
+	1, 2, 3, 4
+`
+
+// GetCallCostSummaries aggregates the call detail records of the given org, optionally limited to a channel, by day,
+// channel and direction for calls which ended on the days (UTC) from since to until inclusive
+func GetCallCostSummaries(ctx context.Context, db Queryer, orgID OrgID, channelID ChannelID, since, until time.Time) ([]*CallCostSummary, error) {
+	start, end := cdrDayRange(since, until)
+
+	rows, err := db.QueryxContext(ctx, selectCallCostsSQL, orgID, start, end, channelID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading call costs")
+	}
+	defer rows.Close()
+
+	byKey := make(map[string]*CallCostSummary)
+	summaries := make([]*CallCostSummary, 0, 10)
+
+	for rows.Next() {
+		row := &struct {
+			Day       string              `db:"day"`
+			ChannelID ChannelID           `db:"channel_id"`
+			Direction ConnectionDirection `db:"direction"`
+			Currency  string              `db:"currency"`
+			Calls     int                 `db:"calls"`
+			Answered  int                 `db:"answered"`
+			Duration  int                 `db:"duration"`
+			Cost      *decimal.Decimal    `db:"cost"`
+			Unpriced  int                 `db:"unpriced"`
+		}{}
+		if err := rows.StructScan(row); err != nil {
+			return nil, errors.Wrapf(err, "error scanning call costs")
+		}
+
+		// rows are per currency so combine them into a summary per day, channel and direction
+		key := fmt.Sprintf("%s:%d:%s", row.Day, row.ChannelID, row.Direction)
+		summary := byKey[key]
+		if summary == nil {
+			summary = &CallCostSummary{Day: row.Day, ChannelID: row.ChannelID, Direction: row.Direction, Costs: make(map[string]decimal.Decimal)}
+			byKey[key] = summary
+			summaries = append(summaries, summary)
+		}
+
+		summary.Calls += row.Calls
+		summary.Answered += row.Answered
+		summary.Duration += row.Duration
+		summary.Unpriced += row.Unpriced
+		if row.Cost != nil {
+			summary.Costs[row.Currency] = summary.Costs[row.Currency].Add(*row.Cost)
+		}
+	}
+
+	return summaries, rows.Err()
+}
+
+// returns the range of times covering the days (UTC) from since to until inclusive
+func cdrDayRange(since, until time.Time) (time.Time, time.Time) {
+	return since.UTC().Truncate(time.Hour * 24), until.UTC().Truncate(time.Hour * 24).Add(time.Hour * 24)
+}
@@ -0,0 +1,120 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallDetailRecords(t *testing.T) {
+	ctx, _, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	conn1, err := models.InsertIVRConnection(ctx, db, testdata.Org1.ID, testdata.TwilioChannel.ID, models.NilStartID, testdata.Cathy.ID, testdata.Cathy.URNID, models.ConnectionDirectionOut, models.ConnectionStatusWired, "CA123")
+	require.NoError(t, err)
+	conn2, err := models.InsertIVRConnection(ctx, db, testdata.Org1.ID, testdata.TwilioChannel.ID, models.NilStartID, testdata.Bob.ID, testdata.Bob.URNID, models.ConnectionDirectionOut, models.ConnectionStatusWired, "CA456")
+	require.NoError(t, err)
+	conn3, err := models.InsertIVRConnection(ctx, db, testdata.Org1.ID, testdata.VonageChannel.ID, models.NilStartID, testdata.George.ID, testdata.George.URNID, models.ConnectionDirectionIn, models.ConnectionStatusWired, "e8f2ac1d")
+	require.NoError(t, err)
+	conn4, err := models.InsertIVRConnection(ctx, db, testdata.Org1.ID, testdata.TwilioChannel.ID, models.NilStartID, testdata.Cathy.ID, testdata.Cathy.URNID, models.ConnectionDirectionOut, models.ConnectionStatusWired, "CA789")
+	require.NoError(t, err)
+
+	price1, price2, price3 := decimal.RequireFromString("0.14"), decimal.RequireFromString("0.0275"), decimal.RequireFromString("0.05")
+	answeredOn := time.Date(2021, 6, 10, 12, 29, 0, 0, time.UTC)
+
+	cdrs := []struct {
+		conn *models.ChannelConnection
+		cdr  *models.CallDetailRecord
+	}{
+		{conn1, &models.CallDetailRecord{Status: models.ConnectionStatusCompleted, Duration: 60, Price: &price1, Currency: "USD", HangupCause: "completed", AnsweredOn: &answeredOn, EndedOn: time.Date(2021, 6, 10, 12, 30, 0, 0, time.UTC)}},
+		{conn2, &models.CallDetailRecord{Status: models.ConnectionStatusErrored, Price: &price2, Currency: "USD", HangupCause: "busy", EndedOn: time.Date(2021, 6, 10, 9, 15, 0, 0, time.UTC)}},
+		{conn3, &models.CallDetailRecord{Status: models.ConnectionStatusCompleted, Duration: 30, HangupCause: "completed", AnsweredOn: &answeredOn, EndedOn: time.Date(2021, 6, 10, 13, 0, 0, 0, time.UTC)}},
+		{conn3, &models.CallDetailRecord{Status: models.ConnectionStatusCompleted, Duration: 30, Price: &price3, Currency: "EUR", HangupCause: "completed", AnsweredOn: &answeredOn, EndedOn: time.Date(2021, 6, 10, 13, 0, 0, 0, time.UTC)}}, // callback repeated
+		{conn4, &models.CallDetailRecord{Status: models.ConnectionStatusFailed, HangupCause: "failed", EndedOn: time.Date(2021, 6, 12, 8, 0, 0, 0, time.UTC)}},
+	}
+	for _, c := range cdrs {
+		require.NoError(t, models.RecordCallDetailRecord(ctx, db, c.conn, c.cdr))
+	}
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM channels_channelconnectioncdr`).Returns(4)
+
+	records, err := models.GetCallDetailRecords(ctx, db, testdata.Org1.ID, models.NilChannelID, time.Date(2021, 6, 10, 0, 0, 0, 0, time.UTC), time.Date(2021, 6, 11, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	assert.Equal(t, conn2.ID(), records[0].ConnectionID)
+	assert.Equal(t, models.ConnectionDirectionOut, records[0].Direction)
+	assert.Equal(t, "CA456", records[0].ExternalID)
+	assert.Equal(t, conn1.ID(), records[1].ConnectionID)
+	assert.Equal(t, testdata.TwilioChannel.ID, records[1].ChannelID)
+	assert.Equal(t, conn3.ID(), records[2].ConnectionID)
+	assert.Equal(t, models.ConnectionDirectionIn, records[2].Direction)
+	assert.Equal(t, "0.05", records[2].Price.String())
+
+	// records can be limited to a channel
+	records, err = models.GetCallDetailRecords(ctx, db, testdata.Org1.ID, testdata.VonageChannel.ID, time.Date(2021, 6, 10, 0, 0, 0, 0, time.UTC), time.Date(2021, 6, 12, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, conn3.ID(), records[0].ConnectionID)
+
+	summaries, err := models.GetCallCostSummaries(ctx, db, testdata.Org1.ID, models.NilChannelID, time.Date(2021, 6, 10, 0, 0, 0, 0, time.UTC), time.Date(2021, 6, 11, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Len(t, summaries, 2)
+
+	assert.Equal(t, "2021-06-10", summaries[0].Day)
+	assert.Equal(t, testdata.TwilioChannel.ID, summaries[0].ChannelID)
+	assert.Equal(t, models.ConnectionDirectionOut, summaries[0].Direction)
+	assert.Equal(t, 2, summaries[0].Calls)
+	assert.Equal(t, 1, summaries[0].Answered)
+	assert.Equal(t, 60, summaries[0].Duration)
+	assert.Equal(t, "0.1675", summaries[0].Costs["USD"].String())
+	assert.Equal(t, 0, summaries[0].Unpriced)
+
+	assert.Equal(t, testdata.VonageChannel.ID, summaries[1].ChannelID)
+	assert.Equal(t, models.ConnectionDirectionIn, summaries[1].Direction)
+	assert.Equal(t, 1, summaries[1].Calls)
+	assert.Equal(t, "0.05", summaries[1].Costs["EUR"].String())
+
+	// days without calls have no records
+	records, err = models.GetCallDetailRecords(ctx, db, testdata.Org1.ID, models.NilChannelID, time.Date(2021, 6, 11, 0, 0, 0, 0, time.UTC), time.Date(2021, 6, 11, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Len(t, records, 0)
+
+	records, err = models.GetCallDetailRecords(ctx, db, testdata.Org2.ID, models.NilChannelID, time.Date(2021, 6, 10, 0, 0, 0, 0, time.UTC), time.Date(2021, 6, 12, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Len(t, records, 0)
+
+	// the unpriced failed call is due to be checked for a price
+	toPrice, err := models.LoadCallDetailRecordsToPrice(ctx, db, 10)
+	require.NoError(t, err)
+	require.Len(t, toPrice, 1)
+	assert.Equal(t, conn4.ID(), toPrice[0].ConnectionID)
+	assert.Equal(t, 0, toPrice[0].PriceChecks)
+
+	// if the provider still doesn't have a price, we'll check again later
+	err = toPrice[0].UpdatePrice(ctx, db, nil, "", 1)
+	require.NoError(t, err)
+
+	toPrice, err = models.LoadCallDetailRecordsToPrice(ctx, db, 10)
+	require.NoError(t, err)
+	require.Len(t, toPrice, 1)
+	assert.Equal(t, 1, toPrice[0].PriceChecks)
+
+	price := decimal.RequireFromString("0.02")
+	err = toPrice[0].UpdatePrice(ctx, db, &price, "USD", 2)
+	require.NoError(t, err)
+
+	toPrice, err = models.LoadCallDetailRecordsToPrice(ctx, db, 10)
+	require.NoError(t, err)
+	assert.Len(t, toPrice, 0)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM channels_channelconnectioncdr WHERE connection_id = $1 AND price = 0.02 AND currency = 'USD'`, conn4.ID()).Returns(1)
+}
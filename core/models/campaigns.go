@@ -121,6 +121,17 @@ type CampaignEvent struct {
 	campaign *Campaign
 }
 
+// NewCampaignEvent creates a new campaign event for the passed in campaign, which isn't saved, from its definition
+func NewCampaignEvent(campaign *Campaign, relativeToKey string, offset int, unit OffsetUnit, deliveryHour int, startMode StartMode) *CampaignEvent {
+	e := &CampaignEvent{campaign: campaign}
+	e.e.RelativeToKey = relativeToKey
+	e.e.Offset = offset
+	e.e.Unit = unit
+	e.e.DeliveryHour = deliveryHour
+	e.e.StartMode = startMode
+	return e
+}
+
 // UnmarshalJSON is our unmarshaller for json data
 func (e *CampaignEvent) UnmarshalJSON(data []byte) error {
 	return json.Unmarshal(data, &e.e)
@@ -629,14 +640,26 @@ func ScheduleCampaignEvent(ctx context.Context, rt *runtime.Runtime, orgID OrgID
 		return errors.Errorf("can't find campaign event with id %d", eventID)
 	}
 
+	fas, err := CampaignEventFires(ctx, rt.DB, oa, event, time.Now())
+	if err != nil {
+		return errors.Wrapf(err, "unable to calculate event fires for event %d", eventID)
+	}
+
+	// add all our new event fires
+	return AddEventFires(ctx, rt.DB, fas)
+}
+
+// CampaignEventFires calculates the next fire of the passed in event for each eligible contact in its campaign's group,
+// without writing anything
+func CampaignEventFires(ctx context.Context, db Queryer, oa *OrgAssets, event *CampaignEvent, now time.Time) ([]*FireAdd, error) {
 	field := oa.FieldByKey(event.RelativeToKey())
 	if field == nil {
-		return errors.Errorf("can't find field with key %s", event.RelativeToKey())
+		return nil, errors.Errorf("can't find field with key %s", event.RelativeToKey())
 	}
 
-	eligible, err := campaignEventEligibleContacts(ctx, rt.DB, event.campaign.GroupID(), field)
+	eligible, err := campaignEventEligibleContacts(ctx, db, event.campaign.GroupID(), field)
 	if err != nil {
-		return errors.Wrapf(err, "unable to calculate eligible contacts for event %d", eventID)
+		return nil, errors.Wrapf(err, "unable to calculate eligible contacts")
 	}
 
 	fas := make([]*FireAdd, 0, len(eligible))
@@ -647,19 +670,18 @@ func ScheduleCampaignEvent(ctx context.Context, rt *runtime.Runtime, orgID OrgID
 			start := *el.RelToValue
 
 			// calculate next fire for this contact
-			scheduled, err := event.ScheduleForTime(tz, time.Now(), start)
+			scheduled, err := event.ScheduleForTime(tz, now, start)
 			if err != nil {
-				return errors.Wrapf(err, "error calculating offset for start: %s and event: %d", start, eventID)
+				return nil, errors.Wrapf(err, "error calculating offset for start: %s and event: %d", start, event.ID())
 			}
 
 			if scheduled != nil {
-				fas = append(fas, &FireAdd{ContactID: el.ContactID, EventID: eventID, Scheduled: *scheduled})
+				fas = append(fas, &FireAdd{ContactID: el.ContactID, EventID: event.ID(), Scheduled: *scheduled})
 			}
 		}
 	}
 
-	// add all our new event fires
-	return AddEventFires(ctx, rt.DB, fas)
+	return fas, nil
 }
 
 type eligibleContact struct {
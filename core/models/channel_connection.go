@@ -67,24 +67,27 @@ const (
 // ChannelConnection models a session or connection with a particular channel
 type ChannelConnection struct {
 	c struct {
-		ID             ConnectionID        `json:"id"              db:"id"`
-		CreatedOn      time.Time           `json:"created_on"      db:"created_on"`
-		ModifiedOn     time.Time           `json:"modified_on"     db:"modified_on"`
-		ExternalID     string              `json:"external_id"     db:"external_id"`
-		Status         ConnectionStatus    `json:"status"          db:"status"`
-		Direction      ConnectionDirection `json:"direction"       db:"direction"`
-		StartedOn      *time.Time          `json:"started_on"      db:"started_on"`
-		EndedOn        *time.Time          `json:"ended_on"        db:"ended_on"`
-		ConnectionType ConnectionType      `json:"connection_type" db:"connection_type"`
-		Duration       int                 `json:"duration"        db:"duration"`
-		ErrorReason    null.String         `json:"error_reason"    db:"error_reason"`
-		ErrorCount     int                 `json:"error_count"     db:"error_count"`
-		NextAttempt    *time.Time          `json:"next_attempt"    db:"next_attempt"`
-		ChannelID      ChannelID           `json:"channel_id"      db:"channel_id"`
-		ContactID      ContactID           `json:"contact_id"      db:"contact_id"`
-		ContactURNID   URNID               `json:"contact_urn_id"  db:"contact_urn_id"`
-		OrgID          OrgID               `json:"org_id"          db:"org_id"`
-		StartID        StartID             `json:"start_id"        db:"start_id"`
+		ID              ConnectionID        `json:"id"              db:"id"`
+		CreatedOn       time.Time           `json:"created_on"      db:"created_on"`
+		ModifiedOn      time.Time           `json:"modified_on"     db:"modified_on"`
+		ExternalID      string              `json:"external_id"     db:"external_id"`
+		Status          ConnectionStatus    `json:"status"          db:"status"`
+		Direction       ConnectionDirection `json:"direction"       db:"direction"`
+		StartedOn       *time.Time          `json:"started_on"      db:"started_on"`
+		EndedOn         *time.Time          `json:"ended_on"        db:"ended_on"`
+		ConnectionType  ConnectionType      `json:"connection_type" db:"connection_type"`
+		Duration        int                 `json:"duration"        db:"duration"`
+		ErrorReason     null.String         `json:"error_reason"    db:"error_reason"`
+		ErrorCount      int                 `json:"error_count"     db:"error_count"`
+		NextAttempt     *time.Time          `json:"next_attempt"    db:"next_attempt"`
+		AttemptCount    int                 `json:"attempt_count"   db:"attempt_count"`
+		LastAttemptOn   *time.Time          `json:"last_attempt_on" db:"last_attempt_on"`
+		VoicemailLeftOn *time.Time          `json:"voicemail_left_on" db:"voicemail_left_on"`
+		ChannelID       ChannelID           `json:"channel_id"      db:"channel_id"`
+		ContactID       ContactID           `json:"contact_id"      db:"contact_id"`
+		ContactURNID    URNID               `json:"contact_urn_id"  db:"contact_urn_id"`
+		OrgID           OrgID               `json:"org_id"          db:"org_id"`
+		StartID         StartID             `json:"start_id"        db:"start_id"`
 	}
 }
 
@@ -104,6 +107,8 @@ func (c *ChannelConnection) StartID() StartID     { return c.c.StartID }
 func (c *ChannelConnection) ErrorReason() ConnectionError { return ConnectionError(c.c.ErrorReason) }
 func (c *ChannelConnection) ErrorCount() int              { return c.c.ErrorCount }
 func (c *ChannelConnection) NextAttempt() *time.Time      { return c.c.NextAttempt }
+func (c *ChannelConnection) AttemptCount() int            { return c.c.AttemptCount }
+func (c *ChannelConnection) LastAttemptOn() *time.Time    { return c.c.LastAttemptOn }
 
 const insertConnectionSQL = `
 INSERT INTO
@@ -120,7 +125,8 @@ INSERT INTO
 	channel_id,
 	contact_id,
 	contact_urn_id,
-	error_count
+	error_count,
+	attempt_count
 )
 
 VALUES(
@@ -135,6 +141,7 @@ VALUES(
 	:channel_id,
 	:contact_id,
 	:contact_urn_id,
+	0,
 	0
 )
 RETURNING
@@ -207,6 +214,9 @@ SELECT
 	cc.error_reason as error_reason,
 	cc.error_count as error_count,
 	cc.next_attempt as next_attempt, 
+	cc.attempt_count as attempt_count,
+	cc.last_attempt_on as last_attempt_on,
+	cc.voicemail_left_on as voicemail_left_on,
 	cc.channel_id as channel_id, 
 	cc.contact_id as contact_id, 
 	cc.contact_urn_id as contact_urn_id, 
@@ -244,6 +254,9 @@ SELECT
 	cc.error_reason as error_reason,
 	cc.error_count as error_count,
 	cc.next_attempt as next_attempt, 
+	cc.attempt_count as attempt_count,
+	cc.last_attempt_on as last_attempt_on,
+	cc.voicemail_left_on as voicemail_left_on,
 	cc.channel_id as channel_id, 
 	cc.contact_id as contact_id, 
 	cc.contact_urn_id as contact_urn_id, 
@@ -286,6 +299,9 @@ SELECT
 	cc.error_reason as error_reason,
 	cc.error_count as error_count,
 	cc.next_attempt as next_attempt, 
+	cc.attempt_count as attempt_count,
+	cc.last_attempt_on as last_attempt_on,
+	cc.voicemail_left_on as voicemail_left_on,
 	cc.channel_id as channel_id, 
 	cc.contact_id as contact_id, 
 	cc.contact_urn_id as contact_urn_id, 
@@ -341,6 +357,23 @@ func (c *ChannelConnection) UpdateExternalID(ctx context.Context, db Queryer, id
 	return nil
 }
 
+// MarkAttempted records that we are about to request the call for this connection on the IVR provider
+func (c *ChannelConnection) MarkAttempted(ctx context.Context, db Queryer, now time.Time) error {
+	c.c.AttemptCount++
+	c.c.LastAttemptOn = &now
+
+	_, err := db.ExecContext(ctx,
+		`UPDATE channels_channelconnection SET attempt_count = $2, last_attempt_on = $3, modified_on = NOW() WHERE id = $1`,
+		c.c.ID, c.c.AttemptCount, c.c.LastAttemptOn,
+	)
+
+	if err != nil {
+		return errors.Wrapf(err, "error marking channel connection as attempted")
+	}
+
+	return nil
+}
+
 // MarkStarted updates the status for this connection as well as sets the started on date
 func (c *ChannelConnection) MarkStarted(ctx context.Context, db Queryer, now time.Time) error {
 	c.c.Status = ConnectionStatusInProgress
@@ -359,11 +392,17 @@ func (c *ChannelConnection) MarkStarted(ctx context.Context, db Queryer, now tim
 
 // MarkErrored updates the status for this connection to errored and schedules a retry if appropriate
 func (c *ChannelConnection) MarkErrored(ctx context.Context, db Queryer, now time.Time, retryWait *time.Duration, errorReason ConnectionError) error {
+	return c.MarkErroredWithRetries(ctx, db, now, retryWait, ConnectionMaxRetries, errorReason)
+}
+
+// MarkErroredWithRetries updates the status for this connection to errored and schedules a retry if it has been
+// retried fewer than maxRetries times
+func (c *ChannelConnection) MarkErroredWithRetries(ctx context.Context, db Queryer, now time.Time, retryWait *time.Duration, maxRetries int, errorReason ConnectionError) error {
 	c.c.Status = ConnectionStatusErrored
 	c.c.ErrorReason = null.String(errorReason)
 	c.c.EndedOn = &now
 
-	if c.c.ErrorCount < ConnectionMaxRetries && retryWait != nil {
+	if c.c.ErrorCount < maxRetries && retryWait != nil {
 		c.c.ErrorCount++
 		next := now.Add(*retryWait)
 		c.c.NextAttempt = &next
@@ -401,11 +440,41 @@ func (c *ChannelConnection) MarkFailed(ctx context.Context, db Queryer, now time
 	return nil
 }
 
+// MarkVoicemailLeft updates this connection as completed by leaving a voicemail, which is recorded separately from its
+// status so that it can be told apart from calls completed by a person
+func (c *ChannelConnection) MarkVoicemailLeft(ctx context.Context, db Queryer, now time.Time) error {
+	c.c.Status = ConnectionStatusCompleted
+	c.c.ErrorReason = ""
+	c.c.EndedOn = &now
+	c.c.NextAttempt = nil
+	c.c.VoicemailLeftOn = &now
+
+	_, err := db.ExecContext(ctx,
+		`UPDATE channels_channelconnection SET status = $2, error_reason = NULL, ended_on = $3, next_attempt = NULL, voicemail_left_on = $3, modified_on = NOW() WHERE id = $1`,
+		c.c.ID, c.c.Status, c.c.EndedOn,
+	)
+
+	if err != nil {
+		return errors.Wrapf(err, "error marking channel connection as voicemail left")
+	}
+
+	return nil
+}
+
+// IsVoicemailLeft returns whether this connection was completed by leaving a voicemail
+func (c *ChannelConnection) IsVoicemailLeft() bool {
+	return c.c.VoicemailLeftOn != nil
+}
+
 // MarkThrottled updates the status for this connection to be queued, to be retried in a minute
 func (c *ChannelConnection) MarkThrottled(ctx context.Context, db Queryer, now time.Time) error {
+	return c.MarkQueued(ctx, db, now.Add(ConnectionThrottleWait))
+}
+
+// MarkQueued updates the status for this connection to be queued, to be retried at the passed in time
+func (c *ChannelConnection) MarkQueued(ctx context.Context, db Queryer, nextAttempt time.Time) error {
 	c.c.Status = ConnectionStatusQueued
-	next := now.Add(ConnectionThrottleWait)
-	c.c.NextAttempt = &next
+	c.c.NextAttempt = &nextAttempt
 
 	_, err := db.ExecContext(ctx,
 		`UPDATE channels_channelconnection SET status = $2, next_attempt = $3, modified_on = NOW() WHERE id = $1`,
@@ -413,7 +482,7 @@ func (c *ChannelConnection) MarkThrottled(ctx context.Context, db Queryer, now t
 	)
 
 	if err != nil {
-		return errors.Wrapf(err, "error marking channel connection as throttled")
+		return errors.Wrapf(err, "error marking channel connection as queued")
 	}
 
 	return nil
@@ -71,3 +71,25 @@ func TestChannelConnections(t *testing.T) {
 	err = conn3.MarkFailed(ctx, db, time.Now())
 	assert.NoError(t, err)
 }
+
+func TestChannelConnectionVoicemailLeft(t *testing.T) {
+	ctx, _, db, _ := testsuite.Get()
+
+	defer db.MustExec(`DELETE FROM channels_channelconnection`)
+
+	conn, err := models.InsertIVRConnection(ctx, db, testdata.Org1.ID, testdata.TwilioChannel.ID, models.NilStartID, testdata.Cathy.ID, testdata.Cathy.URNID, models.ConnectionDirectionOut, models.ConnectionStatusPending, "test1")
+	assert.NoError(t, err)
+	assert.False(t, conn.IsVoicemailLeft())
+
+	err = conn.MarkVoicemailLeft(ctx, db, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, conn.IsVoicemailLeft())
+
+	// a voicemail is a completed call without an error reason
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM channels_channelconnection WHERE id = $1 AND status = 'D' AND error_reason IS NULL AND voicemail_left_on IS NOT NULL`, conn.ID()).Returns(1)
+
+	conn2, err := models.SelectChannelConnection(ctx, db, conn.ID())
+	assert.NoError(t, err)
+	assert.True(t, conn2.IsVoicemailLeft())
+	assert.Equal(t, models.ConnectionError(""), conn2.ErrorReason())
+}
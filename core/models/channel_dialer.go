@@ -0,0 +1,215 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/pkg/errors"
+)
+
+// config keys for the outbound IVR dialer of a channel
+const (
+	// ChannelConfigCallsPerSecond is the number of calls a channel can request per second, can be fractional
+	ChannelConfigCallsPerSecond = "calls_per_second"
+
+	// ChannelConfigCallWindowStart and ChannelConfigCallWindowEnd are the times of day (HH:MM) between which outgoing
+	// calls can be made, in the contact's timezone. The window can wrap around midnight.
+	ChannelConfigCallWindowStart = "call_window_start"
+	ChannelConfigCallWindowEnd   = "call_window_end"
+
+	// ChannelConfigRetrySchedule is a map of error reason (busy, no_answer, machine or provider) to a list of minutes to
+	// wait before each retry of a call which errored for that reason, e.g. {"busy": [5, 30], "machine": []}
+	ChannelConfigRetrySchedule = "retry_schedule"
+)
+
+// DialerMaxPacingWait is the longest we'll wait for a call slot before queuing a call to be retried later instead
+const DialerMaxPacingWait = time.Second * 5
+
+const channelDialerNextKey = "channel_dialer:%s:next"
+
+var connectionErrorNames = map[string]ConnectionError{
+	"provider":  ConnectionErrorProvider,
+	"busy":      ConnectionErrorBusy,
+	"no_answer": ConnectionErrorNoAnswer,
+	"machine":   ConnectionErrorMachine,
+}
+
+// ConnectionErrorName returns the name of the passed in error reason as used in config and metrics
+func ConnectionErrorName(reason ConnectionError) string {
+	for name, r := range connectionErrorNames {
+		if r == reason {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// ChannelDialer is the outbound call pacing, call window and retry configuration of a channel, zero values meaning no
+// limits and the flow's retry settings being used
+type ChannelDialer struct {
+	CallsPerSecond float64
+	WindowStart    int // minutes since midnight, -1 if not set
+	WindowEnd      int // minutes since midnight, -1 if not set
+	RetrySchedule  map[ConnectionError][]time.Duration
+}
+
+// Dialer returns the dialer configuration of this channel
+func (c *Channel) Dialer() *ChannelDialer {
+	d := &ChannelDialer{
+		WindowStart:   parseTimeOfDay(c.ConfigValue(ChannelConfigCallWindowStart, "")),
+		WindowEnd:     parseTimeOfDay(c.ConfigValue(ChannelConfigCallWindowEnd, "")),
+		RetrySchedule: make(map[ConnectionError][]time.Duration),
+	}
+
+	switch cps := c.c.Config[ChannelConfigCallsPerSecond].(type) {
+	case float64:
+		d.CallsPerSecond = cps
+	case string:
+		d.CallsPerSecond, _ = strconv.ParseFloat(cps, 64)
+	}
+
+	schedule, _ := c.c.Config[ChannelConfigRetrySchedule].(map[string]interface{})
+	for name, mins := range schedule {
+		reason, known := connectionErrorNames[name]
+		minsList, isList := mins.([]interface{})
+		if !known || !isList {
+			continue
+		}
+
+		waits := make([]time.Duration, 0, len(minsList))
+		for _, m := range minsList {
+			if f, isFloat := m.(float64); isFloat && f >= 0 {
+				waits = append(waits, time.Duration(f*float64(time.Minute)))
+			}
+		}
+		d.RetrySchedule[reason] = waits
+	}
+
+	return d
+}
+
+// HasCallWindow returns whether calls can only be made during part of the day
+func (d *ChannelDialer) HasCallWindow() bool {
+	return d.WindowStart >= 0 && d.WindowEnd >= 0 && d.WindowStart != d.WindowEnd
+}
+
+// NextCallWindow returns the passed in time if it falls within the call window, otherwise the time when the next
+// call window opens
+func (d *ChannelDialer) NextCallWindow(now time.Time, tz *time.Location) time.Time {
+	if !d.HasCallWindow() {
+		return now
+	}
+
+	local := now.In(tz)
+	mins := local.Hour()*60 + local.Minute()
+
+	inWindow := false
+	if d.WindowStart < d.WindowEnd {
+		inWindow = mins >= d.WindowStart && mins < d.WindowEnd
+	} else {
+		inWindow = mins >= d.WindowStart || mins < d.WindowEnd
+	}
+	if inWindow {
+		return now
+	}
+
+	next := time.Date(local.Year(), local.Month(), local.Day(), d.WindowStart/60, d.WindowStart%60, 0, 0, tz)
+	if mins >= d.WindowStart {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// RetryWait returns how long to wait before retrying a call which has errored for the passed in reason, having already
+// been retried errorCount times, and how many retries are allowed in total. If there is no schedule for the reason on
+// this channel the passed in flow wait and the default number of retries are used.
+func (d *ChannelDialer) RetryWait(reason ConnectionError, errorCount int, flowWait *time.Duration) (*time.Duration, int) {
+	schedule, hasSchedule := d.RetrySchedule[reason]
+	if !hasSchedule {
+		return flowWait, ConnectionMaxRetries
+	}
+	if errorCount >= len(schedule) {
+		return nil, len(schedule)
+	}
+
+	wait := schedule[errorCount]
+	return &wait, len(schedule)
+}
+
+// CallTimezone returns the timezone of the contact at the passed in tel URN for the purposes of call windows. Contacts
+// don't have their own timezone so we use that of the country of their number, unless that is the org's own country,
+// spans several timezones or can't be determined, in which case we use the org's timezone.
+func CallTimezone(oa *OrgAssets, urn urns.URN) *time.Location {
+	orgTZ := oa.Env().Timezone()
+
+	country := envs.DeriveCountryFromTel(urn.Path())
+	if country == envs.NilCountry || country == oa.Env().DefaultCountry() {
+		return orgTZ
+	}
+
+	name, found := countryTimezones[country]
+	if !found {
+		return orgTZ
+	}
+	tz, err := time.LoadLocation(name)
+	if err != nil {
+		return orgTZ
+	}
+	return tz
+}
+
+func parseTimeOfDay(s string) int {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return -1
+	}
+	return t.Hour()*60 + t.Minute()
+}
+
+var reserveCallSlotScript = redis.NewScript(1, `-- KEYS: [NextKey], ARGV: [Now, Interval, MaxWait]
+local nextKey = KEYS[1]
+local now, interval, maxWait = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+
+local start = math.max(now, tonumber(redis.call("GET", nextKey) or "0"))
+
+-- too far off to wait for, caller should try again later without holding a slot
+if start - now > maxWait then
+	return {string.format("%.6f", start), 0}
+end
+
+redis.call("SET", nextKey, string.format("%.6f", start + interval))
+redis.call("EXPIREAT", nextKey, math.ceil(start + interval) + 60)
+
+return {string.format("%.6f", start), 1}
+`)
+
+// ReserveCallSlot reserves a slot to request a call on the passed in channel so that its calls per second are
+// respected, returning when the call can be requested. If the next free slot is more than DialerMaxPacingWait away,
+// nothing is reserved and false is returned along with when the caller should try again.
+func ReserveCallSlot(rc redis.Conn, channel *Channel, now time.Time) (time.Time, bool, error) {
+	cps := channel.Dialer().CallsPerSecond
+	if cps <= 0 {
+		return now, true, nil
+	}
+
+	values, err := redis.Values(reserveCallSlotScript.Do(rc,
+		fmt.Sprintf(channelDialerNextKey, channel.UUID()),
+		unixSeconds(now), 1/cps, DialerMaxPacingWait.Seconds(),
+	))
+	if err != nil {
+		return now, false, errors.Wrapf(err, "error reserving call slot for channel %s", channel.UUID())
+	}
+
+	var start string
+	var reserved int
+	if _, err := redis.Scan(values, &start, &reserved); err != nil {
+		return now, false, errors.Wrapf(err, "error reading call slot for channel %s", channel.UUID())
+	}
+	startSecs, _ := strconv.ParseFloat(start, 64)
+
+	return time.Unix(0, int64(startSecs*float64(time.Second))), reserved == 1, nil
+}
@@ -0,0 +1,131 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelDialer(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// no limits by default
+	dialer := oa.ChannelByID(testdata.TwilioChannel.ID).Dialer()
+	assert.Equal(t, float64(0), dialer.CallsPerSecond)
+	assert.False(t, dialer.HasCallWindow())
+
+	now := time.Date(2021, 6, 10, 23, 30, 0, 0, time.UTC)
+	assert.Equal(t, now, dialer.NextCallWindow(now, time.UTC))
+
+	flowWait := time.Hour
+	wait, maxRetries := dialer.RetryWait(models.ConnectionErrorBusy, 0, &flowWait)
+	assert.Equal(t, &flowWait, wait)
+	assert.Equal(t, models.ConnectionMaxRetries, maxRetries)
+
+	_, reserved, err := models.ReserveCallSlot(rc, oa.ChannelByID(testdata.TwilioChannel.ID), now)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	db.MustExec(`UPDATE channels_channel SET config = config::jsonb || '{
+		"calls_per_second": 0.5,
+		"call_window_start": "09:00",
+		"call_window_end": "20:30",
+		"retry_schedule": {"busy": [5, 30], "machine": [], "xxx": [1]}
+	}'::jsonb WHERE id = $1`, testdata.TwilioChannel.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	channel := oa.ChannelByID(testdata.TwilioChannel.ID)
+	dialer = channel.Dialer()
+	assert.Equal(t, 0.5, dialer.CallsPerSecond)
+	assert.Equal(t, 9*60, dialer.WindowStart)
+	assert.Equal(t, 20*60+30, dialer.WindowEnd)
+	assert.Equal(t, map[models.ConnectionError][]time.Duration{
+		models.ConnectionErrorBusy:    {5 * time.Minute, 30 * time.Minute},
+		models.ConnectionErrorMachine: {},
+	}, dialer.RetrySchedule)
+
+	kigali, _ := time.LoadLocation("Africa/Kigali")
+
+	tcs := []struct {
+		now      time.Time
+		expected time.Time
+	}{
+		{time.Date(2021, 6, 10, 12, 0, 0, 0, kigali), time.Date(2021, 6, 10, 12, 0, 0, 0, kigali)},   // inside window
+		{time.Date(2021, 6, 10, 7, 0, 0, 0, kigali), time.Date(2021, 6, 10, 9, 0, 0, 0, kigali)},     // before window opens
+		{time.Date(2021, 6, 10, 20, 30, 0, 0, kigali), time.Date(2021, 6, 11, 9, 0, 0, 0, kigali)},   // after window closes
+		{time.Date(2021, 6, 10, 18, 45, 0, 0, time.UTC), time.Date(2021, 6, 11, 9, 0, 0, 0, kigali)}, // after in contact's timezone
+	}
+	for _, tc := range tcs {
+		assert.Equal(t, tc.expected.UTC(), dialer.NextCallWindow(tc.now, kigali).UTC(), "next call window mismatch for %s", tc.now)
+	}
+
+	// windows can wrap around midnight
+	overnight := &models.ChannelDialer{WindowStart: 22 * 60, WindowEnd: 2 * 60}
+	assert.Equal(t, time.Date(2021, 6, 10, 23, 0, 0, 0, time.UTC), overnight.NextCallWindow(time.Date(2021, 6, 10, 23, 0, 0, 0, time.UTC), time.UTC))
+	assert.Equal(t, time.Date(2021, 6, 11, 1, 0, 0, 0, time.UTC), overnight.NextCallWindow(time.Date(2021, 6, 11, 1, 0, 0, 0, time.UTC), time.UTC))
+	assert.Equal(t, time.Date(2021, 6, 11, 22, 0, 0, 0, time.UTC), overnight.NextCallWindow(time.Date(2021, 6, 11, 3, 0, 0, 0, time.UTC), time.UTC))
+
+	// busy calls are retried according to their schedule
+	wait, maxRetries = dialer.RetryWait(models.ConnectionErrorBusy, 1, &flowWait)
+	assert.Equal(t, 30*time.Minute, *wait)
+	assert.Equal(t, 2, maxRetries)
+
+	wait, _ = dialer.RetryWait(models.ConnectionErrorBusy, 2, &flowWait)
+	assert.Nil(t, wait)
+
+	// machine answered calls are never retried
+	wait, maxRetries = dialer.RetryWait(models.ConnectionErrorMachine, 0, &flowWait)
+	assert.Nil(t, wait)
+	assert.Equal(t, 0, maxRetries)
+
+	// and no answer calls fall back to the flow settings
+	wait, maxRetries = dialer.RetryWait(models.ConnectionErrorNoAnswer, 2, &flowWait)
+	assert.Equal(t, &flowWait, wait)
+	assert.Equal(t, models.ConnectionMaxRetries, maxRetries)
+
+	// at 0.5 calls per second, calls are 2 seconds apart
+	now = time.Now()
+	for i := 0; i < 3; i++ {
+		slot, reserved, err := models.ReserveCallSlot(rc, channel, now)
+		assert.NoError(t, err)
+		assert.True(t, reserved)
+		assert.WithinDuration(t, now.Add(time.Duration(i)*2*time.Second), slot, time.Millisecond)
+	}
+
+	// next slot is 6 seconds away which is too long to wait so nothing is reserved
+	slot, reserved, err := models.ReserveCallSlot(rc, channel, now)
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.WithinDuration(t, now.Add(6*time.Second), slot, time.Millisecond)
+
+	slot, reserved, err = models.ReserveCallSlot(rc, channel, now.Add(time.Second))
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	assert.WithinDuration(t, now.Add(6*time.Second), slot, time.Millisecond)
+
+	// call windows use the timezone of the country of the contact's number, or the org's if it's from the org's country
+	// or a country which spans several timezones
+	assert.Equal(t, "America/Los_Angeles", models.CallTimezone(oa, "tel:+16055741111").String())
+	assert.Equal(t, "Africa/Kigali", models.CallTimezone(oa, "tel:+250788123123").String())
+	assert.Equal(t, "Africa/Nairobi", models.CallTimezone(oa, "tel:+254712345678").String())
+	assert.Equal(t, "America/Los_Angeles", models.CallTimezone(oa, "tel:+5582999887766").String())
+	assert.Equal(t, "America/Los_Angeles", models.CallTimezone(oa, "tel:123").String())
+
+	assert.Equal(t, "busy", models.ConnectionErrorName(models.ConnectionErrorBusy))
+	assert.Equal(t, "unknown", models.ConnectionErrorName(models.ConnectionError("X")))
+}
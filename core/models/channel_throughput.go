@@ -0,0 +1,195 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/pkg/errors"
+)
+
+// config keys for the throughput budget of a channel
+const (
+	// ChannelConfigThroughputPerMinute is the number of messages a channel can send per minute
+	ChannelConfigThroughputPerMinute = "throughput_per_minute"
+
+	// ChannelConfigDailyLimit is the number of messages a channel can send per day, e.g. the messaging tier of a
+	// WhatsApp number
+	ChannelConfigDailyLimit = "daily_limit"
+)
+
+const (
+	channelThroughputNextKey  = "channel_throughput:%s:next"
+	channelThroughputDailyKey = "channel_throughput:%s:daily"
+)
+
+// ChannelThroughput is the throughput budget of a channel, zero values mean no limit
+type ChannelThroughput struct {
+	PerMinute  int `json:"per_minute"`
+	DailyLimit int `json:"daily_limit"`
+}
+
+// IsLimited returns whether this budget limits sending at all
+func (t *ChannelThroughput) IsLimited() bool {
+	return t.PerMinute > 0 || t.DailyLimit > 0
+}
+
+// Throughput returns the throughput budget of this channel. Budgets are opt-in via channel config, TPS is left to
+// courier to enforce as it sends.
+func (c *Channel) Throughput() *ChannelThroughput {
+	perMinute, _ := strconv.Atoi(c.ConfigValue(ChannelConfigThroughputPerMinute, "0"))
+	dailyLimit, _ := strconv.Atoi(c.ConfigValue(ChannelConfigDailyLimit, "0"))
+
+	return &ChannelThroughput{PerMinute: perMinute, DailyLimit: dailyLimit}
+}
+
+// ThrottleChannel returns the channel whose throughput budget sends for the passed in org should respect. That is the
+// passed in channel if there is one, otherwise the org's only sending channel. If the org has several sending channels
+// we can't know which one messages will go out on, so nothing is throttled.
+func ThrottleChannel(oa *OrgAssets, channelID ChannelID) *Channel {
+	var channel *Channel
+
+	if channelID != NilChannelID {
+		channel = oa.ChannelByID(channelID)
+	} else {
+		channels, _ := oa.Channels()
+		for _, ch := range channels {
+			if ch.(*Channel).HasRole(assets.ChannelRoleSend) {
+				if channel != nil {
+					return nil
+				}
+				channel = ch.(*Channel)
+			}
+		}
+	}
+
+	if channel != nil && channel.Throughput().IsLimited() {
+		return channel
+	}
+	return nil
+}
+
+var reserveThroughputScript = redis.NewScript(2, `-- KEYS: [NextKey, DailyKey], ARGV: [Now, Count, PerMinute, DailyLimit]
+local nextKey, dailyKey = KEYS[1], KEYS[2]
+local now, count, perMinute, dailyLimit = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+
+-- we can't start before whatever was reserved before us has been sent
+local start = math.max(now, tonumber(redis.call("GET", nextKey) or "0"))
+
+-- move to the next day if this day's limit would be exceeded
+if dailyLimit > 0 then
+	local day = math.floor(start / 86400)
+	for i = 1, 366 do
+		local used = tonumber(redis.call("HGET", dailyKey, day) or "0")
+		if used == 0 or used + count <= dailyLimit then
+			break
+		end
+		day = day + 1
+		start = math.max(start, day * 86400)
+	end
+
+	redis.call("HINCRBY", dailyKey, day, count)
+	redis.call("EXPIREAT", dailyKey, (day + 2) * 86400)
+end
+
+-- and push back the start of whoever comes after us by how long it will take to send these
+if perMinute > 0 then
+	local finish = start + (count * 60 / perMinute)
+	redis.call("SET", nextKey, string.format("%.6f", finish))
+	redis.call("EXPIREAT", nextKey, math.ceil(finish) + 60)
+end
+
+return string.format("%.6f", start)
+`)
+
+// ReserveChannelThroughput reserves the sending of count messages on the passed in channel, returning the time at
+// which they can be queued so that the channel's per minute and daily budgets are respected
+func ReserveChannelThroughput(rc redis.Conn, channel *Channel, count int, now time.Time) (time.Time, error) {
+	t := channel.Throughput()
+	if !t.IsLimited() || count == 0 {
+		return now, nil
+	}
+
+	start, err := redis.Float64(reserveThroughputScript.Do(rc,
+		fmt.Sprintf(channelThroughputNextKey, channel.UUID()),
+		fmt.Sprintf(channelThroughputDailyKey, channel.UUID()),
+		unixSeconds(now), count, t.PerMinute, t.DailyLimit,
+	))
+	if err != nil {
+		return now, errors.Wrapf(err, "error reserving throughput for channel %s", channel.UUID())
+	}
+
+	return time.Unix(0, int64(start*float64(time.Second))), nil
+}
+
+// QueueThrottledTask queues a task which will send count messages, scheduling it for later if that is needed to
+// respect the throughput budget of the passed in channel. If channel is nil the task is queued as normal.
+func QueueThrottledTask(rc redis.Conn, channel *Channel, count int, q string, taskType string, orgID OrgID, task interface{}, priority queue.Priority) error {
+	if channel == nil {
+		return queue.AddTask(rc, q, taskType, int(orgID), task, priority)
+	}
+
+	now := time.Now()
+	at, err := ReserveChannelThroughput(rc, channel, count, now)
+	if err != nil {
+		return err
+	}
+	if !at.After(now) {
+		return queue.AddTask(rc, q, taskType, int(orgID), task, priority)
+	}
+
+	payload, err := queue.NewTask(taskType, int(orgID), task)
+	if err != nil {
+		return errors.Wrapf(err, "error creating task")
+	}
+	return queue.ScheduleTask(rc, q, int(orgID), payload, at, priority)
+}
+
+// ChannelBudget is the remaining throughput budget of a channel
+type ChannelBudget struct {
+	ChannelUUID    assets.ChannelUUID `json:"channel_uuid"`
+	Throughput     *ChannelThroughput `json:"throughput"`
+	DailyUsed      int                `json:"daily_used"`
+	DailyRemaining *int               `json:"daily_remaining"`
+	NextSendOn     time.Time          `json:"next_send_on"`
+}
+
+// GetChannelBudget gets the remaining throughput budget of the passed in channel, i.e. how much of today's limit
+// has been reserved and when the next reserved batch could start sending
+func GetChannelBudget(rc redis.Conn, channel *Channel, now time.Time) (*ChannelBudget, error) {
+	t := channel.Throughput()
+	budget := &ChannelBudget{ChannelUUID: channel.UUID(), Throughput: t, NextSendOn: now}
+
+	next, err := redis.Float64(rc.Do("GET", fmt.Sprintf(channelThroughputNextKey, channel.UUID())))
+	if err != nil && err != redis.ErrNil {
+		return nil, errors.Wrapf(err, "error getting next send time for channel %s", channel.UUID())
+	}
+	if nextOn := time.Unix(0, int64(next*float64(time.Second))); nextOn.After(now) {
+		budget.NextSendOn = nextOn
+	}
+
+	day := now.Unix() / 86400
+	used, err := redis.Int(rc.Do("HGET", fmt.Sprintf(channelThroughputDailyKey, channel.UUID()), day))
+	if err != nil && err != redis.ErrNil {
+		return nil, errors.Wrapf(err, "error getting daily usage for channel %s", channel.UUID())
+	}
+	budget.DailyUsed = used
+
+	// remaining is null if there is no daily limit
+	if t.DailyLimit > 0 {
+		remaining := 0
+		if used < t.DailyLimit {
+			remaining = t.DailyLimit - used
+		}
+		budget.DailyRemaining = &remaining
+	}
+
+	return budget, nil
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()/int64(time.Microsecond)) / float64(1000000)
+}
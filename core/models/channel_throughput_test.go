@@ -0,0 +1,97 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelThroughput(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// no channels have budgets by default
+	assert.Nil(t, models.ThrottleChannel(oa, models.NilChannelID))
+	assert.Nil(t, models.ThrottleChannel(oa, testdata.WhatsAppCloudChannel.ID))
+
+	// give our whatsapp channel a budget of 60 messages a minute and 250 a day
+	db.MustExec(`UPDATE channels_channel SET config = config::jsonb || '{"throughput_per_minute": 60, "daily_limit": 250}'::jsonb WHERE id = $1`, testdata.WhatsAppCloudChannel.ID)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	// sends on other channels aren't throttled by it, nor are sends where the org has several channels to choose from
+	assert.Nil(t, models.ThrottleChannel(oa, testdata.TwilioChannel.ID))
+	assert.Nil(t, models.ThrottleChannel(oa, models.NilChannelID))
+
+	// but an org with a single sending channel is throttled by that channel even when none is given
+	db.MustExec(`UPDATE channels_channel SET config = config::jsonb || '{"throughput_per_minute": 60}'::jsonb WHERE id = $1`, testdata.Org2Channel.ID)
+
+	oa2, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org2.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	org2Channel := models.ThrottleChannel(oa2, models.NilChannelID)
+	require.NotNil(t, org2Channel)
+	assert.Equal(t, testdata.Org2Channel.UUID, org2Channel.UUID())
+
+	channel := models.ThrottleChannel(oa, testdata.WhatsAppCloudChannel.ID)
+	require.NotNil(t, channel)
+	assert.Equal(t, testdata.WhatsAppCloudChannel.UUID, channel.UUID())
+	assert.Equal(t, &models.ChannelThroughput{PerMinute: 60, DailyLimit: 250}, channel.Throughput())
+
+	now := time.Now().UTC()
+	tomorrow := now.Truncate(time.Hour * 24).Add(time.Hour * 24)
+
+	// first batch can go right away, second has to wait for the first to be sent
+	at, err := models.ReserveChannelThroughput(rc, channel, 100, now)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, now, at, time.Millisecond)
+
+	at, err = models.ReserveChannelThroughput(rc, channel, 100, now)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, now.Add(100*time.Second), at, time.Millisecond)
+
+	budget, err := models.GetChannelBudget(rc, channel, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, budget.DailyUsed)
+	assert.Equal(t, 50, *budget.DailyRemaining)
+	assert.WithinDuration(t, now.Add(200*time.Second), budget.NextSendOn, time.Millisecond)
+
+	// third batch would exceed today's limit so is pushed to tomorrow
+	at, err = models.ReserveChannelThroughput(rc, channel, 100, now)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, tomorrow, at, time.Millisecond)
+
+	// throttled tasks are scheduled for when they can be sent
+	err = models.QueueThrottledTask(rc, channel, 10, "throttled", "test", testdata.Org1.ID, "task", queue.DefaultPriority)
+	assert.NoError(t, err)
+
+	task, err := queue.PopNextTask(rc, "throttled")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	size, err := queue.Size(rc, "throttled")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	// unless there is no channel to throttle by
+	err = models.QueueThrottledTask(rc, nil, 10, "unthrottled", "test", testdata.Org1.ID, "task", queue.DefaultPriority)
+	assert.NoError(t, err)
+
+	task, err = queue.PopNextTask(rc, "unthrottled")
+	assert.NoError(t, err)
+	assert.NotNil(t, task)
+}
@@ -87,6 +87,16 @@ func (c *Channel) Schemes() []string { return c.c.Schemes }
 // Roles returns the roles this channel supports
 func (c *Channel) Roles() []assets.ChannelRole { return c.c.Roles }
 
+// HasRole returns whether this channel has the passed in role
+func (c *Channel) HasRole(role assets.ChannelRole) bool {
+	for _, r := range c.c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
 // MatchPrefixes returns the prefixes we should also match when determining channel affinity
 func (c *Channel) MatchPrefixes() []string { return c.c.MatchPrefixes }
 
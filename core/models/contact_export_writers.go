@@ -0,0 +1,173 @@
+package models
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// contactExportWriter writes the rows of a contact export in a particular format
+type contactExportWriter interface {
+	WriteRow([]interface{}) error
+	Close() error
+}
+
+func newContactExportWriter(format ContactExportFormat, w io.Writer, columns []*ContactExportColumn) (contactExportWriter, error) {
+	switch format {
+	case ContactExportFormatCSV:
+		return newCSVExportWriter(w, columns)
+	case ContactExportFormatXLSX:
+		return newXLSXExportWriter(w, columns)
+	case ContactExportFormatJSONL:
+		return &jsonlExportWriter{w: bufio.NewWriter(w), columns: columns}, nil
+	}
+	return nil, errors.Errorf("unknown contact export format: %s", format)
+}
+
+// formats a column value for a tabular format, URN paths being joined and missing values being empty
+func formatExportValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ", ")
+	}
+	return fmt.Sprint(value)
+}
+
+// writes a header row and then a row per contact
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func newCSVExportWriter(w io.Writer, columns []*ContactExportColumn) (*csvExportWriter, error) {
+	cw := &csvExportWriter{w: csv.NewWriter(w)}
+
+	headers := make([]string, len(columns))
+	for i, c := range columns {
+		headers[i] = c.Header
+	}
+	return cw, cw.w.Write(headers)
+}
+
+func (w *csvExportWriter) WriteRow(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = formatExportValue(v)
+	}
+	return w.w.Write(record)
+}
+
+func (w *csvExportWriter) Close() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// writes a JSON object per contact keyed by column key, e.g. {"uuid": "...", "urn:tel": ["+1234"], "field:age": "30"}
+type jsonlExportWriter struct {
+	w       *bufio.Writer
+	columns []*ContactExportColumn
+}
+
+func (w *jsonlExportWriter) WriteRow(values []interface{}) error {
+	obj := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		obj[w.columns[i].Key] = v
+	}
+
+	line, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	w.w.Write(line)
+	return w.w.WriteByte('\n')
+}
+
+func (w *jsonlExportWriter) Close() error {
+	return w.w.Flush()
+}
+
+// writes a workbook with a single sheet of inline strings. The sheet is streamed into the zip as rows are written and
+// the other parts of the workbook are added when it is closed.
+type xlsxExportWriter struct {
+	z     *zip.Writer
+	sheet *bufio.Writer
+}
+
+const xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+
+const xlsxSheetEnd = `</sheetData></worksheet>`
+
+var xlsxParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Contacts" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+func newXLSXExportWriter(w io.Writer, columns []*ContactExportColumn) (*xlsxExportWriter, error) {
+	z := zip.NewWriter(w)
+
+	sheet, err := z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	xw := &xlsxExportWriter{z: z, sheet: bufio.NewWriter(sheet)}
+	xw.sheet.WriteString(xlsxSheetStart)
+
+	headers := make([]interface{}, len(columns))
+	for i, c := range columns {
+		headers[i] = c.Header
+	}
+	return xw, xw.WriteRow(headers)
+}
+
+func (w *xlsxExportWriter) WriteRow(values []interface{}) error {
+	w.sheet.WriteString(`<row>`)
+	for _, v := range values {
+		w.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+		if err := xml.EscapeText(w.sheet, []byte(formatExportValue(v))); err != nil {
+			return err
+		}
+		w.sheet.WriteString(`</t></is></c>`)
+	}
+	_, err := w.sheet.WriteString(`</row>`)
+	return err
+}
+
+func (w *xlsxExportWriter) Close() error {
+	w.sheet.WriteString(xlsxSheetEnd)
+	if err := w.sheet.Flush(); err != nil {
+		return err
+	}
+
+	for _, part := range xlsxParts {
+		pw, err := w.z.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(pw, part.content); err != nil {
+			return err
+		}
+	}
+
+	return w.z.Close()
+}
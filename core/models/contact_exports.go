@@ -0,0 +1,253 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+)
+
+// ContactExportFormat is the file format of a contact export
+type ContactExportFormat string
+
+// possible contact export formats
+const (
+	ContactExportFormatCSV   = ContactExportFormat("csv")
+	ContactExportFormatXLSX  = ContactExportFormat("xlsx")
+	ContactExportFormatJSONL = ContactExportFormat("jsonl")
+)
+
+// ContentType returns the MIME type of files in this format
+func (f ContactExportFormat) ContentType() string {
+	switch f {
+	case ContactExportFormatXLSX:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case ContactExportFormatJSONL:
+		return "application/x-ndjson"
+	}
+	return "text/csv"
+}
+
+// how many contacts we load at a time when exporting
+const contactExportBatchSize = 500
+
+// ContactExport is an export of the contacts in a group and/or matching a query, with their attributes and the selected
+// fields, URN schemes and group memberships
+type ContactExport struct {
+	UUID      string              `json:"uuid"`
+	GroupUUID assets.GroupUUID    `json:"group_uuid,omitempty"`
+	Query     string              `json:"query,omitempty"`
+	Format    ContactExportFormat `json:"format"`
+	Fields    []string            `json:"fields,omitempty"`
+	Schemes   []string            `json:"schemes,omitempty"`
+	Groups    []assets.GroupUUID  `json:"groups,omitempty"`
+}
+
+// ContactExportColumn is a column of a contact export
+type ContactExportColumn struct {
+	Key    string
+	Header string
+	value  func(*Contact) interface{}
+}
+
+// Columns returns the columns of this export, erroring if any of the selected fields or groups don't exist
+func (e *ContactExport) Columns(oa *OrgAssets) ([]*ContactExportColumn, error) {
+	tz := oa.Env().Timezone()
+	formatTime := func(t time.Time) interface{} { return t.In(tz).Format(time.RFC3339) }
+
+	columns := []*ContactExportColumn{
+		{"uuid", "Contact UUID", func(c *Contact) interface{} { return string(c.UUID()) }},
+		{"name", "Name", func(c *Contact) interface{} { return c.Name() }},
+		{"language", "Language", func(c *Contact) interface{} { return string(c.Language()) }},
+		{"status", "Status", func(c *Contact) interface{} { return contactExportStatuses[c.Status()] }},
+		{"created_on", "Created On", func(c *Contact) interface{} { return formatTime(c.CreatedOn()) }},
+		{"last_seen_on", "Last Seen On", func(c *Contact) interface{} {
+			if c.LastSeenOn() == nil {
+				return nil
+			}
+			return formatTime(*c.LastSeenOn())
+		}},
+	}
+
+	for _, scheme := range e.Schemes {
+		scheme := scheme
+		columns = append(columns, &ContactExportColumn{"urn:" + scheme, "URN:" + scheme, func(c *Contact) interface{} {
+			paths := make([]string, 0, 1)
+			for _, u := range c.URNs() {
+				if u.Scheme() == scheme {
+					paths = append(paths, u.Path())
+				}
+			}
+			return paths
+		}})
+	}
+
+	for _, key := range e.Fields {
+		field := oa.FieldByKey(key)
+		if field == nil {
+			return nil, errors.Errorf("no such field with key: %s", key)
+		}
+		columns = append(columns, &ContactExportColumn{"field:" + key, "Field:" + field.Name(), func(c *Contact) interface{} {
+			value := c.Fields()[field.Key()]
+			if value == nil {
+				return nil
+			}
+			return value.Text.Native()
+		}})
+	}
+
+	for _, groupUUID := range e.Groups {
+		group := oa.GroupByUUID(groupUUID)
+		if group == nil {
+			return nil, errors.Errorf("no such group with uuid: %s", groupUUID)
+		}
+		columns = append(columns, &ContactExportColumn{"group:" + string(groupUUID), "Group:" + group.Name(), func(c *Contact) interface{} {
+			for _, g := range c.Groups() {
+				if g.ID() == group.ID() {
+					return true
+				}
+			}
+			return false
+		}})
+	}
+
+	return columns, nil
+}
+
+var contactExportStatuses = map[ContactStatus]string{
+	ContactStatusActive:   "active",
+	ContactStatusBlocked:  "blocked",
+	ContactStatusStopped:  "stopped",
+	ContactStatusArchived: "archived",
+}
+
+// WriteContactExport writes the contacts of the passed in export to the given writer in the export's format, calling the
+// progress function (if any) with the number of contacts written after each batch. It returns the number of contacts
+// written.
+func WriteContactExport(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, export *ContactExport, w io.Writer, progress func(int) error) (int, error) {
+	columns, err := export.Columns(oa)
+	if err != nil {
+		return 0, err
+	}
+
+	ew, err := newContactExportWriter(export.Format, w, columns)
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+
+	err = ScrollContactIDs(ctx, rt, oa, export.GroupUUID, export.Query, contactExportBatchSize, func(ids []ContactID) error {
+		contacts, err := LoadContacts(ctx, rt.ReadonlyDB, oa, ids)
+		if err != nil {
+			return errors.Wrapf(err, "error loading contacts for export")
+		}
+
+		// keep the order we were given the ids in
+		byID := make(map[ContactID]*Contact, len(contacts))
+		for _, c := range contacts {
+			byID[c.ID()] = c
+		}
+
+		for _, id := range ids {
+			if c := byID[id]; c != nil {
+				values := make([]interface{}, len(columns))
+				for i, col := range columns {
+					values[i] = col.value(c)
+				}
+				if err := ew.WriteRow(values); err != nil {
+					return errors.Wrapf(err, "error writing contact export")
+				}
+				written++
+			}
+		}
+
+		if progress != nil {
+			return progress(written)
+		}
+		return nil
+	})
+	if err != nil {
+		return written, err
+	}
+
+	if err := ew.Close(); err != nil {
+		return written, errors.Wrapf(err, "error writing contact export")
+	}
+
+	return written, nil
+}
+
+// ContactExportStatus is the status of a background contact export
+type ContactExportStatus string
+
+// possible contact export statuses
+const (
+	ContactExportStatusQueued    = ContactExportStatus("queued")
+	ContactExportStatusExporting = ContactExportStatus("exporting")
+	ContactExportStatusComplete  = ContactExportStatus("complete")
+	ContactExportStatusFailed    = ContactExportStatus("failed")
+)
+
+const (
+	contactExportProgressKey    = "contact_export:%s"
+	contactExportProgressExpire = time.Hour * 24 * 7 // how long we keep the progress of an export around
+)
+
+// ContactExportProgress is the progress of a background contact export
+type ContactExportProgress struct {
+	OrgID    OrgID               `json:"org_id"             redis:"org_id"`
+	Status   ContactExportStatus `json:"status"             redis:"status"`
+	Total    int                 `json:"total"              redis:"total"`
+	Exported int                 `json:"exported"           redis:"exported"`
+	URL      string              `json:"url,omitempty"      redis:"url"`
+	Error    string              `json:"error,omitempty"    redis:"error"`
+}
+
+// SetContactExportProgress records the progress of the given contact export, overwriting any existing values
+func SetContactExportProgress(rc redis.Conn, exportUUID string, progress *ContactExportProgress) error {
+	key := fmt.Sprintf(contactExportProgressKey, exportUUID)
+
+	rc.Send("MULTI")
+	rc.Send("HSET", redis.Args{}.Add(key).AddFlat(progress)...)
+	rc.Send("EXPIRE", key, int(contactExportProgressExpire/time.Second))
+	_, err := rc.Do("EXEC")
+	if err != nil {
+		return errors.Wrapf(err, "error setting progress for contact export %s", exportUUID)
+	}
+	return nil
+}
+
+// GetContactExportProgress gets the progress of the given contact export, returning nil if it doesn't exist
+func GetContactExportProgress(rc redis.Conn, exportUUID string) (*ContactExportProgress, error) {
+	values, err := redis.Values(rc.Do("HGETALL", fmt.Sprintf(contactExportProgressKey, exportUUID)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting progress for contact export %s", exportUUID)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	progress := &ContactExportProgress{}
+	if err := redis.ScanStruct(values, progress); err != nil {
+		return nil, errors.Wrapf(err, "error reading progress for contact export %s", exportUUID)
+	}
+	return progress, nil
+}
+
+// ContactExportPath returns the media storage path of the given contact export
+func ContactExportPath(prefix string, orgID OrgID, export *ContactExport) string {
+	p := strings.TrimRight(prefix, "/") + fmt.Sprintf("/contact_exports/%d/%s.%s", orgID, export.UUID, export.Format)
+
+	// ensure path begins with /
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
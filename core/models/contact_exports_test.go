@@ -0,0 +1,123 @@
+package models_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteContactExport(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer func() { rt.ES = nil }()
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// without elastic exports page through the database
+	rt.ES = nil
+
+	db.MustExec(`UPDATE contacts_contact SET fields = $2::jsonb WHERE id = $1`, testdata.Cathy.ID, fmt.Sprintf(`{"%s": {"text": "F"}}`, testdata.GenderField.UUID))
+	db.MustExec(`UPDATE contacts_contact SET fields = NULL WHERE id = $1`, testdata.Bob.ID)
+	db.MustExec(`DELETE FROM contacts_contactgroup_contacts WHERE contactgroup_id IN ($1, $2)`, testdata.TestersGroup.ID, testdata.DoctorsGroup.ID)
+	testdata.TestersGroup.Add(db, testdata.Cathy, testdata.Bob)
+	testdata.DoctorsGroup.Add(db, testdata.Bob)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFields|models.RefreshGroups)
+	require.NoError(t, err)
+
+	export := &models.ContactExport{
+		GroupUUID: testdata.TestersGroup.UUID,
+		Format:    models.ContactExportFormatCSV,
+		Fields:    []string{"gender"},
+		Schemes:   []string{"tel"},
+		Groups:    []assets.GroupUUID{testdata.DoctorsGroup.UUID},
+	}
+
+	// CSV has a header row and a row per contact
+	b := &bytes.Buffer{}
+	progress := make([]int, 0)
+	count, err := models.WriteContactExport(ctx, rt, oa, export, b, func(n int) error {
+		progress = append(progress, n)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, []int{2}, progress)
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, "Contact UUID,Name,Language,Status,Created On,Last Seen On,URN:tel,Field:Gender,Group:Doctors", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], string(testdata.Cathy.UUID)+",Cathy,"))
+	assert.True(t, strings.HasSuffix(lines[1], ",+16055741111,F,false"))
+	assert.True(t, strings.HasSuffix(lines[2], ",+16055742222,,true"))
+
+	// JSONL has an object per contact keyed by column
+	export.Format = models.ContactExportFormatJSONL
+	export.Query = "gender = F"
+	b = &bytes.Buffer{}
+	count, err = models.WriteContactExport(ctx, rt, oa, export, b, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	row := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(bytes.TrimSpace(b.Bytes()), &row))
+	assert.Equal(t, string(testdata.Cathy.UUID), row["uuid"])
+	assert.Equal(t, "active", row["status"])
+	assert.Equal(t, []interface{}{"+16055741111"}, row["urn:tel"])
+	assert.Equal(t, "F", row["field:gender"])
+	assert.Equal(t, false, row["group:"+string(testdata.DoctorsGroup.UUID)])
+
+	// XLSX is a zipped workbook with a single sheet
+	export.Format = models.ContactExportFormatXLSX
+	b = &bytes.Buffer{}
+	_, err = models.WriteContactExport(ctx, rt, oa, export, b, nil)
+	require.NoError(t, err)
+
+	z, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	require.NoError(t, err)
+	assert.Equal(t, 5, len(z.File))
+
+	sheet, err := z.Open("xl/worksheets/sheet1.xml")
+	require.NoError(t, err)
+	sheetXML, err := io.ReadAll(sheet)
+	require.NoError(t, err)
+	assert.Contains(t, string(sheetXML), `<t xml:space="preserve">Cathy</t>`)
+
+	// selected fields must exist
+	export.Fields = []string{"xyz"}
+	_, err = models.WriteContactExport(ctx, rt, oa, export, b, nil)
+	assert.EqualError(t, err, "no such field with key: xyz")
+}
+
+func TestContactExportProgress(t *testing.T) {
+	_, rt, _, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	progress, err := models.GetContactExportProgress(rc, "2bd3d2a2-0b0d-4bd8-8c69-3d1f8a1a3f1e")
+	assert.NoError(t, err)
+	assert.Nil(t, progress)
+
+	err = models.SetContactExportProgress(rc, "2bd3d2a2-0b0d-4bd8-8c69-3d1f8a1a3f1e", &models.ContactExportProgress{OrgID: testdata.Org1.ID, Status: models.ContactExportStatusExporting, Total: 10, Exported: 5})
+	assert.NoError(t, err)
+
+	progress, err = models.GetContactExportProgress(rc, "2bd3d2a2-0b0d-4bd8-8c69-3d1f8a1a3f1e")
+	assert.NoError(t, err)
+	assert.Equal(t, &models.ContactExportProgress{OrgID: testdata.Org1.ID, Status: models.ContactExportStatusExporting, Total: 10, Exported: 5}, progress)
+
+	assert.Equal(t, "/media/contact_exports/1/2bd3d2a2-0b0d-4bd8-8c69-3d1f8a1a3f1e.csv", models.ContactExportPath(rt.Config.S3MediaPrefix, testdata.Org1.ID, &models.ContactExport{UUID: "2bd3d2a2-0b0d-4bd8-8c69-3d1f8a1a3f1e", Format: models.ContactExportFormatCSV}))
+}
@@ -0,0 +1,402 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// FieldMergePolicy is how values of a field which both the target and a source contact have are resolved in a merge
+type FieldMergePolicy string
+
+// field merge policies
+const (
+	// FieldMergeKeepTarget keeps the target's values, only taking values from sources for fields the target doesn't have
+	FieldMergeKeepTarget = FieldMergePolicy("keep_target")
+
+	// FieldMergeOverwrite takes the values of sources over those of the target, later sources taking precedence
+	FieldMergeOverwrite = FieldMergePolicy("overwrite")
+)
+
+// ContactMerge is the outcome of merging source contacts into a target contact
+type ContactMerge struct {
+	ContactID      ContactID   `json:"contact_id"`
+	MergedIDs      []ContactID `json:"merged_ids"`
+	FieldConflicts []string    `json:"field_conflicts"`
+}
+
+// MergeContacts merges the passed in source contacts into the target contact in a single transaction, moving their
+// URNs, field values, group memberships, messages, runs, tickets and campaign event fires onto the target. Unfired
+// campaign event fires of the target are then rescheduled from its merged values. Sources have their waiting sessions
+// interrupted and are released once merged. Callers should hold the locks of all contacts.
+func MergeContacts(ctx context.Context, db *sqlx.DB, oa *OrgAssets, userID UserID, target *Contact, sources []*Contact, policy FieldMergePolicy) (*ContactMerge, error) {
+	sourceIDs := make([]ContactID, len(sources))
+	flowSourceIDs := make([]flows.ContactID, len(sources))
+	for i, s := range sources {
+		sourceIDs[i] = s.ID()
+		flowSourceIDs[i] = flows.ContactID(s.ID())
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error starting transaction to merge contacts")
+	}
+
+	// sources can't be waiting in sessions which will then belong to the target
+	for _, sessionType := range []FlowType{FlowTypeMessaging, FlowTypeVoice} {
+		if err := InterruptContactRuns(ctx, tx, sessionType, flowSourceIDs, dates.Now()); err != nil {
+			tx.Rollback()
+			return nil, errors.Wrapf(err, "error interrupting sessions of merged contacts")
+		}
+	}
+
+	conflicts, err := mergeContactFields(ctx, tx, oa, target.ID(), sourceIDs, policy)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = Exec(ctx, "moving merged contact URNs", tx, mergeContactURNsSQL, target.ID(), pq.Array(sourceIDs), topURNPriority)
+	if err == nil {
+		err = Exec(ctx, "moving merged contact groups", tx, mergeContactGroupsSQL, target.ID(), pq.Array(sourceIDs), oa.OrgID())
+	}
+	for _, table := range mergedContactTables {
+		if err == nil {
+			err = Exec(ctx, "moving merged contact "+table, tx, `UPDATE `+table+` SET contact_id = $1 WHERE contact_id = ANY($2)`, target.ID(), pq.Array(sourceIDs))
+		}
+	}
+	if err == nil {
+		err = Exec(ctx, "removing merged contacts from triggers", tx, `DELETE FROM triggers_trigger_contacts WHERE contact_id = ANY($1)`, pq.Array(sourceIDs))
+	}
+	if err == nil {
+		err = Exec(ctx, "releasing merged contacts", tx, releaseMergedContactsSQL, pq.Array(sourceIDs), userID)
+	}
+	if err == nil {
+		err = Exec(ctx, "updating merge target", tx, `UPDATE contacts_contact SET modified_on = NOW(), modified_by_id = COALESCE($2, modified_by_id) WHERE id = $1`, target.ID(), userID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, errors.Wrapf(err, "error merging contacts into contact: %d", target.ID())
+	}
+
+	// the target's dynamic groups and campaign event fires may have changed with its new field values and URNs
+	merged, err := LoadContact(ctx, tx, oa, target.ID())
+	if err != nil {
+		tx.Rollback()
+		return nil, errors.Wrapf(err, "error loading merged contact")
+	}
+	flowContact, err := merged.FlowContact(oa)
+	if err != nil {
+		tx.Rollback()
+		return nil, errors.Wrapf(err, "error creating flow contact for merged contact")
+	}
+	if err := CalculateDynamicGroups(ctx, tx, oa, []*flows.Contact{flowContact}); err != nil {
+		tx.Rollback()
+		return nil, errors.Wrapf(err, "error recalculating dynamic groups of merged contact")
+	}
+	if err := rescheduleMergedContactEvents(ctx, tx, oa, flowContact); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "error committing contact merge")
+	}
+
+	return &ContactMerge{ContactID: target.ID(), MergedIDs: sourceIDs, FieldConflicts: conflicts}, nil
+}
+
+// replaces the unfired campaign event fires of the merged contact, its own and those moved from sources, with fires
+// calculated from its merged field values and groups
+func rescheduleMergedContactEvents(ctx context.Context, tx Queryer, oa *OrgAssets, contact *flows.Contact) error {
+	contactID := ContactID(contact.ID())
+
+	if err := DeleteUnfiredContactEvents(ctx, tx, []ContactID{contactID}); err != nil {
+		return err
+	}
+
+	fas := make([]*FireAdd, 0, 10)
+	tz := oa.Env().Timezone()
+	now := time.Now()
+
+	for _, c := range oa.Campaigns() {
+		for _, e := range c.Events() {
+			scheduled, err := e.ScheduleForContact(tz, now, contact)
+			if err != nil {
+				return errors.Wrapf(err, "error calculating schedule for event: %d and contact: %d", e.ID(), contactID)
+			}
+			if scheduled != nil {
+				fas = append(fas, &FireAdd{ContactID: contactID, EventID: e.ID(), Scheduled: *scheduled})
+			}
+		}
+	}
+
+	return AddEventFires(ctx, tx, fas)
+}
+
+// the tables whose rows belonging to merged contacts are moved as they are onto the target
+var mergedContactTables = []string{
+	"msgs_msg",
+	"flows_flowsession",
+	"flows_flowrun",
+	"tickets_ticket",
+	"tickets_ticketevent",
+	"campaigns_eventfire",
+	"channels_channelevent",
+	"channels_channelconnection",
+}
+
+// merges the field values of the sources into those of the target according to the passed in policy, returning the
+// keys of the fields which had conflicting values
+func mergeContactFields(ctx context.Context, tx Queryer, oa *OrgAssets, targetID ContactID, sourceIDs []ContactID, policy FieldMergePolicy) ([]string, error) {
+	rows, err := tx.QueryxContext(ctx, `SELECT id, COALESCE(fields, '{}'::jsonb) FROM contacts_contact WHERE id = $1 OR id = ANY($2)`, targetID, pq.Array(sourceIDs))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading fields of merged contacts")
+	}
+	defer rows.Close()
+
+	fieldsByContact := make(map[ContactID]map[assets.FieldUUID]json.RawMessage, len(sourceIDs)+1)
+	for rows.Next() {
+		var id ContactID
+		var raw []byte
+		if err := rows.Scan(&id, &raw); err != nil {
+			return nil, errors.Wrapf(err, "error scanning contact fields")
+		}
+		fields := make(map[assets.FieldUUID]json.RawMessage)
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshalling fields of contact: %d", id)
+		}
+		fieldsByContact[id] = fields
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error loading fields of merged contacts")
+	}
+
+	merged := fieldsByContact[targetID]
+	if merged == nil {
+		merged = make(map[assets.FieldUUID]json.RawMessage)
+	}
+	conflicts := make(map[string]bool)
+
+	for _, sourceID := range sourceIDs {
+		for uuid, value := range fieldsByContact[sourceID] {
+			existing, exists := merged[uuid]
+			if exists && !sameFieldValue(existing, value) {
+				if field := oa.FieldByUUID(uuid); field != nil {
+					conflicts[field.Key()] = true
+				}
+			}
+			if !exists || policy == FieldMergeOverwrite {
+				merged[uuid] = value
+			}
+		}
+	}
+
+	updated, err := json.Marshal(merged)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error marshalling merged contact fields")
+	}
+
+	err = Exec(ctx, "updating merged contact fields", tx, `UPDATE contacts_contact SET fields = $2::jsonb WHERE id = $1`, targetID, string(updated))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(conflicts))
+	for key := range conflicts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+type fieldValueEnvelope struct {
+	Text string `json:"text"`
+}
+
+// field values are the same if their text is, other properties being derived from it
+func sameFieldValue(v1, v2 json.RawMessage) bool {
+	t1, t2 := &fieldValueEnvelope{}, &fieldValueEnvelope{}
+	if json.Unmarshal(v1, t1) != nil || json.Unmarshal(v2, t2) != nil {
+		return bytes.Equal(v1, v2)
+	}
+	return t1.Text == t2.Text
+}
+
+// moves the URNs of the sources to the target, after the target's own URNs so its preferred URN doesn't change
+const mergeContactURNsSQL = `
+UPDATE
+	contacts_contacturn u
+SET
+	contact_id = $1,
+	priority = r.priority
+FROM (
+	SELECT
+		id,
+		$3 - ROW_NUMBER() OVER (ORDER BY contact_id = $1 DESC, priority DESC, id ASC) + 1 AS priority
+	FROM
+		contacts_contacturn
+	WHERE
+		contact_id = $1 OR contact_id = ANY($2)
+) r
+WHERE
+	u.id = r.id
+`
+
+// adds the target to the static groups of the sources and removes the sources from all user groups
+const mergeContactGroupsSQL = `
+WITH added AS (
+	INSERT INTO
+		contacts_contactgroup_contacts(contact_id, contactgroup_id)
+	SELECT DISTINCT
+		$1::int,
+		gc.contactgroup_id
+	FROM
+		contacts_contactgroup_contacts gc
+		JOIN contacts_contactgroup g ON g.id = gc.contactgroup_id
+	WHERE
+		gc.contact_id = ANY($2) AND
+		g.org_id = $3 AND
+		g.group_type = 'U' AND
+		g.query IS NULL
+	ON CONFLICT
+		DO NOTHING
+)
+DELETE FROM
+	contacts_contactgroup_contacts
+WHERE
+	contact_id = ANY($2) AND
+	contactgroup_id = ANY(SELECT id FROM contacts_contactgroup WHERE org_id = $3 AND group_type = 'U')
+`
+
+const releaseMergedContactsSQL = `
+UPDATE
+	contacts_contact
+SET
+	is_active = FALSE,
+	modified_on = NOW(),
+	modified_by_id = COALESCE($2, modified_by_id)
+WHERE
+	id = ANY($1)
+`
+
+// DuplicateReason is why contacts are considered likely duplicates of each other
+type DuplicateReason string
+
+// duplicate reasons
+const (
+	DuplicateReasonURN  = DuplicateReason("urn")
+	DuplicateReasonName = DuplicateReason("name")
+)
+
+// DuplicateCandidate is a set of contacts which are likely to be the same person
+type DuplicateCandidate struct {
+	Reason     DuplicateReason `json:"reason"`
+	Key        string          `json:"key"`
+	ContactIDs []ContactID     `json:"contact_ids"`
+}
+
+// contacts with URNs whose paths are the same phone number, regardless of scheme or formatting. Brazilian mobile
+// numbers are compared without their ninth digit as in generateWhatsAppURNVariation.
+const selectURNDuplicatesSQL = `
+SELECT
+	'urn' AS reason,
+	n.key,
+	ARRAY_AGG(DISTINCT n.contact_id ORDER BY n.contact_id) AS contact_ids
+FROM (
+	SELECT
+		u.contact_id,
+		CASE
+			WHEN d.digits LIKE '55%' AND LENGTH(d.digits) = 13 AND SUBSTRING(d.digits, 5, 1) = '9' THEN SUBSTRING(d.digits, 1, 4) || SUBSTRING(d.digits, 6)
+			ELSE d.digits
+		END AS key
+	FROM
+		contacts_contacturn u
+		JOIN contacts_contact c ON c.id = u.contact_id
+		CROSS JOIN LATERAL (SELECT REGEXP_REPLACE(u.path, '[^0-9]', '', 'g') AS digits) d
+	WHERE
+		u.org_id = $1 AND
+		u.scheme IN ('tel', 'whatsapp', 'wa') AND
+		c.is_active = TRUE AND
+		LENGTH(d.digits) >= 8
+) n
+GROUP BY
+	n.key
+HAVING
+	COUNT(DISTINCT n.contact_id) > 1
+ORDER BY
+	n.key
+LIMIT $2
+`
+
+// contacts with the same name, ignoring case and whitespace
+const selectNameDuplicatesSQL = `
+SELECT
+	'name' AS reason,
+	n.key,
+	ARRAY_AGG(n.id ORDER BY n.id) AS contact_ids
+FROM (
+	SELECT
+		id,
+		LOWER(REGEXP_REPLACE(TRIM(name), '\s+', ' ', 'g')) AS key
+	FROM
+		contacts_contact
+	WHERE
+		org_id = $1 AND
+		is_active = TRUE AND
+		name IS NOT NULL
+) n
+WHERE
+	LENGTH(n.key) > 2
+GROUP BY
+	n.key
+HAVING
+	COUNT(*) > 1
+ORDER BY
+	n.key
+LIMIT $2
+`
+
+// FindDuplicateContacts finds sets of active contacts in the passed in org which are likely duplicates, either because
+// they have URNs for the same phone number or because they have the same name. Up to limit sets are returned for each
+// reason.
+func FindDuplicateContacts(ctx context.Context, db Queryer, orgID OrgID, limit int) ([]*DuplicateCandidate, error) {
+	start := time.Now()
+	candidates := make([]*DuplicateCandidate, 0, 10)
+
+	for _, query := range []string{selectURNDuplicatesSQL, selectNameDuplicatesSQL} {
+		rows, err := db.QueryxContext(ctx, query, orgID, limit)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error querying duplicate contacts")
+		}
+
+		for rows.Next() {
+			candidate := &DuplicateCandidate{}
+			var contactIDs pq.Int64Array
+			if err := rows.Scan(&candidate.Reason, &candidate.Key, &contactIDs); err != nil {
+				rows.Close()
+				return nil, errors.Wrapf(err, "error scanning duplicate contacts")
+			}
+			candidate.ContactIDs = make([]ContactID, len(contactIDs))
+			for i, id := range contactIDs {
+				candidate.ContactIDs[i] = ContactID(id)
+			}
+			candidates = append(candidates, candidate)
+		}
+		rows.Close()
+	}
+
+	logrus.WithField("org_id", orgID).WithField("elapsed", time.Since(start)).WithField("count", len(candidates)).Debug("found duplicate contacts")
+
+	return candidates, nil
+}
@@ -0,0 +1,117 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeContacts(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	db.MustExec(`UPDATE contacts_contact SET fields = $2::jsonb WHERE id = $1`, testdata.Cathy.ID, fmt.Sprintf(`{"%s": {"text": "F"}}`, testdata.GenderField.UUID))
+	db.MustExec(`UPDATE contacts_contact SET fields = $2::jsonb WHERE id = $1`, testdata.Bob.ID, fmt.Sprintf(`{"%s": {"text": "M"}, "%s": {"text": "30", "number": 30}, "%s": {"text": "2030-01-01T00:00:00Z", "datetime": "2030-01-01T00:00:00Z"}}`, testdata.GenderField.UUID, testdata.AgeField.UUID, testdata.JoinedField.UUID))
+
+	// a second source with a whatsapp URN
+	bobWA := testdata.InsertContact(db, testdata.Org1, flows.ContactUUID("c2b3e9dc-4a6a-4c2f-8b6d-5f7fa0f3e1a1"), "Bob", envs.NilLanguage)
+	bobWAURNID := testdata.InsertContactURN(db, testdata.Org1, bobWA, urns.URN("whatsapp:16055742222"), 1000)
+
+	db.MustExec(`DELETE FROM contacts_contactgroup_contacts WHERE contact_id IN ($1, $2)`, testdata.Cathy.ID, testdata.Bob.ID)
+	testdata.TestersGroup.Add(db, testdata.Bob)
+	testdata.DoctorsGroup.Add(db, testdata.Cathy)
+
+	testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob, "hi", models.MsgStatusHandled)
+	testdata.InsertOpenTicket(db, testdata.Org1, bobWA, testdata.Mailgun, testdata.DefaultTopic, "Help", "", nil)
+
+	db.MustExec(`DELETE FROM campaigns_eventfire`)
+	db.MustExec(`INSERT INTO campaigns_eventfire(contact_id, event_id, scheduled) VALUES($1, $3, NOW()), ($2, $3, NOW()), ($2, $4, NOW())`, testdata.Cathy.ID, testdata.Bob.ID, testdata.RemindersEvent1.ID, testdata.RemindersEvent2.ID)
+	db.MustExec(`INSERT INTO campaigns_eventfire(contact_id, event_id, scheduled, fired, fired_result) VALUES($1, $2, NOW(), NOW(), 'F')`, testdata.Bob.ID, testdata.RemindersEvent2.ID)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	contacts, err := models.LoadContacts(ctx, db, oa, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, bobWA.ID})
+	require.NoError(t, err)
+	require.Len(t, contacts, 3)
+
+	byID := make(map[models.ContactID]*models.Contact)
+	for _, c := range contacts {
+		byID[c.ID()] = c
+	}
+
+	merge, err := models.MergeContacts(ctx, db, oa, testdata.Admin.ID, byID[testdata.Cathy.ID], []*models.Contact{byID[testdata.Bob.ID], byID[bobWA.ID]}, models.FieldMergeKeepTarget)
+	require.NoError(t, err)
+	assert.Equal(t, &models.ContactMerge{ContactID: testdata.Cathy.ID, MergedIDs: []models.ContactID{testdata.Bob.ID, bobWA.ID}, FieldConflicts: []string{"gender"}}, merge)
+
+	// the target's own values win but it gains the values it didn't have
+	cathy, err := models.LoadContact(ctx, db, oa, testdata.Cathy.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "F", cathy.Fields()["gender"].Text.Native())
+	assert.Equal(t, "30", cathy.Fields()["age"].Text.Native())
+
+	// and all the URNs, its own still being preferred
+	assert.Equal(t, []urns.URN{
+		urns.URN(fmt.Sprintf("tel:+16055741111?id=%d&priority=1000", testdata.Cathy.URNID)),
+		urns.URN(fmt.Sprintf("tel:+16055742222?id=%d&priority=999", testdata.Bob.URNID)),
+		urns.URN(fmt.Sprintf("whatsapp:16055742222?id=%d&priority=998", bobWAURNID)),
+	}, cathy.URNs())
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM contacts_contact WHERE id IN ($1, $2) AND is_active = FALSE`, testdata.Bob.ID, bobWA.ID).Returns(2)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1 AND contact_id = $2`, testdata.TestersGroup.ID, testdata.Cathy.ID).Returns(1)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contact_id = $1`, testdata.Bob.ID).Returns(0)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1`, testdata.Bob.ID).Returns(0)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM tickets_ticket WHERE contact_id = $1`, bobWA.ID).Returns(0)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM tickets_ticket WHERE contact_id = $1 AND body = 'Help'`, testdata.Cathy.ID).Returns(1)
+
+	// the target is scheduled once for each event, relative to the joined value it gained from the merge
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1 AND fired IS NULL`, testdata.Cathy.ID).Returns(2)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1 AND event_id = $2 AND scheduled = $3 AND fired IS NULL`, testdata.Cathy.ID, testdata.RemindersEvent1.ID, time.Date(2030, 1, 5, 20, 0, 0, 0, time.UTC)).Returns(1)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1 AND event_id = $2 AND scheduled = $3 AND fired IS NULL`, testdata.Cathy.ID, testdata.RemindersEvent2.ID, time.Date(2030, 1, 1, 0, 10, 0, 0, time.UTC)).Returns(1)
+
+	// fires which already fired are kept as they were
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1 AND fired IS NOT NULL`, testdata.Cathy.ID).Returns(1)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id = $1`, testdata.Bob.ID).Returns(0)
+}
+
+func TestFindDuplicateContacts(t *testing.T) {
+	ctx, _, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// WhatsApp URNs for Brazilian numbers with and without the ninth digit
+	ana1 := testdata.InsertContact(db, testdata.Org1, flows.ContactUUID("0c9e1a8b-8d1e-4b35-9b7f-2f8d8d1c6f11"), "Ana  Maria", envs.NilLanguage)
+	ana2 := testdata.InsertContact(db, testdata.Org1, flows.ContactUUID("5d7d3b9a-3c41-4c6e-a1c0-9c8f1a2b3e22"), "ana maria", envs.NilLanguage)
+	ana3 := testdata.InsertContact(db, testdata.Org1, flows.ContactUUID("8f1e2d3c-4b5a-4697-8877-6655443322e3"), "Ana", envs.NilLanguage)
+	testdata.InsertContactURN(db, testdata.Org1, ana1, urns.URN("whatsapp:5565999887766"), 1000)
+	testdata.InsertContactURN(db, testdata.Org1, ana3, urns.URN("tel:+556599887766"), 1000)
+
+	// inactive contacts aren't duplicates
+	released := testdata.InsertContact(db, testdata.Org1, flows.ContactUUID("1a2b3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c55"), "Ana Maria", envs.NilLanguage)
+	testdata.InsertContactURN(db, testdata.Org1, released, urns.URN("whatsapp:556599887766"), 1000)
+	db.MustExec(`UPDATE contacts_contact SET is_active = FALSE WHERE id = $1`, released.ID)
+
+	duplicates, err := models.FindDuplicateContacts(ctx, db, testdata.Org1.ID, 100)
+	require.NoError(t, err)
+
+	assert.Contains(t, duplicates, &models.DuplicateCandidate{Reason: models.DuplicateReasonURN, Key: "556599887766", ContactIDs: []models.ContactID{ana1.ID, ana3.ID}})
+	assert.Contains(t, duplicates, &models.DuplicateCandidate{Reason: models.DuplicateReasonName, Key: "ana maria", ContactIDs: []models.ContactID{ana1.ID, ana2.ID}})
+
+	// other orgs have their own duplicates
+	duplicates, err = models.FindDuplicateContacts(ctx, db, testdata.Org2.ID, 100)
+	require.NoError(t, err)
+	for _, d := range duplicates {
+		assert.NotContains(t, d.ContactIDs, ana1.ID)
+	}
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// ContactModificationStatus is the status of a bulk contact modification
+type ContactModificationStatus string
+
+// possible contact modification statuses
+const (
+	ContactModificationStatusQueued    = ContactModificationStatus("queued")
+	ContactModificationStatusModifying = ContactModificationStatus("modifying")
+	ContactModificationStatusComplete  = ContactModificationStatus("complete")
+	ContactModificationStatusFailed    = ContactModificationStatus("failed")
+)
+
+const (
+	contactModificationProgressKey    = "contact_modification:%s"
+	contactModificationProgressExpire = time.Hour * 24 * 7 // how long we keep the progress of a modification around
+)
+
+// ContactModificationProgress is the progress of a bulk contact modification being done in the background
+type ContactModificationProgress struct {
+	OrgID    OrgID                     `json:"org_id"           redis:"org_id"`
+	Status   ContactModificationStatus `json:"status"           redis:"status"`
+	Total    int                       `json:"total"            redis:"total"`
+	Modified int                       `json:"modified"         redis:"modified"`
+	Error    string                    `json:"error,omitempty"  redis:"error"`
+}
+
+// SetContactModificationProgress records the progress of the given contact modification, overwriting any existing values
+func SetContactModificationProgress(rc redis.Conn, modificationUUID string, progress *ContactModificationProgress) error {
+	key := fmt.Sprintf(contactModificationProgressKey, modificationUUID)
+
+	rc.Send("MULTI")
+	rc.Send("HSET", redis.Args{}.Add(key).AddFlat(progress)...)
+	rc.Send("EXPIRE", key, int(contactModificationProgressExpire/time.Second))
+	_, err := rc.Do("EXEC")
+	if err != nil {
+		return errors.Wrapf(err, "error setting progress for contact modification %s", modificationUUID)
+	}
+	return nil
+}
+
+// GetContactModificationProgress gets the progress of the given contact modification, returning nil if it doesn't exist
+func GetContactModificationProgress(rc redis.Conn, modificationUUID string) (*ContactModificationProgress, error) {
+	values, err := redis.Values(rc.Do("HGETALL", fmt.Sprintf(contactModificationProgressKey, modificationUUID)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting progress for contact modification %s", modificationUUID)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	progress := &ContactModificationProgress{}
+	if err := redis.ScanStruct(values, progress); err != nil {
+		return nil, errors.Wrapf(err, "error reading progress for contact modification %s", modificationUUID)
+	}
+	return progress, nil
+}
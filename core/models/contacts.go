@@ -822,6 +822,21 @@ func GetOrCreateContactIDsFromURNs(ctx context.Context, db QueryerWithTx, oa *Or
 	return owners, nil
 }
 
+// GetContactIDsFromURNs fetches the contacts for the passed in URNs without creating any, returning a map the same length
+// as the passed in URNs with the ids of the contacts, or NilContactID for URNs that don't belong to a contact.
+func GetContactIDsFromURNs(ctx context.Context, db Queryer, oa *OrgAssets, urnz []urns.URN) (map[urns.URN]ContactID, error) {
+	normalized := make([]urns.URN, len(urnz))
+	for i, urn := range urnz {
+		normalized[i] = urn.Normalize(string(oa.Env().DefaultCountry()))
+	}
+
+	owners, err := contactIDsFromURNs(ctx, db, oa.OrgID(), normalized, oa.Org().o.Config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up contacts for URNs")
+	}
+	return owners, nil
+}
+
 // looks up the contacts who own the given urns (which should be normalized by the caller) and returns that information as a map
 func contactIDsFromURNs(ctx context.Context, db Queryer, orgID OrgID, urnz []urns.URN, orgConfig null.Map) (map[urns.URN]ContactID, error) {
 	identityToOriginal := make(map[urns.URN]urns.URN, len(urnz))
@@ -0,0 +1,481 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/lib/pq"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// flow analytics are aggregated into a hash per flow per day (UTC) with fields like:
+//
+//   node:<node uuid>:<run status>       - number of runs which ended at the node with that status
+//   seg:<from uuid>:<to uuid>:<bucket>  - number of steps from one node to the next in that duration bucket
+//   seg:<from uuid>:<to uuid>:ms        - total milliseconds of those steps
+//
+// which are periodically flushed to the flows_flowanalyticscount table, keyed by flow, day and field
+const flowAnalyticsKey = "flow_analytics:%d:%s"
+
+// set of the flow analytics hashes which have counts that haven't been flushed yet
+const flowAnalyticsPendingKey = "flow_analytics_pending"
+
+// how long counts which haven't been flushed are kept for, in case flushing isn't happening
+const flowAnalyticsUnflushedTTL = time.Hour * 24 * 7
+
+// FlowAnalyticsRetention is how long analytics are kept for
+const FlowAnalyticsRetention = time.Hour * 24 * 90
+
+// SegmentDurationBuckets are the upper bounds of the buckets of segment duration histograms, with a final bucket for
+// anything longer than the last bound
+var SegmentDurationBuckets = []time.Duration{
+	time.Second * 10,
+	time.Minute,
+	time.Minute * 5,
+	time.Minute * 15,
+	time.Hour,
+	time.Hour * 6,
+	time.Hour * 24,
+}
+
+// names of the run statuses we count runs ending with at nodes
+var nodeExitStatuses = map[RunStatus]string{
+	RunStatusCompleted:   "completed",
+	RunStatusExpired:     "expired",
+	RunStatusInterrupted: "interrupted",
+	RunStatusFailed:      "failed",
+}
+
+func flowAnalyticsDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func durationBucket(d time.Duration) int {
+	for i, bound := range SegmentDurationBuckets {
+		if d <= bound {
+			return i
+		}
+	}
+	return len(SegmentDurationBuckets)
+}
+
+// accumulates increments to flow analytics so they can be written in one go
+type flowAnalyticsBatch map[string]map[string]int64
+
+func (b flowAnalyticsBatch) incr(flowID FlowID, on time.Time, field string, by int64) {
+	key := fmt.Sprintf(flowAnalyticsKey, flowID, flowAnalyticsDay(on))
+	if b[key] == nil {
+		b[key] = make(map[string]int64)
+	}
+	b[key][field] += by
+}
+
+func (b flowAnalyticsBatch) write(rc redis.Conn) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	for key, fields := range b {
+		for field, by := range fields {
+			rc.Send("HINCRBY", key, field, by)
+		}
+		rc.Send("EXPIRE", key, int(flowAnalyticsUnflushedTTL/time.Second))
+		rc.Send("SADD", flowAnalyticsPendingKey, key)
+	}
+	_, err := rc.Do("")
+	return err
+}
+
+// RecordFlowAnalytics records analytics for the runs of the passed in sessions which were created or updated by their
+// last write. It should be called once that write has been committed. Failures are logged but otherwise ignored.
+func RecordFlowAnalytics(rt *runtime.Runtime, sessions []*Session) {
+	batch := make(flowAnalyticsBatch)
+	for _, s := range sessions {
+		batch.addRuns(s.changedRuns, s.seenRuns)
+		s.changedRuns = nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := batch.write(rc); err != nil {
+		logrus.WithError(err).Error("error recording flow analytics")
+	}
+}
+
+// adds the passed in runs which have been created or updated by the engine. Only steps which arrived after a run was
+// last seen are counted.
+func (b flowAnalyticsBatch) addRuns(runs []*FlowRun, seen map[flows.RunUUID]time.Time) {
+	for _, r := range runs {
+		if r.run == nil {
+			continue
+		}
+		lastSeen := seen[r.UUID()]
+
+		path := r.run.Path()
+		for i := 1; i < len(path); i++ {
+			if !path[i].ArrivedOn().After(lastSeen) {
+				continue
+			}
+
+			duration := path[i].ArrivedOn().Sub(path[i-1].ArrivedOn())
+			segment := fmt.Sprintf("seg:%s:%s", path[i-1].NodeUUID(), path[i].NodeUUID())
+
+			b.incr(r.r.FlowID, path[i].ArrivedOn(), fmt.Sprintf("%s:%d", segment, durationBucket(duration)), 1)
+			b.incr(r.r.FlowID, path[i].ArrivedOn(), segment+":ms", int64(duration/time.Millisecond))
+		}
+
+		status, ended := nodeExitStatuses[r.r.Status]
+		if ended && r.r.CurrentNodeUUID != "" {
+			exitedOn := time.Now()
+			if r.r.ExitedOn != nil {
+				exitedOn = *r.r.ExitedOn
+			}
+			b.incr(r.r.FlowID, exitedOn, fmt.Sprintf("node:%s:%s", r.r.CurrentNodeUUID, status), 1)
+		}
+	}
+}
+
+// NodeExit is a number of runs of a flow which exited at a node
+type NodeExit struct {
+	FlowID   FlowID         `db:"flow_id"`
+	NodeUUID flows.NodeUUID `db:"node_uuid"`
+	Count    int            `db:"count"`
+}
+
+const selectActiveRunNodesForSessionsSQL = `
+SELECT flow_id, current_node_uuid::text AS node_uuid, count(*) AS count
+  FROM flows_flowrun
+ WHERE session_id = ANY($1) AND is_active = TRUE AND current_node_uuid IS NOT NULL
+GROUP BY flow_id, current_node_uuid`
+
+const selectActiveRunNodesForContactsSQL = `
+SELECT fr.flow_id, fr.current_node_uuid::text AS node_uuid, count(*) AS count
+  FROM flows_flowrun fr
+  JOIN flows_flow ff ON fr.flow_id = ff.id
+ WHERE fr.contact_id = ANY($2) AND fr.is_active = TRUE AND ff.flow_type = $1 AND fr.current_node_uuid IS NOT NULL
+GROUP BY fr.flow_id, fr.current_node_uuid`
+
+// ActiveRunNodesForSessions counts the active runs of the given sessions by the nodes they are at, which is where they
+// will exit if the sessions are ended outside of the engine
+func ActiveRunNodesForSessions(ctx context.Context, db Queryer, sessionIDs []SessionID) ([]*NodeExit, error) {
+	return selectNodeExits(ctx, db, selectActiveRunNodesForSessionsSQL, pq.Array(sessionIDs))
+}
+
+// ActiveRunNodesForContacts counts the active runs of the given contacts in flows of the given type by the nodes they
+// are at, which is where they will exit if the contacts are interrupted
+func ActiveRunNodesForContacts(ctx context.Context, db Queryer, flowType FlowType, contactIDs []flows.ContactID) ([]*NodeExit, error) {
+	return selectNodeExits(ctx, db, selectActiveRunNodesForContactsSQL, flowType, pq.Array(contactIDs))
+}
+
+func selectNodeExits(ctx context.Context, db Queryer, sql string, args ...interface{}) ([]*NodeExit, error) {
+	rows, err := db.QueryxContext(ctx, sql, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting nodes of active runs")
+	}
+	defer rows.Close()
+
+	exits := make([]*NodeExit, 0, 10)
+	for rows.Next() {
+		exit := &NodeExit{}
+		if err := rows.StructScan(exit); err != nil {
+			return nil, errors.Wrapf(err, "error scanning node of active runs")
+		}
+		exits = append(exits, exit)
+	}
+	return exits, nil
+}
+
+// RecordNodeExits records runs which exited at nodes outside of the engine, e.g. because they were interrupted or
+// expired. Failures are logged but otherwise ignored.
+func RecordNodeExits(rt *runtime.Runtime, exits []*NodeExit, status RunStatus, exitedOn time.Time) {
+	name, ended := nodeExitStatuses[status]
+	if !ended || len(exits) == 0 {
+		return
+	}
+
+	batch := make(flowAnalyticsBatch)
+	for _, e := range exits {
+		batch.incr(e.FlowID, exitedOn, fmt.Sprintf("node:%s:%s", e.NodeUUID, name), int64(e.Count))
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	if err := batch.write(rc); err != nil {
+		logrus.WithError(err).Error("error recording node exits")
+	}
+}
+
+// FlowAnalytics are the aggregated analytics of a flow over a date range
+type FlowAnalytics struct {
+	Nodes    []*NodeAnalytics    `json:"nodes"`
+	Segments []*SegmentAnalytics `json:"segments"`
+}
+
+// NodeAnalytics are the counts of runs which ended at a node by how they ended
+type NodeAnalytics struct {
+	NodeUUID    flows.NodeUUID `json:"node_uuid"`
+	Completed   int            `json:"completed"`
+	Expired     int            `json:"expired"`
+	Interrupted int            `json:"interrupted"`
+	Failed      int            `json:"failed"`
+}
+
+// SegmentAnalytics are the durations of the steps contacts took from one node to the next
+type SegmentAnalytics struct {
+	FromUUID   flows.NodeUUID    `json:"from_uuid"`
+	ToUUID     flows.NodeUUID    `json:"to_uuid"`
+	Count      int               `json:"count"`
+	AvgSeconds float64           `json:"avg_seconds"`
+	Histogram  []*DurationBucket `json:"histogram"`
+	totalMS    int64
+}
+
+// DurationBucket is a bucket of a duration histogram. The last bucket has no upper bound.
+type DurationBucket struct {
+	MaxSeconds *int `json:"max_seconds"`
+	Count      int  `json:"count"`
+}
+
+const upsertFlowAnalyticsCountsSQL = `
+INSERT INTO
+	flows_flowanalyticscount(flow_id, day, field, count)
+	SELECT $1, $2::date, unnest($3::text[]), unnest($4::bigint[])
+ON CONFLICT (flow_id, day, field) DO UPDATE SET count = flows_flowanalyticscount.count + EXCLUDED.count
+`
+
+// FlushFlowAnalytics moves the counts of up to limit of the flow analytics hashes in redis into the database, and
+// deletes counts which are older than our retention period. Returns the number of hashes flushed.
+func FlushFlowAnalytics(ctx context.Context, rt *runtime.Runtime, limit int) (int, error) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	keys, err := redis.Strings(rc.Do("SPOP", flowAnalyticsPendingKey, limit))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error popping pending flow analytics")
+	}
+
+	flushed := 0
+	for i, key := range keys {
+		if err := flushFlowAnalyticsKey(ctx, rt.DB, rc, key); err != nil {
+			// put back what we didn't get to so it's flushed next time
+			if _, perr := rc.Do("SADD", redis.Args{flowAnalyticsPendingKey}.AddFlat(keys[i:])...); perr != nil {
+				logrus.WithError(perr).Error("error restoring pending flow analytics")
+			}
+			return flushed, err
+		}
+		flushed++
+	}
+
+	if _, err := rt.DB.ExecContext(ctx, `DELETE FROM flows_flowanalyticscount WHERE day < $1::date`, time.Now().UTC().Add(-FlowAnalyticsRetention)); err != nil {
+		return flushed, errors.Wrapf(err, "error deleting expired flow analytics")
+	}
+
+	return flushed, nil
+}
+
+// moves a flow analytics hash to its flushing hash. If a previous flush was interrupted and left that behind, the counts
+// are merged into it rather than it being overwritten, so that they're flushed once along with the new counts.
+var startFlushFlowAnalyticsScript = redis.NewScript(2, `-- KEYS: [Key, FlushingKey]
+local key, flushingKey = KEYS[1], KEYS[2]
+
+if redis.call("EXISTS", flushingKey) == 0 then
+	if redis.call("EXISTS", key) == 0 then
+		return 0
+	end
+	redis.call("RENAME", key, flushingKey)
+	return 1
+end
+
+local counts = redis.call("HGETALL", key)
+for i = 1, #counts, 2 do
+	redis.call("HINCRBY", flushingKey, counts[i], counts[i + 1])
+end
+redis.call("DEL", key)
+return 1
+`)
+
+// flushes a single flow analytics hash. The hash is moved first so that increments made while we're flushing go to
+// a new hash, and if we can't write its counts to the database, they're added back.
+func flushFlowAnalyticsKey(ctx context.Context, db Queryer, rc redis.Conn, key string) error {
+	parts := strings.Split(key, ":")
+	if len(parts) != 3 {
+		return errors.Errorf("invalid flow analytics key %s", key)
+	}
+	flowID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return errors.Wrapf(err, "invalid flow analytics key %s", key)
+	}
+	day := parts[2]
+
+	flushing := key + ":flushing"
+	started, err := redis.Bool(startFlushFlowAnalyticsScript.Do(rc, key, flushing))
+	if err != nil {
+		return errors.Wrapf(err, "error moving flow analytics %s", key)
+	}
+	// hash has expired without being flushed
+	if !started {
+		return nil
+	}
+
+	counts, err := redis.Int64Map(rc.Do("HGETALL", flushing))
+	if err != nil {
+		return errors.Wrapf(err, "error reading flow analytics %s", key)
+	}
+
+	fields := make([]string, 0, len(counts))
+	values := make([]int64, 0, len(counts))
+	for field, count := range counts {
+		fields = append(fields, field)
+		values = append(values, count)
+	}
+
+	if _, err := db.ExecContext(ctx, upsertFlowAnalyticsCountsSQL, FlowID(flowID), day, pq.Array(fields), pq.Array(values)); err != nil {
+		for field, count := range counts {
+			rc.Send("HINCRBY", key, field, count)
+		}
+		rc.Send("EXPIRE", key, int(flowAnalyticsUnflushedTTL/time.Second))
+		rc.Send("SADD", flowAnalyticsPendingKey, key)
+		rc.Send("DEL", flushing)
+		if _, rerr := rc.Do(""); rerr != nil {
+			logrus.WithError(rerr).WithField("key", key).Error("error restoring unflushed flow analytics")
+		}
+		return errors.Wrapf(err, "error writing flow analytics %s", key)
+	}
+
+	if _, err := rc.Do("DEL", flushing); err != nil {
+		return errors.Wrapf(err, "error deleting flushed flow analytics %s", key)
+	}
+	return nil
+}
+
+const selectFlowAnalyticsCountsSQL = `
+SELECT field, sum(count) AS count
+  FROM flows_flowanalyticscount
+ WHERE flow_id = $1 AND day >= $2::date AND day <= $3::date
+GROUP BY field`
+
+// GetFlowAnalytics gets the analytics of the given flow for the days (UTC) from since to until inclusive, combining
+// those flushed to the database with those still in redis
+func GetFlowAnalytics(ctx context.Context, db Queryer, rc redis.Conn, flowID FlowID, since, until time.Time) (*FlowAnalytics, error) {
+	counts := make(map[string]int64)
+
+	rows, err := db.QueryxContext(ctx, selectFlowAnalyticsCountsSQL, flowID, flowAnalyticsDay(since), flowAnalyticsDay(until))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading flow analytics")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var field string
+		var count int64
+		if err := rows.Scan(&field, &count); err != nil {
+			return nil, errors.Wrapf(err, "error scanning flow analytics")
+		}
+		counts[field] += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error loading flow analytics")
+	}
+
+	// counts which haven't been flushed yet might be in the hash or the hash being flushed
+	for day := since.UTC().Truncate(time.Hour * 24); !day.After(until.UTC()); day = day.Add(time.Hour * 24) {
+		key := fmt.Sprintf(flowAnalyticsKey, flowID, flowAnalyticsDay(day))
+		rc.Send("HGETALL", key)
+		rc.Send("HGETALL", key+":flushing")
+	}
+	if err := rc.Flush(); err != nil {
+		return nil, errors.Wrapf(err, "error loading flow analytics")
+	}
+
+	for day := since.UTC().Truncate(time.Hour * 24); !day.After(until.UTC()); day = day.Add(time.Hour * 24) {
+		for i := 0; i < 2; i++ {
+			values, err := redis.Int64Map(rc.Receive())
+			if err != nil {
+				return nil, errors.Wrapf(err, "error loading flow analytics for %s", flowAnalyticsDay(day))
+			}
+			for field, value := range values {
+				counts[field] += value
+			}
+		}
+	}
+
+	nodes := make(map[flows.NodeUUID]*NodeAnalytics)
+	segments := make(map[string]*SegmentAnalytics)
+
+	for field, value := range counts {
+		parts := strings.Split(field, ":")
+
+		if parts[0] == "node" && len(parts) == 3 {
+			node := nodes[flows.NodeUUID(parts[1])]
+			if node == nil {
+				node = &NodeAnalytics{NodeUUID: flows.NodeUUID(parts[1])}
+				nodes[node.NodeUUID] = node
+			}
+			switch parts[2] {
+			case "completed":
+				node.Completed += int(value)
+			case "expired":
+				node.Expired += int(value)
+			case "interrupted":
+				node.Interrupted += int(value)
+			case "failed":
+				node.Failed += int(value)
+			}
+		} else if parts[0] == "seg" && len(parts) == 4 {
+			key := parts[1] + ":" + parts[2]
+			seg := segments[key]
+			if seg == nil {
+				seg = &SegmentAnalytics{FromUUID: flows.NodeUUID(parts[1]), ToUUID: flows.NodeUUID(parts[2]), Histogram: newDurationHistogram()}
+				segments[key] = seg
+			}
+
+			if parts[3] == "ms" {
+				seg.totalMS += value
+			} else if bucket, err := strconv.Atoi(parts[3]); err == nil && bucket >= 0 && bucket < len(seg.Histogram) {
+				seg.Histogram[bucket].Count += int(value)
+				seg.Count += int(value)
+			}
+		}
+	}
+
+	analytics := &FlowAnalytics{Nodes: make([]*NodeAnalytics, 0, len(nodes)), Segments: make([]*SegmentAnalytics, 0, len(segments))}
+	for _, n := range nodes {
+		analytics.Nodes = append(analytics.Nodes, n)
+	}
+	for _, s := range segments {
+		if s.Count > 0 {
+			s.AvgSeconds = float64(s.totalMS) / float64(s.Count) / 1000
+		}
+		analytics.Segments = append(analytics.Segments, s)
+	}
+
+	sort.Slice(analytics.Nodes, func(i, j int) bool { return analytics.Nodes[i].NodeUUID < analytics.Nodes[j].NodeUUID })
+	sort.Slice(analytics.Segments, func(i, j int) bool {
+		if analytics.Segments[i].FromUUID != analytics.Segments[j].FromUUID {
+			return analytics.Segments[i].FromUUID < analytics.Segments[j].FromUUID
+		}
+		return analytics.Segments[i].ToUUID < analytics.Segments[j].ToUUID
+	})
+
+	return analytics, nil
+}
+
+func newDurationHistogram() []*DurationBucket {
+	buckets := make([]*DurationBucket, len(SegmentDurationBuckets)+1)
+	for i, bound := range SegmentDurationBuckets {
+		seconds := int(bound / time.Second)
+		buckets[i] = &DurationBucket{MaxSeconds: &seconds}
+	}
+	buckets[len(SegmentDurationBuckets)] = &DurationBucket{}
+	return buckets
+}
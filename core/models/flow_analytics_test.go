@@ -0,0 +1,138 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/redisx/assertredis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowAnalytics(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	sessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusWaiting, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting, "", nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Cathy, testdata.PickANumber, models.RunStatusWaiting, "", nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Cathy, testdata.SingleMessage, models.RunStatusCompleted, "", nil)
+
+	db.MustExec(`UPDATE flows_flowrun SET current_node_uuid = '5253c207-46da-4fb7-8d35-e0c2bdb8d2b2' WHERE flow_id = $1`, testdata.Favorites.ID)
+	db.MustExec(`UPDATE flows_flowrun SET current_node_uuid = '10e483a8-5ffb-4c4f-917b-d43ce86c1d65' WHERE flow_id IN ($1, $2)`, testdata.PickANumber.ID, testdata.SingleMessage.ID)
+
+	// only active runs are counted
+	exits, err := models.ActiveRunNodesForSessions(ctx, db, []models.SessionID{sessionID})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*models.NodeExit{
+		{FlowID: testdata.Favorites.ID, NodeUUID: "5253c207-46da-4fb7-8d35-e0c2bdb8d2b2", Count: 1},
+		{FlowID: testdata.PickANumber.ID, NodeUUID: "10e483a8-5ffb-4c4f-917b-d43ce86c1d65", Count: 1},
+	}, exits)
+
+	exits, err = models.ActiveRunNodesForContacts(ctx, db, models.FlowTypeMessaging, []flows.ContactID{flows.ContactID(testdata.Cathy.ID), flows.ContactID(testdata.Bob.ID)})
+	require.NoError(t, err)
+	assert.Len(t, exits, 2)
+
+	today := time.Now().UTC()
+	yesterday := today.Add(-time.Hour * 24)
+
+	models.RecordNodeExits(rt, exits[:1], models.RunStatusInterrupted, yesterday)
+	models.RecordNodeExits(rt, []*models.NodeExit{{FlowID: exits[0].FlowID, NodeUUID: exits[0].NodeUUID, Count: 3}}, models.RunStatusExpired, today)
+
+	// waiting isn't a way to exit a node so is ignored
+	models.RecordNodeExits(rt, exits[:1], models.RunStatusWaiting, today)
+
+	analytics, err := models.GetFlowAnalytics(ctx, db, rc, exits[0].FlowID, yesterday, today)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.NodeAnalytics{
+		{NodeUUID: exits[0].NodeUUID, Interrupted: 1, Expired: 3},
+	}, analytics.Nodes)
+	assert.Equal(t, 0, len(analytics.Segments))
+
+	// only look at today
+	analytics, err = models.GetFlowAnalytics(ctx, db, rc, exits[0].FlowID, today, today)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.NodeAnalytics{
+		{NodeUUID: exits[0].NodeUUID, Expired: 3},
+	}, analytics.Nodes)
+
+	// nothing for other flows
+	analytics, err = models.GetFlowAnalytics(ctx, db, rc, testdata.IVRFlow.ID, yesterday, today)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(analytics.Nodes))
+}
+
+func TestFlushFlowAnalytics(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	today := time.Now().UTC()
+	yesterday := today.Add(-time.Hour * 24)
+	node := flows.NodeUUID("5253c207-46da-4fb7-8d35-e0c2bdb8d2b2")
+
+	models.RecordNodeExits(rt, []*models.NodeExit{{FlowID: testdata.Favorites.ID, NodeUUID: node, Count: 2}}, models.RunStatusInterrupted, yesterday)
+	models.RecordNodeExits(rt, []*models.NodeExit{{FlowID: testdata.Favorites.ID, NodeUUID: node, Count: 3}}, models.RunStatusExpired, today)
+
+	flushed, err := models.FlushFlowAnalytics(ctx, rt, 100)
+	require.NoError(t, err)
+	assert.Equal(t, 2, flushed)
+
+	// counts are now in the database and gone from redis
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_flowanalyticscount WHERE flow_id = $1`, testdata.Favorites.ID).Returns(2)
+	testsuite.AssertQuery(t, db, `SELECT sum(count) FROM flows_flowanalyticscount WHERE flow_id = $1 AND field = $2`, testdata.Favorites.ID, "node:"+string(node)+":expired").Returns(3)
+	assertredis.SMembers(t, rp, "flow_analytics_pending", []string{})
+	keys, err := redis.Strings(rc.Do("KEYS", "flow_analytics:*"))
+	require.NoError(t, err)
+	assert.Len(t, keys, 0)
+
+	// more counts for today which haven't been flushed are combined with those which have
+	models.RecordNodeExits(rt, []*models.NodeExit{{FlowID: testdata.Favorites.ID, NodeUUID: node, Count: 1}}, models.RunStatusExpired, today)
+
+	analytics, err := models.GetFlowAnalytics(ctx, db, rc, testdata.Favorites.ID, yesterday, today)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.NodeAnalytics{{NodeUUID: node, Interrupted: 2, Expired: 4}}, analytics.Nodes)
+
+	// and added to them when flushed
+	flushed, err = models.FlushFlowAnalytics(ctx, rt, 100)
+	require.NoError(t, err)
+	assert.Equal(t, 1, flushed)
+
+	testsuite.AssertQuery(t, db, `SELECT sum(count) FROM flows_flowanalyticscount WHERE flow_id = $1 AND field = $2`, testdata.Favorites.ID, "node:"+string(node)+":expired").Returns(4)
+
+	analytics, err = models.GetFlowAnalytics(ctx, db, rc, testdata.Favorites.ID, yesterday, today)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.NodeAnalytics{{NodeUUID: node, Interrupted: 2, Expired: 4}}, analytics.Nodes)
+
+	// nothing left to flush
+	flushed, err = models.FlushFlowAnalytics(ctx, rt, 100)
+	require.NoError(t, err)
+	assert.Equal(t, 0, flushed)
+
+	// counts left behind by an interrupted flush are merged with new counts rather than overwritten by them
+	key := fmt.Sprintf("flow_analytics:%d:%s", testdata.Favorites.ID, today.Format("2006-01-02"))
+	rc.Do("HSET", key+":flushing", "node:"+string(node)+":expired", 5)
+	models.RecordNodeExits(rt, []*models.NodeExit{{FlowID: testdata.Favorites.ID, NodeUUID: node, Count: 1}}, models.RunStatusExpired, today)
+
+	flushed, err = models.FlushFlowAnalytics(ctx, rt, 100)
+	require.NoError(t, err)
+	assert.Equal(t, 1, flushed)
+
+	testsuite.AssertQuery(t, db, `SELECT sum(count) FROM flows_flowanalyticscount WHERE flow_id = $1 AND field = $2`, testdata.Favorites.ID, "node:"+string(node)+":expired").Returns(10)
+	keys, err = redis.Strings(rc.Do("KEYS", "flow_analytics:*"))
+	require.NoError(t, err)
+	assert.Len(t, keys, 0)
+}
@@ -0,0 +1,212 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/null"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// config keys for how a flow's revisions are used by sessions
+const (
+	// FlowConfigPinRevision is whether sessions stay on the revision of the flow they started on
+	FlowConfigPinRevision = "pin_revision"
+
+	// FlowConfigRolloutPercent is the percentage of new starts which get the latest revision of the flow
+	FlowConfigRolloutPercent = "rollout_percent"
+
+	// FlowConfigRolloutBaseRevision is the revision of the flow which new starts outside of a rollout get
+	FlowConfigRolloutBaseRevision = "rollout_base_revision"
+)
+
+// the maximum number of clones of an org's assets with flows on pinned revisions which we keep
+const maxPinnedClones = 50
+
+// FlowRollout is a gradual rollout of the latest revision of a flow to new starts
+type FlowRollout struct {
+	BaseRevision int
+	Percent      int
+}
+
+// PinsRevision returns whether sessions stay on the revision of this flow they started on. Flows being rolled out
+// always pin their revisions or contacts outside the rollout would move onto the latest revision at their next resume.
+func (f *Flow) PinsRevision() bool {
+	return f.f.Config.Get(FlowConfigPinRevision, false) == true || f.Rollout() != nil
+}
+
+// Rollout returns the rollout of this flow's latest revision if it's being rolled out
+func (f *Flow) Rollout() *FlowRollout {
+	percent, isFloat := f.f.Config.Get(FlowConfigRolloutPercent, nil).(float64)
+	base, _ := f.f.Config.Get(FlowConfigRolloutBaseRevision, nil).(float64)
+
+	if !isFloat || percent < 0 || percent >= 100 || base <= 0 || int(base) >= f.Revision() {
+		return nil
+	}
+	return &FlowRollout{BaseRevision: int(base), Percent: int(percent)}
+}
+
+// Includes returns whether the given contact is in this rollout of the passed in flow, i.e. gets its latest revision.
+// Contacts are assigned deterministically so a contact started again gets the same revision.
+func (r *FlowRollout) Includes(flow *Flow, contactID ContactID) bool {
+	return AssignABVariant(int64(flow.ID()), contactID, []ABVariant{{Name: "latest", Weight: r.Percent}, {Name: "base", Weight: 100 - r.Percent}}) == 0
+}
+
+// RolloutBaseOrgAssets returns a clone of the passed in assets where the passed in flow uses the base revision of its
+// rollout, or nil if the flow isn't being rolled out
+func RolloutBaseOrgAssets(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, flow *Flow) (*OrgAssets, error) {
+	rollout := flow.Rollout()
+	if rollout == nil {
+		return nil, nil
+	}
+
+	return pinnedClone(ctx, rt, oa, SessionFlowRevisions{flow.UUID(): rollout.BaseRevision})
+}
+
+// SessionFlowRevisions are the revisions of pinned flows used by a session
+type SessionFlowRevisions map[assets.FlowUUID]int
+
+// the revisions of pinned flows are recorded on the runs of those flows, and aggregated when a session is loaded
+const selectSessionFlowRevisionsSQL = `(
+	SELECT jsonb_object_agg(f.uuid, r.flow_revision)
+	  FROM flows_flowrun r
+	  JOIN flows_flow f ON f.id = r.flow_id
+	 WHERE r.session_id = fs.id AND r.flow_revision IS NOT NULL
+) AS flow_revisions`
+
+// returns the revision of the flow of the passed in run if that flow pins its revisions or the session is already
+// pinned to a revision of it
+func pinnedFlowRevision(org *OrgAssets, session *Session, fr flows.FlowRun) null.Int {
+	if fr.Flow() == nil {
+		return 0
+	}
+
+	revs, _ := session.FlowRevisions()
+	_, pinned := revs[fr.FlowReference().UUID]
+	if !pinned {
+		flow, err := org.Flow(fr.FlowReference().UUID)
+		pinned = err == nil && flow.(*Flow).PinsRevision()
+	}
+	if !pinned {
+		return 0
+	}
+	return null.Int(fr.Flow().Revision())
+}
+
+// FlowRevisions returns the revisions of pinned flows used by this session
+func (s *Session) FlowRevisions() (SessionFlowRevisions, error) {
+	revs := make(SessionFlowRevisions)
+	if s.s.FlowRevisions != "" {
+		if err := json.Unmarshal([]byte(s.s.FlowRevisions), &revs); err != nil {
+			return nil, errors.Wrapf(err, "error reading flow revisions of session %s", s.UUID())
+		}
+	}
+	return revs, nil
+}
+
+// adds the revision of the flow of the passed in run to those of this session if that flow pins its revisions
+func (s *Session) addFlowRevision(r *FlowRun) {
+	if r.r.FlowRevision == 0 {
+		return
+	}
+
+	revs, err := s.FlowRevisions()
+	if err != nil {
+		revs = make(SessionFlowRevisions)
+	}
+	revs[r.run.FlowReference().UUID] = int(r.r.FlowRevision)
+
+	revsJSON, _ := json.Marshal(revs)
+	s.s.FlowRevisions = null.String(revsJSON)
+}
+
+// PinnedOrgAssets returns assets where any flows of the passed in session which pin their revisions use the revisions
+// the session started them on. If none do, or they're already on those revisions, the passed in assets are returned.
+func PinnedOrgAssets(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, session *Session) (*OrgAssets, error) {
+	revs, err := session.FlowRevisions()
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := make(SessionFlowRevisions, len(revs))
+	for flowUUID, revision := range revs {
+		flow, err := oa.Flow(flowUUID)
+		if err != nil {
+			continue
+		}
+		f := flow.(*Flow)
+
+		if f.PinsRevision() && f.Revision() != revision {
+			pinned[flowUUID] = revision
+		}
+	}
+
+	if len(pinned) == 0 {
+		return oa, nil
+	}
+
+	clone, err := pinnedClone(ctx, rt, oa, pinned)
+	if err != nil || clone == nil {
+		return oa, err
+	}
+	return clone, nil
+}
+
+// returns a clone of the passed in assets where flows use the passed in revisions, or nil if none of those revisions
+// exist. Clones are cached on the assets they were cloned from so that sessions on the same revisions share them.
+func pinnedClone(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, revisions SessionFlowRevisions) (*OrgAssets, error) {
+	parts := make([]string, 0, len(revisions))
+	for flowUUID, revision := range revisions {
+		parts = append(parts, fmt.Sprintf("%s:%d", flowUUID, revision))
+	}
+	sort.Strings(parts)
+	key := strings.Join(parts, ",")
+
+	oa.pinnedClonesLock.Lock()
+	clone := oa.pinnedClones[key]
+	oa.pinnedClonesLock.Unlock()
+
+	if clone != nil {
+		return clone, nil
+	}
+
+	revs := make([]*FlowRevision, 0, len(revisions))
+	for flowUUID, revision := range revisions {
+		rev, err := LoadFlowRevision(ctx, rt.DB, oa.OrgID(), flowUUID, revision)
+		if err != nil {
+			return nil, err
+		}
+		if rev == nil {
+			logrus.WithField("flow_uuid", flowUUID).WithField("revision", revision).Error("unable to find pinned revision of flow")
+			continue
+		}
+		revs = append(revs, rev)
+	}
+
+	if len(revs) == 0 {
+		return nil, nil
+	}
+
+	clone, err := oa.CloneWithFlowRevisions(ctx, rt, revs)
+	if err != nil {
+		return nil, err
+	}
+
+	oa.pinnedClonesLock.Lock()
+	if oa.pinnedClones == nil {
+		oa.pinnedClones = make(map[string]*OrgAssets)
+	}
+	if len(oa.pinnedClones) < maxPinnedClones {
+		oa.pinnedClones[key] = clone
+	}
+	oa.pinnedClonesLock.Unlock()
+
+	return clone, nil
+}
@@ -39,7 +39,9 @@ func (t FlowType) Interrupts() bool {
 }
 
 const (
-	flowConfigIVRRetryMinutes = "ivr_retry"
+	flowConfigIVRRetryMinutes   = "ivr_retry"
+	flowConfigIVRVoicemailText  = "ivr_voicemail_text"
+	flowConfigIVRVoicemailAudio = "ivr_voicemail_audio"
 )
 
 var flowTypeMapping = map[flows.FlowType]FlowType{
@@ -60,6 +62,7 @@ type Flow struct {
 		Version        string          `json:"version"`
 		FlowType       FlowType        `json:"flow_type"`
 		Definition     json.RawMessage `json:"definition"`
+		Revision       int             `json:"revision"`
 		IgnoreTriggers bool            `json:"ignore_triggers"`
 	}
 }
@@ -103,6 +106,27 @@ func (f *Flow) IVRRetryWait() *time.Duration {
 	return &wait
 }
 
+// IVRVoicemail is the message left on answering machines by a voice flow, either spoken text or a recording
+type IVRVoicemail struct {
+	Text     string
+	AudioURL string
+}
+
+// IVRVoicemail returns the voicemail to leave if a call for this flow is answered by a machine (nil means hang up)
+func (f *Flow) IVRVoicemail() *IVRVoicemail {
+	vm := &IVRVoicemail{
+		Text:     f.f.Config.GetString(flowConfigIVRVoicemailText, ""),
+		AudioURL: f.f.Config.GetString(flowConfigIVRVoicemailAudio, ""),
+	}
+	if vm.Text == "" && vm.AudioURL == "" {
+		return nil
+	}
+	return vm
+}
+
+// Revision returns the revision of this flow's definition
+func (f *Flow) Revision() int { return f.f.Revision }
+
 // IgnoreTriggers returns whether this flow ignores triggers
 func (f *Flow) IgnoreTriggers() bool { return f.f.IgnoreTriggers }
 
@@ -118,6 +142,13 @@ func (f *Flow) cloneWithNewDefinition(def []byte) *Flow {
 	return &c
 }
 
+// clones this flow but gives it the definition of the provided revision
+func (f *Flow) cloneWithRevision(rev *FlowRevision) *Flow {
+	c := f.cloneWithNewDefinition(rev.Definition)
+	c.f.Revision = rev.Revision
+	return c
+}
+
 func FlowIDForUUID(ctx context.Context, tx *sqlx.Tx, oa *OrgAssets, flowUUID assets.FlowUUID) (FlowID, error) {
 	// first try to look up in our assets
 	flow, _ := oa.Flow(flowUUID)
@@ -174,6 +205,7 @@ SELECT ROW_TO_JSON(r) FROM (SELECT
 	ignore_triggers,
 	flow_type,
 	fr.spec_version as version,
+	fr.revision as revision,
 	coalesce(metadata, '{}')::jsonb as config,
 	definition::jsonb || 
 		jsonb_build_object(
@@ -222,6 +254,7 @@ SELECT ROW_TO_JSON(r) FROM (SELECT
 	ignore_triggers,
 	flow_type,
 	fr.spec_version as version,
+	fr.revision as revision,
 	coalesce(metadata, '{}')::jsonb as config,
 	definition::jsonb || 
 		jsonb_build_object(
@@ -261,6 +294,94 @@ WHERE
 	is_archived = FALSE
 ) r;`
 
+// FlowRevision is a saved revision of a flow definition
+type FlowRevision struct {
+	FlowUUID   assets.FlowUUID `db:"flow_uuid"`
+	Revision   int             `db:"revision"`
+	Definition json.RawMessage `db:"definition"`
+	CreatedOn  time.Time       `db:"created_on"`
+}
+
+// LoadFlowRevisionAt loads the revision of the passed in flow which was current at the given time, returning nil if
+// the flow has no revision that old
+func LoadFlowRevisionAt(ctx context.Context, db Queryer, orgID OrgID, flowUUID assets.FlowUUID, at time.Time) (*FlowRevision, error) {
+	rows, err := db.QueryxContext(ctx, selectFlowRevisionAtSQL, orgID, flowUUID, at)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying revision of flow %s", flowUUID)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, nil
+	}
+
+	rev := &FlowRevision{}
+	if err := rows.StructScan(rev); err != nil {
+		return nil, errors.Wrapf(err, "error reading revision of flow %s", flowUUID)
+	}
+	return rev, nil
+}
+
+const selectFlowRevisionAtSQL = `
+SELECT
+	f.uuid AS flow_uuid,
+	fr.revision,
+	fr.definition::jsonb || jsonb_build_object('uuid', f.uuid, 'name', f.name, 'spec_version', fr.spec_version) AS definition,
+	fr.created_on
+FROM
+	flows_flowrevision fr
+	JOIN flows_flow f ON f.id = fr.flow_id
+WHERE
+	f.org_id = $1 AND
+	f.uuid = $2 AND
+	fr.is_active = TRUE AND
+	fr.created_on <= $3
+ORDER BY
+	fr.revision DESC
+LIMIT 1
+`
+
+// LoadFlowRevision loads the given revision of the passed in flow, returning nil if there is no such revision
+func LoadFlowRevision(ctx context.Context, db Queryer, orgID OrgID, flowUUID assets.FlowUUID, revision int) (*FlowRevision, error) {
+	rows, err := db.QueryxContext(ctx, selectFlowRevisionSQL, orgID, flowUUID, revision)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying revision %d of flow %s", revision, flowUUID)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, nil
+	}
+
+	rev := &FlowRevision{}
+	if err := rows.StructScan(rev); err != nil {
+		return nil, errors.Wrapf(err, "error reading revision %d of flow %s", revision, flowUUID)
+	}
+	return rev, nil
+}
+
+const selectFlowRevisionSQL = `
+SELECT
+	f.uuid AS flow_uuid,
+	fr.revision,
+	fr.definition::jsonb || jsonb_build_object(
+		'uuid', f.uuid,
+		'name', f.name,
+		'spec_version', fr.spec_version,
+		'expire_after_minutes', f.expires_after_minutes,
+		'revision', fr.revision
+	) AS definition,
+	fr.created_on
+FROM
+	flows_flowrevision fr
+	JOIN flows_flow f ON f.id = fr.flow_id
+WHERE
+	f.org_id = $1 AND
+	f.uuid = $2 AND
+	fr.revision = $3 AND
+	fr.is_active = TRUE
+`
+
 // MarshalJSON marshals into JSON. 0 values will become null
 func (i FlowID) MarshalJSON() ([]byte, error) {
 	return null.Int(i).MarshalJSON()
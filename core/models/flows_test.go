@@ -15,23 +15,24 @@ import (
 func TestLoadFlows(t *testing.T) {
 	ctx, rt, db, _ := testsuite.Get()
 
-	db.MustExec(`UPDATE flows_flow SET metadata = '{"ivr_retry": 30}'::json WHERE id = $1`, testdata.IVRFlow.ID)
+	db.MustExec(`UPDATE flows_flow SET metadata = '{"ivr_retry": 30, "ivr_voicemail_text": "Please call us back"}'::json WHERE id = $1`, testdata.IVRFlow.ID)
 	db.MustExec(`UPDATE flows_flow SET metadata = '{"ivr_retry": -1}'::json WHERE id = $1`, testdata.SurveyorFlow.ID)
 
 	sixtyMinutes := 60 * time.Minute
 	thirtyMinutes := 30 * time.Minute
 
 	tcs := []struct {
-		org              *testdata.Org
-		flowID           models.FlowID
-		flowUUID         assets.FlowUUID
-		expectedName     string
-		expectedIVRRetry *time.Duration
+		org               *testdata.Org
+		flowID            models.FlowID
+		flowUUID          assets.FlowUUID
+		expectedName      string
+		expectedIVRRetry  *time.Duration
+		expectedVoicemail *models.IVRVoicemail
 	}{
-		{testdata.Org1, testdata.Favorites.ID, testdata.Favorites.UUID, "Favorites", &sixtyMinutes},    // will use default IVR retry
-		{testdata.Org1, testdata.IVRFlow.ID, testdata.IVRFlow.UUID, "IVR Flow", &thirtyMinutes},        // will have explicit IVR retry
-		{testdata.Org1, testdata.SurveyorFlow.ID, testdata.SurveyorFlow.UUID, "Contact Surveyor", nil}, // will have no IVR retry
-		{testdata.Org2, models.FlowID(0), assets.FlowUUID("51e3c67d-8483-449c-abf7-25e50686f0db"), "", nil},
+		{testdata.Org1, testdata.Favorites.ID, testdata.Favorites.UUID, "Favorites", &sixtyMinutes, nil},                                           // will use default IVR retry
+		{testdata.Org1, testdata.IVRFlow.ID, testdata.IVRFlow.UUID, "IVR Flow", &thirtyMinutes, &models.IVRVoicemail{Text: "Please call us back"}}, // will have explicit IVR retry and voicemail
+		{testdata.Org1, testdata.SurveyorFlow.ID, testdata.SurveyorFlow.UUID, "Contact Surveyor", nil, nil},                                        // will have no IVR retry
+		{testdata.Org2, models.FlowID(0), assets.FlowUUID("51e3c67d-8483-449c-abf7-25e50686f0db"), "", nil, nil},
 	}
 
 	for i, tc := range tcs {
@@ -44,6 +45,7 @@ func TestLoadFlows(t *testing.T) {
 			assert.Equal(t, tc.flowUUID, flow.UUID())
 			assert.Equal(t, tc.expectedName, flow.Name(), "%d: name mismatch", i)
 			assert.Equal(t, tc.expectedIVRRetry, flow.IVRRetryWait(), "%d: IVR retry mismatch", i)
+			assert.Equal(t, tc.expectedVoicemail, flow.IVRVoicemail(), "%d: IVR voicemail mismatch", i)
 
 			_, err := goflow.ReadFlow(rt.Config, flow.Definition())
 			assert.NoError(t, err)
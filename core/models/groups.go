@@ -6,11 +6,11 @@ import (
 
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/runtime"
 	"github.com/nyaruka/mailroom/utils/dbutil"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
-	"github.com/olivere/elastic/v7"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -175,6 +175,9 @@ func ContactIDsForGroupIDs(ctx context.Context, tx Queryer, groupIDs []GroupID)
 		}
 		contactIDs = append(contactIDs, contactID)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error iterating contacts for groups")
+	}
 
 	return contactIDs, nil
 }
@@ -334,7 +337,9 @@ func AddContactsToGroupAndCampaigns(ctx context.Context, db *sqlx.DB, org *OrgAs
 
 // PopulateDynamicGroup calculates which members should be part of a group and populates the contacts
 // for that group by performing the minimum number of inserts / deletes.
-func PopulateDynamicGroup(ctx context.Context, db *sqlx.DB, es *elastic.Client, org *OrgAssets, groupID GroupID, query string) (int, error) {
+func PopulateDynamicGroup(ctx context.Context, rt *runtime.Runtime, org *OrgAssets, groupID GroupID, query string) (int, error) {
+	db := rt.DB
+
 	err := UpdateGroupStatus(ctx, db, groupID, GroupStatusEvaluating)
 	if err != nil {
 		return 0, errors.Wrapf(err, "error marking dynamic group as evaluating")
@@ -342,6 +347,13 @@ func PopulateDynamicGroup(ctx context.Context, db *sqlx.DB, es *elastic.Client,
 
 	start := time.Now()
 
+	// database searches always see the latest contacts so only elastic searches need to wait for the indexer, and if
+	// we're searching the database, use the primary so that we don't have to wait for replicas either
+	inDB, err := searchInDB(ctx, rt, org, false)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error deciding where to search for org: %d", org.OrgID())
+	}
+
 	// we have a bit of a race with the indexer process.. we want to make sure that any contacts that changed
 	// before this group was updated but after the last index are included, so if a contact was modified
 	// more recently than 10 seconds ago, we wait that long before starting in populating our group
@@ -349,7 +361,7 @@ func PopulateDynamicGroup(ctx context.Context, db *sqlx.DB, es *elastic.Client,
 	if err != nil {
 		return 0, errors.Wrapf(err, "error getting most recent contact modified_on for org: %d", org.OrgID())
 	}
-	if newest != nil {
+	if newest != nil && !inDB {
 		n := *newest
 
 		// if it was more recent than 10 seconds ago, sleep until it has been 10 seconds
@@ -371,7 +383,7 @@ func PopulateDynamicGroup(ctx context.Context, db *sqlx.DB, es *elastic.Client,
 	}
 
 	// calculate new set of ids
-	new, err := ContactIDsForQuery(ctx, es, org, query)
+	new, err := SearchContactIDs(ctx, rt, org, query, inDB)
 	if err != nil {
 		return 0, errors.Wrapf(err, "error performing query: %s for group: %d", query, groupID)
 	}
@@ -91,6 +91,8 @@ func TestDynamicGroups(t *testing.T) {
 	)
 	assert.NoError(t, err)
 
+	rt.ES = es
+
 	contactHit := `{
 		"_scroll_id": "DXF1ZXJ5QW5kRmV0Y2gBAAAAAAAbgc0WS1hqbHlfb01SM2lLTWJRMnVOSVZDdw==",
 		"took": 2,
@@ -153,7 +155,7 @@ func TestDynamicGroups(t *testing.T) {
 		assert.NoError(t, err)
 
 		esServer.NextResponse = tc.ESResponse
-		count, err := models.PopulateDynamicGroup(ctx, db, es, oa, testdata.DoctorsGroup.ID, tc.Query)
+		count, err := models.PopulateDynamicGroup(ctx, rt, oa, testdata.DoctorsGroup.ID, tc.Query)
 		assert.NoError(t, err, "error populating dynamic group for: %s", tc.Query)
 
 		assert.Equal(t, count, len(tc.ContactIDs))
@@ -33,6 +33,9 @@ const (
 
 	// LogTypeExternalServiceCalled is our type for when we call a external service
 	LogTypeExternalServiceCalled = "external_service_called"
+
+	// LogTypeLoopDetected is our type for when the loop guard stops messages to a contact
+	LogTypeLoopDetected = "loop_detected"
 )
 
 // HTTPLog is our type for a HTTPLog
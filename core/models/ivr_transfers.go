@@ -0,0 +1,189 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/pkg/errors"
+)
+
+// config keys for transferring IVR calls to agents when a voice flow opens a ticket
+const (
+	// TicketerConfigIVRTransferDestination is the agent destination which IVR calls are bridged to when a voice flow
+	// ends after opening a ticket on this ticketer, either a SIP URI (sip:agents@pbx.example.com) or a phone number
+	TicketerConfigIVRTransferDestination = "ivr_transfer_destination"
+
+	// TicketerConfigIVRTransferTimeout is how many seconds to ring the agent destination for before giving up
+	TicketerConfigIVRTransferTimeout = "ivr_transfer_timeout"
+)
+
+// ticket config keys which record the transfer of the call which opened the ticket
+const (
+	TicketConfigIVRConnectionID        = "ivr_connection_id"
+	TicketConfigIVRTransferStatus      = "ivr_transfer_status"
+	TicketConfigIVRTransferDuration    = "ivr_transfer_duration"
+	TicketConfigIVRTransferDestination = "ivr_transfer_destination"
+)
+
+// TransferDestinationType is the type of an agent destination
+type TransferDestinationType string
+
+// transfer destination types
+const (
+	TransferDestinationSIP   = TransferDestinationType("sip")
+	TransferDestinationPhone = TransferDestinationType("phone")
+)
+
+// TransferDestination is where an IVR call is bridged to so that an agent can take over
+type TransferDestination struct {
+	Type    TransferDestinationType
+	Address string
+	Timeout int
+}
+
+func (d *TransferDestination) String() string {
+	if d.Type == TransferDestinationSIP {
+		return d.Address
+	}
+	return "tel:" + d.Address
+}
+
+// IVRTransferDestination returns the agent destination for IVR calls which open tickets on this ticketer in the
+// passed in topic, if any. A destination for a specific topic can be configured by suffixing the config key with the
+// topic UUID, e.g. ivr_transfer_destination:<topic uuid>, otherwise the ticketer's destination is used.
+func (t *Ticketer) IVRTransferDestination(topic *Topic) *TransferDestination {
+	value := ""
+	if topic != nil {
+		value = t.Config(fmt.Sprintf("%s:%s", TicketerConfigIVRTransferDestination, topic.UUID()))
+	}
+	if value == "" {
+		value = t.Config(TicketerConfigIVRTransferDestination)
+	}
+
+	dest := parseTransferDestination(value)
+	if dest != nil {
+		dest.Timeout, _ = strconv.Atoi(t.Config(TicketerConfigIVRTransferTimeout))
+	}
+	return dest
+}
+
+func parseTransferDestination(value string) *TransferDestination {
+	value = strings.TrimSpace(value)
+
+	if strings.HasPrefix(value, "sip:") || strings.HasPrefix(value, "sips:") {
+		return &TransferDestination{Type: TransferDestinationSIP, Address: value}
+	}
+
+	number := strings.TrimPrefix(value, "tel:")
+	if number == "" {
+		return nil
+	}
+	return &TransferDestination{Type: TransferDestinationPhone, Address: number}
+}
+
+// TransferStatus is the status of the transfer of an IVR call to an agent
+type TransferStatus string
+
+// transfer statuses, final statuses being the same as those of a dial
+const (
+	TransferStatusBridging = TransferStatus("bridging")
+	TransferStatusAnswered = TransferStatus(flows.DialStatusAnswered)
+	TransferStatusNoAnswer = TransferStatus(flows.DialStatusNoAnswer)
+	TransferStatusBusy     = TransferStatus(flows.DialStatusBusy)
+	TransferStatusFailed   = TransferStatus(flows.DialStatusFailed)
+)
+
+// ConnectionTransfer is the transfer of an IVR call to an agent destination along with the ticket it was opened for
+type ConnectionTransfer struct {
+	TicketID    TicketID       `db:"transfer_ticket_id"`
+	Destination string         `db:"transfer_destination"`
+	Status      TransferStatus `db:"transfer_status"`
+	Duration    int            `db:"transfer_duration"`
+	StartedOn   time.Time      `db:"transfer_started_on"`
+}
+
+const selectConnectionTransferSQL = `
+SELECT
+	transfer_ticket_id,
+	transfer_destination,
+	transfer_status,
+	COALESCE(transfer_duration, 0) AS transfer_duration,
+	transfer_started_on
+FROM
+	channels_channelconnection
+WHERE
+	id = $1 AND
+	transfer_ticket_id IS NOT NULL
+`
+
+// Transfer returns the transfer of this connection to an agent, or nil if it hasn't been transferred
+func (c *ChannelConnection) Transfer(ctx context.Context, db Queryer) (*ConnectionTransfer, error) {
+	transfer := &ConnectionTransfer{}
+	err := db.GetContext(ctx, transfer, selectConnectionTransferSQL, c.ID())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading transfer for connection: %d", c.ID())
+	}
+	return transfer, nil
+}
+
+const updateConnectionTransferSQL = `
+UPDATE
+	channels_channelconnection
+SET
+	transfer_ticket_id = $2,
+	transfer_destination = $3,
+	transfer_status = $4,
+	transfer_duration = $5,
+	transfer_started_on = $6,
+	modified_on = NOW()
+WHERE
+	id = $1
+`
+
+// SetTransfer records the passed in transfer of this connection to an agent
+func (c *ChannelConnection) SetTransfer(ctx context.Context, db Queryer, transfer *ConnectionTransfer) error {
+	_, err := db.ExecContext(ctx, updateConnectionTransferSQL, c.ID(), transfer.TicketID, transfer.Destination, transfer.Status, transfer.Duration, transfer.StartedOn)
+	if err != nil {
+		return errors.Wrapf(err, "error updating transfer for connection: %d", c.ID())
+	}
+	return nil
+}
+
+// TranscriptLine is a message spoken to or by the contact during an IVR call
+type TranscriptLine struct {
+	Direction MsgDirection `db:"direction"`
+	Text      string       `db:"text"`
+	CreatedOn time.Time    `db:"created_on"`
+}
+
+const selectConnectionTranscriptSQL = `
+SELECT
+	direction,
+	text,
+	created_on
+FROM
+	msgs_msg
+WHERE
+	connection_id = $1
+ORDER BY
+	created_on ASC,
+	id ASC`
+
+// LoadConnectionTranscript loads the messages spoken to and by the contact on the passed in connection in order
+func LoadConnectionTranscript(ctx context.Context, db *sqlx.DB, connID ConnectionID) ([]*TranscriptLine, error) {
+	lines := make([]*TranscriptLine, 0, 10)
+	err := db.SelectContext(ctx, &lines, selectConnectionTranscriptSQL, connID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading transcript for connection: %d", connID)
+	}
+	return lines, nil
+}
@@ -0,0 +1,92 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIVRTransfers(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	// no destination by default
+	assert.Nil(t, oa.TicketerByID(testdata.Mailgun.ID).IVRTransferDestination(nil))
+
+	db.MustExec(`UPDATE tickets_ticketer SET config = config || $2::jsonb WHERE id = $1`, testdata.Mailgun.ID, `{
+		"ivr_transfer_destination": "tel:+12065551212",
+		"ivr_transfer_destination:9ef2ff21-064a-41f1-8560-ccc990b4f937": "sip:sales@pbx.nyaruka.com",
+		"ivr_transfer_timeout": "20"
+	}`)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshTicketers)
+	require.NoError(t, err)
+
+	ticketer := oa.TicketerByID(testdata.Mailgun.ID)
+
+	dest := ticketer.IVRTransferDestination(nil)
+	assert.Equal(t, &models.TransferDestination{Type: models.TransferDestinationPhone, Address: "+12065551212", Timeout: 20}, dest)
+	assert.Equal(t, "tel:+12065551212", dest.String())
+
+	// topics without their own destination use the ticketer's
+	dest = ticketer.IVRTransferDestination(oa.TopicByUUID(testdata.SupportTopic.UUID))
+	assert.Equal(t, models.TransferDestinationPhone, dest.Type)
+
+	dest = ticketer.IVRTransferDestination(oa.TopicByUUID(testdata.SalesTopic.UUID))
+	assert.Equal(t, &models.TransferDestination{Type: models.TransferDestinationSIP, Address: "sip:sales@pbx.nyaruka.com", Timeout: 20}, dest)
+	assert.Equal(t, "sip:sales@pbx.nyaruka.com", dest.String())
+
+	conn, err := models.InsertIVRConnection(ctx, db, testdata.Org1.ID, testdata.TwilioChannel.ID, models.NilStartID, testdata.Cathy.ID, testdata.Cathy.URNID, models.ConnectionDirectionOut, models.ConnectionStatusInProgress, "CA123")
+	require.NoError(t, err)
+
+	transfer, err := conn.Transfer(ctx, db)
+	assert.NoError(t, err)
+	assert.Nil(t, transfer)
+
+	ticket := testdata.InsertOpenTicket(db, testdata.Org1, testdata.Cathy, testdata.Mailgun, testdata.DefaultTopic, "Need help", "", nil)
+
+	startedOn := time.Date(2021, 6, 10, 12, 30, 0, 0, time.UTC)
+	err = conn.SetTransfer(ctx, db, &models.ConnectionTransfer{TicketID: ticket.ID, Destination: "tel:+12065551212", Status: models.TransferStatusBridging, StartedOn: startedOn})
+	assert.NoError(t, err)
+
+	// transfer is recorded on the connection
+	transfer, err = conn.Transfer(ctx, db)
+	assert.NoError(t, err)
+	assert.Equal(t, ticket.ID, transfer.TicketID)
+	assert.Equal(t, "tel:+12065551212", transfer.Destination)
+	assert.Equal(t, models.TransferStatusBridging, transfer.Status)
+	assert.Equal(t, 0, transfer.Duration)
+	assert.Equal(t, startedOn, transfer.StartedOn.UTC())
+
+	transfer.Status = models.TransferStatusAnswered
+	transfer.Duration = 25
+	err = conn.SetTransfer(ctx, db, transfer)
+	assert.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM channels_channelconnection WHERE id = $1 AND transfer_ticket_id = $2 AND transfer_status = 'answered' AND transfer_duration = 25`, conn.ID(), ticket.ID).Returns(1)
+
+	// transcript is made up of the messages on the connection
+	in := testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "I need help", models.MsgStatusHandled)
+	out := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "How can we help?", nil, models.MsgStatusWired, false)
+	testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "Not on this call", models.MsgStatusHandled)
+	db.MustExec(`UPDATE msgs_msg SET connection_id = $1, created_on = NOW() - INTERVAL '1 minute' WHERE id = $2`, conn.ID(), out.ID())
+	db.MustExec(`UPDATE msgs_msg SET connection_id = $1 WHERE id = $2`, conn.ID(), in.ID())
+
+	transcript, err := models.LoadConnectionTranscript(ctx, db, conn.ID())
+	assert.NoError(t, err)
+	require.Len(t, transcript, 2)
+	assert.Equal(t, models.DirectionOut, transcript[0].Direction)
+	assert.Equal(t, "How can we help?", transcript[0].Text)
+	assert.Equal(t, models.DirectionIn, transcript[1].Direction)
+	assert.Equal(t, "I need help", transcript[1].Text)
+}
@@ -0,0 +1,217 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/redisx"
+	"github.com/pkg/errors"
+)
+
+// IncidentTypeContactsLooping is the type of incident opened when contacts of an org trip the loop guard
+const IncidentTypeContactsLooping IncidentType = "contacts:looping"
+
+// LoopGuardReason is the reason the loop guard tripped for a contact
+type LoopGuardReason string
+
+// reasons the loop guard can trip
+const (
+	LoopGuardMinuteBudget LoopGuardReason = "minute_budget"
+	LoopGuardHourBudget   LoopGuardReason = "hour_budget"
+	LoopGuardPingPong     LoopGuardReason = "ping_pong"
+)
+
+// LoopGuardCheck is the result of checking a contact against the loop guard
+type LoopGuardCheck struct {
+	ContactID      ContactID       `json:"contact_id"`
+	URN            urns.URN        `json:"urn"`
+	Reason         LoopGuardReason `json:"reason"`
+	SentLastMinute int             `json:"sent_last_minute"`
+	SentLastHour   int             `json:"sent_last_hour"`
+	RecvLastMinute int             `json:"received_last_minute"`
+}
+
+// Tripped returns whether this check found the contact to be over a limit
+func (c *LoopGuardCheck) Tripped() bool { return c.Reason != "" }
+
+// LoopGuardEnabled returns whether any loop guard limits are configured
+func LoopGuardEnabled(cfg *runtime.Config) bool {
+	return cfg.MsgBudgetPerMinute > 0 || cfg.MsgBudgetPerHour > 0 || cfg.MsgPingPongLimit > 0
+}
+
+// series of messages sent to contacts in the last minute and hour, and received from contacts in the last minute
+func loopGuardSeries() (*redisx.IntervalSeries, *redisx.IntervalSeries, *redisx.IntervalSeries) {
+	return redisx.NewIntervalSeries("loop_guard:sent:minute", time.Second*10, 6),
+		redisx.NewIntervalSeries("loop_guard:sent:hour", time.Minute*5, 12),
+		redisx.NewIntervalSeries("loop_guard:received:minute", time.Second*10, 6)
+}
+
+// RecordLoopGuardReceived records that a message from the given contact resumed their session
+func RecordLoopGuardReceived(rt *runtime.Runtime, contactID ContactID) error {
+	if !LoopGuardEnabled(rt.Config) {
+		return nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	_, _, received := loopGuardSeries()
+	return errors.Wrapf(received.Record(rc, fmt.Sprint(contactID), 1), "error recording received message for contact %d", contactID)
+}
+
+// CheckLoopGuard records that count messages are about to be sent to the given contact and checks the totals against
+// our budgets. A contact which is both sending and receiving at the ping-pong limit is only considered to be looping if
+// the URN being sent to is the address of a channel, i.e. the other side is another bot served by us.
+func CheckLoopGuard(ctx context.Context, rt *runtime.Runtime, contactID ContactID, urn urns.URN, count int) (*LoopGuardCheck, error) {
+	check := &LoopGuardCheck{ContactID: contactID, URN: urn}
+	if !LoopGuardEnabled(rt.Config) || count == 0 {
+		return check, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	minute, hour, received := loopGuardSeries()
+	field := fmt.Sprint(contactID)
+
+	var err error
+	if check.SentLastMinute, err = recordAndTotal(rc, minute, field, count); err != nil {
+		return nil, err
+	}
+	if check.SentLastHour, err = recordAndTotal(rc, hour, field, count); err != nil {
+		return nil, err
+	}
+	if check.RecvLastMinute, err = recordAndTotal(rc, received, field, 0); err != nil {
+		return nil, err
+	}
+
+	cfg := rt.Config
+
+	if cfg.MsgBudgetPerMinute > 0 && check.SentLastMinute > cfg.MsgBudgetPerMinute {
+		check.Reason = LoopGuardMinuteBudget
+	} else if cfg.MsgBudgetPerHour > 0 && check.SentLastHour > cfg.MsgBudgetPerHour {
+		check.Reason = LoopGuardHourBudget
+	} else if cfg.MsgPingPongLimit > 0 && check.SentLastMinute >= cfg.MsgPingPongLimit && check.RecvLastMinute >= cfg.MsgPingPongLimit {
+		served, err := isChannelAddress(ctx, rt.DB, urn)
+		if err != nil {
+			return nil, err
+		}
+		if served {
+			check.Reason = LoopGuardPingPong
+		}
+	}
+
+	return check, nil
+}
+
+func recordAndTotal(rc redis.Conn, series *redisx.IntervalSeries, field string, value int) (int, error) {
+	if value > 0 {
+		if err := series.Record(rc, field, int64(value)); err != nil {
+			return 0, errors.Wrap(err, "error recording loop guard series")
+		}
+	}
+	total, err := series.Total(rc, field)
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting loop guard series total")
+	}
+	return int(total), nil
+}
+
+const selectChannelAddressExistsSQL = `SELECT EXISTS(SELECT 1 FROM channels_channel WHERE is_active = TRUE AND address = ANY($1))`
+
+// returns whether the path of the given URN is the address of one of our active channels
+func isChannelAddress(ctx context.Context, db Queryer, urn urns.URN) (bool, error) {
+	path := urn.Path()
+	if path == "" {
+		return false, nil
+	}
+
+	// channel addresses of phone numbers may or may not include the +
+	addresses := []string{path, "+" + strings.TrimPrefix(path, "+"), strings.TrimPrefix(path, "+")}
+
+	var exists bool
+	err := db.GetContext(ctx, &exists, selectChannelAddressExistsSQL, pq.Array(addresses))
+	return exists, errors.Wrapf(err, "error checking whether %s is a channel address", urn.Identity())
+}
+
+// IncidentContactsLooping ensures there is an open looping contacts incident for the given org
+func IncidentContactsLooping(ctx context.Context, db Queryer, rp *redis.Pool, oa *OrgAssets, contacts []flows.ContactUUID) (IncidentID, error) {
+	id, err := getOrCreateIncident(ctx, db, oa, &Incident{
+		OrgID:     oa.OrgID(),
+		Type:      IncidentTypeContactsLooping,
+		StartedOn: dates.Now(),
+		Scope:     "",
+	})
+	if err != nil {
+		return NilIncidentID, err
+	}
+
+	if len(contacts) > 0 {
+		rc := rp.Get()
+		defer rc.Close()
+
+		contactsKey := fmt.Sprintf("incident:%d:contacts", id)
+		rc.Send("MULTI")
+		rc.Send("SADD", redis.Args{}.Add(contactsKey).AddFlat(contacts)...)
+		rc.Send("EXPIRE", contactsKey, 60*60*24) // 24 hours
+		_, err = rc.Do("EXEC")
+		if err != nil {
+			return NilIncidentID, errors.Wrap(err, "error adding contact uuids to incident")
+		}
+	}
+
+	return id, nil
+}
+
+// NewLoopDetectedLog creates a new HTTP log recording that the loop guard stopped messages to a contact. The request
+// is the check which tripped and the response is what we did about it.
+func NewLoopDetectedLog(orgID OrgID, flowID FlowID, check *LoopGuardCheck, stopped int, session *Session, createdOn time.Time) *HTTPLog {
+	request, _ := json.Marshal(check)
+
+	response := fmt.Sprintf("%d messages not sent", stopped)
+	if session != nil {
+		response += fmt.Sprintf(", session %s interrupted", session.UUID())
+	}
+
+	h := newHTTPLog(orgID, LogTypeLoopDetected, check.URN.Identity().String(), 0, string(request), response, true, 0, 0, createdOn)
+	h.FlowID = flowID
+	h.ContactID = check.ContactID
+	return h
+}
+
+// FailMessages marks the passed in messages as failed(F) with the given reason so that they aren't sent
+func FailMessages(ctx context.Context, db Queryer, msgs []*Msg, reason MsgFailedReason) error {
+	is := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		m := &msg.m
+		m.Status = MsgStatusFailed
+		m.FailedReason = reason
+		is[i] = m
+	}
+
+	return BulkQuery(ctx, "failing messages", db, failMsgsSQL, is)
+}
+
+const failMsgsSQL = `
+UPDATE
+	msgs_msg
+SET
+	status = m.status,
+	failed_reason = m.failed_reason,
+	modified_on = NOW()
+FROM (
+	VALUES(:id, :status, :failed_reason)
+) AS
+	m(id, status, failed_reason)
+WHERE
+	msgs_msg.id = m.id::bigint
+`
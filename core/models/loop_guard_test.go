@@ -0,0 +1,84 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoopGuard(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// nothing is recorded or checked if no limits are configured
+	check, err := models.CheckLoopGuard(ctx, rt, testdata.Cathy.ID, testdata.Cathy.URN, 100)
+	require.NoError(t, err)
+	assert.False(t, check.Tripped())
+	assert.Equal(t, 0, check.SentLastMinute)
+
+	rt.Config.MsgBudgetPerMinute = 5
+	rt.Config.MsgBudgetPerHour = 8
+	rt.Config.MsgPingPongLimit = 2
+
+	// within budget
+	check, err = models.CheckLoopGuard(ctx, rt, testdata.Cathy.ID, testdata.Cathy.URN, 4)
+	require.NoError(t, err)
+	assert.False(t, check.Tripped())
+	assert.Equal(t, 4, check.SentLastMinute)
+	assert.Equal(t, 4, check.SentLastHour)
+
+	// over the per minute budget
+	check, err = models.CheckLoopGuard(ctx, rt, testdata.Cathy.ID, testdata.Cathy.URN, 2)
+	require.NoError(t, err)
+	assert.Equal(t, models.LoopGuardMinuteBudget, check.Reason)
+	assert.Equal(t, 6, check.SentLastMinute)
+
+	// budgets are per contact
+	check, err = models.CheckLoopGuard(ctx, rt, testdata.Bob.ID, testdata.Bob.URN, 2)
+	require.NoError(t, err)
+	assert.False(t, check.Tripped())
+
+	// raise the minute budget so we hit the hourly one instead
+	rt.Config.MsgBudgetPerMinute = 100
+
+	check, err = models.CheckLoopGuard(ctx, rt, testdata.Cathy.ID, testdata.Cathy.URN, 3)
+	require.NoError(t, err)
+	assert.Equal(t, models.LoopGuardHourBudget, check.Reason)
+	assert.Equal(t, 9, check.SentLastHour)
+
+	// Bob is sending and receiving at the ping-pong limit but isn't one of our channels
+	require.NoError(t, models.RecordLoopGuardReceived(rt, testdata.Bob.ID))
+	require.NoError(t, models.RecordLoopGuardReceived(rt, testdata.Bob.ID))
+
+	check, err = models.CheckLoopGuard(ctx, rt, testdata.Bob.ID, testdata.Bob.URN, 1)
+	require.NoError(t, err)
+	assert.False(t, check.Tripped())
+	assert.Equal(t, 2, check.RecvLastMinute)
+
+	// until he is
+	db.MustExec(`UPDATE channels_channel SET address = $2 WHERE id = $1`, testdata.VonageChannel.ID, testdata.Bob.URN.Path())
+
+	check, err = models.CheckLoopGuard(ctx, rt, testdata.Bob.ID, testdata.Bob.URN, 1)
+	require.NoError(t, err)
+	assert.Equal(t, models.LoopGuardPingPong, check.Reason)
+
+	// and record it
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	_, err = models.IncidentContactsLooping(ctx, db, rt.RP, oa, nil)
+	require.NoError(t, err)
+
+	err = models.InsertHTTPLogs(ctx, db, []*models.HTTPLog{models.NewLoopDetectedLog(testdata.Org1.ID, testdata.Favorites.ID, check, 1, nil, time.Now())})
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM notifications_incident WHERE org_id = $1 AND incident_type = 'contacts:looping'`, testdata.Org1.ID).Returns(1)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM request_logs_httplog WHERE log_type = 'loop_detected' AND contact_id = $1 AND is_error`, testdata.Bob.ID).Returns(1)
+}
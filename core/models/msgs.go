@@ -1070,6 +1070,16 @@ func UpdateMessage(ctx context.Context, tx Queryer, msgID flows.MsgID, status Ms
 	return nil
 }
 
+// UpdateMessageText sets the text of the passed in message if it doesn't have any, e.g. once an IVR recording has been
+// transcribed
+func UpdateMessageText(ctx context.Context, db Queryer, msgID flows.MsgID, text string) error {
+	_, err := db.ExecContext(ctx, `UPDATE msgs_msg SET text = $2, modified_on = NOW() WHERE id = $1 AND text = ''`, msgID, text)
+	if err != nil {
+		return errors.Wrapf(err, "error updating text of msg: %d", msgID)
+	}
+	return nil
+}
+
 // MarkMessagesPending marks the passed in messages as pending(P)
 func MarkMessagesPending(ctx context.Context, db Queryer, msgs []*Msg) error {
 	return updateMessageStatus(ctx, db, msgs, MsgStatusPending)
@@ -1114,22 +1124,24 @@ type BroadcastTranslation struct {
 // Broadcast represents a broadcast that needs to be sent
 type Broadcast struct {
 	b struct {
-		BroadcastID    BroadcastID                             `json:"broadcast_id,omitempty" db:"id"`
-		Translations   map[envs.Language]*BroadcastTranslation `json:"translations"`
-		Text           hstore.Hstore                           `                              db:"text"`
-		TemplateState  TemplateState                           `json:"template_state"`
-		BaseLanguage   envs.Language                           `json:"base_language"          db:"base_language"`
-		URNs           []urns.URN                              `json:"urns,omitempty"`
-		ContactIDs     []ContactID                             `json:"contact_ids,omitempty"`
-		GroupIDs       []GroupID                               `json:"group_ids,omitempty"`
-		OrgID          OrgID                                   `json:"org_id"                 db:"org_id"`
-		ParentID       BroadcastID                             `json:"parent_id,omitempty"    db:"parent_id"`
-		TicketID       TicketID                                `json:"ticket_id,omitempty"    db:"ticket_id"`
-		BroadcastType  events.BroadcastType                    `json:"broadcast_type"         db:"broadcast_type"`
-		IsBulkSend     bool                                    `json:"is_bulk_send"           db:"is_bulk_send"`
-		CatalogMessage BroadcastCatalogMessage                 `json:"catalog_message"`
-		Footer         string                                  `json:"footer"`
-		Header         BroadcastMessageHeader                  `json:"header"`
+		BroadcastID     BroadcastID                             `json:"broadcast_id,omitempty" db:"id"`
+		Translations    map[envs.Language]*BroadcastTranslation `json:"translations"`
+		Text            hstore.Hstore                           `                              db:"text"`
+		TemplateState   TemplateState                           `json:"template_state"`
+		BaseLanguage    envs.Language                           `json:"base_language"          db:"base_language"`
+		URNs            []urns.URN                              `json:"urns,omitempty"`
+		ContactIDs      []ContactID                             `json:"contact_ids,omitempty"`
+		GroupIDs        []GroupID                               `json:"group_ids,omitempty"`
+		Query           string                                  `json:"query,omitempty"`
+		ExcludeGroupIDs []GroupID                               `json:"exclude_group_ids,omitempty"`
+		OrgID           OrgID                                   `json:"org_id"                 db:"org_id"`
+		ParentID        BroadcastID                             `json:"parent_id,omitempty"    db:"parent_id"`
+		TicketID        TicketID                                `json:"ticket_id,omitempty"    db:"ticket_id"`
+		BroadcastType   events.BroadcastType                    `json:"broadcast_type"         db:"broadcast_type"`
+		IsBulkSend      bool                                    `json:"is_bulk_send"           db:"is_bulk_send"`
+		CatalogMessage  BroadcastCatalogMessage                 `json:"catalog_message"`
+		Footer          string                                  `json:"footer"`
+		Header          BroadcastMessageHeader                  `json:"header"`
 	}
 }
 
@@ -1148,6 +1160,17 @@ func (b *Broadcast) Header() BroadcastMessageHeader                        { ret
 func (b *Broadcast) Footer() string                                        { return b.b.Footer }
 func (b *Broadcast) CatalogMessage() BroadcastCatalogMessage               { return b.b.CatalogMessage }
 
+func (b *Broadcast) Query() string { return b.b.Query }
+func (b *Broadcast) WithQuery(query string) *Broadcast {
+	b.b.Query = query
+	return b
+}
+func (b *Broadcast) ExcludeGroupIDs() []GroupID { return b.b.ExcludeGroupIDs }
+func (b *Broadcast) WithExcludeGroupIDs(groupIDs []GroupID) *Broadcast {
+	b.b.ExcludeGroupIDs = groupIDs
+	return b
+}
+
 func (b *Broadcast) MarshalJSON() ([]byte, error)    { return json.Marshal(b.b) }
 func (b *Broadcast) UnmarshalJSON(data []byte) error { return json.Unmarshal(data, &b.b) }
 
@@ -1192,6 +1215,8 @@ func InsertChildBroadcast(ctx context.Context, db Queryer, parent *Broadcast) (*
 	)
 	// populate our parent id
 	child.b.ParentID = parent.ID()
+	child.b.Query = parent.b.Query
+	child.b.ExcludeGroupIDs = parent.b.ExcludeGroupIDs
 
 	if parent.b.IsBulkSend {
 		child.b.IsBulkSend = true
@@ -1443,9 +1468,13 @@ func CreateBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *OrgAs
 	// for each contact, build our message
 	msgs := make([]*Msg, 0, len(contacts))
 
+	// contacts we skip are tracked in our broadcast stats
+	skipped := newBroadcastSkips()
+
 	// utility method to build up our message
 	buildMessage := func(c *Contact, forceURN urns.URN) (*Msg, error) {
 		if c.Status() != ContactStatusActive {
+			skipped.blocked[c.ID()] = true
 			return nil, nil
 		}
 
@@ -1461,12 +1490,13 @@ func CreateBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *OrgAs
 		if forceURN != urns.NilURN {
 			for _, u := range contact.URNs() {
 				if u.URN().Identity() == forceURN.Identity() {
-					c := channels.GetForURN(u, assets.ChannelRoleSend)
-					if c == nil {
+					ch := channels.GetForURN(u, assets.ChannelRoleSend)
+					if ch == nil {
+						skipped.noURN[c.ID()] = true
 						return nil, nil
 					}
 					urn = u.URN()
-					channel = oa.ChannelByUUID(c.UUID())
+					channel = oa.ChannelByUUID(ch.UUID())
 					break
 				}
 			}
@@ -1484,6 +1514,7 @@ func CreateBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *OrgAs
 
 		// no urn and channel? move on
 		if channel == nil {
+			skipped.noURN[c.ID()] = true
 			return nil, nil
 		}
 
@@ -1617,6 +1648,7 @@ func CreateBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *OrgAs
 		}
 		if msg != nil {
 			msgs = append(msgs, msg)
+			skipped.sent[c.ID()] = true
 		}
 
 		// if this is a contact that will receive two messages, calculate that one as well
@@ -1625,6 +1657,9 @@ func CreateBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *OrgAs
 			if err != nil {
 				return nil, errors.Wrapf(err, "error creating broadcast message")
 			}
+			if m2 != nil {
+				skipped.sent[c.ID()] = true
+			}
 
 			// add this message if it isn't a duplicate
 			if m2 != nil && m2.URN() != msg.URN() {
@@ -1633,6 +1668,10 @@ func CreateBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *OrgAs
 		}
 	}
 
+	if err := recordBroadcastSkips(rt, bcast.BroadcastID(), skipped.stats()); err != nil {
+		logrus.WithError(err).WithField("broadcast_id", bcast.BroadcastID()).Error("error recording broadcast stats")
+	}
+
 	// allocate a topup for these message if org uses topups
 	topup, err := AllocateTopups(ctx, rt.DB, rt.RP, oa.Org(), len(msgs))
 	if err != nil {
@@ -1706,17 +1745,26 @@ type WppBroadcastMessage struct {
 	TTLSeconds             int                       `json:"ttl_seconds,omitempty"`
 }
 
+// WppBroadcastVariant is a variant of the message of an A/B split WhatsApp broadcast
+type WppBroadcastVariant struct {
+	ABVariant
+	Msg WppBroadcastMessage `json:"msg"`
+}
+
 type WppBroadcast struct {
 	b struct {
-		BroadcastID BroadcastID         `json:"broadcast_id,omitempty" db:"id"`
-		URNs        []urns.URN          `json:"urns,omitempty"`
-		ContactIDs  []ContactID         `json:"contact_ids,omitempty"`
-		GroupIDs    []GroupID           `json:"group_ids,omitempty"`
-		OrgID       OrgID               `json:"org_id"                 db:"org_id"`
-		ParentID    BroadcastID         `json:"parent_id,omitempty"    db:"parent_id"`
-		Msg         WppBroadcastMessage `json:"msg"`
-		ChannelID   ChannelID           `json:"channel_id,omitempty"`
-		Queue       string              `json:"queue,omitempty"`
+		BroadcastID     BroadcastID            `json:"broadcast_id,omitempty" db:"id"`
+		URNs            []urns.URN             `json:"urns,omitempty"`
+		ContactIDs      []ContactID            `json:"contact_ids,omitempty"`
+		GroupIDs        []GroupID              `json:"group_ids,omitempty"`
+		Query           string                 `json:"query,omitempty"`
+		ExcludeGroupIDs []GroupID              `json:"exclude_group_ids,omitempty"`
+		OrgID           OrgID                  `json:"org_id"                 db:"org_id"`
+		ParentID        BroadcastID            `json:"parent_id,omitempty"    db:"parent_id"`
+		Msg             WppBroadcastMessage    `json:"msg"`
+		Variants        []*WppBroadcastVariant `json:"variants,omitempty"`
+		ChannelID       ChannelID              `json:"channel_id,omitempty"`
+		Queue           string                 `json:"queue,omitempty"`
 	}
 }
 
@@ -1729,6 +1777,32 @@ func (b *WppBroadcast) Msg() WppBroadcastMessage { return b.b.Msg }
 func (b *WppBroadcast) ChannelID() ChannelID     { return b.b.ChannelID }
 func (b *WppBroadcast) Queue() string            { return b.b.Queue }
 
+func (b *WppBroadcast) Query() string { return b.b.Query }
+func (b *WppBroadcast) WithQuery(query string) *WppBroadcast {
+	b.b.Query = query
+	return b
+}
+func (b *WppBroadcast) ExcludeGroupIDs() []GroupID { return b.b.ExcludeGroupIDs }
+func (b *WppBroadcast) WithExcludeGroupIDs(groupIDs []GroupID) *WppBroadcast {
+	b.b.ExcludeGroupIDs = groupIDs
+	return b
+}
+
+func (b *WppBroadcast) Variants() []*WppBroadcastVariant { return b.b.Variants }
+func (b *WppBroadcast) WithVariants(variants []*WppBroadcastVariant) *WppBroadcast {
+	b.b.Variants = variants
+	return b
+}
+
+// ABVariants returns the variants of this broadcast if it is an A/B split
+func (b *WppBroadcast) ABVariants() []ABVariant {
+	variants := make([]ABVariant, len(b.b.Variants))
+	for i, v := range b.b.Variants {
+		variants[i] = v.ABVariant
+	}
+	return variants
+}
+
 func (b *WppBroadcast) MarshalJSON() ([]byte, error)    { return json.Marshal(b.b) }
 func (b *WppBroadcast) UnmarshalJSON(data []byte) error { return json.Unmarshal(data, &b.b) }
 
@@ -1757,10 +1831,19 @@ func (b *WppBroadcast) CreateBatch(contactIDs []ContactID) *WppBroadcastBatch {
 	return batch
 }
 
+// CreateVariantBatch creates a batch which sends the message of the given variant to the passed in contacts
+func (b *WppBroadcast) CreateVariantBatch(contactIDs []ContactID, variant *WppBroadcastVariant) *WppBroadcastBatch {
+	batch := b.CreateBatch(contactIDs)
+	batch.b.Msg = variant.Msg
+	batch.b.Variant = variant.Name
+	return batch
+}
+
 type WppBroadcastBatch struct {
 	b struct {
 		BroadcastID BroadcastID            `json:"broadcast_id,omitempty"`
 		Msg         WppBroadcastMessage    `json:"msg"`
+		Variant     string                 `json:"variant,omitempty"`
 		URNs        map[ContactID]urns.URN `json:"urns,omitempty"`
 		ContactIDs  []ContactID            `json:"contact_ids,omitempty"`
 		IsLast      bool                   `json:"is_last"`
@@ -1778,6 +1861,7 @@ func (b *WppBroadcastBatch) OrgID() OrgID                        { return b.b.Or
 func (b *WppBroadcastBatch) Msg() WppBroadcastMessage            { return b.b.Msg }
 func (b *WppBroadcastBatch) ChannelID() ChannelID                { return b.b.ChannelID }
 func (b *WppBroadcastBatch) Queue() string                       { return b.b.Queue }
+func (b *WppBroadcastBatch) Variant() string                     { return b.b.Variant }
 
 func (b *WppBroadcastBatch) IsLast() bool        { return b.b.IsLast }
 func (b *WppBroadcastBatch) SetIsLast(last bool) { b.b.IsLast = last }
@@ -1824,9 +1908,13 @@ func CreateWppBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *Or
 	regularMsgs := make([]*Msg, 0, len(contacts))
 	typingIndicatorMsgs := make([]*Msg, 0)
 
+	// contacts we skip are tracked in our broadcast stats
+	skipped := newBroadcastSkips()
+
 	// utility method to build up our message
 	buildMessage := func(c *Contact, forceURN urns.URN) (*Msg, error) {
 		if c.Status() != ContactStatusActive {
+			skipped.blocked[c.ID()] = true
 			return nil, nil
 		}
 
@@ -1842,12 +1930,13 @@ func CreateWppBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *Or
 		if forceURN != urns.NilURN {
 			for _, u := range contact.URNs() {
 				if u.URN().Identity() == forceURN.Identity() {
-					c := channels.GetForURN(u, assets.ChannelRoleSend)
-					if c == nil {
+					ch := channels.GetForURN(u, assets.ChannelRoleSend)
+					if ch == nil {
+						skipped.noURN[c.ID()] = true
 						return nil, nil
 					}
 					urn = u.URN()
-					channel = oa.ChannelByUUID(c.UUID())
+					channel = oa.ChannelByUUID(ch.UUID())
 					break
 				}
 			}
@@ -1869,6 +1958,7 @@ func CreateWppBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *Or
 
 		// no urn and channel? move on
 		if channel == nil {
+			skipped.noURN[c.ID()] = true
 			return nil, nil
 		}
 
@@ -2079,6 +2169,9 @@ func CreateWppBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *Or
 		if carousel {
 			extraMetadata["product_carousel"] = carousel
 		}
+		if bcast.Variant() != "" {
+			extraMetadata[ABVariantMetadataKey] = bcast.Variant()
+		}
 
 		msg, err := NewOutgoingWppBroadcastMsg(rt, oa.Org(), channel, c, out, time.Now(), bcast.BroadcastID(), highPriority, extraMetadata)
 		if err != nil {
@@ -2101,6 +2194,7 @@ func CreateWppBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *Or
 		}
 		if msg != nil {
 			msgs = append(msgs, msg)
+			skipped.sent[c.ID()] = true
 		}
 
 		// if this is a contact that will receive two messages, calculate that one as well
@@ -2109,6 +2203,9 @@ func CreateWppBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *Or
 			if err != nil {
 				return nil, errors.Wrapf(err, "error creating broadcast message")
 			}
+			if m2 != nil {
+				skipped.sent[c.ID()] = true
+			}
 
 			// add this message if it isn't a duplicate
 			if m2 != nil && m2.URN() != msg.URN() {
@@ -2117,6 +2214,10 @@ func CreateWppBroadcastMessages(ctx context.Context, rt *runtime.Runtime, oa *Or
 		}
 	}
 
+	if err := recordBroadcastSkips(rt, bcast.BroadcastID(), skipped.stats()); err != nil {
+		logrus.WithError(err).WithField("broadcast_id", bcast.BroadcastID()).Error("error recording broadcast stats")
+	}
+
 	// Separate regular messages from typing_indicator actions
 	for _, msg := range msgs {
 		metadata := msg.Metadata()
@@ -2256,6 +2357,16 @@ func MarkBroadcastSent(ctx context.Context, db Queryer, id BroadcastID) error {
 	return nil
 }
 
+// GetBroadcastStatus gets the status of the broadcast with the given id in the given org
+func GetBroadcastStatus(ctx context.Context, db Queryer, orgID OrgID, id BroadcastID) (string, error) {
+	var status string
+	err := db.GetContext(ctx, &status, `SELECT status FROM msgs_broadcast WHERE id = $1 AND org_id = $2`, id, orgID)
+	if err != nil {
+		return "", errors.Wrapf(err, "error loading status of broadcast with id %d", id)
+	}
+	return status, nil
+}
+
 func CreateOutgoingMessages(ctx context.Context, rt *runtime.Runtime, oa *OrgAssets, URNs []urns.URN, msgText string) ([]*Msg, error) {
 	// grab our contacts from the passed urns
 	urnContactIDs, err := GetOrCreateContactIDsFromURNs(ctx, rt.DB, oa, URNs)
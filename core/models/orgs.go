@@ -8,6 +8,7 @@ import (
 	"mime"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -167,6 +168,21 @@ func (o *Org) ConfigBoolValue(key string, def bool) bool {
 	return def
 }
 
+// ConfigIntValue returns the int value for the passed in config (or default if not found or not a number)
+func (o *Org) ConfigIntValue(key string, def int) int {
+	switch val := o.o.Config.Get(key, def).(type) {
+	case float64:
+		return int(val)
+	case int:
+		return val
+	case string:
+		if i, err := strconv.Atoi(val); err == nil {
+			return i
+		}
+	}
+	return def
+}
+
 // EmailService returns the email service for this org
 func (o *Org) EmailService(c *runtime.Config, retries *smtpx.RetryConfig) (flows.EmailService, error) {
 	connectionURL := o.ConfigValue(configSMTPServer, c.SMTPServer)
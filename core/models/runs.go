@@ -93,6 +93,7 @@ type FlowRun struct {
 		CurrentNodeUUID null.String     `db:"current_node_uuid"`
 		ContactID       flows.ContactID `db:"contact_id"`
 		FlowID          FlowID          `db:"flow_id"`
+		FlowRevision    null.Int        `db:"flow_revision"`
 		OrgID           OrgID           `db:"org_id"`
 		ParentUUID      *flows.RunUUID  `db:"parent_uuid"`
 		SessionID       SessionID       `db:"session_id"`
@@ -111,6 +112,16 @@ func (r *FlowRun) UUID() flows.RunUUID                  { return r.r.UUID }
 func (r *FlowRun) ModifiedOn() time.Time                { return r.r.ModifiedOn }
 func (r *FlowRun) CreatedOn() time.Time                 { return r.r.CreatedOn }
 
+// Results returns the results of this run
+func (r *FlowRun) Results() (flows.Results, error) {
+	results := flows.Results{}
+	if r.r.Results == "" {
+		return results, nil
+	}
+	err := json.Unmarshal([]byte(r.r.Results), &results)
+	return results, errors.Wrapf(err, "error unmarshalling results for run: %s", r.UUID())
+}
+
 // MarshalJSON is our custom marshaller so that our inner struct get output
 func (r *FlowRun) MarshalJSON() ([]byte, error) {
 	return json.Marshal(r.r)
@@ -161,6 +172,7 @@ func newRun(ctx context.Context, tx *sqlx.Tx, org *OrgAssets, session *Session,
 	r.ModifiedOn = fr.ModifiedOn()
 	r.ContactID = fr.Contact().ID()
 	r.FlowID = flowID
+	r.FlowRevision = pinnedFlowRevision(org, session, fr)
 	r.SessionID = session.ID()
 	r.StartID = NilStartID
 	r.OrgID = org.OrgID()
@@ -339,9 +351,9 @@ func ExpireRunsAndSessions(ctx context.Context, db *sqlx.DB, runIDs []FlowRunID,
 const insertRunSQL = `
 INSERT INTO
 flows_flowrun(uuid, is_active, created_on, modified_on, exited_on, exit_type, status, expires_on, responded, results, path, 
-	          events, current_node_uuid, contact_id, flow_id, org_id, session_id, start_id, parent_uuid, connection_id)
+	          events, current_node_uuid, contact_id, flow_id, flow_revision, org_id, session_id, start_id, parent_uuid, connection_id)
 	   VALUES(:uuid, :is_active, :created_on, NOW(), :exited_on, :exit_type, :status, :expires_on, :responded, :results, :path,
-	          :events, :current_node_uuid, :contact_id, :flow_id, :org_id, :session_id, :start_id, :parent_uuid, :connection_id)
+	          :events, :current_node_uuid, :contact_id, :flow_id, :flow_revision, :org_id, :session_id, :start_id, :parent_uuid, :connection_id)
 RETURNING id
 `
 
@@ -211,7 +211,7 @@ func TestFlowSessionRepairsMissingErrorText(t *testing.T) {
 		testdata.Favorites.ID,
 	)
 
-	sessionModel, err := models.ActiveSessionForContact(ctx, db, rt.SessionStorage, oa, models.FlowTypeMessaging, flowContact)
+	sessionModel, err := models.ActiveSessionForContact(ctx, rt, oa, models.FlowTypeMessaging, flowContact)
 	require.NoError(t, err)
 	require.NotNil(t, sessionModel)
 
@@ -161,3 +161,40 @@ func ContactIDsForQuery(ctx context.Context, client *elastic.Client, org *OrgAss
 		}
 	}
 }
+
+// scrolls through the ids of the contacts that match the passed in query in elastic, calling the passed in function
+// with each batch of them
+func scrollContactIDsFromElastic(ctx context.Context, client *elastic.Client, org *OrgAssets, group assets.GroupUUID, parsed *contactql.ContactQuery, batchSize int, fn func([]ContactID) error) error {
+	if client == nil {
+		return errors.Errorf("no elastic client available, check your configuration")
+	}
+
+	eq := BuildElasticQuery(org, group, NilContactStatus, nil, parsed)
+
+	scroll := client.Scroll("contacts").Routing(strconv.FormatInt(int64(org.OrgID()), 10))
+	scroll = scroll.KeepAlive("15m").Size(batchSize).Query(eq).FetchSource(false)
+	defer scroll.Clear(context.Background())
+
+	for {
+		results, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error scrolling through results for search: %s", parsed)
+		}
+
+		ids := make([]ContactID, 0, len(results.Hits.Hits))
+		for _, hit := range results.Hits.Hits {
+			id, err := strconv.Atoi(hit.Id)
+			if err != nil {
+				return errors.Wrapf(err, "unexpected non-integer contact id: %s for search: %s", hit.Id, parsed)
+			}
+			ids = append(ids, ContactID(id))
+		}
+
+		if err := fn(ids); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,571 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrUnsupportedDBQuery is returned when a contact query uses something which can only be searched for in elastic,
+// such as location fields or flow history
+var ErrUnsupportedDBQuery = errors.New("query not supported by database search")
+
+// BuildSQLQuery turns the passed in contact ql query into the conditions of a SQL query on contacts_contact aliased as
+// c, along with the arguments for it. It supports the common subset of queries, i.e. conditions on text, number and
+// datetime fields, groups, URNs, name, language, created_on, last_seen_on and tickets.
+func BuildSQLQuery(org *OrgAssets, group assets.GroupUUID, status ContactStatus, excludeIDs []ContactID, query *contactql.ContactQuery) (string, []interface{}, error) {
+	b := &sqlQueryBuilder{org: org, env: org.Env()}
+
+	// filter by org and active contacts
+	conditions := []string{
+		"c.org_id = " + b.arg(org.OrgID()),
+		"c.is_active = TRUE",
+	}
+
+	// our group if present, which may be a system group so we can't look it up in our assets
+	if group != "" {
+		conditions = append(conditions, fmt.Sprintf(`c.id IN (SELECT gc.contact_id FROM contacts_contactgroup_contacts gc JOIN contacts_contactgroup g ON g.id = gc.contactgroup_id WHERE g.uuid = %s)`, b.arg(group)))
+	}
+
+	// our status is present
+	if status != NilContactStatus {
+		conditions = append(conditions, "c.status = "+b.arg(status))
+	}
+
+	// exclude ids if present
+	if len(excludeIDs) > 0 {
+		conditions = append(conditions, fmt.Sprintf("NOT (c.id = ANY(%s))", b.arg(pq.Array(excludeIDs))))
+	}
+
+	// and by our query if present
+	if query != nil {
+		condition, err := b.node(query.Root())
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	return strings.Join(conditions, " AND "), b.args, nil
+}
+
+// BuildSQLSort turns the passed in sort, e.g. -created_on, into the ORDER BY of a SQL query on contacts_contact aliased
+// as c, with ties broken by id
+func BuildSQLSort(org *OrgAssets, sort string) (string, error) {
+	direction := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		direction = "DESC"
+	}
+	key := strings.TrimLeft(sort, "+-")
+
+	var expr string
+	switch key {
+	case "", "id":
+		return "c.id " + direction, nil
+	case "name", "created_on", "last_seen_on":
+		expr = "c." + key
+	default:
+		field := org.FieldByKey(key)
+		if field == nil {
+			return "", errors.Wrapf(ErrUnsupportedDBQuery, "can't sort by %s", key)
+		}
+		expr = fieldValueSQL(field, "")
+		if expr == "" {
+			return "", errors.Wrapf(ErrUnsupportedDBQuery, "can't sort by %s", key)
+		}
+	}
+
+	return fmt.Sprintf("%s %s NULLS LAST, c.id %s", expr, direction, direction), nil
+}
+
+type sqlQueryBuilder struct {
+	org  *OrgAssets
+	env  envs.Environment
+	args []interface{}
+}
+
+// adds the passed in value as an argument to our query, returning its placeholder
+func (b *sqlQueryBuilder) arg(value interface{}) string {
+	b.args = append(b.args, value)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+func (b *sqlQueryBuilder) node(node contactql.QueryNode) (string, error) {
+	switch n := node.(type) {
+	case *contactql.BoolCombination:
+		children := make([]string, len(n.Children()))
+		for i, child := range n.Children() {
+			condition, err := b.node(child)
+			if err != nil {
+				return "", err
+			}
+			children[i] = condition
+		}
+
+		join := " AND "
+		if n.Operator() == contactql.BoolOperatorOr {
+			join = " OR "
+		}
+		return "(" + strings.Join(children, join) + ")", nil
+
+	case *contactql.Condition:
+		return b.condition(n)
+	}
+
+	return "", errors.Wrapf(ErrUnsupportedDBQuery, "unknown query node: %T", node)
+}
+
+func (b *sqlQueryBuilder) condition(c *contactql.Condition) (string, error) {
+	switch c.PropertyType() {
+	case contactql.PropertyTypeField:
+		field := b.org.FieldByKey(c.PropertyKey())
+		if field == nil {
+			return "", errors.Wrapf(ErrUnsupportedDBQuery, "unknown field: %s", c.PropertyKey())
+		}
+
+		arg := b.arg(string(field.UUID()))
+		switch field.Type() {
+		case assets.FieldTypeText:
+			return b.textCondition(fieldValueSQL(field, arg), c, true)
+		case assets.FieldTypeNumber:
+			return b.numberCondition(fieldValueSQL(field, arg), c, true)
+		case assets.FieldTypeDatetime:
+			return b.datetimeCondition(fieldValueSQL(field, arg), c)
+		}
+
+	case contactql.PropertyTypeScheme:
+		return b.urnCondition(c, c.PropertyKey())
+
+	case contactql.PropertyTypeAttribute:
+		switch c.PropertyKey() {
+		case "uuid":
+			return b.textCondition("c.uuid::text", c, false)
+		case "id":
+			return b.numberCondition("c.id", c, false)
+		case "name":
+			return b.textCondition("c.name", c, true)
+		case "language":
+			return b.textCondition("c.language", c, false)
+		case "created_on":
+			return b.datetimeCondition("c.created_on", c)
+		case "last_seen_on":
+			return b.datetimeCondition("c.last_seen_on", c)
+		case "urn":
+			return b.urnCondition(c, "")
+		case "group":
+			return b.groupCondition(c)
+		case "tickets":
+			return b.numberCondition("c.ticket_count", c, false)
+		}
+	}
+
+	return "", errors.Wrapf(ErrUnsupportedDBQuery, "can't search by %s", c.PropertyKey())
+}
+
+// conditions on text are case insensitive, and a condition on an empty value checks whether there is a value
+func (b *sqlQueryBuilder) textCondition(expr string, c *contactql.Condition, canContain bool) (string, error) {
+	value := c.Value()
+
+	switch c.Operator() {
+	case contactql.OpEqual:
+		if value == "" {
+			return fmt.Sprintf("COALESCE(%s, '') = ''", expr), nil
+		}
+		return fmt.Sprintf("LOWER(%s) = LOWER(%s)", expr, b.arg(value)), nil
+	case contactql.OpNotEqual:
+		if value == "" {
+			return fmt.Sprintf("COALESCE(%s, '') != ''", expr), nil
+		}
+		return fmt.Sprintf("COALESCE(LOWER(%s), '') != LOWER(%s)", expr, b.arg(value)), nil
+	case contactql.OpContains:
+		if canContain {
+			return fmt.Sprintf("LOWER(%s) LIKE %s", expr, b.arg(containsPattern(value))), nil
+		}
+	}
+
+	return "", errors.Wrapf(ErrUnsupportedDBQuery, "can't search %s with %s", c.PropertyKey(), c.Operator())
+}
+
+var sqlComparisons = map[contactql.Operator]string{
+	contactql.OpEqual:              "=",
+	contactql.OpNotEqual:           "IS DISTINCT FROM",
+	contactql.OpGreaterThan:        ">",
+	contactql.OpGreaterThanOrEqual: ">=",
+	contactql.OpLessThan:           "<",
+	contactql.OpLessThanOrEqual:    "<=",
+}
+
+func (b *sqlQueryBuilder) numberCondition(expr string, c *contactql.Condition, canBeUnset bool) (string, error) {
+	if c.Value() == "" && canBeUnset {
+		return b.unsetCondition(expr, c)
+	}
+
+	comparison, supported := sqlComparisons[c.Operator()]
+	if !supported {
+		return "", errors.Wrapf(ErrUnsupportedDBQuery, "can't search %s with %s", c.PropertyKey(), c.Operator())
+	}
+
+	number, err := c.ValueAsNumber()
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid number: %s", c.Value())
+	}
+
+	return fmt.Sprintf("%s %s %s", expr, comparison, b.arg(number.String())+"::numeric"), nil
+}
+
+// conditions on datetimes are on days in the org's timezone, e.g. created_on = 2021-06-01 matches any time that day
+func (b *sqlQueryBuilder) datetimeCondition(expr string, c *contactql.Condition) (string, error) {
+	if c.Value() == "" {
+		return b.unsetCondition(expr, c)
+	}
+
+	date, err := c.ValueAsDate(b.env)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid date: %s", c.Value())
+	}
+
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, b.env.Timezone())
+	end := start.AddDate(0, 0, 1)
+
+	switch c.Operator() {
+	case contactql.OpEqual:
+		return fmt.Sprintf("(%s >= %s AND %s < %s)", expr, b.arg(start), expr, b.arg(end)), nil
+	case contactql.OpNotEqual:
+		return fmt.Sprintf("(%s IS NULL OR %s < %s OR %s >= %s)", expr, expr, b.arg(start), expr, b.arg(end)), nil
+	case contactql.OpGreaterThan:
+		return fmt.Sprintf("%s >= %s", expr, b.arg(end)), nil
+	case contactql.OpGreaterThanOrEqual:
+		return fmt.Sprintf("%s >= %s", expr, b.arg(start)), nil
+	case contactql.OpLessThan:
+		return fmt.Sprintf("%s < %s", expr, b.arg(start)), nil
+	case contactql.OpLessThanOrEqual:
+		return fmt.Sprintf("%s < %s", expr, b.arg(end)), nil
+	}
+
+	return "", errors.Wrapf(ErrUnsupportedDBQuery, "can't search %s with %s", c.PropertyKey(), c.Operator())
+}
+
+func (b *sqlQueryBuilder) unsetCondition(expr string, c *contactql.Condition) (string, error) {
+	switch c.Operator() {
+	case contactql.OpEqual:
+		return fmt.Sprintf("%s IS NULL", expr), nil
+	case contactql.OpNotEqual:
+		return fmt.Sprintf("%s IS NOT NULL", expr), nil
+	}
+	return "", errors.Wrapf(ErrUnsupportedDBQuery, "can't search %s with %s", c.PropertyKey(), c.Operator())
+}
+
+// conditions on URNs are on their paths, optionally only those with the given scheme
+func (b *sqlQueryBuilder) urnCondition(c *contactql.Condition, scheme string) (string, error) {
+	urns := "SELECT 1 FROM contacts_contacturn u WHERE u.contact_id = c.id"
+	if scheme != "" {
+		urns += " AND u.scheme = " + b.arg(scheme)
+	}
+	value := c.Value()
+
+	switch c.Operator() {
+	case contactql.OpEqual:
+		if value == "" {
+			return fmt.Sprintf("NOT EXISTS (%s)", urns), nil
+		}
+		return fmt.Sprintf("EXISTS (%s AND LOWER(u.path) = LOWER(%s))", urns, b.arg(value)), nil
+	case contactql.OpNotEqual:
+		if value == "" {
+			return fmt.Sprintf("EXISTS (%s)", urns), nil
+		}
+		return fmt.Sprintf("NOT EXISTS (%s AND LOWER(u.path) = LOWER(%s))", urns, b.arg(value)), nil
+	case contactql.OpContains:
+		return fmt.Sprintf("EXISTS (%s AND LOWER(u.path) LIKE %s)", urns, b.arg(containsPattern(value))), nil
+	}
+
+	return "", errors.Wrapf(ErrUnsupportedDBQuery, "can't search %s with %s", c.PropertyKey(), c.Operator())
+}
+
+// conditions on groups are on their names
+func (b *sqlQueryBuilder) groupCondition(c *contactql.Condition) (string, error) {
+	var group *Group
+	groups, _ := b.org.Groups()
+	for _, g := range groups {
+		if strings.EqualFold(g.Name(), c.Value()) {
+			group = g.(*Group)
+			break
+		}
+	}
+	if group == nil {
+		return "", errors.Wrapf(ErrUnsupportedDBQuery, "unknown group: %s", c.Value())
+	}
+
+	members := "SELECT gc.contact_id FROM contacts_contactgroup_contacts gc WHERE gc.contactgroup_id = " + b.arg(group.ID())
+
+	switch c.Operator() {
+	case contactql.OpEqual:
+		return fmt.Sprintf("c.id IN (%s)", members), nil
+	case contactql.OpNotEqual:
+		return fmt.Sprintf("c.id NOT IN (%s)", members), nil
+	}
+
+	return "", errors.Wrapf(ErrUnsupportedDBQuery, "can't search %s with %s", c.PropertyKey(), c.Operator())
+}
+
+// the SQL expression for the value of the passed in field, whose UUID is given by the passed in argument or inlined if
+// that is empty, or an empty string for location fields which can't be compared in SQL
+func fieldValueSQL(field *Field, arg string) string {
+	if arg == "" {
+		arg = fmt.Sprintf("'%s'", field.UUID())
+	}
+
+	switch field.Type() {
+	case assets.FieldTypeText:
+		return fmt.Sprintf("(c.fields->%s::text->>'text')", arg)
+	case assets.FieldTypeNumber:
+		return fmt.Sprintf("(c.fields->%s::text->>'number')::numeric", arg)
+	case assets.FieldTypeDatetime:
+		return fmt.Sprintf("(c.fields->%s::text->>'datetime')::timestamptz", arg)
+	}
+	return ""
+}
+
+// a LIKE pattern for values which contain the passed in text
+func containsPattern(text string) string {
+	text = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(text))
+	return "%" + text + "%"
+}
+
+// contactIDsForQueryPageFromDB returns the ids of the contacts for the passed in query page by searching the database
+func contactIDsForQueryPageFromDB(ctx context.Context, db Queryer, org *OrgAssets, group assets.GroupUUID, excludeIDs []ContactID, parsed *contactql.ContactQuery, sort string, offset int, pageSize int) ([]ContactID, int64, error) {
+	start := time.Now()
+
+	where, args, err := BuildSQLQuery(org, group, NilContactStatus, excludeIDs, parsed)
+	if err != nil {
+		return nil, 0, err
+	}
+	orderBy, err := BuildSQLSort(org, sort)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int64
+	if err := db.GetContext(ctx, &total, `SELECT count(*) FROM contacts_contact c WHERE `+where, args...); err != nil {
+		return nil, 0, errors.Wrapf(err, "error counting contacts")
+	}
+
+	ids, err := queryContactIDs(ctx, db, fmt.Sprintf(`SELECT c.id FROM contacts_contact c WHERE %s ORDER BY %s LIMIT %d OFFSET %d`, where, orderBy, pageSize, offset), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":      org.OrgID(),
+		"parsed":      parsed,
+		"group_uuid":  group,
+		"elapsed":     time.Since(start),
+		"page_count":  len(ids),
+		"total_count": total,
+	}).Debug("paged contact query in database complete")
+
+	return ids, total, nil
+}
+
+// contactIDsForQueryFromDB returns the ids of all the active contacts that match the passed in query by searching the
+// database
+func contactIDsForQueryFromDB(ctx context.Context, db Queryer, org *OrgAssets, parsed *contactql.ContactQuery) ([]ContactID, error) {
+	start := time.Now()
+
+	where, args, err := BuildSQLQuery(org, "", ContactStatusActive, nil, parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := queryContactIDs(ctx, db, `SELECT c.id FROM contacts_contact c WHERE `+where+` ORDER BY c.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"org_id":      org.OrgID(),
+		"parsed":      parsed,
+		"elapsed":     time.Since(start),
+		"match_count": len(ids),
+	}).Debug("contact query in database complete")
+
+	return ids, nil
+}
+
+// SearchContactIDsPage returns the ids of the contacts for the passed in query page. The search is done in the database
+// rather than elastic if elastic isn't configured, if the caller needs strong consistency or if the org is small enough,
+// and elastic errors are retried in the database if it can handle the query.
+func SearchContactIDsPage(ctx context.Context, rt *runtime.Runtime, org *OrgAssets, group assets.GroupUUID, excludeIDs []ContactID, query string, sort string, offset int, pageSize int, strong bool) (*contactql.ContactQuery, []ContactID, int64, error) {
+	var parsed *contactql.ContactQuery
+	var err error
+
+	if query != "" {
+		parsed, err = contactql.ParseQuery(org.Env(), query, org.SessionAssets())
+		if err != nil {
+			return nil, nil, 0, errors.Wrapf(err, "error parsing query: %s", query)
+		}
+	}
+
+	inDB, err := searchInDB(ctx, rt, org, strong)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if inDB {
+		ids, total, err := contactIDsForQueryPageFromDB(ctx, searchDB(rt, strong), org, group, excludeIDs, parsed, sort, offset, pageSize)
+		if err == nil || errors.Cause(err) != ErrUnsupportedDBQuery || rt.ES == nil {
+			return parsed, ids, total, err
+		}
+
+		logrus.WithField("org_id", org.OrgID()).WithField("query", query).WithError(err).Debug("query not supported by database, searching elastic")
+	}
+
+	_, ids, total, err := ContactIDsForQueryPage(ctx, rt.ES, org, group, excludeIDs, query, sort, offset, pageSize)
+	if err != nil && !inDB {
+		var dbErr error
+		if ids, total, dbErr = contactIDsForQueryPageFromDB(ctx, rt.ReadonlyDB, org, group, excludeIDs, parsed, sort, offset, pageSize); dbErr == nil {
+			logrus.WithField("org_id", org.OrgID()).WithField("query", query).WithError(err).Warn("error searching elastic, searched database instead")
+			return parsed, ids, total, nil
+		}
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return parsed, ids, total, nil
+}
+
+// SearchContactIDs returns the ids of all the active contacts that match the passed in query, searching the database or
+// elastic in the same way as SearchContactIDsPage
+func SearchContactIDs(ctx context.Context, rt *runtime.Runtime, org *OrgAssets, query string, strong bool) ([]ContactID, error) {
+	parsed, err := contactql.ParseQuery(org.Env(), query, org.SessionAssets())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing query: %s", query)
+	}
+
+	inDB, err := searchInDB(ctx, rt, org, strong)
+	if err != nil {
+		return nil, err
+	}
+
+	if inDB {
+		ids, err := contactIDsForQueryFromDB(ctx, searchDB(rt, strong), org, parsed)
+		if err == nil || errors.Cause(err) != ErrUnsupportedDBQuery || rt.ES == nil {
+			return ids, err
+		}
+
+		logrus.WithField("org_id", org.OrgID()).WithField("query", query).WithError(err).Debug("query not supported by database, searching elastic")
+	}
+
+	ids, err := ContactIDsForQuery(ctx, rt.ES, org, query)
+	if err != nil && !inDB {
+		if ids, dbErr := contactIDsForQueryFromDB(ctx, rt.ReadonlyDB, org, parsed); dbErr == nil {
+			logrus.WithField("org_id", org.OrgID()).WithField("query", query).WithError(err).Warn("error searching elastic, searched database instead")
+			return ids, nil
+		}
+	}
+
+	return ids, err
+}
+
+// whether searches for the passed in org should be done in the database rather than elastic
+func searchInDB(ctx context.Context, rt *runtime.Runtime, org *OrgAssets, strong bool) (bool, error) {
+	if rt.ES == nil || strong {
+		return true, nil
+	}
+
+	maxContacts := rt.Config.DBSearchMaxContacts
+	if maxContacts <= 0 {
+		return false, nil
+	}
+
+	// only count as far as we need to
+	var count int
+	err := rt.ReadonlyDB.GetContext(ctx, &count, `SELECT count(*) FROM (SELECT 1 FROM contacts_contact WHERE org_id = $1 AND is_active = TRUE LIMIT $2) c`, org.OrgID(), maxContacts+1)
+	if err != nil {
+		return false, errors.Wrapf(err, "error counting contacts for org #%d", org.OrgID())
+	}
+
+	return count <= maxContacts, nil
+}
+
+// strongly consistent searches can't use a replica which may be lagging behind
+func searchDB(rt *runtime.Runtime, strong bool) *sqlx.DB {
+	if strong {
+		return rt.DB
+	}
+	return rt.ReadonlyDB
+}
+
+// ScrollContactIDs calls the passed in function with batches of the ids of the contacts in the given group (if any) that
+// match the passed in query (if any), scrolling through elastic results or paging through the database in the same way
+// as SearchContactIDsPage decides where to search
+func ScrollContactIDs(ctx context.Context, rt *runtime.Runtime, org *OrgAssets, group assets.GroupUUID, query string, batchSize int, fn func([]ContactID) error) error {
+	var parsed *contactql.ContactQuery
+	var err error
+
+	if query != "" {
+		parsed, err = contactql.ParseQuery(org.Env(), query, org.SessionAssets())
+		if err != nil {
+			return errors.Wrapf(err, "error parsing query: %s", query)
+		}
+	}
+
+	inDB, err := searchInDB(ctx, rt, org, false)
+	if err != nil {
+		return err
+	}
+
+	if inDB {
+		err := scrollContactIDsFromDB(ctx, rt.ReadonlyDB, org, group, parsed, batchSize, fn)
+		if err == nil || errors.Cause(err) != ErrUnsupportedDBQuery || rt.ES == nil {
+			return err
+		}
+
+		logrus.WithField("org_id", org.OrgID()).WithField("query", query).WithError(err).Debug("query not supported by database, scrolling elastic")
+	}
+
+	// once we've started passing batches to the caller we can't fall back to the database if elastic errors
+	return scrollContactIDsFromElastic(ctx, rt.ES, org, group, parsed, batchSize, fn)
+}
+
+// pages through the ids of the contacts that match the passed in query in the database, calling the passed in function
+// with each batch of them
+func scrollContactIDsFromDB(ctx context.Context, db Queryer, org *OrgAssets, group assets.GroupUUID, parsed *contactql.ContactQuery, batchSize int, fn func([]ContactID) error) error {
+	where, args, err := BuildSQLQuery(org, group, NilContactStatus, nil, parsed)
+	if err != nil {
+		return err
+	}
+
+	sql := fmt.Sprintf(`SELECT c.id FROM contacts_contact c WHERE %s AND c.id > $%d ORDER BY c.id LIMIT %d`, where, len(args)+1, batchSize)
+	lastID := ContactID(0)
+
+	for {
+		ids, err := queryContactIDs(ctx, db, sql, append(args, lastID)...)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		if err := fn(ids); err != nil {
+			return err
+		}
+
+		if len(ids) < batchSize {
+			return nil
+		}
+		lastID = ids[len(ids)-1]
+	}
+}
@@ -0,0 +1,68 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchContactIDsInDB(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer func() { rt.ES = nil }()
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// without elastic all searches are done in the database
+	rt.ES = nil
+
+	db.MustExec(`UPDATE contacts_contact SET fields = $2::jsonb WHERE id = $1`, testdata.Cathy.ID, fmt.Sprintf(`{"%s": {"text": "F"}, "%s": {"text": "30", "number": 30}}`, testdata.GenderField.UUID, testdata.AgeField.UUID))
+	db.MustExec(`UPDATE contacts_contact SET fields = $2::jsonb WHERE id = $1`, testdata.Bob.ID, fmt.Sprintf(`{"%s": {"text": "M"}, "%s": {"text": "40", "number": 40}}`, testdata.GenderField.UUID, testdata.AgeField.UUID))
+	db.MustExec(`UPDATE contacts_contact SET created_on = '2021-06-01T12:00:00Z' WHERE id = $1`, testdata.George.ID)
+	db.MustExec(`DELETE FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, testdata.TestersGroup.ID)
+	testdata.TestersGroup.Add(db, testdata.Alexandria)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFields|models.RefreshGroups)
+	require.NoError(t, err)
+
+	tcs := []struct {
+		query    string
+		expected []models.ContactID
+	}{
+		{`gender = f`, []models.ContactID{testdata.Cathy.ID}},
+		{`age > 35`, []models.ContactID{testdata.Bob.ID}},
+		{`age >= 30 AND gender != "F"`, []models.ContactID{testdata.Bob.ID}},
+		{`gender = M OR age = 30`, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}},
+		{`name ~ "cath"`, []models.ContactID{testdata.Cathy.ID}},
+		{`tel = +16055741111`, []models.ContactID{testdata.Cathy.ID}},
+		{`group = testers`, []models.ContactID{testdata.Alexandria.ID}},
+		{`created_on = 2021-06-01`, []models.ContactID{testdata.George.ID}},
+	}
+
+	for _, tc := range tcs {
+		ids, err := models.SearchContactIDs(ctx, rt, oa, tc.query, false)
+		assert.NoError(t, err, "unexpected error for query: %s", tc.query)
+		assert.Equal(t, tc.expected, ids, "contacts mismatch for query: %s", tc.query)
+	}
+
+	// paged searches are limited to the group and can exclude contacts
+	parsed, ids, total, err := models.SearchContactIDsPage(ctx, rt, oa, testdata.AllContactsGroup.UUID, []models.ContactID{testdata.Cathy.ID}, "gender != \"\"", "-age", 0, 50, true)
+	assert.NoError(t, err)
+	assert.Equal(t, `gender != ""`, parsed.String())
+	assert.Equal(t, []models.ContactID{testdata.Bob.ID}, ids)
+	assert.Equal(t, int64(1), total)
+
+	// queries are still validated
+	_, err = models.SearchContactIDs(ctx, rt, oa, "birthday = tomorrow", false)
+	assert.EqualError(t, err, "error parsing query: birthday = tomorrow: can't resolve 'birthday' to attribute, scheme or field")
+
+	// but not everything can be done in the database
+	_, err = models.BuildSQLSort(oa, "-district")
+	assert.Equal(t, models.ErrUnsupportedDBQuery, errors.Cause(err))
+}
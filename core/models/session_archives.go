@@ -0,0 +1,378 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/null"
+	"github.com/pkg/errors"
+)
+
+// OrgConfigSessionRetentionDays is the org config key which overrides how many days ended sessions are kept for
+const OrgConfigSessionRetentionDays = "session_retention_days"
+
+// SessionRetentionPolicy is how long an org keeps its ended sessions and runs for before they're archived
+type SessionRetentionPolicy struct {
+	OrgID OrgID `db:"org_id"`
+	Days  int   `db:"days"`
+}
+
+const selectSessionRetentionPoliciesSQL = `
+SELECT org_id, days FROM (
+	SELECT
+		id AS org_id,
+		CASE
+			WHEN config::jsonb->>'session_retention_days' ~ '^\d+$' THEN (config::jsonb->>'session_retention_days')::int
+			ELSE $1
+		END AS days
+	FROM
+		orgs_org
+	WHERE
+		is_active = TRUE
+) p
+WHERE
+	days > 0
+ORDER BY
+	org_id
+`
+
+// LoadSessionRetentionPolicies loads the retention policies of all orgs which don't keep sessions forever, where the
+// passed in default applies to orgs which haven't configured their own
+func LoadSessionRetentionPolicies(ctx context.Context, db Queryer, defaultDays int) ([]*SessionRetentionPolicy, error) {
+	rows, err := db.QueryxContext(ctx, selectSessionRetentionPoliciesSQL, defaultDays)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting session retention policies")
+	}
+	defer rows.Close()
+
+	policies := make([]*SessionRetentionPolicy, 0)
+	for rows.Next() {
+		p := &SessionRetentionPolicy{}
+		if err := rows.StructScan(p); err != nil {
+			return nil, errors.Wrapf(err, "error scanning session retention policy")
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+// SessionArchiveManifest describes what was written to a session archive, it is written alongside the archive itself
+type SessionArchiveManifest struct {
+	OrgID        OrgID               `json:"org_id"`
+	Path         string              `json:"path"`
+	CreatedOn    time.Time           `json:"created_on"`
+	EndedBefore  time.Time           `json:"ended_before"`
+	SessionUUIDs []flows.SessionUUID `json:"session_uuids"`
+	RunUUIDs     []flows.RunUUID     `json:"run_uuids"`
+}
+
+// a single line of a session archive, a session and its runs as they were in the db
+type sessionArchiveRecord struct {
+	SessionID   SessionID         `json:"-"       db:"id"`
+	SessionUUID flows.SessionUUID `json:"-"       db:"uuid"`
+	RunIDs      pq.Int64Array     `json:"-"       db:"run_ids"`
+	RunUUIDs    pq.StringArray    `json:"-"       db:"run_uuids"`
+	Session     json.RawMessage   `json:"session" db:"session"`
+	Runs        json.RawMessage   `json:"runs"    db:"runs"`
+}
+
+const selectSessionsToArchiveSQL = `
+SELECT
+	s.id,
+	s.uuid,
+	ARRAY(SELECT r.id FROM flows_flowrun r WHERE r.session_id = s.id ORDER BY r.id) AS run_ids,
+	ARRAY(SELECT r.uuid::text FROM flows_flowrun r WHERE r.session_id = s.id ORDER BY r.id) AS run_uuids,
+	to_jsonb(s) AS session,
+	COALESCE((SELECT jsonb_agg(to_jsonb(r) ORDER BY r.id) FROM flows_flowrun r WHERE r.session_id = s.id), '[]'::jsonb) AS runs
+FROM
+	flows_flowsession s
+WHERE
+	s.org_id = $1 AND
+	s.status != 'W' AND
+	COALESCE(s.ended_on, s.created_on) < $2
+ORDER BY
+	s.id
+LIMIT $3
+`
+
+// ArchiveSessions archives up to limit of the passed in org's sessions which ended before the given time. The sessions
+// and their runs are written as JSONL to session storage along with a manifest, and then deleted from the db leaving
+// behind an index of what was archived where so that they can still be looked up. Returns the manifest of the archive or nil if there was nothing to archive.
+func ArchiveSessions(ctx context.Context, rt *runtime.Runtime, orgID OrgID, endedBefore time.Time, limit int) (*SessionArchiveManifest, error) {
+	rows, err := rt.DB.QueryxContext(ctx, selectSessionsToArchiveSQL, orgID, endedBefore, limit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting sessions to archive")
+	}
+	defer rows.Close()
+
+	records := make([]*sessionArchiveRecord, 0, limit)
+	for rows.Next() {
+		r := &sessionArchiveRecord{}
+		if err := rows.StructScan(r); err != nil {
+			return nil, errors.Wrapf(err, "error scanning session to archive")
+		}
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error selecting sessions to archive")
+	}
+	rows.Close()
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	manifest := &SessionArchiveManifest{
+		OrgID:        orgID,
+		Path:         sessionArchivePath(rt.Config, orgID, now, records[0].SessionID),
+		CreatedOn:    now,
+		EndedBefore:  endedBefore,
+		SessionUUIDs: make([]flows.SessionUUID, 0, len(records)),
+		RunUUIDs:     make([]flows.RunUUID, 0),
+	}
+
+	archive := &bytes.Buffer{}
+	sessionIDs := make([]SessionID, 0, len(records))
+	runIDs := make([]int64, 0)
+
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error marshalling session %s for archive", r.SessionUUID)
+		}
+		archive.Write(line)
+		archive.WriteByte('\n')
+
+		sessionIDs = append(sessionIDs, r.SessionID)
+		runIDs = append(runIDs, r.RunIDs...)
+		manifest.SessionUUIDs = append(manifest.SessionUUIDs, r.SessionUUID)
+		for _, u := range r.RunUUIDs {
+			manifest.RunUUIDs = append(manifest.RunUUIDs, flows.RunUUID(u))
+		}
+	}
+
+	// write the archive and then its manifest, if either fails we haven't deleted anything yet
+	if _, err := rt.SessionStorage.Put(ctx, manifest.Path, "application/x-ndjson", archive.Bytes()); err != nil {
+		return nil, errors.Wrapf(err, "error writing session archive %s", manifest.Path)
+	}
+
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error marshalling session archive manifest")
+	}
+	if _, err := rt.SessionStorage.Put(ctx, manifest.Path+".manifest.json", "application/json", manifestJSON); err != nil {
+		return nil, errors.Wrapf(err, "error writing session archive manifest %s", manifest.Path)
+	}
+
+	if err := deleteArchivedSessions(ctx, rt, manifest, sessionIDs, runIDs); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// returns the path in session storage of a new archive, e.g. /orgs/1/archives/sessions/20060102T150405.123Z_1234.jsonl
+func sessionArchivePath(cfg *runtime.Config, orgID OrgID, now time.Time, firstID SessionID) string {
+	return path.Join(
+		cfg.S3SessionPrefix,
+		"orgs",
+		fmt.Sprintf("%d", orgID),
+		"archives",
+		"sessions",
+		fmt.Sprintf("%s_%d.jsonl", now.UTC().Format(storageTSFormat), firstID),
+	)
+}
+
+// archived sessions are indexed by their UUID and the UUIDs of their runs. The flows_archivedsession table is owned by
+// RapidPro like the rest of the schema, and needs a migration there before this can be deployed.
+const insertArchivedSessionsSQL = `
+INSERT INTO
+	flows_archivedsession(org_id, session_uuid, run_uuids, archive_path, archived_on)
+SELECT
+	s.org_id,
+	s.uuid,
+	ARRAY(SELECT r.uuid FROM flows_flowrun r WHERE r.session_id = s.id ORDER BY r.id),
+	$2,
+	$3
+FROM
+	flows_flowsession s
+WHERE
+	s.id = ANY($1)
+`
+
+// indexes the passed in archived sessions and runs and then deletes them along with anything referencing them
+func deleteArchivedSessions(ctx context.Context, rt *runtime.Runtime, manifest *SessionArchiveManifest, sessionIDs []SessionID, runIDs []int64) error {
+	tx, err := rt.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error starting transaction to delete archived sessions")
+	}
+
+	if err := Exec(ctx, "indexing archived sessions", tx, insertArchivedSessionsSQL, pq.Array(sessionIDs), manifest.Path, manifest.CreatedOn); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error indexing session archive %s", manifest.Path)
+	}
+
+	if len(runIDs) > 0 {
+		if err := Exec(ctx, "deleting archived run paths", tx, `DELETE FROM flows_flowpathrecentrun WHERE run_id = ANY($1)`, pq.Array(runIDs)); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error deleting recent runs of archived runs")
+		}
+		if err := Exec(ctx, "unparenting archived runs", tx, `UPDATE flows_flowrun SET parent_id = NULL WHERE parent_id = ANY($1)`, pq.Array(runIDs)); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error unparenting archived runs")
+		}
+		if err := Exec(ctx, "deleting archived runs", tx, `DELETE FROM flows_flowrun WHERE id = ANY($1)`, pq.Array(runIDs)); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error deleting archived runs")
+		}
+	}
+
+	if err := Exec(ctx, "deleting archived sessions", tx, `DELETE FROM flows_flowsession WHERE id = ANY($1)`, pq.Array(sessionIDs)); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "error deleting archived sessions")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "error committing deletion of archived sessions")
+	}
+	return nil
+}
+
+// finds the record in our session archives which matches, looking in the archive found by the passed in index query,
+// returning nil if it was never archived
+func findArchivedRecord(ctx context.Context, rt *runtime.Runtime, indexSQL string, indexArgs []interface{}, match func(*archivedRecord) bool) (*archivedRecord, error) {
+	var archivePath string
+	err := rt.DB.GetContext(ctx, &archivePath, indexSQL, indexArgs...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up session archive")
+	}
+
+	_, archive, err := rt.SessionStorage.Get(ctx, archivePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading session archive %s", archivePath)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(archive))
+	scanner.Buffer(make([]byte, 64*1024), len(archive)+1)
+	for scanner.Scan() {
+		record := &archivedRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, errors.Wrapf(err, "error reading session archive %s", archivePath)
+		}
+		if match(record) {
+			return record, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error reading session archive %s", archivePath)
+	}
+
+	return nil, nil
+}
+
+// a line of a session archive as read back
+type archivedRecord struct {
+	Session struct {
+		ID            SessionID         `json:"id"`
+		UUID          flows.SessionUUID `json:"uuid"`
+		SessionType   FlowType          `json:"session_type"`
+		Status        SessionStatus     `json:"status"`
+		Responded     bool              `json:"responded"`
+		Output        null.String       `json:"output"`
+		OutputURL     null.String       `json:"output_url"`
+		ContactID     ContactID         `json:"contact_id"`
+		OrgID         OrgID             `json:"org_id"`
+		CreatedOn     time.Time         `json:"created_on"`
+		EndedOn       *time.Time        `json:"ended_on"`
+		CurrentFlowID FlowID            `json:"current_flow_id"`
+		ConnectionID  *ConnectionID     `json:"connection_id"`
+	} `json:"session"`
+	Runs []json.RawMessage `json:"runs"`
+}
+
+const selectSessionArchivePathSQL = `SELECT archive_path FROM flows_archivedsession WHERE org_id = $1 AND session_uuid = $2`
+
+// loads a session from our archives, which won't have any runs or contact loaded
+func loadArchivedSession(ctx context.Context, rt *runtime.Runtime, orgID OrgID, uuid flows.SessionUUID) (*Session, error) {
+	record, err := findArchivedRecord(ctx, rt, selectSessionArchivePathSQL, []interface{}{orgID, uuid}, func(r *archivedRecord) bool { return r.Session.UUID == uuid })
+	if err != nil || record == nil {
+		return nil, err
+	}
+
+	a := &record.Session
+	session := &Session{}
+	session.scene = NewSceneForSession(session)
+
+	s := &session.s
+	s.ID = a.ID
+	s.UUID = a.UUID
+	s.SessionType = a.SessionType
+	s.Status = a.Status
+	s.Responded = a.Responded
+	s.Output = a.Output
+	s.OutputURL = a.OutputURL
+	s.ContactID = a.ContactID
+	s.OrgID = a.OrgID
+	s.CreatedOn = a.CreatedOn
+	s.EndedOn = a.EndedOn
+	s.CurrentFlowID = a.CurrentFlowID
+	s.ConnectionID = a.ConnectionID
+
+	if err := session.loadOutput(ctx, rt); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+const selectRunArchivePathSQL = `SELECT archive_path FROM flows_archivedsession WHERE org_id = $1 AND run_uuids @> ARRAY[$2::uuid]`
+
+// LoadRunRecord loads the db record of the run with the passed in UUID as JSON, reading it from our session archives if
+// it has been archived. Returns nil if there is no such run.
+func LoadRunRecord(ctx context.Context, rt *runtime.Runtime, orgID OrgID, uuid flows.RunUUID) (json.RawMessage, error) {
+	rows, err := rt.DB.QueryxContext(ctx, `SELECT to_jsonb(r) FROM flows_flowrun r WHERE r.org_id = $1 AND r.uuid = $2`, orgID, uuid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting run %s", uuid)
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		var run json.RawMessage
+		if err := rows.Scan(&run); err != nil {
+			return nil, errors.Wrapf(err, "error scanning run %s", uuid)
+		}
+		return run, nil
+	}
+	rows.Close()
+
+	// not in the db, look in our archives
+	runUUID := &struct {
+		UUID flows.RunUUID `json:"uuid"`
+	}{}
+
+	var run json.RawMessage
+	_, err = findArchivedRecord(ctx, rt, selectRunArchivePathSQL, []interface{}{orgID, uuid}, func(r *archivedRecord) bool {
+		for _, rr := range r.Runs {
+			if json.Unmarshal(rr, runUUID) == nil && runUUID.UUID == uuid {
+				run = rr
+				return true
+			}
+		}
+		return false
+	})
+
+	return run, err
+}
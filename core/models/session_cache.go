@@ -0,0 +1,93 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const sessionCacheKey = "session_output:%s"
+
+// results of session cache lookups
+const (
+	sessionCacheHit     = "hit"
+	sessionCacheMiss    = "miss"
+	sessionCacheInvalid = "invalid"
+)
+
+var sessionCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mr_session_cache_lookups",
+	Help: "The number of lookups of active session outputs in the redis cache by result (hit|miss|invalid)",
+}, []string{"result"})
+
+// sessionCacheEnabled returns whether we cache the output of active sessions in redis
+func sessionCacheEnabled(cfg *runtime.Config) bool {
+	return cfg.SessionCacheTTL > 0
+}
+
+// returns the version of the output of this session as it was written, i.e. the URL it was written to in storage or
+// the md5 of what was written to the db. Only a cached output with the same version as the db row can be used.
+func (s *Session) outputVersion() string {
+	if s.s.OutputURL != "" {
+		return string(s.s.OutputURL)
+	}
+	return string(s.s.StoredMD5)
+}
+
+// CacheSessionOutputs writes the outputs of the passed in sessions to our cache if they are waiting and removes them
+// if they are not. Failures are logged but otherwise ignored as the db and storage remain our source of truth.
+func CacheSessionOutputs(rt *runtime.Runtime, sessions []*Session) {
+	if !sessionCacheEnabled(rt.Config) || len(sessions) == 0 {
+		return
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	rc.Send("MULTI")
+	for _, s := range sessions {
+		key := fmt.Sprintf(sessionCacheKey, s.UUID())
+
+		if s.Status() != SessionStatusWaiting || len(s.output) > rt.Config.SessionCacheMaxBytes {
+			rc.Send("DEL", key)
+			continue
+		}
+
+		rc.Send("HSET", key, "version", s.outputVersion(), "md5", s.OutputMD5(), "output", s.output)
+		rc.Send("EXPIRE", key, rt.Config.SessionCacheTTL)
+	}
+	if _, err := rc.Do("EXEC"); err != nil {
+		logrus.WithError(err).WithField("sessions", len(sessions)).Error("error caching session outputs")
+	}
+}
+
+// loads the output of the passed in session from our cache, returning whether it was found and valid
+func loadCachedSessionOutput(rc redis.Conn, s *Session) (bool, error) {
+	values, err := redis.Strings(rc.Do("HMGET", fmt.Sprintf(sessionCacheKey, s.UUID()), "version", "md5", "output"))
+	if err != nil {
+		return false, errors.Wrapf(err, "error reading cached output for session %s", s.UUID())
+	}
+
+	version, md5, output := values[0], values[1], values[2]
+	if version == "" {
+		sessionCacheLookups.WithLabelValues(sessionCacheMiss).Inc()
+		return false, nil
+	}
+
+	s.output = output
+
+	// check that what we have is the output that was last written and that it wasn't mangled on the way
+	if version != s.outputVersion() || md5 != s.OutputMD5() {
+		s.output = ""
+		sessionCacheLookups.WithLabelValues(sessionCacheInvalid).Inc()
+		return false, nil
+	}
+
+	sessionCacheLookups.WithLabelValues(sessionCacheHit).Inc()
+	return true, nil
+}
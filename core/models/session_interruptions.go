@@ -0,0 +1,30 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// SessionInterruption is the audit record of waiting sessions being interrupted in bulk on request of a user
+type SessionInterruption struct {
+	OrgID         OrgID     `db:"org_id"`
+	RequestedByID UserID    `db:"requested_by_id"`
+	Selectors     []byte    `db:"selectors"`
+	Interrupted   int       `db:"interrupted"`
+	StartedOn     time.Time `db:"started_on"`
+	EndedOn       time.Time `db:"ended_on"`
+}
+
+// the flows_sessioninterruption table is owned by RapidPro like the rest of the schema, and needs a migration there
+// before this can be deployed
+const insertSessionInterruptionSQL = `
+INSERT INTO
+	flows_sessioninterruption(org_id, requested_by_id, selectors, interrupted, started_on, ended_on)
+VALUES
+	($1, $2, $3::jsonb, $4, $5, $6)
+`
+
+// InsertSessionInterruption inserts the passed in audit record of a bulk interruption of sessions
+func InsertSessionInterruption(ctx context.Context, db Queryer, i *SessionInterruption) error {
+	return Exec(ctx, "inserting session interruption", db, insertSessionInterruptionSQL, i.OrgID, i.RequestedByID, string(i.Selectors), i.Interrupted, i.StartedOn, i.EndedOn)
+}
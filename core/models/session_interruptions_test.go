@@ -0,0 +1,34 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertSessionInterruption(t *testing.T) {
+	ctx, _, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	err := models.InsertSessionInterruption(ctx, db, &models.SessionInterruption{
+		OrgID:         testdata.Org1.ID,
+		RequestedByID: testdata.Admin.ID,
+		Selectors:     []byte(`{"flow_ids": [10000], "requested_by_id": 3}`),
+		Interrupted:   12,
+		StartedOn:     start,
+		EndedOn:       start.Add(time.Second * 5),
+	})
+	assert.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_sessioninterruption WHERE org_id = $1 AND requested_by_id = $2 AND interrupted = 12`, testdata.Org1.ID, testdata.Admin.ID).Returns(1)
+	testsuite.AssertQuery(t, db, `SELECT selectors->'flow_ids'->>0 FROM flows_sessioninterruption`).Returns("10000")
+	testsuite.AssertQuery(t, db, `SELECT EXTRACT(EPOCH FROM ended_on - started_on)::int FROM flows_sessioninterruption`).Returns(5)
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"context"
 	"crypto/md5"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -22,6 +23,7 @@ import (
 	"github.com/nyaruka/goflow/flows/events"
 	"github.com/nyaruka/mailroom/core/goflow"
 	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/codecs"
 	"github.com/nyaruka/null"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -56,6 +58,7 @@ type Session struct {
 		Responded     bool              `db:"responded"`
 		Output        null.String       `db:"output"`
 		OutputURL     null.String       `db:"output_url"`
+		StoredMD5     null.String       `db:"output_md5"`
 		ContactID     ContactID         `db:"contact_id"`
 		OrgID         OrgID             `db:"org_id"`
 		CreatedOn     time.Time         `db:"created_on"`
@@ -64,8 +67,12 @@ type Session struct {
 		WaitStartedOn *time.Time        `db:"wait_started_on"`
 		CurrentFlowID FlowID            `db:"current_flow_id"`
 		ConnectionID  *ConnectionID     `db:"connection_id"`
+		FlowRevisions null.String       `db:"flow_revisions"`
 	}
 
+	// our output as JSON, s.Output is our output as written which may be encoded
+	output string
+
 	incomingMsgID      MsgID
 	incomingExternalID null.String
 
@@ -80,6 +87,9 @@ type Session struct {
 
 	seenRuns map[flows.RunUUID]time.Time
 
+	// runs created or updated by our last write, whose analytics are recorded once it is committed
+	changedRuns []*FlowRun
+
 	// we keep around a reference to the sprint associated with this session
 	sprint flows.Sprint
 
@@ -97,7 +107,7 @@ func (s *Session) UUID() flows.SessionUUID            { return flows.SessionUUID
 func (s *Session) SessionType() FlowType              { return s.s.SessionType }
 func (s *Session) Status() SessionStatus              { return s.s.Status }
 func (s *Session) Responded() bool                    { return s.s.Responded }
-func (s *Session) Output() string                     { return string(s.s.Output) }
+func (s *Session) Output() string                     { return s.output }
 func (s *Session) OutputURL() string                  { return string(s.s.OutputURL) }
 func (s *Session) ContactID() ContactID               { return s.s.ContactID }
 func (s *Session) OrgID() OrgID                       { return s.s.OrgID }
@@ -121,8 +131,8 @@ func WriteSessionOutputsToStorage(ctx context.Context, rt *runtime.Runtime, sess
 	for i, s := range sessions {
 		uploads[i] = &storage.Upload{
 			Path:        s.StoragePath(rt.Config),
-			Body:        []byte(s.Output()),
-			ContentType: "application/json",
+			Body:        []byte(s.s.Output),
+			ContentType: outputContentType(s.s.Output),
 			ACL:         s3.ObjectCannedACLPrivate,
 		}
 	}
@@ -196,7 +206,42 @@ func (s *Session) Timeout() *time.Duration {
 
 // OutputMD5 returns the md5 of the passed in session
 func (s *Session) OutputMD5() string {
-	return fmt.Sprintf("%x", md5.Sum([]byte(s.s.Output)))
+	return fmt.Sprintf("%x", md5.Sum([]byte(s.output)))
+}
+
+// sets our output to the passed in JSON, it isn't encoded until we write it
+func (s *Session) setOutput(output []byte) {
+	s.output = string(output)
+	s.s.Output = null.String(output)
+}
+
+// encodes our output with the passed in codec ready to be written to the db or storage
+func (s *Session) encodeOutput(codec codecs.Codec) error {
+	encoded, err := codecs.Encode(codec, []byte(s.output))
+	if err != nil {
+		return errors.Wrapf(err, "error encoding output for session %s", s.UUID())
+	}
+	s.s.Output = null.String(encoded)
+	s.s.StoredMD5 = null.String(fmt.Sprintf("%x", md5.Sum(encoded)))
+	return nil
+}
+
+// decodes our output as read from the db or storage, which may have been written with any codec
+func (s *Session) decodeOutput() error {
+	output, err := codecs.Decode([]byte(s.s.Output))
+	if err != nil {
+		return errors.Wrapf(err, "error decoding output for session %s", s.UUID())
+	}
+	s.output = string(output)
+	return nil
+}
+
+// returns the content type to use when writing the passed in output to storage
+func outputContentType(output null.String) string {
+	if codecs.Detect([]byte(output)) != codecs.None {
+		return "text/plain"
+	}
+	return "application/json"
 }
 
 // SetIncomingMsg set the incoming message that this session should be associated with in this sprint
@@ -228,7 +273,10 @@ func (s *Session) MarshalJSON() ([]byte, error) {
 
 // UnmarshalJSON is our custom marshaller so that our inner struct get output
 func (s *Session) UnmarshalJSON(b []byte) error {
-	return json.Unmarshal(b, &s.s)
+	if err := json.Unmarshal(b, &s.s); err != nil {
+		return err
+	}
+	return s.decodeOutput()
 }
 
 // NewSession a session objects from the passed in flow session. It does NOT
@@ -268,7 +316,7 @@ func NewSession(ctx context.Context, tx *sqlx.Tx, org *OrgAssets, fs flows.Sessi
 	s.Status = sessionStatus
 	s.SessionType = sessionType
 	s.Responded = false
-	s.Output = null.String(output)
+	session.setOutput(output)
 	s.ContactID = ContactID(fs.Contact().ID())
 	s.OrgID = org.OrgID()
 	s.CreatedOn = fs.Runs()[0].CreatedOn()
@@ -289,6 +337,7 @@ func NewSession(ctx context.Context, tx *sqlx.Tx, org *OrgAssets, fs flows.Sessi
 
 		// save the run to our session
 		session.runs = append(session.runs, run)
+		session.addFlowRevision(run)
 
 		// if this run is waiting, save it as the current flow
 		if r.Status() == flows.RunStatusWaiting {
@@ -307,8 +356,14 @@ func NewSession(ctx context.Context, tx *sqlx.Tx, org *OrgAssets, fs flows.Sessi
 }
 
 // ActiveSessionForContact returns the active session for the passed in contact, if any
-func ActiveSessionForContact(ctx context.Context, db *sqlx.DB, st storage.Storage, org *OrgAssets, sessionType FlowType, contact *flows.Contact) (*Session, error) {
-	rows, err := db.QueryxContext(ctx, selectLastSessionSQL, sessionType, contact.ID())
+func ActiveSessionForContact(ctx context.Context, rt *runtime.Runtime, org *OrgAssets, sessionType FlowType, contact *flows.Contact) (*Session, error) {
+	// if we're caching outputs we only need the stored md5 of the output to know if our cached output is current
+	selectSQL := selectLastSessionSQL
+	if sessionCacheEnabled(rt.Config) {
+		selectSQL = selectLastSessionSQLNoOutput
+	}
+
+	rows, err := rt.DB.QueryxContext(ctx, selectSQL, sessionType, contact.ID())
 	if err != nil {
 		return nil, errors.Wrapf(err, "error selecting active session")
 	}
@@ -328,29 +383,109 @@ func ActiveSessionForContact(ctx context.Context, db *sqlx.DB, st storage.Storag
 	if err := rows.StructScan(&session.s); err != nil {
 		return nil, errors.Wrapf(err, "error scanning session")
 	}
+	rows.Close()
+
+	if sessionCacheEnabled(rt.Config) {
+		rc := rt.RP.Get()
+		found, err := loadCachedSessionOutput(rc, session)
+		rc.Close()
+
+		if err != nil {
+			logrus.WithError(err).WithField("session_uuid", session.UUID()).Error("error reading session output from cache")
+		}
+		if found {
+			return session, nil
+		}
+
+		// not cached, so read the output from the db if that's where it lives
+		if session.OutputURL() == "" {
+			err := rt.DB.GetContext(ctx, &session.s.Output, `SELECT output FROM flows_flowsession WHERE id = $1`, session.ID())
+			if err != nil {
+				return nil, errors.Wrapf(err, "error selecting output for session %s", session.UUID())
+			}
+		}
+	}
+
+	if err := session.loadOutput(ctx, rt); err != nil {
+		return nil, err
+	}
 
-	// load our output from storage if necessary
-	if session.OutputURL() != "" {
+	// populate our cache so the next read of this session doesn't need to go to the db or storage
+	CacheSessionOutputs(rt, []*Session{session})
+
+	return session, nil
+}
+
+// loads our output from storage if it was written there, and decodes it
+func (s *Session) loadOutput(ctx context.Context, rt *runtime.Runtime) error {
+	if s.OutputURL() != "" {
 		// strip just the path out of our output URL
-		u, err := url.Parse(session.OutputURL())
+		u, err := url.Parse(s.OutputURL())
 		if err != nil {
-			return nil, errors.Wrapf(err, "error parsing output URL: %s", session.OutputURL())
+			return errors.Wrapf(err, "error parsing output URL: %s", s.OutputURL())
 		}
 
 		start := time.Now()
 
-		_, output, err := st.Get(ctx, u.Path)
+		_, output, err := rt.SessionStorage.Get(ctx, u.Path)
 		if err != nil {
-			return nil, errors.Wrapf(err, "error reading session from storage: %s", session.OutputURL())
+			return errors.Wrapf(err, "error reading session from storage: %s", s.OutputURL())
 		}
 
-		logrus.WithField("elapsed", time.Since(start)).WithField("output_url", session.OutputURL()).Debug("loaded session from storage")
-		session.s.Output = null.String(output)
+		logrus.WithField("elapsed", time.Since(start)).WithField("output_url", s.OutputURL()).Debug("loaded session from storage")
+		s.s.Output = null.String(output)
+	}
+
+	return s.decodeOutput()
+}
+
+// LoadSessionByUUID loads the session with the passed in UUID regardless of its status, including its output. If the
+// session has been archived it is read from our archives.
+func LoadSessionByUUID(ctx context.Context, rt *runtime.Runtime, orgID OrgID, uuid flows.SessionUUID) (*Session, error) {
+	session := &Session{}
+	session.scene = NewSceneForSession(session)
+
+	err := rt.DB.GetContext(ctx, &session.s, selectSessionByUUIDSQL, orgID, uuid)
+	if err == sql.ErrNoRows {
+		return loadArchivedSession(ctx, rt, orgID, uuid)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting session %s", uuid)
+	}
+
+	if err := session.loadOutput(ctx, rt); err != nil {
+		return nil, err
 	}
 
 	return session, nil
 }
 
+const selectSessionByUUIDSQL = `
+SELECT 
+	id,
+	uuid,
+	session_type,
+	status,
+	responded,
+	output,
+	output_url,
+	output_md5,
+	contact_id,
+	org_id,
+	created_on,
+	ended_on,
+	timeout_on,
+	wait_started_on,
+	current_flow_id,
+	connection_id,
+	` + selectSessionFlowRevisionsSQL + `
+FROM 
+	flows_flowsession fs
+WHERE
+	org_id = $1 AND
+	uuid = $2
+`
+
 const selectLastSessionSQL = `
 SELECT 
 	id,
@@ -360,6 +495,7 @@ SELECT
 	responded,
 	output,
 	output_url,
+	output_md5,
 	contact_id,
 	org_id,
 	created_on,
@@ -367,7 +503,38 @@ SELECT
 	timeout_on,
 	wait_started_on,
 	current_flow_id,
-	connection_id
+	connection_id,
+	` + selectSessionFlowRevisionsSQL + `
+FROM 
+	flows_flowsession fs
+WHERE
+    session_type = $1 AND
+	contact_id = $2 AND
+	status = 'W'
+ORDER BY
+	created_on DESC
+LIMIT 1
+`
+
+const selectLastSessionSQLNoOutput = `
+SELECT 
+	id,
+	uuid,
+	session_type,
+	status,
+	responded,
+	NULL AS output,
+	output_url,
+	output_md5,
+	contact_id,
+	org_id,
+	created_on,
+	ended_on,
+	timeout_on,
+	wait_started_on,
+	current_flow_id,
+	connection_id,
+	` + selectSessionFlowRevisionsSQL + `
 FROM 
 	flows_flowsession fs
 WHERE
@@ -381,15 +548,15 @@ LIMIT 1
 
 const insertCompleteSessionSQL = `
 INSERT INTO
-	flows_flowsession( uuid, session_type, status, responded, output, output_url, contact_id, org_id, created_on, ended_on, wait_started_on, connection_id)
-               VALUES(:uuid,:session_type,:status,:responded,:output,:output_url,:contact_id,:org_id, NOW(),      NOW(),    NULL,           :connection_id)
+	flows_flowsession( uuid, session_type, status, responded, output, output_url, output_md5, contact_id, org_id, created_on, ended_on, wait_started_on, connection_id)
+               VALUES(:uuid,:session_type,:status,:responded,:output,:output_url,:output_md5,:contact_id,:org_id, NOW(),      NOW(),    NULL,           :connection_id)
 RETURNING id
 `
 
 const insertIncompleteSessionSQL = `
 INSERT INTO
-	flows_flowsession( uuid, session_type, status, responded, output, output_url, contact_id, org_id, created_on, current_flow_id, timeout_on, wait_started_on, connection_id)
-               VALUES(:uuid,:session_type,:status,:responded,:output,:output_url,:contact_id,:org_id, NOW(),     :current_flow_id,:timeout_on,:wait_started_on,:connection_id)
+	flows_flowsession( uuid, session_type, status, responded, output, output_url, output_md5, contact_id, org_id, created_on, current_flow_id, timeout_on, wait_started_on, connection_id)
+               VALUES(:uuid,:session_type,:status,:responded,:output,:output_url,:output_md5,:contact_id,:org_id, NOW(),     :current_flow_id,:timeout_on,:wait_started_on,:connection_id)
 RETURNING id
 `
 
@@ -409,7 +576,7 @@ RETURNING id
 
 // FlowSession creates a flow session for the passed in session object. It also populates the runs we know about
 func (s *Session) FlowSession(cfg *runtime.Config, sa flows.SessionAssets, env envs.Environment) (flows.Session, error) {
-	output := string(s.s.Output)
+	output := s.output
 	session, err := goflow.Engine(cfg).ReadSession(sa, json.RawMessage(output), assets.IgnoreMissing)
 	if err != nil {
 		if repaired, changed, repairErr := sanitizeSessionOutput(output); repairErr == nil && changed {
@@ -523,7 +690,7 @@ func (s *Session) WriteUpdatedSession(ctx context.Context, rt *runtime.Runtime,
 	if err != nil {
 		return errors.Wrapf(err, "error marshalling flow session")
 	}
-	s.s.Output = null.String(output)
+	s.setOutput(output)
 
 	// map our status over
 	status, found := sessionStatusMap[fs.Status()]
@@ -541,6 +708,7 @@ func (s *Session) WriteUpdatedSession(ctx context.Context, rt *runtime.Runtime,
 
 		// set the run on our session
 		s.runs = append(s.runs, run)
+		s.addFlowRevision(run)
 	}
 
 	// calculate our new timeout
@@ -585,6 +753,10 @@ func (s *Session) WriteUpdatedSession(ctx context.Context, rt *runtime.Runtime,
 	// the SQL statement we'll use to update this session
 	updateSQL := updateSessionSQL
 
+	if err := s.encodeOutput(codecs.Codec(rt.Config.SessionCodec)); err != nil {
+		return err
+	}
+
 	// if writing to S3, do so
 	if rt.Config.SessionStorage == "s3" {
 		err := WriteSessionOutputsToStorage(ctx, rt, []*Session{s})
@@ -602,6 +774,8 @@ func (s *Session) WriteUpdatedSession(ctx context.Context, rt *runtime.Runtime,
 		return errors.Wrapf(err, "error updating session")
 	}
 
+	CacheSessionOutputs(rt, []*Session{s})
+
 	// if this session is complete, so is any associated connection
 	if s.channelConnection != nil {
 		if s.Status() == SessionStatusCompleted || s.Status() == SessionStatusFailed {
@@ -615,15 +789,18 @@ func (s *Session) WriteUpdatedSession(ctx context.Context, rt *runtime.Runtime,
 	// figure out which runs are new and which are updated
 	updatedRuns := make([]interface{}, 0, 1)
 	newRuns := make([]interface{}, 0)
+	changedRuns := make([]*FlowRun, 0, len(s.Runs()))
 	for _, r := range s.Runs() {
 		modified, found := s.seenRuns[r.UUID()]
 		if !found {
 			newRuns = append(newRuns, &r.r)
+			changedRuns = append(changedRuns, r)
 			continue
 		}
 
 		if r.ModifiedOn().After(modified) {
 			updatedRuns = append(updatedRuns, &r.r)
+			changedRuns = append(changedRuns, r)
 			continue
 		}
 	}
@@ -653,6 +830,8 @@ func (s *Session) WriteUpdatedSession(ctx context.Context, rt *runtime.Runtime,
 		return errors.Wrapf(err, "error saving flow statistics")
 	}
 
+	s.changedRuns = changedRuns
+
 	// apply all our events
 	if s.Status() != SessionStatusFailed {
 		err = HandleEvents(ctx, rt, tx, org, s.scene, sprint.Events())
@@ -676,6 +855,7 @@ UPDATE
 SET 
 	output = :output, 
 	output_url = :output_url,
+	output_md5 = :output_md5,
 	status = :status, 
 	ended_on = CASE WHEN :status = 'W' THEN NULL ELSE NOW() END,
 	responded = :responded,
@@ -775,6 +955,13 @@ func WriteSessions(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, org *O
 	insertCompleteSQL := insertCompleteSessionSQL
 	insertIncompleteSQL := insertIncompleteSessionSQL
 
+	codec := codecs.Codec(rt.Config.SessionCodec)
+	for _, s := range sessions {
+		if err := s.encodeOutput(codec); err != nil {
+			return nil, err
+		}
+	}
+
 	// if writing our sessions to S3, do so
 	if rt.Config.SessionStorage == "s3" {
 		err := WriteSessionOutputsToStorage(ctx, rt, sessions)
@@ -805,9 +992,12 @@ func WriteSessions(ctx context.Context, rt *runtime.Runtime, tx *sqlx.Tx, org *O
 		return nil, errors.Wrapf(err, "error inserting incomplete sessions")
 	}
 
+	CacheSessionOutputs(rt, sessions)
+
 	// for each session associate our run with each
 	runs := make([]interface{}, 0, len(sessions))
 	for _, s := range sessions {
+		s.changedRuns = s.runs
 		for _, r := range s.runs {
 			runs = append(runs, &r.r)
 
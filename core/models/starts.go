@@ -118,8 +118,9 @@ type FlowStartBatch struct {
 		RestartParticipants RestartParticipants `json:"restart_participants"`
 		IncludeActive       IncludeActive       `json:"include_active"`
 
-		IsLast        bool `json:"is_last,omitempty"`
-		TotalContacts int  `json:"total_contacts"`
+		IsLast        bool   `json:"is_last,omitempty"`
+		TotalContacts int    `json:"total_contacts"`
+		Variant       string `json:"variant,omitempty"`
 
 		CreatedBy string `json:"created_by"` // deprecated
 	}
@@ -135,6 +136,7 @@ func (b *FlowStartBatch) RestartParticipants() RestartParticipants { return b.b.
 func (b *FlowStartBatch) IncludeActive() IncludeActive             { return b.b.IncludeActive }
 func (b *FlowStartBatch) IsLast() bool                             { return b.b.IsLast }
 func (b *FlowStartBatch) TotalContacts() int                       { return b.b.TotalContacts }
+func (b *FlowStartBatch) Variant() string                          { return b.b.Variant }
 
 func (b *FlowStartBatch) ParentSummary() json.RawMessage  { return json.RawMessage(b.b.ParentSummary) }
 func (b *FlowStartBatch) SessionHistory() json.RawMessage { return json.RawMessage(b.b.SessionHistory) }
@@ -143,6 +145,12 @@ func (b *FlowStartBatch) Extra() json.RawMessage          { return json.RawMessa
 func (b *FlowStartBatch) MarshalJSON() ([]byte, error)    { return json.Marshal(b.b) }
 func (b *FlowStartBatch) UnmarshalJSON(data []byte) error { return json.Unmarshal(data, &b.b) }
 
+// FlowStartVariant is a variant of an A/B split flow start, its cohort of contacts is started in its flow
+type FlowStartVariant struct {
+	ABVariant
+	FlowID FlowID `json:"flow_id" validate:"required"`
+}
+
 // FlowStart represents the top level flow start in our system
 type FlowStart struct {
 	s struct {
@@ -167,6 +175,8 @@ type FlowStart struct {
 		Extra          null.JSON `json:"extra,omitempty"           db:"extra"`
 		ParentSummary  null.JSON `json:"parent_summary,omitempty"  db:"parent_summary"`
 		SessionHistory null.JSON `json:"session_history,omitempty" db:"session_history"`
+
+		Variants []*FlowStartVariant `json:"variants,omitempty"`
 	}
 }
 
@@ -232,6 +242,21 @@ func (s *FlowStart) WithExtra(extra json.RawMessage) *FlowStart {
 	return s
 }
 
+func (s *FlowStart) Variants() []*FlowStartVariant { return s.s.Variants }
+func (s *FlowStart) WithVariants(variants []*FlowStartVariant) *FlowStart {
+	s.s.Variants = variants
+	return s
+}
+
+// ABVariants returns the names and weights of our variants
+func (s *FlowStart) ABVariants() []ABVariant {
+	variants := make([]ABVariant, len(s.s.Variants))
+	for i, v := range s.s.Variants {
+		variants[i] = v.ABVariant
+	}
+	return variants
+}
+
 func (s *FlowStart) MarshalJSON() ([]byte, error)    { return json.Marshal(s.s) }
 func (s *FlowStart) UnmarshalJSON(data []byte) error { return json.Unmarshal(data, &s.s) }
 
@@ -364,6 +389,14 @@ func (s *FlowStart) CreateBatch(contactIDs []ContactID, last bool, totalContacts
 	return b
 }
 
+// CreateVariantBatch creates a batch for this start which starts the passed in contact ids in the flow of the given variant
+func (s *FlowStart) CreateVariantBatch(contactIDs []ContactID, last bool, totalContacts int, variant *FlowStartVariant) *FlowStartBatch {
+	b := s.CreateBatch(contactIDs, last, totalContacts)
+	b.b.FlowID = variant.FlowID
+	b.b.Variant = variant.Name
+	return b
+}
+
 // MarshalJSON marshals into JSON. 0 values will become null
 func (i StartID) MarshalJSON() ([]byte, error) {
 	return null.Int(i).MarshalJSON()
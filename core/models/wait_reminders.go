@@ -0,0 +1,397 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/lib/pq"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// WaitReminder is a reminder sent to a contact who hasn't responded to a wait after the given number of seconds. They
+// are configured on the wait of a node in the flow definition, e.g.
+//
+//   "wait": {
+//     "type": "msg",
+//     "timeout": {"seconds": 172800, "category_uuid": "..."},
+//     "reminders": [
+//       {"after_seconds": 3600, "text": "Are you still there?", "translations": {"spa": "¿Sigues ahí?"}},
+//       {"after_seconds": 86400, "text": "Last chance to reply!"}
+//     ]
+//   }
+//
+type WaitReminder struct {
+	AfterSeconds int                      `json:"after_seconds"`
+	Text         string                   `json:"text"`
+	Translations map[envs.Language]string `json:"translations,omitempty"`
+}
+
+// reminders that are due are kept in a sorted set of session ids scored by when they are due, with the state of each
+// session's reminders in a hash
+const (
+	waitRemindersKey     = "wait_reminders"
+	waitReminderStateKey = "wait_reminder:%d"
+	waitReminderStatsKey = "wait_reminder_stats:%d"
+)
+
+// how long we keep the state of a session's reminders after its last reminder is due, so that responses can be tracked
+const waitReminderStateTTL = 60 * 60 * 24 * 7 // 1 week
+
+// how long we keep the reminder stats of a flow after a reminder of it was last sent or responded to
+const waitReminderStatsTTL = 60 * 60 * 24 * 90 // 90 days
+
+var waitRemindersSent = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "mr_wait_reminders_sent",
+	Help: "The number of reminders sent to contacts who haven't responded to a wait",
+})
+
+// WaitReminders returns the reminders configured on the wait of the given node of this flow, ordered by when they are
+// due. Reminders without text are ignored.
+func (f *Flow) WaitReminders(nodeUUID flows.NodeUUID) []*WaitReminder {
+	// most flows won't have reminders so avoid parsing their definitions
+	if !bytes.Contains(f.Definition(), []byte(`"reminders"`)) {
+		return nil
+	}
+
+	definition := &struct {
+		Nodes []struct {
+			UUID   flows.NodeUUID `json:"uuid"`
+			Router *struct {
+				Wait *struct {
+					Reminders []*WaitReminder `json:"reminders"`
+				} `json:"wait"`
+			} `json:"router"`
+		} `json:"nodes"`
+	}{}
+	if err := json.Unmarshal(f.Definition(), definition); err != nil {
+		return nil
+	}
+
+	for _, node := range definition.Nodes {
+		if node.UUID != nodeUUID || node.Router == nil || node.Router.Wait == nil {
+			continue
+		}
+
+		reminders := make([]*WaitReminder, 0, len(node.Router.Wait.Reminders))
+		for _, r := range node.Router.Wait.Reminders {
+			if r != nil && r.AfterSeconds > 0 && r.Text != "" {
+				reminders = append(reminders, r)
+			}
+		}
+		sort.SliceStable(reminders, func(i, j int) bool { return reminders[i].AfterSeconds < reminders[j].AfterSeconds })
+		return reminders
+	}
+	return nil
+}
+
+// BaseLanguage returns the language of the passed in flow definition
+func (f *Flow) BaseLanguage() envs.Language {
+	definition := &struct {
+		Language envs.Language `json:"language"`
+	}{}
+	json.Unmarshal(f.Definition(), definition)
+	return definition.Language
+}
+
+// WaitReminderState is the state of the reminders of a session waiting at a node
+type WaitReminderState struct {
+	SessionID     SessionID
+	OrgID         OrgID
+	ContactID     ContactID
+	FlowID        FlowID
+	NodeUUID      flows.NodeUUID
+	WaitStartedOn time.Time
+
+	// the number of reminders sent so far, which is also the index of the next reminder
+	Sent int
+}
+
+// ScheduleWaitReminders schedules the reminders of the passed in sessions if they are waiting at nodes with reminders,
+// replacing any reminders of their previous waits. Failures are logged but otherwise ignored.
+func ScheduleWaitReminders(rt *runtime.Runtime, oa *OrgAssets, sessions []*Session) {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	now := time.Now()
+
+	for _, s := range sessions {
+		if s.ID() == NilSessionID {
+			continue
+		}
+
+		var state *WaitReminderState
+		var reminders []*WaitReminder
+
+		if s.Status() == SessionStatusWaiting && s.SessionType() == FlowTypeMessaging {
+			state, reminders = waitingReminders(oa, s)
+		}
+
+		if len(reminders) == 0 {
+			sendClearWaitReminders(rc, s.ID())
+			continue
+		}
+
+		if s.WaitStartedOn() != nil {
+			state.WaitStartedOn = *s.WaitStartedOn()
+		} else {
+			state.WaitStartedOn = now
+		}
+		sendSetWaitReminders(rc, state, reminders)
+	}
+
+	// commands are pipelined so we only wait for them all at once
+	if _, err := rc.Do(""); err != nil {
+		logrus.WithError(err).Error("error scheduling wait reminders")
+	}
+}
+
+// gets the state and reminders of the wait of the waiting run of the passed in session
+func waitingReminders(oa *OrgAssets, s *Session) (*WaitReminderState, []*WaitReminder) {
+	for _, r := range s.Runs() {
+		if r.r.Status != RunStatusWaiting || r.r.CurrentNodeUUID == "" {
+			continue
+		}
+
+		flow, err := oa.FlowByID(r.r.FlowID)
+		if err != nil {
+			return nil, nil
+		}
+
+		nodeUUID := flows.NodeUUID(r.r.CurrentNodeUUID)
+		reminders := flow.WaitReminders(nodeUUID)
+		if len(reminders) == 0 {
+			return nil, nil
+		}
+
+		return &WaitReminderState{SessionID: s.ID(), OrgID: s.OrgID(), ContactID: s.ContactID(), FlowID: flow.ID(), NodeUUID: nodeUUID}, reminders
+	}
+	return nil, nil
+}
+
+func sendSetWaitReminders(rc redis.Conn, state *WaitReminderState, reminders []*WaitReminder) {
+	key := fmt.Sprintf(waitReminderStateKey, state.SessionID)
+	lastDue := state.WaitStartedOn.Add(time.Duration(reminders[len(reminders)-1].AfterSeconds) * time.Second)
+	ttl := int(time.Until(lastDue)/time.Second) + waitReminderStateTTL
+
+	rc.Send("DEL", key)
+	rc.Send("HSET", key,
+		"org_id", state.OrgID,
+		"contact_id", state.ContactID,
+		"flow_id", state.FlowID,
+		"node_uuid", state.NodeUUID,
+		"wait_started_on", state.WaitStartedOn.Unix(),
+		"sent", state.Sent,
+	)
+	rc.Send("EXPIRE", key, ttl)
+	sendScheduleNextReminder(rc, state, reminders)
+}
+
+func sendScheduleNextReminder(rc redis.Conn, state *WaitReminderState, reminders []*WaitReminder) {
+	if state.Sent < len(reminders) {
+		due := state.WaitStartedOn.Add(time.Duration(reminders[state.Sent].AfterSeconds) * time.Second)
+		rc.Send("ZADD", waitRemindersKey, due.Unix(), state.SessionID)
+	} else {
+		rc.Send("ZREM", waitRemindersKey, state.SessionID)
+	}
+}
+
+func sendClearWaitReminders(rc redis.Conn, sessionID SessionID) {
+	rc.Send("DEL", fmt.Sprintf(waitReminderStateKey, sessionID))
+	rc.Send("ZREM", waitRemindersKey, sessionID)
+}
+
+// ClearWaitReminders removes the reminders of the given session
+func ClearWaitReminders(rc redis.Conn, sessionID SessionID) error {
+	sendClearWaitReminders(rc, sessionID)
+	_, err := rc.Do("")
+	return err
+}
+
+// LoadWaitReminderState loads the state of the reminders of the given session, returning nil if it has none
+func LoadWaitReminderState(rc redis.Conn, sessionID SessionID) (*WaitReminderState, error) {
+	values, err := redis.StringMap(rc.Do("HGETALL", fmt.Sprintf(waitReminderStateKey, sessionID)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading wait reminders of session %d", sessionID)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	atoi := func(s string) int { i, _ := strconv.Atoi(s); return i }
+
+	return &WaitReminderState{
+		SessionID:     sessionID,
+		OrgID:         OrgID(atoi(values["org_id"])),
+		ContactID:     ContactID(atoi(values["contact_id"])),
+		FlowID:        FlowID(atoi(values["flow_id"])),
+		NodeUUID:      flows.NodeUUID(values["node_uuid"]),
+		WaitStartedOn: time.Unix(int64(atoi(values["wait_started_on"])), 0),
+		Sent:          atoi(values["sent"]),
+	}, nil
+}
+
+// DueWaitReminders gets the states of up to limit sessions with reminders which are due
+func DueWaitReminders(rc redis.Conn, now time.Time, limit int) ([]*WaitReminderState, error) {
+	ids, err := redis.Ints(rc.Do("ZRANGEBYSCORE", waitRemindersKey, "-inf", now.Unix(), "LIMIT", 0, limit))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting due wait reminders")
+	}
+
+	states := make([]*WaitReminderState, 0, len(ids))
+	for _, id := range ids {
+		state, err := LoadWaitReminderState(rc, SessionID(id))
+		if err != nil {
+			return nil, err
+		}
+
+		// state has expired, nothing to remind
+		if state == nil {
+			if _, err := rc.Do("ZREM", waitRemindersKey, id); err != nil {
+				return nil, errors.Wrapf(err, "error removing expired wait reminder")
+			}
+			continue
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// MarkWaitReminderSent records that the next reminder of the passed in session has been sent, scheduling the one after
+// that if there is one
+func MarkWaitReminderSent(rc redis.Conn, state *WaitReminderState, reminders []*WaitReminder) error {
+	state.Sent++
+
+	statsKey := fmt.Sprintf(waitReminderStatsKey, state.FlowID)
+	rc.Send("HINCRBY", statsKey, fmt.Sprintf("%s:%d:sent", state.NodeUUID, state.Sent-1), 1)
+	rc.Send("EXPIRE", statsKey, waitReminderStatsTTL)
+	rc.Send("HSET", fmt.Sprintf(waitReminderStateKey, state.SessionID), "sent", state.Sent)
+	sendScheduleNextReminder(rc, state, reminders)
+	_, err := rc.Do("")
+	if err != nil {
+		return errors.Wrapf(err, "error marking wait reminder of session %d as sent", state.SessionID)
+	}
+
+	waitRemindersSent.Inc()
+	return nil
+}
+
+// RecordWaitReminderResponse records that the contact of the passed in session responded, crediting the last reminder
+// sent to them for their current wait if any
+func RecordWaitReminderResponse(rt *runtime.Runtime, sessionID SessionID) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	state, err := LoadWaitReminderState(rc, sessionID)
+	if err != nil || state == nil || state.Sent == 0 {
+		return err
+	}
+
+	statsKey := fmt.Sprintf(waitReminderStatsKey, state.FlowID)
+	rc.Send("HINCRBY", statsKey, fmt.Sprintf("%s:%d:responded", state.NodeUUID, state.Sent-1), 1)
+	rc.Send("EXPIRE", statsKey, waitReminderStatsTTL)
+	_, err = rc.Do("")
+	return err
+}
+
+// WaitReminderStats are how many times a reminder of a wait was sent and how many contacts responded after it
+type WaitReminderStats struct {
+	NodeUUID  flows.NodeUUID `json:"node_uuid"`
+	Reminder  int            `json:"reminder"`
+	Sent      int            `json:"sent"`
+	Responded int            `json:"responded"`
+}
+
+// GetWaitReminderStats gets the stats of the reminders of the given flow, ordered by node and reminder
+func GetWaitReminderStats(rc redis.Conn, flowID FlowID) ([]*WaitReminderStats, error) {
+	values, err := redis.IntMap(rc.Do("HGETALL", fmt.Sprintf(waitReminderStatsKey, flowID)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading wait reminder stats for flow %d", flowID)
+	}
+
+	byKey := make(map[string]*WaitReminderStats)
+	for field, count := range values {
+		parts := strings.Split(field, ":")
+		if len(parts) != 3 {
+			continue
+		}
+		reminder, _ := strconv.Atoi(parts[1])
+
+		key := parts[0] + ":" + parts[1]
+		stats := byKey[key]
+		if stats == nil {
+			stats = &WaitReminderStats{NodeUUID: flows.NodeUUID(parts[0]), Reminder: reminder}
+			byKey[key] = stats
+		}
+
+		switch parts[2] {
+		case "sent":
+			stats.Sent = count
+		case "responded":
+			stats.Responded = count
+		}
+	}
+
+	all := make([]*WaitReminderStats, 0, len(byKey))
+	for _, s := range byKey {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].NodeUUID != all[j].NodeUUID {
+			return all[i].NodeUUID < all[j].NodeUUID
+		}
+		return all[i].Reminder < all[j].Reminder
+	})
+	return all, nil
+}
+
+const selectSessionsWaitingAtNodesSQL = `
+SELECT fs.id, COALESCE(fr.current_node_uuid::text, '')
+  FROM flows_flowsession fs
+  JOIN flows_flowrun fr ON fr.session_id = fs.id AND fr.status = 'W'
+ WHERE fs.id = ANY($1) AND fs.status = 'W'`
+
+// FilterStillWaiting returns the passed in reminder states whose sessions are still waiting at the nodes the reminders
+// were scheduled for
+func FilterStillWaiting(ctx context.Context, db Queryer, states []*WaitReminderState) ([]*WaitReminderState, error) {
+	ids := make([]SessionID, len(states))
+	for i, s := range states {
+		ids[i] = s.SessionID
+	}
+
+	rows, err := db.QueryxContext(ctx, selectSessionsWaitingAtNodesSQL, pq.Array(ids))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error selecting waiting sessions")
+	}
+	defer rows.Close()
+
+	waitingAt := make(map[SessionID]flows.NodeUUID, len(states))
+	for rows.Next() {
+		var id SessionID
+		var node flows.NodeUUID
+		if err := rows.Scan(&id, &node); err != nil {
+			return nil, errors.Wrapf(err, "error scanning waiting session")
+		}
+		waitingAt[id] = node
+	}
+
+	waiting := make([]*WaitReminderState, 0, len(states))
+	for _, s := range states {
+		if waitingAt[s.SessionID] == s.NodeUUID {
+			waiting = append(waiting, s)
+		}
+	}
+	return waiting, nil
+}
@@ -25,8 +25,9 @@ type Task struct {
 type Priority int
 
 const (
-	queuePattern  = "%s:%d"
-	activePattern = "%s:active"
+	queuePattern     = "%s:%d"
+	activePattern    = "%s:active"
+	scheduledPattern = "%s:scheduled"
 
 	// DefaultPriority is the default priority for tasks
 	DefaultPriority = Priority(0)
@@ -79,6 +80,9 @@ const (
 	// StartIVRFlowBatch is our task for starting an ivr batch
 	StartIVRFlowBatch = "start_ivr_flow_batch"
 
+	// TranscribeRecording is our task for transcribing an IVR recording
+	TranscribeRecording = "transcribe_recording"
+
 	// SendHistory is our task for sending history to a ticket integration
 	SendHistory = "send_history"
 
@@ -107,23 +111,37 @@ func Size(rc redis.Conn, queue string) (int, error) {
 		size += count
 	}
 
-	return size, nil
-}
+	// and those which are scheduled for later
+	scheduled, err := redis.Int(rc.Do("zcard", fmt.Sprintf(scheduledPattern, queue)))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error getting scheduled size of: %s", queue)
+	}
 
-// AddTask adds the passed in task to our queue for execution
-func AddTask(rc redis.Conn, queue string, taskType string, orgID int, task interface{}, priority Priority) error {
-	score := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Microsecond))/float64(1000000)+float64(priority), 'f', 6, 64)
+	return size + scheduled, nil
+}
 
+// NewTask creates a new task payload of the given type for the passed in org
+func NewTask(taskType string, orgID int, task interface{}) (*Task, error) {
 	taskBody, err := json.Marshal(task)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	payload := &Task{
+	return &Task{
 		Type:     taskType,
 		OrgID:    orgID,
 		Task:     taskBody,
 		QueuedOn: time.Now(),
+	}, nil
+}
+
+// AddTask adds the passed in task to our queue for execution
+func AddTask(rc redis.Conn, queue string, taskType string, orgID int, task interface{}, priority Priority) error {
+	score := strconv.FormatFloat(float64(time.Now().UnixNano()/int64(time.Microsecond))/float64(1000000)+float64(priority), 'f', 6, 64)
+
+	payload, err := NewTask(taskType, orgID, task)
+	if err != nil {
+		return err
 	}
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
@@ -136,7 +154,16 @@ func AddTask(rc redis.Conn, queue string, taskType string, orgID int, task inter
 	return err
 }
 
-var popTask = redis.NewScript(1, `-- KEYS: [QueueName]
+var popTask = redis.NewScript(1, `-- KEYS: [QueueName], ARGV: [Now]
+	-- move any scheduled tasks which are now due onto their org queues
+	local due = redis.call("zrangebyscore", KEYS[1] .. ":scheduled", "-inf", ARGV[1], "LIMIT", 0, 100)
+	for _, entry in ipairs(due) do
+		local scheduled = cjson.decode(entry)
+		redis.call("zadd", KEYS[1] .. ":" .. scheduled.org_id, scheduled.score, scheduled.task)
+		redis.call("zincrby", KEYS[1] .. ":active", 0, scheduled.org_id)
+		redis.call("zrem", KEYS[1] .. ":scheduled", entry)
+	end
+
     -- first get what is the active queue
 	local result = redis.call("zrange", KEYS[1] .. ":active", 0, 0, "WITHSCORES")
 
@@ -168,11 +195,11 @@ var popTask = redis.NewScript(1, `-- KEYS: [QueueName]
 	end
 `)
 
-// PopNextTask pops the next task off our queue
+// PopNextTask pops the next task off our queue, first moving any scheduled tasks which are due onto their queues
 func PopNextTask(rc redis.Conn, queue string) (*Task, error) {
 	task := Task{}
 	for {
-		values, err := redis.Strings(popTask.Do(rc, queue))
+		values, err := redis.Strings(popTask.Do(rc, queue, formatScore(time.Now(), 0)))
 		if err != nil {
 			return nil, err
 		}
@@ -274,6 +301,32 @@ func AddTaskAt(rc redis.Conn, queue string, orgID int, payload *Task, at time.Ti
 	return err
 }
 
+// scheduledTask is an entry in the scheduled set of a queue, waiting to be moved onto its org queue
+type scheduledTask struct {
+	OrgID int    `json:"org_id"`
+	Score string `json:"score"`
+	Task  string `json:"task"`
+}
+
+// ScheduleTask adds a task to the scheduled set of a queue, it won't be moved onto its org queue and so can't be
+// popped until that time has passed
+func ScheduleTask(rc redis.Conn, queue string, orgID int, payload *Task, at time.Time, priority Priority) error {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(&scheduledTask{OrgID: orgID, Score: formatScore(at, priority), Task: string(jsonPayload)})
+	if err != nil {
+		return err
+	}
+	_, err = rc.Do("zadd", fmt.Sprintf(scheduledPattern, queue), formatScore(at, 0), entry)
+	return err
+}
+
+func formatScore(t time.Time, priority Priority) string {
+	return strconv.FormatFloat(float64(t.UnixNano()/int64(time.Microsecond))/float64(1000000)+float64(priority), 'f', 6, 64)
+}
+
 // RequeueExpired looks for processing tasks past deadline and requeues them with backoff
 func RequeueExpired(rc redis.Conn, queue string, now time.Time) (int, error) {
 	orgIDs, err := redis.Ints(rc.Do("zrange", fmt.Sprintf(activePattern, queue), 0, -1))
@@ -78,6 +78,54 @@ func TestQueues(t *testing.T) {
 	}
 }
 
+func TestScheduledTasks(t *testing.T) {
+	rc, err := redis.Dial("tcp", "localhost:6379")
+	assert.NoError(t, err)
+	defer rc.Close()
+	rc.Do("del", "sched:active", "sched:scheduled", "sched:1", "sched:2")
+
+	later, err := NewTask("campaign", 1, "later")
+	assert.NoError(t, err)
+	assert.NoError(t, ScheduleTask(rc, "sched", 1, later, time.Now().Add(time.Hour), DefaultPriority))
+
+	// a task scheduled for later doesn't block the queues of other orgs
+	assert.NoError(t, AddTask(rc, "sched", "campaign", 2, "now", DefaultPriority))
+	assert.NoError(t, AddTask(rc, "sched", "campaign", 2, "low", LowPriority))
+
+	task, err := PopNextTask(rc, "sched")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, task.OrgID)
+	assert.Equal(t, `"now"`, string(task.Task))
+
+	task, err = PopNextTask(rc, "sched")
+	assert.NoError(t, err)
+	assert.Equal(t, `"low"`, string(task.Task))
+
+	task, err = PopNextTask(rc, "sched")
+	assert.NoError(t, err)
+	assert.Nil(t, task)
+
+	// but is still counted as queued
+	size, err := Size(rc, "sched")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	// once its time has come it is moved onto its org queue and can be popped
+	due, err := NewTask("campaign", 1, "due")
+	assert.NoError(t, err)
+	assert.NoError(t, ScheduleTask(rc, "sched", 1, due, time.Now().Add(-time.Second), DefaultPriority))
+
+	task, err = PopNextTask(rc, "sched")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, task.OrgID)
+	assert.Equal(t, `"due"`, string(task.Task))
+
+	// leaving the other still scheduled
+	count, err := redis.Int(rc.Do("zcard", "sched:scheduled"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
 func TestProcessingAndRequeueSendHistory(t *testing.T) {
 	rc, err := redis.Dial("tcp", "localhost:6379")
 	assert.NoError(t, err)
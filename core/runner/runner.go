@@ -11,6 +11,7 @@ import (
 	"github.com/nyaruka/goflow/assets"
 	"github.com/nyaruka/goflow/excellent/types"
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/resumes"
 	"github.com/nyaruka/goflow/flows/triggers"
 	"github.com/nyaruka/goflow/utils"
 	"github.com/nyaruka/librato"
@@ -70,7 +71,6 @@ type TriggerBuilder func(contact *flows.Contact) flows.Trigger
 // ResumeFlow resumes the passed in session using the passed in session
 func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, session *models.Session, resume flows.Resume, hook models.SessionCommitHook) (*models.Session, error) {
 	start := time.Now()
-	sa := oa.SessionAssets()
 
 	// does the flow this session is part of still exist?
 	_, err := oa.FlowByID(session.CurrentFlowID())
@@ -83,8 +83,25 @@ func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 		return nil, errors.Wrapf(err, "error loading session flow: %d", session.CurrentFlowID())
 	}
 
+	// record messages from the contact so that the loop guard can spot them ping-ponging with another bot, and so that
+	// any reminder they were sent for this wait is credited with their response
+	if resume.Type() == resumes.TypeMsg {
+		if err := models.RecordLoopGuardReceived(rt, session.ContactID()); err != nil {
+			logrus.WithError(err).WithField("contact_uuid", session.Contact().UUID()).Error("error recording message for loop guard")
+		}
+		if err := models.RecordWaitReminderResponse(rt, session.ID()); err != nil {
+			logrus.WithError(err).WithField("session_id", session.ID()).Error("error recording response to wait reminder")
+		}
+	}
+
+	// if any of the session's flows pin their revisions, resume it on the revisions it started them on
+	oa, err = models.PinnedOrgAssets(ctx, rt, oa, session)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading pinned flow revisions")
+	}
+
 	// build our flow session
-	fs, err := session.FlowSession(rt.Config, sa, oa.Env())
+	fs, err := session.FlowSession(rt.Config, oa.SessionAssets(), oa.Env())
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to create session from output")
 	}
@@ -122,6 +139,9 @@ func ResumeFlow(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 		return nil, errors.Wrapf(err, "error committing resumption of flow")
 	}
 
+	models.RecordFlowAnalytics(rt, []*models.Session{session})
+	models.ScheduleWaitReminders(rt, oa, []*models.Session{session})
+
 	// now take care of any post-commit hooks
 	txCTX, cancel = context.WithTimeout(ctx, postCommitTimeout)
 	defer cancel()
@@ -242,6 +262,20 @@ func StartFlowBatch(
 		return nil, errors.Wrapf(err, "error loading campaign flow: %d", batch.FlowID())
 	}
 
+	// if this batch is for a variant of an A/B split, record that on the contacts before they start
+	if batch.Variant() != "" {
+		err = models.SetContactABVariants(ctx, rt, oa, batch.ContactIDs(), batch.Variant())
+		if err != nil {
+			return nil, errors.Wrapf(err, "error setting A/B variant of contacts")
+		}
+
+		// setting the field may have refreshed our assets
+		oa, err = models.GetOrgAssets(ctx, rt, batch.OrgID())
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reloading assets for org: %d", batch.OrgID())
+		}
+	}
+
 	// get the user that created this flow start if there was one
 	var flowUser *flows.User
 	if batch.CreatedByID() != models.NilUserID {
@@ -652,8 +686,6 @@ func StartFlow(
 func StartFlowForContacts(
 	ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets,
 	flow *models.Flow, triggers []flows.Trigger, hook models.SessionCommitHook, interrupt bool) ([]*models.Session, error) {
-	sa := oa.SessionAssets()
-
 	// no triggers? nothing to do
 	if len(triggers) == 0 {
 		return nil, nil
@@ -662,6 +694,13 @@ func StartFlowForContacts(
 	start := time.Now()
 	log := logrus.WithField("flow_name", flow.Name()).WithField("flow_uuid", flow.UUID())
 
+	// if this flow is being rolled out, contacts outside of the rollout are started on its base revision
+	rollout := flow.Rollout()
+	baseOA, err := models.RolloutBaseOrgAssets(ctx, rt, oa, flow)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading base revision of flow rollout")
+	}
+
 	// for each trigger start the flow
 	sessions := make([]flows.Session, 0, len(triggers))
 	sprints := make([]flows.Sprint, 0, len(triggers))
@@ -671,6 +710,11 @@ func StartFlowForContacts(
 		log := log.WithField("contact_uuid", trigger.Contact().UUID())
 		start := time.Now()
 
+		sa := oa.SessionAssets()
+		if baseOA != nil && !rollout.Includes(flow, models.ContactID(trigger.Contact().ID())) {
+			sa = baseOA.SessionAssets()
+		}
+
 		session, sprint, err := goflow.Engine(rt.Config).NewSession(sa, trigger)
 		if err != nil {
 			log.WithError(err).Errorf("error starting flow")
@@ -703,8 +747,15 @@ func StartFlowForContacts(
 		contactIDs[i] = triggers[i].Contact().ID()
 	}
 
-	// interrupt all our contacts if desired
+	// interrupt all our contacts if desired, noting where their runs were so we can record it for analytics
+	var interruptedNodes []*models.NodeExit
 	if interrupt {
+		interruptedNodes, err = models.ActiveRunNodesForContacts(txCTX, tx, flow.FlowType(), contactIDs)
+		if err != nil {
+			tx.Rollback()
+			return nil, errors.Wrap(err, "error finding nodes of runs to interrupt")
+		}
+
 		err = models.InterruptContactRuns(txCTX, tx, flow.FlowType(), contactIDs, start)
 		if err != nil {
 			tx.Rollback()
@@ -721,6 +772,7 @@ func StartFlowForContacts(
 
 		if err == nil {
 			logrus.WithField("elapsed", time.Since(commitStart)).WithField("count", len(sessions)).Debug("sessions committed")
+			models.RecordNodeExits(rt, interruptedNodes, models.RunStatusInterrupted, time.Now())
 		}
 	}
 
@@ -770,6 +822,12 @@ func StartFlowForContacts(
 		}
 	}
 
+	// record analytics for the runs of the sessions we committed
+	models.RecordFlowAnalytics(rt, dbSessions)
+
+	// schedule reminders for any sessions waiting at nodes which have them
+	models.ScheduleWaitReminders(rt, oa, dbSessions)
+
 	// now take care of any post-commit hooks
 	txCTX, cancel = context.WithTimeout(ctx, postCommitTimeout*time.Duration(len(sessions)))
 	defer cancel()
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -284,7 +285,9 @@ func TestBatchStartWithOrderInExtra(t *testing.T) {
 func TestResume(t *testing.T) {
 	ctx, rt, db, _ := testsuite.Get()
 
-	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetStorage)
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetStorage | testsuite.ResetRedis)
+
+	testsuite.Reset(testsuite.ResetRedis)
 
 	// write sessions to s3 storage
 	rt.Config.SessionStorage = "s3"
@@ -360,6 +363,165 @@ func TestResume(t *testing.T) {
 		testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND text like $2`, contact.ID(), tc.Substring).
 			Returns(1, "%d: didn't find expected message", i)
 	}
+
+	// check that every step of the run was recorded in our flow analytics, as well as where it completed
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	analytics, err := models.GetFlowAnalytics(ctx, db, rc, flow.ID(), time.Now(), time.Now())
+	require.NoError(t, err)
+
+	steps := 0
+	for _, seg := range analytics.Segments {
+		steps += seg.Count
+	}
+	assert.Equal(t, 6, steps)
+	require.Len(t, analytics.Nodes, 1)
+	assert.Equal(t, 1, analytics.Nodes[0].Completed)
+}
+
+func TestResumeWithSessionCodec(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// write sessions to the db compressed with zstd
+	rt.Config.SessionStorage = "db"
+	rt.Config.SessionCodec = "zstd"
+	defer func() { rt.Config.SessionCodec = "none" }()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+
+	_, contact := testdata.Cathy.Load(db, oa)
+
+	trigger := triggers.NewBuilder(oa.Env(), flow.FlowReference(), contact).Manual().Build()
+	_, err = runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{trigger}, nil, true)
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1 AND status = 'W' AND output LIKE 'zs:%'`, contact.ID()).Returns(1)
+
+	// reading the session back gives us its output as JSON
+	session, err := models.ActiveSessionForContact(ctx, rt, oa, models.FlowTypeMessaging, contact)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	assert.True(t, strings.HasPrefix(session.Output(), "{"))
+
+	// switch codecs, the session we wrote with zstd can still be resumed
+	rt.Config.SessionCodec = "gzip"
+
+	msg := flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.Cathy.URN, nil, "Red", nil)
+	msg.SetID(10)
+	_, err = runner.ResumeFlow(ctx, rt, oa, session, resumes.NewMsg(oa.Env(), contact, msg), nil)
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_flowsession WHERE contact_id = $1 AND status = 'W' AND output LIKE 'gz:%'`, contact.ID()).Returns(1)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND text LIKE '%I like Red too%'`, contact.ID()).Returns(1)
+}
+
+func TestSessionCache(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	rt.Config.SessionStorage = "db"
+	rt.Config.SessionCacheTTL = 60
+	defer func() { rt.Config.SessionCacheTTL = 0 }()
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+
+	_, contact := testdata.Cathy.Load(db, oa)
+
+	trigger := triggers.NewBuilder(oa.Env(), flow.FlowReference(), contact).Manual().Build()
+	sessions, err := runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{trigger}, nil, true)
+	require.NoError(t, err)
+
+	// starting the flow writes the output of the waiting session through to our cache
+	key := fmt.Sprintf("session_output:%s", sessions[0].UUID())
+	cached, err := redis.String(rc.Do("HGET", key, "output"))
+	require.NoError(t, err)
+	assert.Equal(t, sessions[0].Output(), cached)
+
+	session, err := models.ActiveSessionForContact(ctx, rt, oa, models.FlowTypeMessaging, contact)
+	require.NoError(t, err)
+	assert.Equal(t, sessions[0].Output(), session.Output())
+
+	// a mangled cached output fails our md5 check and is read from the db instead
+	rc.Do("HSET", key, "output", `{"uuid": "mangled"}`)
+
+	session, err = models.ActiveSessionForContact(ctx, rt, oa, models.FlowTypeMessaging, contact)
+	require.NoError(t, err)
+	assert.Equal(t, sessions[0].Output(), session.Output())
+
+	// and the cache repopulated
+	cached, err = redis.String(rc.Do("HGET", key, "output"))
+	require.NoError(t, err)
+	assert.Equal(t, sessions[0].Output(), cached)
+
+	// a cached output which isn't the version in the db is ignored
+	db.MustExec(`UPDATE flows_flowsession SET output = $2, output_md5 = md5($2) WHERE uuid = $1`, sessions[0].UUID(), strings.Replace(sessions[0].Output(), "favorite", "favourite", -1))
+
+	session, err = models.ActiveSessionForContact(ctx, rt, oa, models.FlowTypeMessaging, contact)
+	require.NoError(t, err)
+	assert.Contains(t, session.Output(), "favourite")
+
+	// resuming to completion removes the session from the cache
+	for _, answer := range []string{"Red", "Mutzig", "Luke"} {
+		msg := flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.Cathy.URN, nil, answer, nil)
+		msg.SetID(10)
+		session, err = runner.ResumeFlow(ctx, rt, oa, session, resumes.NewMsg(oa.Env(), contact, msg), nil)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, models.SessionStatusCompleted, session.Status())
+
+	exists, err := redis.Bool(rc.Do("EXISTS", key))
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestLoopGuard(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	rt.Config.MsgBudgetPerMinute = 1
+	defer func() { rt.Config.MsgBudgetPerMinute = 0 }()
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshOrg)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+
+	_, contact := testdata.Cathy.Load(db, oa)
+
+	// starting the flow sends one message which is within budget
+	trigger := triggers.NewBuilder(oa.Env(), flow.FlowReference(), contact).Manual().Build()
+	sessions, err := runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{trigger}, nil, true)
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND status = 'Q'`, testdata.Cathy.ID).Returns(1)
+
+	// resuming sends another which isn't
+	msg := flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.Cathy.URN, nil, "Red", nil)
+	msg.SetID(10)
+	_, err = runner.ResumeFlow(ctx, rt, oa, sessions[0], resumes.NewMsg(oa.Env(), contact, msg), nil)
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND status = 'F' AND failed_reason = 'L'`, testdata.Cathy.ID).Returns(1)
+	testsuite.AssertQuery(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, sessions[0].ID()).Returns("I")
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM notifications_incident WHERE org_id = $1 AND incident_type = 'contacts:looping'`, testdata.Org1.ID).Returns(1)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM request_logs_httplog WHERE log_type = 'loop_detected' AND contact_id = $1 AND flow_id = $2`, testdata.Cathy.ID, testdata.Favorites.ID).Returns(1)
 }
 
 func TestStartFlowConcurrency(t *testing.T) {
@@ -407,3 +569,111 @@ func TestStartFlowConcurrency(t *testing.T) {
 	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_flowrun`).Returns(len(contacts))
 	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_flowsession`).Returns(len(contacts))
 }
+
+func TestFlowRevisionPinning(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// make favorites pin its revisions
+	db.MustExec(`UPDATE flows_flow SET metadata = '{"pin_revision": true}' WHERE id = $1`, testdata.Favorites.ID)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+	assert.True(t, flow.PinsRevision())
+	assert.Nil(t, flow.Rollout())
+
+	startedOn := flow.Revision()
+
+	_, cathy := testdata.Cathy.Load(db, oa)
+
+	trigger := triggers.NewBuilder(oa.Env(), flow.FlowReference(), cathy).Manual().Build()
+	sessions, err := runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{trigger}, nil, true)
+	require.NoError(t, err)
+
+	// the revision the session started on is recorded on its run, and loaded with the session
+	testsuite.AssertQuery(t, db, `SELECT flow_revision FROM flows_flowrun WHERE session_id = $1`, sessions[0].ID()).Returns(startedOn)
+
+	active, err := models.ActiveSessionForContact(ctx, rt, oa, models.FlowTypeMessaging, cathy)
+	require.NoError(t, err)
+	revs, err := active.FlowRevisions()
+	require.NoError(t, err)
+	assert.Equal(t, models.SessionFlowRevisions{testdata.Favorites.UUID: startedOn}, revs)
+
+	// save a new revision of the flow
+	db.MustExec(`
+	INSERT INTO flows_flowrevision(definition, spec_version, revision, is_active, created_on, modified_on, flow_id, created_by_id, modified_by_id)
+	SELECT replace(definition, 'I like', 'I love'), spec_version, revision + 1, TRUE, NOW(), NOW(), flow_id, created_by_id, modified_by_id
+	FROM flows_flowrevision WHERE flow_id = $1 AND revision = $2`, testdata.Favorites.ID, startedOn)
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	flow, err = oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+	assert.Equal(t, startedOn+1, flow.Revision())
+
+	// sessions on the same revisions share the same pinned assets
+	pinned, err := models.PinnedOrgAssets(ctx, rt, oa, sessions[0])
+	require.NoError(t, err)
+	assert.NotSame(t, oa, pinned)
+
+	pinnedAgain, err := models.PinnedOrgAssets(ctx, rt, oa, sessions[0])
+	require.NoError(t, err)
+	assert.Same(t, pinned, pinnedAgain)
+
+	// resuming Cathy's session still uses the revision she started on
+	msg := flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.Cathy.URN, nil, "Red", nil)
+	msg.SetID(10)
+	_, err = runner.ResumeFlow(ctx, rt, oa, sessions[0], resumes.NewMsg(oa.Env(), cathy, msg), nil)
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND text LIKE '%I like Red too%'`, testdata.Cathy.ID).Returns(1)
+
+	// whereas Bob starts on the new revision
+	_, bob := testdata.Bob.Load(db, oa)
+
+	trigger = triggers.NewBuilder(oa.Env(), flow.FlowReference(), bob).Manual().Build()
+	sessions, err = runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{trigger}, nil, true)
+	require.NoError(t, err)
+
+	msg = flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.Bob.URN, nil, "Red", nil)
+	msg.SetID(11)
+	_, err = runner.ResumeFlow(ctx, rt, oa, sessions[0], resumes.NewMsg(oa.Env(), bob, msg), nil)
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND text LIKE '%I love Red too%'`, testdata.Bob.ID).Returns(1)
+
+	// roll the new revision out to nobody, so that new starts all get the old revision
+	db.MustExec(`UPDATE flows_flow SET metadata = $2 WHERE id = $1`, testdata.Favorites.ID, fmt.Sprintf(`{"rollout_percent": 0, "rollout_base_revision": %d}`, startedOn))
+
+	oa, err = models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	flow, err = oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+	assert.Equal(t, &models.FlowRollout{BaseRevision: startedOn, Percent: 0}, flow.Rollout())
+	assert.True(t, flow.PinsRevision())
+
+	_, george := testdata.George.Load(db, oa)
+
+	trigger = triggers.NewBuilder(oa.Env(), flow.FlowReference(), george).Manual().Build()
+	sessions, err = runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{trigger}, nil, true)
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT flow_revision FROM flows_flowrun WHERE session_id = $1`, sessions[0].ID()).Returns(startedOn)
+
+	revs, err = sessions[0].FlowRevisions()
+	require.NoError(t, err)
+	assert.Equal(t, models.SessionFlowRevisions{testdata.Favorites.UUID: startedOn}, revs)
+
+	msg = flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.George.URN, nil, "Red", nil)
+	msg.SetID(12)
+	_, err = runner.ResumeFlow(ctx, rt, oa, sessions[0], resumes.NewMsg(oa.Env(), george, msg), nil)
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND text LIKE '%I like Red too%'`, testdata.George.ID).Returns(1)
+}
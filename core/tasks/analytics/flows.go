@@ -0,0 +1,57 @@
+package stats
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	flushFlowAnalyticsLock = "flush_flow_analytics"
+	flowAnalyticsBatchSize = 1000
+)
+
+func init() {
+	mailroom.AddInitFunction(StartFlowAnalyticsCron)
+}
+
+// StartFlowAnalyticsCron starts our cron job of flushing flow analytics from redis to the database
+func StartFlowAnalyticsCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.Start(quit, rt, flushFlowAnalyticsLock, time.Minute*5, false,
+		func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			return flushFlowAnalytics(ctx, rt)
+		},
+	)
+	return nil
+}
+
+// flushes all pending flow analytics in batches
+func flushFlowAnalytics(ctx context.Context, rt *runtime.Runtime) error {
+	log := logrus.WithField("comp", "flow_analytics_flusher")
+	start := time.Now()
+	total := 0
+
+	for {
+		flushed, err := models.FlushFlowAnalytics(ctx, rt, flowAnalyticsBatchSize)
+		total += flushed
+		if err != nil {
+			return errors.Wrapf(err, "error flushing flow analytics")
+		}
+		if flushed < flowAnalyticsBatchSize {
+			break
+		}
+	}
+
+	log.WithField("elapsed", time.Since(start)).WithField("flushed", total).Info("flushed flow analytics")
+	return nil
+}
@@ -67,6 +67,13 @@ func fireCampaignEvents(ctx context.Context, rt *runtime.Runtime) error {
 			return nil
 		}
 
+		// batches are spread over time to respect the throughput budget of the org's sending channel, if it only has one
+		oa, err := models.GetOrgAssets(ctx, rt, orgID)
+		if err != nil {
+			return errors.Wrapf(err, "error loading org assets")
+		}
+		channel := models.ThrottleChannel(oa, models.NilChannelID)
+
 		fireIDs := task.FireIDs
 		for len(fireIDs) > 0 {
 			batchSize := maxBatchSize
@@ -76,7 +83,7 @@ func fireCampaignEvents(ctx context.Context, rt *runtime.Runtime) error {
 			task.FireIDs = fireIDs[:batchSize]
 			fireIDs = fireIDs[batchSize:]
 
-			err = queue.AddTask(rc, queue.BatchQueue, TypeFireCampaignEvent, int(orgID), task, queue.DefaultPriority)
+			err = models.QueueThrottledTask(rc, channel, len(task.FireIDs), queue.BatchQueue, TypeFireCampaignEvent, orgID, task, queue.DefaultPriority)
 			if err != nil {
 				return errors.Wrap(err, "error queuing task")
 			}
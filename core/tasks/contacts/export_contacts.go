@@ -0,0 +1,110 @@
+package contacts
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeExportContacts is the type of the export contacts task
+const TypeExportContacts = "export_contacts"
+
+func init() {
+	tasks.RegisterType(TypeExportContacts, func() tasks.Task { return &ExportContactsTask{} })
+}
+
+// ExportContactsTask is our task to export contacts too numerous to be streamed in a response to media storage
+type ExportContactsTask struct {
+	Export *models.ContactExport `json:"export" validate:"required"`
+	Total  int                   `json:"total"`
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *ExportContactsTask) Timeout() time.Duration {
+	return time.Hour
+}
+
+// Perform writes the export to media storage, recording its progress as it goes
+func (t *ExportContactsTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	start := time.Now()
+	log := logrus.WithField("org_id", orgID).WithField("export_uuid", t.Export.UUID)
+
+	progress := &models.ContactExportProgress{OrgID: orgID, Status: models.ContactExportStatusExporting, Total: t.Total}
+	if err := t.setProgress(rt, progress); err != nil {
+		return err
+	}
+
+	url, err := t.export(ctx, rt, orgID, progress)
+	if err != nil {
+		progress.Status = models.ContactExportStatusFailed
+		progress.Error = err.Error()
+		if err := t.setProgress(rt, progress); err != nil {
+			log.WithError(err).Error("error recording failure of contact export")
+		}
+		return err
+	}
+
+	progress.Status = models.ContactExportStatusComplete
+	progress.URL = url
+	if err := t.setProgress(rt, progress); err != nil {
+		return err
+	}
+
+	log.WithField("elapsed", time.Since(start)).WithField("count", progress.Exported).Info("completed contact export")
+	return nil
+}
+
+func (t *ExportContactsTask) export(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID, progress *models.ContactExportProgress) (string, error) {
+	oa, err := models.GetOrgAssets(ctx, rt, orgID)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to load org assets")
+	}
+
+	// write the export to a temporary file as we page through contacts
+	file, err := os.CreateTemp("", "contact-export-*")
+	if err != nil {
+		return "", errors.Wrapf(err, "error creating temp file for contact export")
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = models.WriteContactExport(ctx, rt, oa, t.Export, file, func(exported int) error {
+		progress.Exported = exported
+		return t.setProgress(rt, progress)
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "error writing contact export")
+	}
+
+	if err := file.Close(); err != nil {
+		return "", errors.Wrapf(err, "error closing contact export temp file")
+	}
+
+	// storage only accepts whole contents so the finished file has to be read back into memory for the upload, which
+	// means peak memory use is still the size of the whole export
+	content, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading contact export temp file")
+	}
+
+	url, err := rt.MediaStorage.Put(ctx, models.ContactExportPath(rt.Config.S3MediaPrefix, orgID, t.Export), t.Export.Format.ContentType(), content)
+	if err != nil {
+		return "", errors.Wrapf(err, "error storing contact export")
+	}
+
+	return url, nil
+}
+
+func (t *ExportContactsTask) setProgress(rt *runtime.Runtime, progress *models.ContactExportProgress) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	return models.SetContactExportProgress(rc, t.Export.UUID, progress)
+}
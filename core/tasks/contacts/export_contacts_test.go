@@ -0,0 +1,72 @@
+package contacts_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportContactsTask(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// without elastic exports page through the database
+	rt.ES = nil
+
+	db.MustExec(`DELETE FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, testdata.TestersGroup.ID)
+	testdata.TestersGroup.Add(db, testdata.Cathy, testdata.George)
+
+	task := &contacts.ExportContactsTask{
+		Export: &models.ContactExport{
+			UUID:      "5f6ae2a1-2a6e-4d2b-8a8c-2c4e9c1b3d7f",
+			GroupUUID: testdata.TestersGroup.UUID,
+			Format:    models.ContactExportFormatCSV,
+			Schemes:   []string{"tel"},
+		},
+		Total: 2,
+	}
+	err := task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	progress, err := models.GetContactExportProgress(rc, "5f6ae2a1-2a6e-4d2b-8a8c-2c4e9c1b3d7f")
+	require.NoError(t, err)
+	assert.Equal(t, models.ContactExportStatusComplete, progress.Status)
+	assert.Equal(t, 2, progress.Total)
+	assert.Equal(t, 2, progress.Exported)
+	assert.Equal(t, "", progress.Error)
+	assert.Equal(t, "_test_media_storage/media/contact_exports/1/5f6ae2a1-2a6e-4d2b-8a8c-2c4e9c1b3d7f.csv", progress.URL)
+
+	// the export has been written to media storage
+	content, err := os.ReadFile(progress.URL)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, "Contact UUID,Name,Language,Status,Created On,Last Seen On,URN:tel", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], string(testdata.Cathy.UUID)+",Cathy,"))
+	assert.True(t, strings.HasPrefix(lines[2], string(testdata.George.UUID)+",George,"))
+
+	// exports of groups which don't exist fail
+	task.Export.UUID = "c9a4d1e8-5b7f-4c3a-9e2d-1f8b6a4c7d20"
+	task.Export.Groups = append(task.Export.Groups, "2d8f0b6c-0c4e-4a1f-8d3b-7e9a5c1f2b46")
+
+	err = task.Perform(ctx, rt, testdata.Org1.ID)
+	assert.EqualError(t, err, "error writing contact export: no such group with uuid: 2d8f0b6c-0c4e-4a1f-8d3b-7e9a5c1f2b46")
+
+	progress, err = models.GetContactExportProgress(rc, "c9a4d1e8-5b7f-4c3a-9e2d-1f8b6a4c7d20")
+	require.NoError(t, err)
+	assert.Equal(t, models.ContactExportStatusFailed, progress.Status)
+	assert.Equal(t, "error writing contact export: no such group with uuid: 2d8f0b6c-0c4e-4a1f-8d3b-7e9a5c1f2b46", progress.Error)
+}
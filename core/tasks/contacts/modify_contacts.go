@@ -0,0 +1,128 @@
+package contacts
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TypeModifyContacts is the type of the modify contacts task
+const TypeModifyContacts = "modify_contacts"
+
+// how many contacts we modify at a time
+const modifyBatchSize = 100
+
+func init() {
+	tasks.RegisterType(TypeModifyContacts, func() tasks.Task { return &ModifyContactsTask{} })
+}
+
+// ModifyContactsTask is our task to apply modifiers to all the contacts matching a query
+type ModifyContactsTask struct {
+	UUID      string            `json:"uuid"      validate:"required"`
+	Query     string            `json:"query"     validate:"required"`
+	Modifiers []json.RawMessage `json:"modifiers" validate:"required"`
+
+	// the user who requested the modification
+	RequestedByID models.UserID `json:"requested_by_id,omitempty"`
+}
+
+// Timeout is the maximum amount of time the task can run for
+func (t *ModifyContactsTask) Timeout() time.Duration {
+	return time.Hour
+}
+
+// Perform applies our modifiers to the matching contacts in batches, recording its progress as it goes
+func (t *ModifyContactsTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	start := time.Now()
+	log := logrus.WithField("org_id", orgID).WithField("modification_uuid", t.UUID).WithField("requested_by_id", t.RequestedByID)
+
+	progress := &models.ContactModificationProgress{OrgID: orgID, Status: models.ContactModificationStatusModifying}
+
+	if err := t.modify(ctx, rt, orgID, progress); err != nil {
+		progress.Status = models.ContactModificationStatusFailed
+		progress.Error = err.Error()
+		if err := t.setProgress(rt, progress); err != nil {
+			log.WithError(err).Error("error recording failure of contact modification")
+		}
+		return err
+	}
+
+	progress.Status = models.ContactModificationStatusComplete
+	if err := t.setProgress(rt, progress); err != nil {
+		return err
+	}
+
+	log.WithField("elapsed", time.Since(start)).WithField("count", progress.Modified).Info("completed contact modification")
+	return nil
+}
+
+func (t *ModifyContactsTask) modify(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID, progress *models.ContactModificationProgress) error {
+	oa, err := models.GetOrgAssets(ctx, rt, orgID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets")
+	}
+
+	// modifiers were validated when this task was queued, so ignore any assets which have since been deleted
+	mods, err := goflow.ReadModifiers(oa.SessionAssets(), t.Modifiers, goflow.IgnoreMissing)
+	if err != nil {
+		return errors.Wrapf(err, "error reading modifiers")
+	}
+
+	contactIDs, err := models.SearchContactIDs(ctx, rt, oa, t.Query, false)
+	if err != nil {
+		return errors.Wrapf(err, "error performing contact search")
+	}
+
+	progress.Total = len(contactIDs)
+	if err := t.setProgress(rt, progress); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(contactIDs); i += modifyBatchSize {
+		end := i + modifyBatchSize
+		if end > len(contactIDs) {
+			end = len(contactIDs)
+		}
+
+		contacts, err := models.LoadContacts(ctx, rt.DB, oa, contactIDs[i:end])
+		if err != nil {
+			return errors.Wrapf(err, "error loading contacts")
+		}
+
+		modifiersByContact := make(map[*flows.Contact][]flows.Modifier, len(contacts))
+		for _, contact := range contacts {
+			flowContact, err := contact.FlowContact(oa)
+			if err != nil {
+				return errors.Wrapf(err, "error creating flow contact for contact: %d", contact.ID())
+			}
+			modifiersByContact[flowContact] = mods
+		}
+
+		if _, err := models.ApplyModifiers(ctx, rt, oa, modifiersByContact); err != nil {
+			return errors.Wrapf(err, "error modifying contacts")
+		}
+
+		progress.Modified += len(contacts)
+		if err := t.setProgress(rt, progress); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *ModifyContactsTask) setProgress(rt *runtime.Runtime, progress *models.ContactModificationProgress) error {
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	return models.SetContactModificationProgress(rc, t.UUID, progress)
+}
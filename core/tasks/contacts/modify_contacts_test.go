@@ -0,0 +1,61 @@
+package contacts_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModifyContactsTask(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// without elastic queries are searched in the database
+	rt.ES = nil
+
+	db.MustExec(`DELETE FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, testdata.TestersGroup.ID)
+
+	task := &contacts.ModifyContactsTask{
+		UUID:  "8f2d6c1a-3b4e-4f5a-9d8c-7e6b5a4c3d21",
+		Query: "tel = +16055741111 OR tel = +16055743333",
+		Modifiers: []json.RawMessage{
+			json.RawMessage(`{"type": "field", "field": {"key": "gender", "name": "Gender"}, "value": "M"}`),
+			json.RawMessage(`{"type": "groups", "modification": "add", "groups": [{"uuid": "5e9d8fab-5e7e-4f51-b533-261af5dea70d", "name": "Testers"}]}`),
+		},
+		RequestedByID: testdata.Admin.ID,
+	}
+	err := task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	progress, err := models.GetContactModificationProgress(rc, "8f2d6c1a-3b4e-4f5a-9d8c-7e6b5a4c3d21")
+	require.NoError(t, err)
+	assert.Equal(t, &models.ContactModificationProgress{OrgID: testdata.Org1.ID, Status: models.ContactModificationStatusComplete, Total: 2, Modified: 2}, progress)
+
+	// the modifiers were applied through the same path as other contact changes
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM contacts_contact WHERE id IN ($1, $2) AND fields->$3::text->>'text' = 'M'`, testdata.Cathy.ID, testdata.George.ID, testdata.GenderField.UUID).Returns(2)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, testdata.TestersGroup.ID).Returns(2)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1 AND contact_id = $2`, testdata.TestersGroup.ID, testdata.Bob.ID).Returns(0)
+
+	// invalid queries fail the modification
+	task.UUID = "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d"
+	task.Query = "birthday = tomorrow"
+
+	err = task.Perform(ctx, rt, testdata.Org1.ID)
+	assert.Error(t, err)
+
+	progress, err = models.GetContactModificationProgress(rc, "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d")
+	require.NoError(t, err)
+	assert.Equal(t, models.ContactModificationStatusFailed, progress.Status)
+	assert.Contains(t, progress.Error, "can't resolve 'birthday' to attribute, scheme or field")
+}
@@ -52,6 +52,7 @@ func expireRuns(ctx context.Context, rt *runtime.Runtime) error {
 	// we expire runs and sessions that have no continuation in batches
 	expiredRuns := make([]models.FlowRunID, 0, expireBatchSize)
 	expiredSessions := make([]models.SessionID, 0, expireBatchSize)
+	expiredNodes := make([]*models.NodeExit, 0, expireBatchSize)
 
 	// select our expired runs
 	rows, err := rt.DB.QueryxContext(ctx, selectExpiredRunsSQL)
@@ -73,6 +74,9 @@ func expireRuns(ctx context.Context, rt *runtime.Runtime) error {
 		// no parent id? we can add this to our batch
 		if expiration.ParentUUID == nil || expiration.SessionID == nil {
 			expiredRuns = append(expiredRuns, expiration.RunID)
+			if expiration.NodeUUID != "" {
+				expiredNodes = append(expiredNodes, &models.NodeExit{FlowID: expiration.FlowID, NodeUUID: expiration.NodeUUID, Count: 1})
+			}
 
 			if expiration.SessionID != nil {
 				expiredSessions = append(expiredSessions, *expiration.SessionID)
@@ -86,8 +90,11 @@ func expireRuns(ctx context.Context, rt *runtime.Runtime) error {
 				if err != nil {
 					return errors.Wrapf(err, "error expiring runs and sessions")
 				}
+				models.RecordNodeExits(rt, expiredNodes, models.RunStatusExpired, time.Now())
+
 				expiredRuns = expiredRuns[:0]
 				expiredSessions = expiredSessions[:0]
+				expiredNodes = expiredNodes[:0]
 			}
 
 			continue
@@ -125,6 +132,7 @@ func expireRuns(ctx context.Context, rt *runtime.Runtime) error {
 		if err != nil {
 			return errors.Wrapf(err, "error expiring runs and sessions")
 		}
+		models.RecordNodeExits(rt, expiredNodes, models.RunStatusExpired, time.Now())
 	}
 
 	log.WithField("elapsed", time.Since(start)).WithField("count", count).Info("expirations complete")
@@ -139,7 +147,8 @@ const selectExpiredRunsSQL = `
 		fr.id as run_id,
 		fr.parent_uuid as parent_uuid,
 		fr.session_id as session_id,
-		fr.expires_on as expires_on
+		fr.expires_on as expires_on,
+		COALESCE(fr.current_node_uuid::text, '') as node_uuid
 	FROM
 		flows_flowrun fr
 		JOIN orgs_org o ON fr.org_id = o.id
@@ -160,4 +169,5 @@ type RunExpiration struct {
 	ParentUUID *flows.RunUUID    `db:"parent_uuid"`
 	SessionID  *models.SessionID `db:"session_id"`
 	ExpiresOn  time.Time         `db:"expires_on"`
+	NodeUUID   flows.NodeUUID    `db:"node_uuid"`
 }
@@ -2,14 +2,18 @@ package interrupts
 
 import (
 	"context"
+	"encoding/json"
+	"sort"
 	"time"
 
+	"github.com/nyaruka/goflow/flows"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/tasks"
 	"github.com/nyaruka/mailroom/runtime"
 
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // TypeInterruptSessions is the type of the interrupt session task
@@ -19,12 +23,27 @@ func init() {
 	tasks.RegisterType(TypeInterruptSessions, func() tasks.Task { return &InterruptSessionsTask{} })
 }
 
-// InterruptSessionsTask is our task for interrupting sessions
+// how many sessions we interrupt at a time
+const interruptBatchSize = 500
+
+// InterruptSessionsTask is our task for interrupting sessions. Waiting sessions matching any of the selectors are
+// interrupted, i.e. selectors are combined with OR.
 type InterruptSessionsTask struct {
 	SessionIDs []models.SessionID `json:"session_ids,omitempty"`
 	ContactIDs []models.ContactID `json:"contact_ids,omitempty"`
 	ChannelIDs []models.ChannelID `json:"channel_ids,omitempty"`
 	FlowIDs    []models.FlowID    `json:"flow_ids,omitempty"`
+	Nodes      []*InterruptNode   `json:"nodes,omitempty"`
+	Query      string             `json:"query,omitempty"`
+
+	// the user who requested the interruption, if set the interruption is audited
+	RequestedByID models.UserID `json:"requested_by_id,omitempty"`
+}
+
+// InterruptNode selects sessions waiting at a node of a flow
+type InterruptNode struct {
+	FlowID   models.FlowID  `json:"flow_id"   validate:"required"`
+	NodeUUID flows.NodeUUID `json:"node_uuid" validate:"required"`
 }
 
 const activeSessionIDsForChannelsSQL = `
@@ -34,8 +53,9 @@ FROM
 	flows_flowsession fs
 	JOIN channels_channelconnection cc ON fs.connection_id = cc.id
 WHERE
+	fs.org_id = $1 AND
 	fs.status = 'W' AND
-	cc.channel_id = ANY($1);
+	cc.channel_id = ANY($2);
 `
 
 const activeSessionIDsForContactsSQL = `
@@ -44,8 +64,9 @@ SELECT
 FROM 
 	flows_flowsession fs
 WHERE
+	fs.org_id = $1 AND
 	fs.status = 'W' AND
-	fs.contact_id = ANY($1);
+	fs.contact_id = ANY($2);
 `
 
 const activeSessionIDsForFlowsSQL = `
@@ -54,8 +75,23 @@ SELECT
 FROM 
 	flows_flowsession fs
 WHERE
+	fs.org_id = $1 AND
 	fs.status = 'W' AND
-	fs.current_flow_id = ANY($1);
+	fs.current_flow_id = ANY($2);
+`
+
+const activeSessionIDsForNodeSQL = `
+SELECT 
+	DISTINCT fr.session_id
+FROM 
+	flows_flowrun fr
+	JOIN flows_flowsession fs ON fr.session_id = fs.id
+WHERE
+	fr.org_id = $1 AND
+	fr.flow_id = $2 AND
+	fr.current_node_uuid = $3 AND
+	fr.status = 'W' AND
+	fs.status = 'W';
 `
 
 // Timeout is the maximum amount of time the task can run for
@@ -64,6 +100,62 @@ func (t *InterruptSessionsTask) Timeout() time.Duration {
 }
 
 func (t *InterruptSessionsTask) Perform(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) error {
+	log := logrus.WithField("org_id", orgID).WithField("requested_by_id", t.RequestedByID)
+	start := time.Now()
+
+	sessionIDs, err := t.SessionIDsToInterrupt(ctx, rt, orgID)
+	if err != nil {
+		return err
+	}
+
+	// interrupt all sessions and their associated runs in batches
+	interrupted := 0
+	for i := 0; i < len(sessionIDs); i += interruptBatchSize {
+		end := i + interruptBatchSize
+		if end > len(sessionIDs) {
+			end = len(sessionIDs)
+		}
+
+		// find where the runs of these sessions are so we can record where they were interrupted
+		exits, err := models.ActiveRunNodesForSessions(ctx, rt.DB, sessionIDs[i:end])
+		if err != nil {
+			return errors.Wrapf(err, "error finding nodes of runs to interrupt")
+		}
+
+		err = models.ExitSessions(ctx, rt.DB, sessionIDs[i:end], models.ExitInterrupted)
+		if err != nil {
+			log.WithField("interrupted", interrupted).WithField("total", len(sessionIDs)).Error("error interrupting batch of sessions")
+			return errors.Wrapf(err, "error interrupting sessions")
+		}
+
+		models.RecordNodeExits(rt, exits, models.RunStatusInterrupted, time.Now())
+
+		interrupted = end
+		log.WithField("interrupted", interrupted).WithField("total", len(sessionIDs)).Debug("interrupted batch of sessions")
+	}
+
+	if t.RequestedByID != models.NilUserID {
+		log.WithField("interrupted", interrupted).WithField("elapsed", time.Since(start)).Info("interrupted sessions on request")
+
+		selectors, _ := json.Marshal(t)
+		audit := &models.SessionInterruption{
+			OrgID:         orgID,
+			RequestedByID: t.RequestedByID,
+			Selectors:     selectors,
+			Interrupted:   interrupted,
+			StartedOn:     start,
+			EndedOn:       time.Now(),
+		}
+		if err := models.InsertSessionInterruption(ctx, rt.DB, audit); err != nil {
+			return errors.Wrapf(err, "error auditing interrupted sessions")
+		}
+	}
+
+	return nil
+}
+
+// SessionIDsToInterrupt resolves the selectors of this task to the ids of the waiting sessions it would interrupt
+func (t *InterruptSessionsTask) SessionIDsToInterrupt(ctx context.Context, rt *runtime.Runtime, orgID models.OrgID) ([]models.SessionID, error) {
 	db := rt.DB
 
 	sessionIDs := make(map[models.SessionID]bool)
@@ -71,45 +163,58 @@ func (t *InterruptSessionsTask) Perform(ctx context.Context, rt *runtime.Runtime
 		sessionIDs[sid] = true
 	}
 
+	addSessions := func(sql string, args ...interface{}) error {
+		ids := make([]models.SessionID, 0)
+		if err := db.SelectContext(ctx, &ids, sql, args...); err != nil {
+			return err
+		}
+		for _, sid := range ids {
+			sessionIDs[sid] = true
+		}
+		return nil
+	}
+
 	// if we have ivr channel ids, explode those to session ids
 	if len(t.ChannelIDs) > 0 {
-		channelSessionIDs := make([]models.SessionID, 0, len(t.ChannelIDs))
+		if err := addSessions(activeSessionIDsForChannelsSQL, orgID, pq.Array(t.ChannelIDs)); err != nil {
+			return nil, errors.Wrapf(err, "error selecting sessions for channels")
+		}
+	}
 
-		err := db.SelectContext(ctx, &channelSessionIDs, activeSessionIDsForChannelsSQL, pq.Array(t.ChannelIDs))
+	// if we have a query, explode that to contact ids
+	contactIDs := t.ContactIDs
+	if t.Query != "" {
+		oa, err := models.GetOrgAssets(ctx, rt, orgID)
 		if err != nil {
-			return errors.Wrapf(err, "error selecting sessions for channels")
+			return nil, errors.Wrapf(err, "error loading org assets")
 		}
 
-		for _, sid := range channelSessionIDs {
-			sessionIDs[sid] = true
+		queryContactIDs, err := models.SearchContactIDs(ctx, rt, oa, t.Query, false)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error performing contact search")
 		}
+
+		contactIDs = append(append(make([]models.ContactID, 0, len(t.ContactIDs)+len(queryContactIDs)), t.ContactIDs...), queryContactIDs...)
 	}
 
 	// if we have contact ids, explode those to session ids
-	if len(t.ContactIDs) > 0 {
-		contactSessionIDs := make([]models.SessionID, 0, len(t.ContactIDs))
-
-		err := db.SelectContext(ctx, &contactSessionIDs, activeSessionIDsForContactsSQL, pq.Array(t.ContactIDs))
-		if err != nil {
-			return errors.Wrapf(err, "error selecting sessions for contacts")
-		}
-
-		for _, sid := range contactSessionIDs {
-			sessionIDs[sid] = true
+	if len(contactIDs) > 0 {
+		if err := addSessions(activeSessionIDsForContactsSQL, orgID, pq.Array(contactIDs)); err != nil {
+			return nil, errors.Wrapf(err, "error selecting sessions for contacts")
 		}
 	}
 
 	// if we have flow ids, explode those to session ids
 	if len(t.FlowIDs) > 0 {
-		flowSessionIDs := make([]models.SessionID, 0, len(t.FlowIDs))
-
-		err := db.SelectContext(ctx, &flowSessionIDs, activeSessionIDsForFlowsSQL, pq.Array(t.FlowIDs))
-		if err != nil {
-			return errors.Wrapf(err, "error selecting sessions for flows")
+		if err := addSessions(activeSessionIDsForFlowsSQL, orgID, pq.Array(t.FlowIDs)); err != nil {
+			return nil, errors.Wrapf(err, "error selecting sessions for flows")
 		}
+	}
 
-		for _, sid := range flowSessionIDs {
-			sessionIDs[sid] = true
+	// if we have nodes, explode those to the sessions with runs waiting at them
+	for _, node := range t.Nodes {
+		if err := addSessions(activeSessionIDsForNodeSQL, orgID, node.FlowID, node.NodeUUID); err != nil {
+			return nil, errors.Wrapf(err, "error selecting sessions for node %s of flow %d", node.NodeUUID, node.FlowID)
 		}
 	}
 
@@ -117,12 +222,7 @@ func (t *InterruptSessionsTask) Perform(ctx context.Context, rt *runtime.Runtime
 	for id := range sessionIDs {
 		uniqueSessionIDs = append(uniqueSessionIDs, id)
 	}
+	sort.Slice(uniqueSessionIDs, func(i, j int) bool { return uniqueSessionIDs[i] < uniqueSessionIDs[j] })
 
-	// interrupt all sessions and their associated runs
-	err := models.ExitSessions(ctx, db, uniqueSessionIDs, models.ExitInterrupted)
-	if err != nil {
-		return errors.Wrapf(err, "error interrupting sessions")
-	}
-
-	return nil
+	return uniqueSessionIDs, nil
 }
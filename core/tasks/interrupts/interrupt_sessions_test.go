@@ -1,15 +1,20 @@
 package interrupts
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/flows"
 	_ "github.com/nyaruka/mailroom/core/handlers"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 
+	"github.com/lib/pq"
+	"github.com/olivere/elastic/v7"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestInterrupts(t *testing.T) {
@@ -118,3 +123,71 @@ func TestInterrupts(t *testing.T) {
 		}
 	}
 }
+
+func TestInterruptsByNodeAndQuery(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	mes := testsuite.NewMockElasticServer()
+	defer mes.Close()
+	es, err := elastic.NewClient(
+		elastic.SetURL(mes.URL()),
+		elastic.SetHealthcheck(false),
+		elastic.SetSniff(false),
+	)
+	require.NoError(t, err)
+	rt.ES = es
+
+	insertWaitingSession := func(contact *testdata.Contact, flow *testdata.Flow, nodeUUID flows.NodeUUID) models.SessionID {
+		sessionID := testdata.InsertFlowSession(db, testdata.Org1, contact, models.SessionStatusWaiting, nil)
+		runID := testdata.InsertFlowRun(db, testdata.Org1, sessionID, contact, flow, models.RunStatusWaiting, "", nil)
+		db.MustExec(`UPDATE flows_flowrun SET current_node_uuid = $2 WHERE id = $1`, runID, nodeUUID)
+		return sessionID
+	}
+
+	node1 := flows.NodeUUID("b4d3e6a2-2d2f-4a5e-9f6e-0f0d4fd5e1a1")
+	node2 := flows.NodeUUID("0a5f7b0c-6d1e-4d6a-8c1b-3e2f9b1c8d2e")
+
+	cathySession := insertWaitingSession(testdata.Cathy, testdata.Favorites, node1)
+	bobSession := insertWaitingSession(testdata.Bob, testdata.Favorites, node2)
+	georgeSession := insertWaitingSession(testdata.George, testdata.PickANumber, node1)
+
+	// a dry run selects the sessions waiting at the node of that flow only
+	task := &InterruptSessionsTask{Nodes: []*InterruptNode{{FlowID: testdata.Favorites.ID, NodeUUID: node1}}}
+
+	sessionIDs, err := task.SessionIDsToInterrupt(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []models.SessionID{cathySession}, sessionIDs)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_flowsession WHERE status = 'W'`).Returns(3)
+
+	// a query selects the sessions of the contacts it matches
+	mes.NextResponse = fmt.Sprintf(`{
+		"_scroll_id": "DXF1ZXJ5QW5kRmV0Y2gBAAAAAAAbgc0WS1hqbHlfb01SM2lLTWJRMnVOSVZDdw==",
+		"took": 2,
+		"timed_out": false,
+		"_shards": {"total": 1, "successful": 1, "skipped": 0, "failed": 0},
+		"hits": {
+			"total": 1,
+			"max_score": null,
+			"hits": [{"_index": "contacts", "_type": "_doc", "_id": "%d", "_score": null, "_routing": "1", "sort": [15124352]}]
+		}
+	}`, testdata.George.ID)
+
+	task = &InterruptSessionsTask{
+		Nodes:         []*InterruptNode{{FlowID: testdata.Favorites.ID, NodeUUID: node1}},
+		Query:         "name = George",
+		RequestedByID: testdata.Admin.ID,
+	}
+
+	err = task.Perform(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = ANY($1) AND status = 'I'`, pq.Array([]models.SessionID{cathySession, georgeSession})).Returns(2)
+	testsuite.AssertQuery(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, bobSession).Returns("W")
+
+	// and because it was requested by a user, it's audited
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_sessioninterruption WHERE org_id = $1 AND requested_by_id = $2 AND interrupted = 2`, testdata.Org1.ID, testdata.Admin.ID).Returns(1)
+	testsuite.AssertQuery(t, db, `SELECT selectors->>'query' FROM flows_sessioninterruption`).Returns("name = George")
+}
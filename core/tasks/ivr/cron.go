@@ -2,10 +2,12 @@ package ivr
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/librato"
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/core/ivr"
 	"github.com/nyaruka/mailroom/core/models"
@@ -13,12 +15,14 @@ import (
 	"github.com/nyaruka/mailroom/utils/cron"
 
 	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	retryIVRLock  = "retry_ivr_calls"
 	expireIVRLock = "expire_ivr_calls"
+	priceIVRLock  = "price_ivr_calls"
 )
 
 func init() {
@@ -43,6 +47,14 @@ func StartIVRCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error
 		},
 	)
 
+	cron.Start(quit, rt, priceIVRLock, time.Minute, false,
+		func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+			defer cancel()
+			return priceCalls(ctx, rt)
+		},
+	)
+
 	return nil
 }
 
@@ -62,6 +74,13 @@ func retryCalls(ctx context.Context, rt *runtime.Runtime) error {
 
 	throttledChannels := make(map[models.ChannelID]bool)
 
+	// counts of retried connections by previous error reason and by their status after being retried
+	retriedByReason := make(map[string]int)
+	retriedByStatus := make(map[models.ConnectionStatus]int)
+
+	// number of calls actually requested from providers and the total attempts made on them so far
+	attempted, attempts := 0, 0
+
 	// schedules calls for each connection
 	for _, conn := range conns {
 		log = log.WithField("connection_id", conn.ID())
@@ -98,16 +117,41 @@ func retryCalls(ctx context.Context, rt *runtime.Runtime) error {
 			continue
 		}
 
-		err = ivr.RequestCallStartForConnection(ctx, rt, channel, urn, conn)
+		if conn.Status() == models.ConnectionStatusErrored {
+			retriedByReason[models.ConnectionErrorName(conn.ErrorReason())]++
+		}
+
+		prevAttempts := conn.AttemptCount()
+
+		err = ivr.RequestCallStartForConnection(ctx, rt, oa, channel, urn, conn)
 		if err != nil {
 			log.WithError(err).Error(err)
 			continue
 		}
 
+		retriedByStatus[conn.Status()]++
+		if conn.AttemptCount() > prevAttempts {
+			attempted++
+			attempts += conn.AttemptCount()
+		}
+
 		// queued status on a connection we just tried means it is throttled, mark our channel as such
 		throttledChannels[conn.ChannelID()] = true
 	}
 
+	librato.Gauge("mr.ivr_retry_elapsed", float64(time.Since(start))/float64(time.Second))
+	librato.Gauge("mr.ivr_retry_count", float64(len(conns)))
+	librato.Gauge("mr.ivr_retry_wired", float64(retriedByStatus[models.ConnectionStatusWired]))
+	librato.Gauge("mr.ivr_retry_queued", float64(retriedByStatus[models.ConnectionStatusQueued]))
+	librato.Gauge("mr.ivr_retry_failed", float64(retriedByStatus[models.ConnectionStatusFailed]))
+	librato.Gauge("mr.ivr_retry_attempted", float64(attempted))
+	if attempted > 0 {
+		librato.Gauge("mr.ivr_retry_avg_attempts", float64(attempts)/float64(attempted))
+	}
+	for reason, count := range retriedByReason {
+		librato.Gauge(fmt.Sprintf("mr.ivr_retry_%s", reason), float64(count))
+	}
+
 	log.WithField("count", len(conns)).WithField("elapsed", time.Since(start)).Info("retried errored calls")
 
 	return nil
@@ -168,6 +212,65 @@ func expireCalls(ctx context.Context, rt *runtime.Runtime) error {
 	return nil
 }
 
+// priceCalls looks for call detail records which weren't priced when the call ended and asks the provider for their price
+func priceCalls(ctx context.Context, rt *runtime.Runtime) error {
+	log := logrus.WithField("comp", "ivr_cron_pricer")
+	start := time.Now()
+
+	cdrs, err := models.LoadCallDetailRecordsToPrice(ctx, rt.DB, 100)
+	if err != nil {
+		return errors.Wrapf(err, "error loading call detail records to price")
+	}
+
+	priced := 0
+
+	for _, cdr := range cdrs {
+		log := log.WithField("connection_id", cdr.ConnectionID).WithField("external_id", cdr.ExternalID)
+
+		// by default don't check again, i.e. if the channel is gone or its provider can't price calls
+		checks := models.CDRMaxPriceChecks
+		var price *decimal.Decimal
+		var currency string
+
+		oa, err := models.GetOrgAssets(ctx, rt, cdr.OrgID)
+		if err != nil {
+			log.WithError(err).WithField("org_id", cdr.OrgID).Error("error loading org")
+			continue
+		}
+
+		if channel := oa.ChannelByID(cdr.ChannelID); channel != nil {
+			svc, err := ivr.GetService(channel)
+			if err != nil {
+				log.WithError(err).Error("unable to create IVR service")
+				continue
+			}
+
+			if ps, canPrice := svc.(ivr.CDRPriceService); canPrice {
+				checks = cdr.PriceChecks + 1
+
+				price, currency, _, err = ps.CallPrice(cdr.ExternalID)
+				if err != nil {
+					log.WithError(err).Error("error fetching price of call")
+				}
+			}
+		}
+
+		if err := cdr.UpdatePrice(ctx, rt.DB, price, currency, checks); err != nil {
+			log.WithError(err).Error("error updating price of call")
+			continue
+		}
+		if price != nil {
+			priced++
+		}
+	}
+
+	if len(cdrs) > 0 {
+		log.WithField("count", len(cdrs)).WithField("priced", priced).WithField("elapsed", time.Since(start)).Info("checked prices of calls")
+	}
+
+	return nil
+}
+
 const selectExpiredRunsSQL = `
 	SELECT
 		fr.id as run_id,	
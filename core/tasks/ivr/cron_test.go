@@ -3,11 +3,14 @@ package ivr
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
+	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/mailroom/core/ivr"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/core/tasks/starts"
+	_ "github.com/nyaruka/mailroom/services/ivr/twiml"
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 
@@ -60,6 +63,9 @@ func TestRetries(t *testing.T) {
 	testsuite.AssertQuery(t, db, `SELECT COUNT(*) FROM channels_channelconnection WHERE contact_id = $1 AND status = $2 AND external_id = $3`,
 		testdata.Cathy.ID, models.ConnectionStatusWired, "call1").Returns(1)
 
+	// and both attempts recorded on the connection
+	testsuite.AssertQuery(t, db, `SELECT COUNT(*) FROM channels_channelconnection WHERE external_id = 'call1' AND attempt_count = 2 AND last_attempt_on IS NOT NULL`).Returns(1)
+
 	// back to retry and make the channel inactive
 	db.MustExec(`UPDATE channels_channelconnection SET status = 'E', next_attempt = NOW() WHERE external_id = 'call1';`)
 	db.MustExec(`UPDATE channels_channel SET is_active = FALSE WHERE id = $1`, testdata.TwilioChannel.ID)
@@ -72,3 +78,37 @@ func TestRetries(t *testing.T) {
 	testsuite.AssertQuery(t, db, `SELECT COUNT(*) FROM channels_channelconnection WHERE contact_id = $1 AND status = $2 AND external_id = $3`,
 		testdata.Cathy.ID, models.ConnectionStatusFailed, "call1").Returns(1)
 }
+
+func TestPriceCalls(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://api.twilio.com/2010-04-01/Accounts/sid/Calls/CA123.json": {
+			httpx.NewMockResponse(200, nil, `{"sid": "CA123", "status": "completed", "price": "-0.14000", "price_unit": "USD"}`),
+		},
+		"https://api.twilio.com/2010-04-01/Accounts/sid/Calls/CA456.json": {
+			httpx.NewMockResponse(200, nil, `{"sid": "CA456", "status": "completed", "price": null, "price_unit": "USD"}`),
+		},
+	}))
+
+	db.MustExec(`UPDATE channels_channel SET config = config::jsonb || '{"auth_token": "token", "account_sid": "sid"}'::jsonb WHERE id = $1`, testdata.TwilioChannel.ID)
+
+	conn1, err := models.InsertIVRConnection(ctx, db, testdata.Org1.ID, testdata.TwilioChannel.ID, models.NilStartID, testdata.Cathy.ID, testdata.Cathy.URNID, models.ConnectionDirectionOut, models.ConnectionStatusCompleted, "CA123")
+	assert.NoError(t, err)
+	conn2, err := models.InsertIVRConnection(ctx, db, testdata.Org1.ID, testdata.TwilioChannel.ID, models.NilStartID, testdata.Bob.ID, testdata.Bob.URNID, models.ConnectionDirectionOut, models.ConnectionStatusCompleted, "CA456")
+	assert.NoError(t, err)
+
+	endedOn := time.Now().Add(-time.Hour)
+	assert.NoError(t, models.RecordCallDetailRecord(ctx, db, conn1, &models.CallDetailRecord{Status: models.ConnectionStatusCompleted, Duration: 60, HangupCause: "completed", EndedOn: endedOn}))
+	assert.NoError(t, models.RecordCallDetailRecord(ctx, db, conn2, &models.CallDetailRecord{Status: models.ConnectionStatusCompleted, Duration: 30, HangupCause: "completed", EndedOn: endedOn}))
+
+	err = priceCalls(ctx, rt)
+	assert.NoError(t, err)
+
+	// first call now priced, second will be checked again later
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM channels_channelconnectioncdr WHERE connection_id = $1 AND price = 0.14 AND currency = 'USD' AND price_checks = 1`, conn1.ID()).Returns(1)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM channels_channelconnectioncdr WHERE connection_id = $1 AND price IS NULL AND price_checks = 1`, conn2.ID()).Returns(1)
+}
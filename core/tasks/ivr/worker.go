@@ -16,6 +16,7 @@ import (
 
 func init() {
 	mailroom.AddTaskFunction(queue.StartIVRFlowBatch, handleFlowStartTask)
+	mailroom.AddTaskFunction(queue.TranscribeRecording, handleTranscribeRecordingTask)
 }
 
 func handleFlowStartTask(ctx context.Context, rt *runtime.Runtime, task *queue.Task) error {
@@ -32,6 +33,18 @@ func handleFlowStartTask(ctx context.Context, rt *runtime.Runtime, task *queue.T
 	return HandleFlowStartBatch(ctx, rt, batch)
 }
 
+func handleTranscribeRecordingTask(ctx context.Context, rt *runtime.Runtime, task *queue.Task) error {
+	transcribe := &ivr.TranscribeRecordingTask{}
+	if err := json.Unmarshal(task.Task, transcribe); err != nil {
+		return errors.Wrapf(err, "error unmarshalling transcription task: %s", string(task.Task))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+
+	return ivr.TranscribeRecording(ctx, rt, models.OrgID(task.OrgID), transcribe)
+}
+
 // HandleFlowStartBatch starts a batch of contacts in an IVR flow
 func HandleFlowStartBatch(bg context.Context, rt *runtime.Runtime, batch *models.FlowStartBatch) error {
 	ctx, cancel := context.WithTimeout(bg, time.Minute*5)
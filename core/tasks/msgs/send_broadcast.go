@@ -66,6 +66,12 @@ func CreateBroadcastBatches(ctx context.Context, rt *runtime.Runtime, bcast *mod
 		return errors.Wrapf(err, "error getting contact ids for urns")
 	}
 
+	// add the contacts matching our query and remove those in our exclusion groups
+	err = resolveQueryRecipients(ctx, rt, oa, bcast.Query(), bcast.ExcludeGroupIDs(), contactIDs, urnMap)
+	if err != nil {
+		return errors.Wrapf(err, "error resolving query recipients for broadcast: %d", bcast.ID())
+	}
+
 	urnContacts := make(map[models.ContactID]urns.URN)
 	repeatedContacts := make(map[models.ContactID]urns.URN)
 
@@ -88,7 +94,11 @@ func CreateBroadcastBatches(ctx context.Context, rt *runtime.Runtime, bcast *mod
 	rc := rt.RP.Get()
 	defer rc.Close()
 
+	// batches are spread over time to respect the throughput budget of the org's sending channel, if it only has one
+	channel := models.ThrottleChannel(oa, models.NilChannelID)
+
 	contacts := make([]models.ContactID, 0, 100)
+	batches := 0
 
 	// utility functions for queueing the current set of contacts
 	queueBatch := func(isLast bool) {
@@ -107,10 +117,11 @@ func CreateBroadcastBatches(ctx context.Context, rt *runtime.Runtime, bcast *mod
 			batch.SetURNs(urnContacts)
 		}
 
-		err = queue.AddTask(rc, q, queue.SendBroadcastBatch, int(bcast.OrgID()), batch, queue.DefaultPriority)
+		err = models.QueueThrottledTask(rc, channel, len(batch.ContactIDs())+len(batch.URNs()), q, queue.SendBroadcastBatch, bcast.OrgID(), batch, queue.DefaultPriority)
 		if err != nil {
 			logrus.WithError(err).Error("error while queuing broadcast batch")
 		}
+		batches++
 		contacts = make([]models.ContactID, 0, 100)
 	}
 
@@ -125,6 +136,47 @@ func CreateBroadcastBatches(ctx context.Context, rt *runtime.Runtime, bcast *mod
 	// queue our last batch
 	queueBatch(true)
 
+	// contacts in URN sends are either in our contact set or have been removed from it as repeated
+	err = models.IncrementBroadcastStats(rc, bcast.ID(), &models.BroadcastStats{ContactsResolved: len(contactIDs) + len(urnContacts), BatchesTotal: batches})
+	if err != nil {
+		logrus.WithError(err).Error("error recording broadcast stats")
+	}
+
+	return nil
+}
+
+// resolveQueryRecipients adds the contacts matching the passed in query to our set of contact ids, then removes all
+// contacts in the passed in exclusion groups, including those we would otherwise send to by URN
+func resolveQueryRecipients(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, query string, excludeGroupIDs []models.GroupID, contactIDs map[models.ContactID]bool, urnMap map[urns.URN]models.ContactID) error {
+	if query != "" {
+		matches, err := models.SearchContactIDs(ctx, rt, oa, query, false)
+		if err != nil {
+			return errors.Wrapf(err, "error performing search")
+		}
+
+		for _, id := range matches {
+			contactIDs[id] = true
+		}
+	}
+
+	if len(excludeGroupIDs) > 0 {
+		excludeContactIDs, err := models.ContactIDsForGroupIDs(ctx, rt.DB, excludeGroupIDs)
+		if err != nil {
+			return errors.Wrapf(err, "error getting contact ids for exclusion groups")
+		}
+
+		excluded := make(map[models.ContactID]bool, len(excludeContactIDs))
+		for _, id := range excludeContactIDs {
+			delete(contactIDs, id)
+			excluded[id] = true
+		}
+		for u, id := range urnMap {
+			if excluded[id] {
+				delete(urnMap, u)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -171,5 +223,18 @@ func SendBroadcastBatch(ctx context.Context, rt *runtime.Runtime, bcast *models.
 	}
 
 	msgio.SendMessages(ctx, rt, rt.DB, nil, msgs)
+
+	// record how this batch went in our broadcast stats
+	stats := models.BroadcastStatsForMsgs(msgs)
+	stats.BatchesSent = 1
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	err = models.IncrementBroadcastStats(rc, bcast.BroadcastID(), stats)
+	if err != nil {
+		logrus.WithError(err).Error("error recording broadcast stats")
+	}
+
 	return nil
 }
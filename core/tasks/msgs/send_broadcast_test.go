@@ -2,6 +2,7 @@ package msgs_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
@@ -17,7 +18,9 @@ import (
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 
+	"github.com/olivere/elastic/v7"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBroadcastEvents(t *testing.T) {
@@ -525,3 +528,110 @@ func TestBroadcastWithHeaderFooterAndCatalog(t *testing.T) {
 		time.Sleep(10 * time.Millisecond)
 	}
 }
+
+func TestBroadcastTaskWithQuery(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	mes := testsuite.NewMockElasticServer()
+	defer mes.Close()
+
+	es, err := elastic.NewClient(
+		elastic.SetURL(mes.URL()),
+		elastic.SetHealthcheck(false),
+		elastic.SetSniff(false),
+	)
+	require.NoError(t, err)
+	rt.ES = es
+
+	// query matches Bob and George, but George is in a group we exclude
+	mes.NextResponse = fmt.Sprintf(`{
+		"_scroll_id": "DXF1ZXJ5QW5kRmV0Y2gBAAAAAAAbgc0WS1hqbHlfb01SM2lLTWJRMnVOSVZDdw==",
+		"took": 2,
+		"timed_out": false,
+		"_shards": {"total": 1, "successful": 1, "skipped": 0, "failed": 0},
+		"hits": {
+			"total": 2,
+			"max_score": null,
+			"hits": [
+				{"_index": "contacts", "_type": "_doc", "_id": "%d", "_score": null, "_routing": "1", "sort": [15124352]},
+				{"_index": "contacts", "_type": "_doc", "_id": "%d", "_score": null, "_routing": "1", "sort": [15124353]}
+			]
+		}
+	}`, testdata.Bob.ID, testdata.George.ID)
+
+	excluded := testdata.InsertContactGroup(db, testdata.Org1, "b8d1c3f2-5a0e-4c4e-9a57-2f4f7e0c6d21", "Excluded", "")
+	excluded.Add(db, testdata.George)
+
+	translations := map[envs.Language]*models.BroadcastTranslation{"eng": {Text: "hello adults"}}
+
+	lastNow := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	// George is also a recipient by URN but exclusion applies to those too
+	bcast := models.NewBroadcast(testdata.Org1.ID, models.NilBroadcastID, translations, models.TemplateStateEvaluated, envs.Language("eng"), []urns.URN{testdata.George.URN}, []models.ContactID{testdata.Cathy.ID}, nil, models.NilTicketID, events.BroadcastTypeDefault, models.BroadcastMessageHeader{}, "", models.BroadcastCatalogMessage{}).
+		WithQuery("age > 18").
+		WithExcludeGroupIDs([]models.GroupID{excluded.ID})
+
+	err = msgs.CreateBroadcastBatches(ctx, rt, bcast)
+	require.NoError(t, err)
+
+	task, err := queue.PopNextTask(rc, queue.HandlerQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+
+	batch := &models.BroadcastBatch{}
+	require.NoError(t, json.Unmarshal(task.Task, batch))
+	assert.ElementsMatch(t, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, batch.ContactIDs())
+	assert.Len(t, batch.URNs(), 0)
+
+	err = msgs.SendBroadcastBatch(ctx, rt, batch)
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE org_id = 1 AND created_on > $1 AND text = 'hello adults'`, lastNow).Returns(2)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND created_on > $2 AND text = 'hello adults'`, testdata.George.ID, lastNow).Returns(0)
+}
+
+func TestBroadcastTaskThrottled(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// Org2 only has one channel so its broadcasts respect that channel's budget
+	db.MustExec(`UPDATE channels_channel SET config = config::jsonb || '{"throughput_per_minute": 60}'::jsonb WHERE id = $1`, testdata.Org2Channel.ID)
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org2.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	channel := oa.ChannelByID(testdata.Org2Channel.ID)
+	require.NotNil(t, channel)
+
+	// another send has already reserved the next minute of the channel
+	now := time.Now()
+	_, err = models.ReserveChannelThroughput(rc, channel, 60, now)
+	require.NoError(t, err)
+
+	translations := map[envs.Language]*models.BroadcastTranslation{"eng": {Text: "hello"}}
+	bcast := models.NewBroadcast(testdata.Org2.ID, models.NilBroadcastID, translations, models.TemplateStateEvaluated, envs.Language("eng"), nil, []models.ContactID{testdata.Org2Contact.ID}, nil, models.NilTicketID, events.BroadcastTypeDefault, models.BroadcastMessageHeader{}, "", models.BroadcastCatalogMessage{})
+
+	err = msgs.CreateBroadcastBatches(ctx, rt, bcast)
+	require.NoError(t, err)
+
+	// so our batch is scheduled for after that and can't be popped yet
+	task, err := queue.PopNextTask(rc, queue.HandlerQueue)
+	require.NoError(t, err)
+	assert.Nil(t, task)
+
+	size, err := queue.Size(rc, queue.HandlerQueue)
+	require.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	budget, err := models.GetChannelBudget(rc, channel, now)
+	require.NoError(t, err)
+	assert.WithinDuration(t, now.Add(61*time.Second), budget.NextSendOn, time.Second)
+}
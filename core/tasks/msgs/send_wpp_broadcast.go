@@ -66,6 +66,12 @@ func CreateWppBroadcastBatches(ctx context.Context, rt *runtime.Runtime, bcast *
 		return errors.Wrapf(err, "error getting contact ids for urns")
 	}
 
+	// add the contacts matching our query and remove those in our exclusion groups
+	err = resolveQueryRecipients(ctx, rt, oa, bcast.Query(), bcast.ExcludeGroupIDs(), contactIDs, urnMap)
+	if err != nil {
+		return errors.Wrapf(err, "error resolving query recipients for wpp broadcast: %d", bcast.ID())
+	}
+
 	urnContacts := make(map[models.ContactID]urns.URN)
 	repeatedContacts := make(map[models.ContactID]urns.URN)
 
@@ -100,46 +106,106 @@ func CreateWppBroadcastBatches(ctx context.Context, rt *runtime.Runtime, bcast *
 	rc := rt.RP.Get()
 	defer rc.Close()
 
+	// if this broadcast is an A/B split, each variant gets its own cohort of contacts and its own batches
+	cohorts := []*wppBroadcastCohort{{contactIDs: contactIDs, urnContacts: urnContacts, repeatedContacts: repeatedContacts}}
+	if len(bcast.Variants()) > 0 {
+		cohorts = splitWppBroadcastCohorts(bcast, contactIDs, urnContacts, repeatedContacts)
+	}
+
+	// batches are spread over time to respect the throughput budget of the channel we're sending on
+	channel := models.ThrottleChannel(oa, bcast.ChannelID())
+
 	contacts := make([]models.ContactID, 0, 100)
+	batches := 0
 
 	// utility functions for queueing the current set of contacts
-	queueBatch := func(isLast bool) {
-		// if this is our last batch include those contacts that overlap with our urns
-		if isLast {
-			for id := range repeatedContacts {
+	queueBatch := func(c *wppBroadcastCohort, isFinal, isLast bool) {
+		// if this is the final batch of the cohort include those contacts that overlap with our urns
+		if isFinal {
+			for id := range c.repeatedContacts {
 				contacts = append(contacts, id)
 			}
 		}
 
-		batch := bcast.CreateBatch(contacts)
+		var batch *models.WppBroadcastBatch
+		if c.variant != nil {
+			batch = bcast.CreateVariantBatch(contacts, c.variant)
+		} else {
+			batch = bcast.CreateBatch(contacts)
+		}
 
 		// also set our URNs
-		if isLast {
-			batch.SetIsLast(true)
-			batch.SetURNs(urnContacts)
+		if isFinal {
+			batch.SetIsLast(isLast)
+			batch.SetURNs(c.urnContacts)
 		}
 
-		err = queue.AddTask(rc, q, queue.SendWppBroadcastBatch, int(bcast.OrgID()), batch, priority)
+		err = models.QueueThrottledTask(rc, channel, len(batch.ContactIDs())+len(batch.URNs()), q, queue.SendWppBroadcastBatch, bcast.OrgID(), batch, priority)
 		if err != nil {
 			logrus.WithError(err).Error("error while queuing wpp broadcast batch")
 		}
+		batches++
 		contacts = make([]models.ContactID, 0, 100)
 	}
 
-	// build up batches of contacts to start
-	for c := range contactIDs {
-		if len(contacts) == startBatchSize {
-			queueBatch(false)
+	for i, c := range cohorts {
+		// build up batches of contacts to start
+		for id := range c.contactIDs {
+			if len(contacts) == startBatchSize {
+				queueBatch(c, false, false)
+			}
+			contacts = append(contacts, id)
 		}
-		contacts = append(contacts, c)
+
+		// queue the final batch of this cohort, which is our last if this is our last cohort
+		queueBatch(c, true, i == len(cohorts)-1)
 	}
 
-	// queue our last batch
-	queueBatch(true)
+	// contacts in URN sends are either in our contact set or have been removed from it as repeated
+	err = models.IncrementBroadcastStats(rc, bcast.ID(), &models.BroadcastStats{ContactsResolved: len(contactIDs) + len(urnContacts), BatchesTotal: batches})
+	if err != nil {
+		logrus.WithError(err).Error("error recording wpp broadcast stats")
+	}
 
 	return nil
 }
 
+// wppBroadcastCohort is the set of contacts which will receive the same message of a broadcast
+type wppBroadcastCohort struct {
+	variant          *models.WppBroadcastVariant
+	contactIDs       map[models.ContactID]bool
+	urnContacts      map[models.ContactID]urns.URN
+	repeatedContacts map[models.ContactID]urns.URN
+}
+
+// splits the recipients of an A/B split broadcast into a cohort per variant, seeded by the broadcast id
+func splitWppBroadcastCohorts(bcast *models.WppBroadcast, contactIDs map[models.ContactID]bool, urnContacts, repeatedContacts map[models.ContactID]urns.URN) []*wppBroadcastCohort {
+	variants := bcast.ABVariants()
+	seed := int64(bcast.ID())
+
+	cohorts := make([]*wppBroadcastCohort, len(variants))
+	for i, v := range bcast.Variants() {
+		cohorts[i] = &wppBroadcastCohort{
+			variant:          v,
+			contactIDs:       make(map[models.ContactID]bool),
+			urnContacts:      make(map[models.ContactID]urns.URN),
+			repeatedContacts: make(map[models.ContactID]urns.URN),
+		}
+	}
+
+	for id := range contactIDs {
+		cohorts[models.AssignABVariant(seed, id, variants)].contactIDs[id] = true
+	}
+	for id, u := range urnContacts {
+		cohorts[models.AssignABVariant(seed, id, variants)].urnContacts[id] = u
+	}
+	for id, u := range repeatedContacts {
+		cohorts[models.AssignABVariant(seed, id, variants)].repeatedContacts[id] = u
+	}
+
+	return cohorts
+}
+
 func handleSendWppBroadcastBatch(ctx context.Context, rt *runtime.Runtime, task *queue.Task) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Minute*60)
 	defer cancel()
@@ -174,6 +240,14 @@ func SendWppBroadcastBatch(ctx context.Context, rt *runtime.Runtime, bcast *mode
 		return errors.Wrapf(err, "error getting org assets")
 	}
 
+	// if this batch is for a variant of an A/B split, record that on the contacts
+	if bcast.Variant() != "" {
+		err = models.SetContactABVariants(ctx, rt, oa, wppBroadcastBatchContactIDs(bcast), bcast.Variant())
+		if err != nil {
+			return errors.Wrapf(err, "error setting A/B variant of contacts")
+		}
+	}
+
 	// create this batch of messages
 	msgs, err := models.CreateWppBroadcastMessages(ctx, rt, oa, bcast)
 	if err != nil {
@@ -181,5 +255,34 @@ func SendWppBroadcastBatch(ctx context.Context, rt *runtime.Runtime, bcast *mode
 	}
 
 	msgio.SendMessages(ctx, rt, rt.DB, nil, msgs)
+
+	// record how this batch went in our broadcast stats
+	stats := models.BroadcastStatsForMsgs(msgs)
+	stats.BatchesSent = 1
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	err = models.IncrementBroadcastStats(rc, bcast.BroadcastID(), stats)
+	if err != nil {
+		logrus.WithError(err).Error("error recording wpp broadcast stats")
+	}
+
 	return nil
 }
+
+// gets the ids of all the contacts in the given batch, including those only referenced by URN
+func wppBroadcastBatchContactIDs(bcast *models.WppBroadcastBatch) []models.ContactID {
+	contactIDs := make([]models.ContactID, 0, len(bcast.ContactIDs())+len(bcast.URNs()))
+	seen := make(map[models.ContactID]bool, len(bcast.ContactIDs()))
+	for _, id := range bcast.ContactIDs() {
+		contactIDs = append(contactIDs, id)
+		seen[id] = true
+	}
+	for id := range bcast.URNs() {
+		if !seen[id] {
+			contactIDs = append(contactIDs, id)
+		}
+	}
+	return contactIDs
+}
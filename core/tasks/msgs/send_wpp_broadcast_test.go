@@ -2,6 +2,7 @@ package msgs_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
@@ -16,7 +17,9 @@ import (
 	"github.com/nyaruka/mailroom/testsuite"
 	"github.com/nyaruka/mailroom/testsuite/testdata"
 
+	"github.com/olivere/elastic/v7"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestWppBroadcastTask(t *testing.T) {
@@ -511,3 +514,64 @@ func TestWppBroadcastTask(t *testing.T) {
 		time.Sleep(10 * time.Millisecond)
 	}
 }
+
+func TestWppBroadcastTaskWithQuery(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	mes := testsuite.NewMockElasticServer()
+	defer mes.Close()
+
+	es, err := elastic.NewClient(
+		elastic.SetURL(mes.URL()),
+		elastic.SetHealthcheck(false),
+		elastic.SetSniff(false),
+	)
+	require.NoError(t, err)
+	rt.ES = es
+
+	// query matches Bob and George, but George is in a group we exclude
+	mes.NextResponse = fmt.Sprintf(`{
+		"_scroll_id": "DXF1ZXJ5QW5kRmV0Y2gBAAAAAAAbgc0WS1hqbHlfb01SM2lLTWJRMnVOSVZDdw==",
+		"took": 2,
+		"timed_out": false,
+		"_shards": {"total": 1, "successful": 1, "skipped": 0, "failed": 0},
+		"hits": {
+			"total": 2,
+			"max_score": null,
+			"hits": [
+				{"_index": "contacts", "_type": "_doc", "_id": "%d", "_score": null, "_routing": "1", "sort": [15124352]},
+				{"_index": "contacts", "_type": "_doc", "_id": "%d", "_score": null, "_routing": "1", "sort": [15124353]}
+			]
+		}
+	}`, testdata.Bob.ID, testdata.George.ID)
+
+	excluded := testdata.InsertContactGroup(db, testdata.Org1, "7d1a5a7e-0c6a-4bd2-9d8c-1f7d5f35e3a2", "Excluded", "")
+	excluded.Add(db, testdata.George)
+
+	lastNow := time.Now()
+
+	bcast := models.NewWppBroadcast(testdata.Org1.ID, models.NilBroadcastID, models.WppBroadcastMessage{Text: "hello adults"}, nil, []models.ContactID{testdata.Cathy.ID}, nil, models.NilChannelID, queue.WppBroadcastBatchQueue).
+		WithQuery("age > 18").
+		WithExcludeGroupIDs([]models.GroupID{excluded.ID})
+
+	err = msgs.CreateWppBroadcastBatches(ctx, rt, bcast)
+	require.NoError(t, err)
+
+	task, err := queue.PopNextTask(rc, queue.WppBroadcastBatchQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+
+	batch := &models.WppBroadcastBatch{}
+	require.NoError(t, json.Unmarshal(task.Task, batch))
+	assert.ElementsMatch(t, []models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}, batch.ContactIDs())
+
+	err = msgs.SendWppBroadcastBatch(ctx, rt, batch)
+	require.NoError(t, err)
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE org_id = 1 AND created_on > $1 AND text = 'hello adults'`, lastNow).Returns(2)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND created_on > $2 AND text = 'hello adults'`, testdata.George.ID, lastNow).Returns(0)
+}
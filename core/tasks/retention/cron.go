@@ -0,0 +1,79 @@
+package retention
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/mailroom"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/cron"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	retentionLock    = "session_retention"
+	archiveBatchSize = 500
+)
+
+// how long a single run of our cron can spend archiving before it leaves the rest for next time
+var maxArchiveTime = time.Minute * 10
+
+func init() {
+	mailroom.AddInitFunction(StartRetentionCron)
+}
+
+// StartRetentionCron starts our cron job of archiving sessions which are older than their org's retention policy
+func StartRetentionCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
+	cron.Start(quit, rt, retentionLock, time.Hour, false,
+		func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), maxArchiveTime+time.Minute*5)
+			defer cancel()
+			return archiveSessions(ctx, rt)
+		},
+	)
+	return nil
+}
+
+// archiveSessions archives the ended sessions of each org which are older than its retention policy allows
+func archiveSessions(ctx context.Context, rt *runtime.Runtime) error {
+	log := logrus.WithField("comp", "session_retention")
+	start := time.Now()
+
+	policies, err := models.LoadSessionRetentionPolicies(ctx, rt.DB, rt.Config.SessionRetentionDays)
+	if err != nil {
+		return errors.Wrapf(err, "error loading session retention policies")
+	}
+
+	numSessions, numRuns := 0, 0
+
+	for _, policy := range policies {
+		endedBefore := start.AddDate(0, 0, -policy.Days)
+
+		for time.Since(start) < maxArchiveTime {
+			manifest, err := models.ArchiveSessions(ctx, rt, policy.OrgID, endedBefore, archiveBatchSize)
+			if err != nil {
+				return errors.Wrapf(err, "error archiving sessions for org %d", policy.OrgID)
+			}
+			if manifest == nil {
+				break
+			}
+
+			numSessions += len(manifest.SessionUUIDs)
+			numRuns += len(manifest.RunUUIDs)
+
+			log.WithField("org_id", policy.OrgID).WithField("path", manifest.Path).WithField("sessions", len(manifest.SessionUUIDs)).Info("archived sessions")
+
+			if len(manifest.SessionUUIDs) < archiveBatchSize {
+				break
+			}
+		}
+	}
+
+	log.WithField("elapsed", time.Since(start)).WithField("sessions", numSessions).WithField("runs", numRuns).Info("session retention complete")
+
+	return nil
+}
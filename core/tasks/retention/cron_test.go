@@ -0,0 +1,82 @@
+package retention
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveSessions(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// org 1 keeps sessions for 30 days, org 2 keeps them forever
+	db.MustExec(`UPDATE orgs_org SET config = config::jsonb || '{"session_retention_days": 30}'::jsonb WHERE id = $1`, testdata.Org1.ID)
+
+	insertSession := func(org *testdata.Org, contact *testdata.Contact, status models.SessionStatus, endedDaysAgo int) (models.SessionID, models.FlowRunID) {
+		sessionID := testdata.InsertFlowSession(db, org, contact, status, nil)
+		runID := testdata.InsertFlowRun(db, org, sessionID, contact, testdata.Favorites, models.RunStatusCompleted, "", nil)
+		db.MustExec(`UPDATE flows_flowsession SET output = '{"uuid": "x"}', ended_on = NOW() - make_interval(days => $2) WHERE id = $1`, sessionID, endedDaysAgo)
+		return sessionID, runID
+	}
+
+	old, oldRun := insertSession(testdata.Org1, testdata.Cathy, models.SessionStatusCompleted, 60)
+	recent, _ := insertSession(testdata.Org1, testdata.Bob, models.SessionStatusCompleted, 10)
+	waiting, _ := insertSession(testdata.Org1, testdata.George, models.SessionStatusWaiting, 60)
+	otherOrg, _ := insertSession(testdata.Org2, testdata.Org2Contact, models.SessionStatusCompleted, 60)
+
+	var oldUUID flows.SessionUUID
+	var oldRunUUID flows.RunUUID
+	db.Get(&oldUUID, `SELECT uuid FROM flows_flowsession WHERE id = $1`, old)
+	db.Get(&oldRunUUID, `SELECT uuid FROM flows_flowrun WHERE id = $1`, oldRun)
+
+	err := archiveSessions(ctx, rt)
+	require.NoError(t, err)
+
+	// only the old ended session of org 1 and its run are gone
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_flowsession WHERE id = $1`, old).Returns(0)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_flowrun WHERE session_id = $1`, old).Returns(0)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_flowsession WHERE id IN ($1, $2, $3)`, recent, waiting, otherOrg).Returns(3)
+
+	// and are indexed by the archive they were written to
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_archivedsession WHERE org_id = $1 AND session_uuid = $2 AND run_uuids = ARRAY[$3::uuid]`, testdata.Org1.ID, oldUUID, oldRunUUID).Returns(1)
+
+	// but can still be read from the archive
+	session, err := models.LoadSessionByUUID(ctx, rt, testdata.Org1.ID, oldUUID)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	assert.Equal(t, old, session.ID())
+	assert.Equal(t, models.SessionStatusCompleted, session.Status())
+	assert.Equal(t, `{"uuid": "x"}`, session.Output())
+
+	run, err := models.LoadRunRecord(ctx, rt, testdata.Org1.ID, oldRunUUID)
+	require.NoError(t, err)
+	require.NotNil(t, run)
+
+	runJSON := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(run, &runJSON))
+	assert.Equal(t, string(oldRunUUID), runJSON["uuid"])
+	assert.Equal(t, float64(old), runJSON["session_id"])
+
+	// but not from another org
+	session, err = models.LoadSessionByUUID(ctx, rt, testdata.Org2.ID, oldUUID)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+
+	run, err = models.LoadRunRecord(ctx, rt, testdata.Org2.ID, oldRunUUID)
+	require.NoError(t, err)
+	assert.Nil(t, run)
+
+	// running again has nothing to archive
+	err = archiveSessions(ctx, rt)
+	require.NoError(t, err)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM flows_flowsession WHERE id IN ($1, $2, $3)`, recent, waiting, otherOrg).Returns(3)
+}
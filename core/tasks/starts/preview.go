@@ -0,0 +1,331 @@
+package starts
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// how many contacts we check at a time when previewing a start
+const previewBatchSize = 1000
+
+// StartPreview is what would happen if a flow start was started now
+type StartPreview struct {
+	Total       int             `json:"total"`
+	NewContacts int             `json:"new_contacts"`
+	Excluded    StartExclusions `json:"excluded"`
+	ToStart     int             `json:"to_start"`
+	Warnings    StartWarnings   `json:"warnings"`
+}
+
+// StartExclusions are the counts of contacts who would be excluded from a start. Contacts are only counted against
+// the first reason they would be excluded for.
+type StartExclusions struct {
+	StartedPreviously int `json:"started_previously"`
+	InOtherFlows      int `json:"in_other_flows"`
+}
+
+// StartWarnings are the counts of contacts who would be started but likely won't get what the flow sends them
+type StartWarnings struct {
+	Blocked    int                `json:"blocked"`
+	Stopped    int                `json:"stopped"`
+	MissingURN MissingURNWarning  `json:"missing_urn"`
+	Templates  []*TemplateWarning `json:"templates"`
+}
+
+// MissingURNWarning is the number of contacts who have no URN with any of the schemes of the flow's channels
+type MissingURNWarning struct {
+	Schemes  []string `json:"schemes"`
+	Contacts int      `json:"contacts"`
+}
+
+// TemplateWarning is a template used by the flow which has no translation for the languages of some contacts
+type TemplateWarning struct {
+	UUID             assets.TemplateUUID `json:"uuid"`
+	Name             string              `json:"name"`
+	MissingLanguages []envs.Language     `json:"missing_languages"`
+	Contacts         int                 `json:"contacts"`
+}
+
+// PreviewFlowStart resolves the contacts of the passed in start the same way as starting it would, without creating
+// any contacts, and reports who would be excluded and any problems those started would likely run into.
+func PreviewFlowStart(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, flow *models.Flow, start *models.FlowStart) (*StartPreview, error) {
+	recipients, err := resolveRecipients(ctx, rt, oa, start, false)
+	if err != nil {
+		return nil, err
+	}
+
+	contactIDs := make([]models.ContactID, 0, len(recipients.contactIDs))
+	for id := range recipients.contactIDs {
+		contactIDs = append(contactIDs, id)
+	}
+	sort.Slice(contactIDs, func(i, j int) bool { return contactIDs[i] < contactIDs[j] })
+
+	preview := &StartPreview{
+		Total:       len(contactIDs) + recipients.newContacts,
+		NewContacts: recipients.newContacts,
+		Warnings:    StartWarnings{MissingURN: MissingURNWarning{Schemes: flowSchemes(oa, flow)}, Templates: []*TemplateWarning{}},
+	}
+
+	// contacts who would actually be started, new contacts are always started
+	toStart := make([]models.ContactID, 0, len(contactIDs))
+	languages := make(map[envs.Language]int)
+
+	for _, batch := range chunkContactIDs(contactIDs, previewBatchSize) {
+		exclude := make(map[models.ContactID]bool)
+
+		if !start.RestartParticipants() {
+			started, err := models.FindFlowStartedOverlap(ctx, rt.DB, flow.ID(), batch)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error finding others started flow: %d", flow.ID())
+			}
+			for _, c := range started {
+				exclude[c] = true
+			}
+			preview.Excluded.StartedPreviously += len(started)
+		}
+
+		if !start.IncludeActive() {
+			active, err := models.FindActiveSessionOverlap(ctx, rt.DB, flow.FlowType(), batch)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error finding other active flow: %d", flow.ID())
+			}
+			for _, c := range active {
+				if !exclude[c] {
+					exclude[c] = true
+					preview.Excluded.InOtherFlows++
+				}
+			}
+		}
+
+		included := make([]models.ContactID, 0, len(batch))
+		for _, c := range batch {
+			if !exclude[c] {
+				included = append(included, c)
+			}
+		}
+		if len(included) == 0 {
+			continue
+		}
+		toStart = append(toStart, included...)
+
+		if err := countContactWarnings(ctx, rt, oa, included, &preview.Warnings, languages); err != nil {
+			return nil, err
+		}
+	}
+
+	preview.ToStart = len(toStart) + recipients.newContacts
+
+	// new contacts will use the org language, and have no URNs with our schemes unless created from one with such a scheme
+	schemes := make(map[string]bool, len(preview.Warnings.MissingURN.Schemes))
+	for _, s := range preview.Warnings.MissingURN.Schemes {
+		schemes[s] = true
+	}
+	for _, u := range recipients.newURNs {
+		if !schemes[u.Scheme()] {
+			preview.Warnings.MissingURN.Contacts++
+		}
+	}
+	preview.Warnings.MissingURN.Contacts += boolToInt(start.CreateContact())
+	languages[oa.Env().DefaultLanguage()] += recipients.newContacts
+
+	preview.Warnings.Templates, err = templateWarnings(oa, flow, languages)
+	if err != nil {
+		return nil, err
+	}
+
+	return preview, nil
+}
+
+const selectContactStatusCountsSQL = `
+SELECT status, count(*) FROM contacts_contact WHERE id = ANY($1) AND status != 'A' GROUP BY status`
+
+const selectContactLanguageCountsSQL = `
+SELECT COALESCE(language, ''), count(*) FROM contacts_contact WHERE id = ANY($1) GROUP BY 1`
+
+const selectMissingURNCountSQL = `
+SELECT count(*) FROM contacts_contact c WHERE c.id = ANY($1) AND NOT EXISTS (
+	SELECT 1 FROM contacts_contacturn u WHERE u.contact_id = c.id AND u.scheme = ANY($2)
+)`
+
+// counts the blocked and stopped contacts and those missing a URN in the passed in batch, and tallies their languages
+func countContactWarnings(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, contactIDs []models.ContactID, warnings *StartWarnings, languages map[envs.Language]int) error {
+	rows, err := rt.DB.QueryxContext(ctx, selectContactStatusCountsSQL, pq.Array(contactIDs))
+	if err != nil {
+		return errors.Wrapf(err, "error counting contact statuses")
+	}
+	defer rows.Close()
+
+	var status string
+	var count int
+	for rows.Next() {
+		if err := rows.Scan(&status, &count); err != nil {
+			return errors.Wrapf(err, "error scanning contact status count")
+		}
+		switch models.ContactStatus(status) {
+		case models.ContactStatusBlocked:
+			warnings.Blocked += count
+		case models.ContactStatusStopped:
+			warnings.Stopped += count
+		}
+	}
+
+	rows, err = rt.DB.QueryxContext(ctx, selectContactLanguageCountsSQL, pq.Array(contactIDs))
+	if err != nil {
+		return errors.Wrapf(err, "error counting contact languages")
+	}
+	defer rows.Close()
+
+	var language envs.Language
+	for rows.Next() {
+		if err := rows.Scan(&language, &count); err != nil {
+			return errors.Wrapf(err, "error scanning contact language count")
+		}
+		if language == envs.NilLanguage {
+			language = oa.Env().DefaultLanguage()
+		}
+		languages[language] += count
+	}
+
+	missing := 0
+	if err := rt.DB.GetContext(ctx, &missing, selectMissingURNCountSQL, pq.Array(contactIDs), pq.Array(warnings.MissingURN.Schemes)); err != nil {
+		return errors.Wrapf(err, "error counting contacts without URNs")
+	}
+	warnings.MissingURN.Contacts += missing
+
+	return nil
+}
+
+// gets the URN schemes the passed in flow can reach contacts on, i.e. those of the channels it explicitly references, or
+// if it doesn't reference any, all the org channels with the role needed for the flow type
+func flowSchemes(oa *models.OrgAssets, flow *models.Flow) []string {
+	role := assets.ChannelRoleSend
+	if flow.FlowType() == models.FlowTypeVoice {
+		role = assets.ChannelRoleCall
+	}
+
+	referenced := make(map[assets.ChannelUUID]bool)
+	walkDefinition(flow.Definition(), func(key string, v map[string]interface{}) {
+		if uuid, ok := v["uuid"].(string); ok && key == "channel" {
+			referenced[assets.ChannelUUID(uuid)] = true
+		}
+	})
+
+	schemes := make(map[string]bool)
+	channels, _ := oa.Channels()
+	for _, ch := range channels {
+		channel := ch.(*models.Channel)
+		if len(referenced) > 0 && !referenced[channel.UUID()] {
+			continue
+		}
+		if len(referenced) == 0 && !channel.HasRole(role) {
+			continue
+		}
+		for _, s := range channel.Schemes() {
+			schemes[s] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(schemes))
+	for s := range schemes {
+		sorted = append(sorted, s)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// gets warnings for any templates used by the passed in flow which lack translations for some of the given languages
+func templateWarnings(oa *models.OrgAssets, flow *models.Flow, languages map[envs.Language]int) ([]*TemplateWarning, error) {
+	used := make(map[assets.TemplateUUID]bool)
+	walkDefinition(flow.Definition(), func(key string, v map[string]interface{}) {
+		if uuid, ok := v["uuid"].(string); ok && key == "template" {
+			used[assets.TemplateUUID(uuid)] = true
+		}
+	})
+	if len(used) == 0 {
+		return []*TemplateWarning{}, nil
+	}
+
+	templates, err := oa.Templates()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading templates")
+	}
+
+	warnings := make([]*TemplateWarning, 0)
+	for _, t := range templates {
+		if !used[t.UUID()] {
+			continue
+		}
+
+		translated := make(map[envs.Language]bool)
+		for _, tr := range t.Translations() {
+			translated[tr.Language()] = true
+		}
+
+		warning := &TemplateWarning{UUID: t.UUID(), Name: t.Name(), MissingLanguages: []envs.Language{}}
+		for lang, count := range languages {
+			if lang != envs.NilLanguage && !translated[lang] {
+				warning.MissingLanguages = append(warning.MissingLanguages, lang)
+				warning.Contacts += count
+			}
+		}
+		if len(warning.MissingLanguages) > 0 {
+			sort.Slice(warning.MissingLanguages, func(i, j int) bool { return warning.MissingLanguages[i] < warning.MissingLanguages[j] })
+			warnings = append(warnings, warning)
+		}
+	}
+
+	sort.Slice(warnings, func(i, j int) bool { return warnings[i].Name < warnings[j].Name })
+	return warnings, nil
+}
+
+// walks the passed in flow definition calling the passed in function for every object with the key it's found under
+func walkDefinition(definition json.RawMessage, fn func(string, map[string]interface{})) {
+	var root interface{}
+	if err := json.Unmarshal(definition, &root); err != nil {
+		return
+	}
+
+	var walk func(string, interface{})
+	walk = func(key string, v interface{}) {
+		switch typed := v.(type) {
+		case map[string]interface{}:
+			fn(key, typed)
+			for k, child := range typed {
+				walk(k, child)
+			}
+		case []interface{}:
+			for _, child := range typed {
+				walk(key, child)
+			}
+		}
+	}
+	walk("", root)
+}
+
+func chunkContactIDs(ids []models.ContactID, size int) [][]models.ContactID {
+	chunks := make([][]models.ContactID, 0, len(ids)/size+1)
+	for i := 0; i < len(ids); i += size {
+		end := i + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunks = append(chunks, ids[i:end])
+	}
+	return chunks
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+package starts
+
+import (
+	"testing"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreviewFlowStart(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// Cathy has been in the flow before, Bob is waiting in another flow and George is blocked
+	sessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusCompleted, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Cathy, testdata.Favorites, models.RunStatusCompleted, "", nil)
+
+	sessionID = testdata.InsertFlowSession(db, testdata.Org1, testdata.Bob, models.SessionStatusWaiting, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Bob, testdata.PickANumber, models.RunStatusWaiting, "", nil)
+	db.MustExec(`UPDATE flows_flowsession SET current_flow_id = $2 WHERE id = $1`, sessionID, testdata.PickANumber.ID)
+
+	db.MustExec(`UPDATE contacts_contact SET status = 'B' WHERE id = $1`, testdata.George.ID)
+
+	oa, err := models.GetOrgAssets(ctx, rt, testdata.Org1.ID)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+
+	start := models.NewFlowStart(testdata.Org1.ID, models.StartTypeManual, models.FlowTypeMessaging, flow.ID(), false, false).
+		WithContactIDs([]models.ContactID{testdata.Cathy.ID, testdata.Bob.ID, testdata.George.ID, testdata.Alexandria.ID}).
+		WithURNs([]urns.URN{"tel:+593979000000"})
+
+	preview, err := PreviewFlowStart(ctx, rt, oa, flow, start)
+	require.NoError(t, err)
+
+	assert.Equal(t, 5, preview.Total)
+	assert.Equal(t, 1, preview.NewContacts)
+	assert.Equal(t, StartExclusions{StartedPreviously: 1, InOtherFlows: 1}, preview.Excluded)
+	assert.Equal(t, 3, preview.ToStart)
+	assert.Equal(t, 1, preview.Warnings.Blocked)
+	assert.Equal(t, 0, preview.Warnings.Stopped)
+	assert.Contains(t, preview.Warnings.MissingURN.Schemes, urns.TelScheme)
+	assert.Equal(t, 0, preview.Warnings.MissingURN.Contacts)
+	assert.Len(t, preview.Warnings.Templates, 0)
+
+	// restarting participants and interrupting active contacts means nobody is excluded, and a contact without URNs
+	// would be created
+	start = models.NewFlowStart(testdata.Org1.ID, models.StartTypeManual, models.FlowTypeMessaging, flow.ID(), true, true).
+		WithContactIDs([]models.ContactID{testdata.Cathy.ID, testdata.Bob.ID}).
+		WithCreateContact(true)
+
+	preview, err = PreviewFlowStart(ctx, rt, oa, flow, start)
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, preview.Total)
+	assert.Equal(t, StartExclusions{}, preview.Excluded)
+	assert.Equal(t, 3, preview.ToStart)
+	assert.Equal(t, 1, preview.Warnings.MissingURN.Contacts)
+
+	// new contacts created from a URN with a scheme none of our channels have are also missing a URN
+	start = models.NewFlowStart(testdata.Org1.ID, models.StartTypeManual, models.FlowTypeMessaging, flow.ID(), true, true).
+		WithURNs([]urns.URN{"tel:+593979000000", "telegram:12345"})
+
+	preview, err = PreviewFlowStart(ctx, rt, oa, flow, start)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, preview.NewContacts)
+	assert.Equal(t, 1, preview.Warnings.MissingURN.Contacts)
+
+	// nothing was created
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM contacts_contacturn WHERE identity = 'tel:+593979000000'`).Returns(0)
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM contacts_contacturn WHERE identity = 'telegram:12345'`).Returns(0)
+}
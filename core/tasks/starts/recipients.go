@@ -0,0 +1,111 @@
+package starts
+
+import (
+	"context"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/pkg/errors"
+)
+
+// the contacts a flow start resolves to
+type recipients struct {
+	contactIDs        map[models.ContactID]bool
+	createdContactIDs []models.ContactID
+
+	// number of contacts which would be created if we weren't allowed to create them, and the URNs of those which
+	// would be created from a URN
+	newContacts int
+	newURNs     []urns.URN
+}
+
+// resolves the URNs, contacts, groups and query of the passed in start to the unique set of contacts it will be started
+// for. If create is false then no contacts are created for URNs or create_contact, and they are only counted.
+func resolveRecipients(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, start *models.FlowStart, create bool) (*recipients, error) {
+	r := &recipients{contactIDs: make(map[models.ContactID]bool), createdContactIDs: make([]models.ContactID, 0)}
+
+	// we are building a set of contact ids, start with the explicit ones
+	for _, id := range start.ContactIDs() {
+		r.contactIDs[id] = true
+	}
+
+	// look up any contacts by URN
+	if len(start.URNs()) > 0 {
+		var urnContactIDs map[urns.URN]models.ContactID
+		var err error
+
+		if create {
+			urnContactIDs, err = models.GetOrCreateContactIDsFromURNs(ctx, rt.DB, oa, start.URNs())
+		} else {
+			urnContactIDs, err = models.GetContactIDsFromURNs(ctx, rt.DB, oa, start.URNs())
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting contact ids from urns")
+		}
+
+		for urn, id := range urnContactIDs {
+			if id == models.NilContactID {
+				r.newContacts++
+				r.newURNs = append(r.newURNs, urn)
+				continue
+			}
+			if !r.contactIDs[id] {
+				r.createdContactIDs = append(r.createdContactIDs, id)
+			}
+			r.contactIDs[id] = true
+		}
+	}
+
+	// if we are meant to create a new contact, do so
+	if start.CreateContact() {
+		if create {
+			contact, _, err := models.CreateContact(ctx, rt.DB, oa, models.NilUserID, "", envs.NilLanguage, nil)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error creating new contact")
+			}
+			r.contactIDs[contact.ID()] = true
+			r.createdContactIDs = append(r.createdContactIDs, contact.ID())
+		} else {
+			r.newContacts++
+		}
+	}
+
+	// if we have inclusion groups, add all the contact ids from those groups
+	if len(start.GroupIDs()) > 0 {
+		groupContactIDs, err := models.ContactIDsForGroupIDs(ctx, rt.DB, start.GroupIDs())
+		if err != nil {
+			return nil, errors.Wrapf(err, "error querying contacts from inclusion groups")
+		}
+		for _, contactID := range groupContactIDs {
+			r.contactIDs[contactID] = true
+		}
+	}
+
+	// if we have a query, add the contacts that match that as well
+	if start.Query() != "" {
+		matches, err := models.SearchContactIDs(ctx, rt, oa, start.Query(), false)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error performing search for start: %d", start.ID())
+		}
+
+		for _, contactID := range matches {
+			r.contactIDs[contactID] = true
+		}
+	}
+
+	// finally, if we have exclusion groups, remove all the contact ids from those groups
+	if len(start.ExcludeGroupIDs()) > 0 {
+		groupContactIDs, err := models.ContactIDsForGroupIDs(ctx, rt.DB, start.ExcludeGroupIDs())
+		if err != nil {
+			return nil, errors.Wrapf(err, "error querying contacts from exclusion groups")
+		}
+		for _, contactID := range groupContactIDs {
+			delete(r.contactIDs, contactID)
+		}
+	}
+
+	return r, nil
+}
@@ -6,14 +6,12 @@ import (
 	"time"
 
 	"github.com/nyaruka/goflow/contactql"
-	"github.com/nyaruka/goflow/envs"
 	"github.com/nyaruka/mailroom"
 	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/core/runner"
 	"github.com/nyaruka/mailroom/runtime"
 
-	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -54,90 +52,17 @@ func handleFlowStart(ctx context.Context, rt *runtime.Runtime, task *queue.Task)
 
 // CreateFlowBatches takes our master flow start and creates batches of flow starts for all the unique contacts
 func CreateFlowBatches(ctx context.Context, rt *runtime.Runtime, start *models.FlowStart) error {
-	contactIDs := make(map[models.ContactID]bool)
-	createdContactIDs := make([]models.ContactID, 0)
-
-	// we are building a set of contact ids, start with the explicit ones
-	for _, id := range start.ContactIDs() {
-		contactIDs[id] = true
-	}
-
 	oa, err := models.GetOrgAssets(ctx, rt, start.OrgID())
 	if err != nil {
 		return errors.Wrapf(err, "error loading org assets")
 	}
 
-	// look up any contacts by URN
-	if len(start.URNs()) > 0 {
-		urnContactIDs, err := models.GetOrCreateContactIDsFromURNs(ctx, rt.DB, oa, start.URNs())
-		if err != nil {
-			return errors.Wrapf(err, "error getting contact ids from urns")
-		}
-		for _, id := range urnContactIDs {
-			if !contactIDs[id] {
-				createdContactIDs = append(createdContactIDs, id)
-			}
-			contactIDs[id] = true
-		}
-	}
-
-	// if we are meant to create a new contact, do so
-	if start.CreateContact() {
-		contact, _, err := models.CreateContact(ctx, rt.DB, oa, models.NilUserID, "", envs.NilLanguage, nil)
-		if err != nil {
-			return errors.Wrapf(err, "error creating new contact")
-		}
-		contactIDs[contact.ID()] = true
-		createdContactIDs = append(createdContactIDs, contact.ID())
-	}
-
-	// if we have inclusion groups, add all the contact ids from those groups
-	if len(start.GroupIDs()) > 0 {
-		rows, err := rt.DB.QueryxContext(ctx, `SELECT contact_id FROM contacts_contactgroup_contacts WHERE contactgroup_id = ANY($1)`, pq.Array(start.GroupIDs()))
-		if err != nil {
-			return errors.Wrapf(err, "error querying contacts from inclusion groups")
-		}
-		defer rows.Close()
-
-		var contactID models.ContactID
-		for rows.Next() {
-			err := rows.Scan(&contactID)
-			if err != nil {
-				return errors.Wrapf(err, "error scanning contact id")
-			}
-			contactIDs[contactID] = true
-		}
-	}
-
-	// if we have a query, add the contacts that match that as well
-	if start.Query() != "" {
-		matches, err := models.ContactIDsForQuery(ctx, rt.ES, oa, start.Query())
-		if err != nil {
-			return errors.Wrapf(err, "error performing search for start: %d", start.ID())
-		}
-
-		for _, contactID := range matches {
-			contactIDs[contactID] = true
-		}
+	recipients, err := resolveRecipients(ctx, rt, oa, start, true)
+	if err != nil {
+		return err
 	}
 
-	// finally, if we have exclusion groups, remove all the contact ids from those groups
-	if len(start.ExcludeGroupIDs()) > 0 {
-		rows, err := rt.DB.QueryxContext(ctx, `SELECT contact_id FROM contacts_contactgroup_contacts WHERE contactgroup_id = ANY($1)`, pq.Array(start.ExcludeGroupIDs()))
-		if err != nil {
-			return errors.Wrapf(err, "error querying contacts from exclusion groups")
-		}
-		defer rows.Close()
-
-		var contactID models.ContactID
-		for rows.Next() {
-			err := rows.Scan(&contactID)
-			if err != nil {
-				return errors.Wrapf(err, "error scanning contact id")
-			}
-			delete(contactIDs, contactID)
-		}
-	}
+	contactIDs, createdContactIDs := recipients.contactIDs, recipients.createdContactIDs
 
 	rc := rt.RP.Get()
 	defer rc.Close()
@@ -169,9 +94,36 @@ func CreateFlowBatches(ctx context.Context, rt *runtime.Runtime, start *models.F
 		taskType = queue.StartIVRFlowBatch
 	}
 
+	// if this start is an A/B split, each variant gets its own cohort of contacts, seeded by our start id
+	cohorts := [][]models.ContactID{make([]models.ContactID, 0, len(contactIDs))}
+	if len(start.Variants()) > 0 {
+		ids := make([]models.ContactID, 0, len(contactIDs))
+		for c := range contactIDs {
+			ids = append(ids, c)
+		}
+		cohorts = models.SplitContactsByABVariant(int64(start.ID()), ids, start.ABVariants())
+	} else {
+		for c := range contactIDs {
+			cohorts[0] = append(cohorts[0], c)
+		}
+	}
+
+	// find the last cohort with contacts, its final batch is our last
+	lastCohort := 0
+	for i, cohort := range cohorts {
+		if len(cohort) > 0 {
+			lastCohort = i
+		}
+	}
+
 	contacts := make([]models.ContactID, 0, 100)
-	queueBatch := func(last bool) {
-		batch := start.CreateBatch(contacts, last, len(contactIDs))
+	queueBatch := func(cohort int, last bool) {
+		var batch *models.FlowStartBatch
+		if len(start.Variants()) > 0 {
+			batch = start.CreateVariantBatch(contacts, last, len(contactIDs), start.Variants()[cohort])
+		} else {
+			batch = start.CreateBatch(contacts, last, len(contactIDs))
+		}
 		err = queue.AddTask(rc, q, taskType, int(start.OrgID()), batch, queue.DefaultPriority)
 		if err != nil {
 			// TODO: is continuing the right thing here? what do we do if redis is down? (panic!)
@@ -180,17 +132,19 @@ func CreateFlowBatches(ctx context.Context, rt *runtime.Runtime, start *models.F
 		contacts = make([]models.ContactID, 0, 100)
 	}
 
-	// build up batches of contacts to start
-	for c := range contactIDs {
-		if len(contacts) == rt.Config.FlowStartBatchSize {
-			queueBatch(false)
+	for i, cohort := range cohorts {
+		// build up batches of contacts to start
+		for _, c := range cohort {
+			if len(contacts) == rt.Config.FlowStartBatchSize {
+				queueBatch(i, false)
+			}
+			contacts = append(contacts, c)
 		}
-		contacts = append(contacts, c)
-	}
 
-	// queue our last batch
-	if len(contacts) > 0 {
-		queueBatch(true)
+		// queue the final batch of this cohort
+		if len(contacts) > 0 {
+			queueBatch(i, i == lastCohort)
+		}
 	}
 
 	return nil
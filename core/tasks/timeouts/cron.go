@@ -27,12 +27,17 @@ func init() {
 	mailroom.AddInitFunction(StartTimeoutCron)
 }
 
-// StartTimeoutCron starts our cron job of continuing timed out sessions every minute
+// StartTimeoutCron starts our cron job of continuing timed out sessions and sending reminders to waiting sessions
+// every minute
 func StartTimeoutCron(rt *runtime.Runtime, wg *sync.WaitGroup, quit chan bool) error {
 	cron.Start(quit, rt, timeoutLock, time.Second*time.Duration(rt.Config.TimeoutTime), false,
 		func() error {
 			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
 			defer cancel()
+
+			if err := remindSessions(ctx, rt); err != nil {
+				logrus.WithError(err).Error("error sending wait reminders")
+			}
 			return timeoutSessions(ctx, rt)
 		},
 	)
@@ -0,0 +1,129 @@
+package timeouts
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/msgio"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// how many due reminders we send each time the cron runs
+const remindersBatchSize = 1000
+
+// remindSessions sends the reminders which are due to contacts who haven't responded to waits. Reminders are sent as
+// messages outside of the flow so sessions stay waiting where they are.
+func remindSessions(ctx context.Context, rt *runtime.Runtime) error {
+	log := logrus.WithField("comp", "wait_reminders")
+	start := time.Now()
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	due, err := models.DueWaitReminders(rc, start, remindersBatchSize)
+	if err != nil {
+		return err
+	}
+	if len(due) == 0 {
+		return nil
+	}
+
+	waiting, err := models.FilterStillWaiting(ctx, rt.DB, due)
+	if err != nil {
+		return err
+	}
+
+	// sessions which have moved on without being resumed, e.g. they were interrupted or expired, don't get reminders
+	isWaiting := make(map[models.SessionID]bool, len(waiting))
+	for _, s := range waiting {
+		isWaiting[s.SessionID] = true
+	}
+	for _, s := range due {
+		if !isWaiting[s.SessionID] {
+			if err := models.ClearWaitReminders(rc, s.SessionID); err != nil {
+				return errors.Wrapf(err, "error clearing wait reminders")
+			}
+		}
+	}
+
+	byOrg := make(map[models.OrgID][]*models.WaitReminderState)
+	for _, s := range waiting {
+		byOrg[s.OrgID] = append(byOrg[s.OrgID], s)
+	}
+
+	count := 0
+	for orgID, states := range byOrg {
+		sent, err := sendWaitReminders(ctx, rt, rc, orgID, states)
+		if err != nil {
+			log.WithError(err).WithField("org_id", orgID).Error("error sending wait reminders")
+		}
+		count += sent
+	}
+
+	log.WithField("elapsed", time.Since(start)).WithField("count", count).Info("wait reminders sent")
+	return nil
+}
+
+// sends the next reminders of the passed in sessions which all belong to the given org
+func sendWaitReminders(ctx context.Context, rt *runtime.Runtime, rc redis.Conn, orgID models.OrgID, states []*models.WaitReminderState) (int, error) {
+	oa, err := models.GetOrgAssets(ctx, rt, orgID)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error loading org assets")
+	}
+
+	msgs := make([]*models.Msg, 0, len(states))
+
+	// whatever happens, send the messages we've created
+	defer func() { msgio.SendMessages(ctx, rt, rt.DB, nil, msgs) }()
+
+	for _, state := range states {
+		var reminders []*models.WaitReminder
+		flow, err := oa.FlowByID(state.FlowID)
+		if err == nil {
+			reminders = flow.WaitReminders(state.NodeUUID)
+		}
+
+		// flow has changed since these reminders were scheduled and no longer has this reminder
+		if state.Sent >= len(reminders) {
+			if err := models.ClearWaitReminders(rc, state.SessionID); err != nil {
+				return len(msgs), errors.Wrapf(err, "error clearing wait reminders")
+			}
+			continue
+		}
+
+		reminder := reminders[state.Sent]
+		baseLanguage := flow.BaseLanguage()
+
+		translations := map[envs.Language]*models.BroadcastTranslation{baseLanguage: {Text: reminder.Text}}
+		for lang, text := range reminder.Translations {
+			translations[lang] = &models.BroadcastTranslation{Text: text}
+		}
+
+		contactIDs := []models.ContactID{state.ContactID}
+		bcast := models.NewBroadcast(orgID, models.NilBroadcastID, translations, models.TemplateStateUnevaluated, baseLanguage, nil, contactIDs, nil, models.NilTicketID, events.BroadcastTypeDefault, models.BroadcastMessageHeader{}, "", models.BroadcastCatalogMessage{})
+
+		// reminders are marked in their metadata so they can be told apart from other messages
+		metadata := map[string]interface{}{
+			"wait_reminder": map[string]interface{}{"flow_uuid": flow.UUID(), "node_uuid": state.NodeUUID, "reminder": state.Sent},
+		}
+
+		created, err := models.CreateBroadcastMessages(ctx, rt, oa, bcast.CreateBatch(contactIDs), metadata)
+		if err != nil {
+			return len(msgs), errors.Wrapf(err, "error creating wait reminder message")
+		}
+		msgs = append(msgs, created...)
+
+		if err := models.MarkWaitReminderSent(rc, state, reminders); err != nil {
+			return len(msgs), err
+		}
+	}
+
+	return len(msgs), nil
+}
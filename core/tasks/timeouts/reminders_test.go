@@ -0,0 +1,131 @@
+package timeouts
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/resumes"
+	"github.com/nyaruka/goflow/flows/triggers"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/runner"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitReminders(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// add reminders to the first wait of the favorites flow
+	var definition string
+	require.NoError(t, db.Get(&definition, `SELECT definition FROM flows_flowrevision WHERE flow_id = $1 ORDER BY revision DESC LIMIT 1`, testdata.Favorites.ID))
+
+	def := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal([]byte(definition), &def))
+
+	var waitNode flows.NodeUUID
+	for _, n := range def["nodes"].([]interface{}) {
+		node := n.(map[string]interface{})
+		router, _ := node["router"].(map[string]interface{})
+		if wait, hasWait := router["wait"].(map[string]interface{}); hasWait {
+			wait["reminders"] = []interface{}{
+				map[string]interface{}{"after_seconds": 3600, "text": "Still there @contact.name?", "translations": map[string]interface{}{"spa": "¿Sigues ahí?"}},
+				map[string]interface{}{"after_seconds": 7200, "text": "Last chance to tell us!"},
+			}
+			waitNode = flows.NodeUUID(node["uuid"].(string))
+			break
+		}
+	}
+	require.NotEqual(t, flows.NodeUUID(""), waitNode)
+
+	updated, _ := json.Marshal(def)
+	db.MustExec(`UPDATE flows_flowrevision SET definition = $2 WHERE flow_id = $1`, testdata.Favorites.ID, string(updated))
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(testdata.Favorites.ID)
+	require.NoError(t, err)
+	assert.Len(t, flow.WaitReminders(waitNode), 2)
+
+	start := func(contact *testdata.Contact) *models.Session {
+		_, fc := contact.Load(db, oa)
+		trigger := triggers.NewBuilder(oa.Env(), flow.FlowReference(), fc).Manual().Build()
+		sessions, err := runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{trigger}, nil, true)
+		require.NoError(t, err)
+		return sessions[0]
+	}
+
+	// makes the next reminder of the given session due now
+	makeDue := func(sessionID models.SessionID) {
+		_, err := rc.Do("ZADD", "wait_reminders", time.Now().Add(-time.Second).Unix(), sessionID)
+		require.NoError(t, err)
+	}
+
+	nextDue := func(sessionID models.SessionID) int64 {
+		due, err := redis.Int64(rc.Do("ZSCORE", "wait_reminders", sessionID))
+		if err == redis.ErrNil {
+			return 0
+		}
+		require.NoError(t, err)
+		return due
+	}
+
+	// starting Cathy in the flow schedules her first reminder
+	before := time.Now()
+	cathySession := start(testdata.Cathy)
+
+	assert.InDelta(t, before.Add(time.Hour).Unix(), nextDue(cathySession.ID()), 5)
+
+	// nothing is due yet so nothing is sent
+	require.NoError(t, remindSessions(ctx, rt))
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND text LIKE 'Still there%'`, testdata.Cathy.ID).Returns(0)
+
+	// once it's due, it's sent without resuming her session and the next reminder is scheduled
+	makeDue(cathySession.ID())
+	require.NoError(t, remindSessions(ctx, rt))
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND direction = 'O' AND text = 'Still there Cathy?'`, testdata.Cathy.ID).Returns(1)
+	testsuite.AssertQuery(t, db, `SELECT metadata::jsonb->'wait_reminder'->>'reminder' FROM msgs_msg WHERE contact_id = $1 AND text = 'Still there Cathy?'`, testdata.Cathy.ID).Returns("0")
+	testsuite.AssertQuery(t, db, `SELECT status FROM flows_flowsession WHERE id = $1`, cathySession.ID()).Returns("W")
+	assert.InDelta(t, before.Add(2*time.Hour).Unix(), nextDue(cathySession.ID()), 5)
+
+	// Bob is started too but his session is interrupted before his reminder is due
+	bobSession := start(testdata.Bob)
+	require.NoError(t, models.ExitSessions(ctx, db, []models.SessionID{bobSession.ID()}, models.ExitInterrupted))
+
+	makeDue(bobSession.ID())
+	require.NoError(t, remindSessions(ctx, rt))
+
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM msgs_msg WHERE contact_id = $1 AND text LIKE 'Still there%'`, testdata.Bob.ID).Returns(0)
+	assert.Equal(t, int64(0), nextDue(bobSession.ID()))
+
+	// Cathy responding credits the reminder she was sent and clears her reminders as her next wait has none
+	_, cathy := testdata.Cathy.Load(db, oa)
+	msg := flows.NewMsgIn(flows.MsgUUID(uuids.New()), testdata.Cathy.URN, nil, "Red", nil)
+	msg.SetID(10)
+	_, err = runner.ResumeFlow(ctx, rt, oa, cathySession, resumes.NewMsg(oa.Env(), cathy, msg), nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(0), nextDue(cathySession.ID()))
+
+	stats, err := models.GetWaitReminderStats(rc, testdata.Favorites.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []*models.WaitReminderStats{{NodeUUID: waitNode, Reminder: 0, Sent: 1, Responded: 1}}, stats)
+
+	// stats expire if the flow's reminders stop being used
+	ttl, err := redis.Int(rc.Do("TTL", fmt.Sprintf("wait_reminder_stats:%d", testdata.Favorites.ID)))
+	require.NoError(t, err)
+	assert.InDelta(t, 60*60*24*90, ttl, 5)
+}
@@ -70,6 +70,7 @@ require (
 	github.com/aws/aws-sdk-go-v2/credentials v1.19.7
 	github.com/aws/aws-sdk-go-v2/service/sqs v1.42.21
 	github.com/gabriel-vasile/mimetype v1.4.1
+	github.com/klauspost/compress v1.18.0
 	github.com/prometheus/client_golang v1.14.0
 	github.com/rabbitmq/amqp091-go v1.10.0
 )
@@ -14,6 +14,7 @@ import (
 
 func init() {
 	utils.RegisterValidatorAlias("session_storage", "eq=db|eq=s3", func(e validator.FieldError) string { return "is not a valid session storage mode" })
+	utils.RegisterValidatorAlias("session_codec", "eq=none|eq=gzip|eq=zstd", func(e validator.FieldError) string { return "is not a valid session output codec" })
 }
 
 // Config is our top level configuration object
@@ -53,7 +54,19 @@ type Config struct {
 	MaxStepsPerSprint    int    `help:"the maximum number of steps allowed per engine sprint"`
 	MaxResumesPerSession int    `help:"the maximum number of resumes allowed per engine session"`
 	MaxValueLength       int    `help:"the maximum size in characters for contact field values and run result values"`
+	MsgBudgetPerMinute   int    `help:"the maximum number of messages sent to a contact per minute before their session is interrupted, zero for no limit"`
+	MsgBudgetPerHour     int    `help:"the maximum number of messages sent to a contact per hour before their session is interrupted, zero for no limit"`
+	MsgPingPongLimit     int    `help:"the number of messages sent to and received from a contact per minute which is a loop if the contact is one of our channels, zero to disable"`
 	SessionStorage       string `validate:"omitempty,session_storage"         help:"where to store session output (s3|db)"`
+	SessionCodec         string `validate:"omitempty,session_codec"           help:"how to compress session output when writing it (none|gzip|zstd)"`
+	SessionCacheTTL      int    `help:"the number of seconds to cache the output of active sessions in redis for, zero to disable"`
+	SessionCacheMaxBytes int    `help:"the maximum size in bytes of a session output that we will cache in redis"`
+	SessionRetentionDays int    `help:"the number of days to keep ended sessions and their runs for before archiving them, zero to keep them forever"`
+
+	IVRRecordingRetentionDays int `help:"the number of days IVR recordings should be kept for, used to prefix their storage paths for expiry by lifecycle rules, zero to keep them forever"`
+
+	DBSearchMaxContacts int `help:"the largest number of contacts an org can have for its contact searches to be done in the database rather than elastic, zero to only search the database if elastic is unavailable"`
+	MaxStreamedExport   int `help:"the largest number of contacts an export can have to be streamed in its response rather than exported in the background to media storage"`
 
 	S3Endpoint           string `help:"the S3 endpoint we will write attachments to"`
 	S3Region             string `help:"the S3 region we will write attachments to"`
@@ -171,7 +184,19 @@ func NewDefaultConfig() *Config {
 		MaxStepsPerSprint:    100,
 		MaxResumesPerSession: 250,
 		MaxValueLength:       640,
+		MsgBudgetPerMinute:   0,
+		MsgBudgetPerHour:     0,
+		MsgPingPongLimit:     0,
 		SessionStorage:       "db",
+		SessionCodec:         "none",
+		SessionCacheTTL:      0,
+		SessionCacheMaxBytes: 256 * 1024, // 256KB
+		SessionRetentionDays: 0,
+
+		IVRRecordingRetentionDays: 0,
+
+		DBSearchMaxContacts: 0,
+		MaxStreamedExport:   10000,
 
 		S3Endpoint:       "https://s3.amazonaws.com",
 		S3Region:         "us-east-1",
@@ -0,0 +1,114 @@
+// Package callcontrol is an IVR service which speaks call control, a provider-neutral JSON protocol meant to be
+// implemented by thin adapters in front of telephony platforms like FreeSWITCH or Asterisk.
+//
+// Mailroom makes requests to the adapter with the channel's API key as a bearer token:
+//
+//   POST <base_url>/calls                  requests a new outgoing call, see CallRequest and CallResponse
+//   POST <base_url>/calls/<call_id>/hangup hangs up a call, responding with 200 or 204
+//
+// The adapter calls back to the answer URL of a call when it's answered (or to the channel's receive URL for incoming
+// calls), to the action URL of any gather, record or dial command when it's done, and to the status URL whenever the
+// status of a call changes. Callbacks are JSON POSTs like CallbackRequest, signed by setting the X-Signature header to
+// the hex encoded HMAC-SHA256 of the full callback URL followed by the request body, using the channel's secret.
+//
+// Mailroom responds to answer and action callbacks with the commands to execute next, see Response.
+package callcontrol
+
+// CallRequest is the request payload to create a new call
+type CallRequest struct {
+	To               string `json:"to"`
+	From             string `json:"from"`
+	AnswerURL        string `json:"answer_url"`
+	StatusURL        string `json:"status_url"`
+	MachineDetection bool   `json:"machine_detection"`
+}
+
+// CallResponse is the response from creating a new call
+//
+//   {
+//     "call_id": "63f61863-4a51-4f6b-86e1-46edebcf9356",
+//     "status": "queued"
+//   }
+//
+type CallResponse struct {
+	CallID string `json:"call_id" validate:"required"`
+	Status string `json:"status"`
+}
+
+// CallbackRequest is the payload of a callback from the adapter
+//
+//   {
+//     "call_id": "63f61863-4a51-4f6b-86e1-46edebcf9356",
+//     "direction": "outbound",
+//     "from": "+12065551212",
+//     "to": "+593979111222",
+//     "status": "in_progress",
+//     "answered_by": "human",
+//     "duration": 0,
+//     "input": {"type": "digits", "digits": "123"}
+//   }
+//
+type CallbackRequest struct {
+	CallID     string         `json:"call_id"`
+	Direction  string         `json:"direction"`
+	From       string         `json:"from"`
+	To         string         `json:"to"`
+	Status     string         `json:"status"`
+	AnsweredBy string         `json:"answered_by,omitempty"`
+	Duration   int            `json:"duration,omitempty"`
+	Input      *CallbackInput `json:"input,omitempty"`
+}
+
+// CallbackInput is the result of a gather, record or dial command
+type CallbackInput struct {
+	Type         string `json:"type"` // digits, recording, dial or timeout
+	Digits       string `json:"digits,omitempty"`
+	RecordingURL string `json:"recording_url,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+	DialStatus   string `json:"dial_status,omitempty"`
+	DialDuration int    `json:"dial_duration,omitempty"`
+}
+
+// Response is our response to an answer or action callback, the commands being executed in order
+type Response struct {
+	Message  string        `json:"_message,omitempty"`
+	Commands []interface{} `json:"commands"`
+}
+
+type Say struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	Language string `json:"language,omitempty"`
+}
+
+type Play struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type Gather struct {
+	Type        string `json:"type"`
+	MaxDigits   int    `json:"max_digits,omitempty"`
+	FinishOnKey string `json:"finish_on_key,omitempty"`
+	Timeout     int    `json:"timeout"`
+	BargeIn     bool   `json:"barge_in"`
+	ActionURL   string `json:"action_url"`
+}
+
+type Record struct {
+	Type        string `json:"type"`
+	MaxLength   int    `json:"max_length"`
+	FinishOnKey string `json:"finish_on_key,omitempty"`
+	ActionURL   string `json:"action_url"`
+}
+
+type Dial struct {
+	Type      string `json:"type"`
+	Number    string `json:"number"`
+	Timeout   int    `json:"timeout,omitempty"`
+	ActionURL string `json:"action_url"`
+}
+
+type Hangup struct {
+	Type string `json:"type"`
+}
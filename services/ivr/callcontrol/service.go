@@ -0,0 +1,456 @@
+package callcontrol
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/goflow/flows/routers/waits"
+	"github.com/nyaruka/goflow/flows/routers/waits/hints"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/ivr"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// IgnoreSignatures controls whether we ignore signatures (public for testing overriding)
+var IgnoreSignatures = false
+
+var dialStatusMap = map[string]flows.DialStatus{
+	"answered":  flows.DialStatusAnswered,
+	"completed": flows.DialStatusAnswered,
+	"busy":      flows.DialStatusBusy,
+	"no_answer": flows.DialStatusNoAnswer,
+	"failed":    flows.DialStatusFailed,
+	"canceled":  flows.DialStatusFailed,
+}
+
+const (
+	callControlChannelType = models.ChannelType("JCC")
+
+	callPath   = "/calls"
+	hangupPath = "/calls/%s/hangup"
+
+	signatureHeader = "X-Signature"
+
+	statusFailed = "failed"
+
+	gatherTimeout = 30
+	recordTimeout = 600
+
+	baseURLConfig = "base_url"
+	apiKeyConfig  = "api_key"
+	secretConfig  = "secret"
+)
+
+type service struct {
+	httpClient *http.Client
+	channel    *models.Channel
+	baseURL    string
+	apiKey     string
+	secret     string
+}
+
+func init() {
+	ivr.RegisterServiceType(callControlChannelType, NewServiceFromChannel)
+}
+
+// NewServiceFromChannel creates a new call control IVR service for the passed in channel
+func NewServiceFromChannel(httpClient *http.Client, channel *models.Channel) (ivr.Service, error) {
+	baseURL := channel.ConfigValue(baseURLConfig, "")
+	apiKey := channel.ConfigValue(apiKeyConfig, "")
+	secret := channel.ConfigValue(secretConfig, "")
+	if baseURL == "" || apiKey == "" || secret == "" {
+		return nil, errors.Errorf("missing %s, %s or %s on channel config for channel: %s", baseURLConfig, apiKeyConfig, secretConfig, channel.UUID())
+	}
+
+	return &service{
+		httpClient: httpClient,
+		channel:    channel,
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		secret:     secret,
+	}, nil
+}
+
+// reads the body of the passed in request, leaving it readable by whoever is next
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewBuffer(body))
+	return body, nil
+}
+
+// reads the callback payload of the passed in request
+func readCallback(r *http.Request) (*CallbackRequest, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading body from request")
+	}
+
+	callback := &CallbackRequest{}
+	if err := json.Unmarshal(body, callback); err != nil {
+		return nil, errors.Wrapf(err, "invalid json body")
+	}
+	return callback, nil
+}
+
+func (s *service) CallIDForRequest(r *http.Request) (string, error) {
+	callback, err := readCallback(r)
+	if err != nil {
+		return "", err
+	}
+	if callback.CallID == "" {
+		return "", errors.Errorf("no call_id set on callback")
+	}
+	return callback.CallID, nil
+}
+
+func (s *service) URNForRequest(r *http.Request) (urns.URN, error) {
+	callback, err := readCallback(r)
+	if err != nil {
+		return "", err
+	}
+
+	number := callback.From
+	if callback.Direction == "outbound" {
+		number = callback.To
+	}
+	if number == "" {
+		return "", errors.Errorf("no caller number found in callback")
+	}
+	return urns.NewTelURNForCountry(number, "")
+}
+
+func (s *service) DownloadMedia(url string) (*http.Response, error) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	return s.httpClient.Do(req)
+}
+
+func (s *service) CheckStartRequest(r *http.Request) models.ConnectionError {
+	callback, err := readCallback(r)
+	if err == nil && (callback.AnsweredBy == "machine" || callback.AnsweredBy == "fax") {
+		return models.ConnectionErrorMachine
+	}
+	return ""
+}
+
+func (s *service) PreprocessStatus(ctx context.Context, rt *runtime.Runtime, r *http.Request) ([]byte, error) {
+	return nil, nil
+}
+
+func (s *service) PreprocessResume(ctx context.Context, rt *runtime.Runtime, conn *models.ChannelConnection, r *http.Request) ([]byte, error) {
+	return nil, nil
+}
+
+// RequestCall requests a new outgoing call from the adapter
+func (s *service) RequestCall(number urns.URN, resumeURL string, statusURL string, machineDetection bool) (ivr.CallID, *httpx.Trace, error) {
+	callR := &CallRequest{
+		To:               number.Path(),
+		From:             s.channel.Address(),
+		AnswerURL:        resumeURL,
+		StatusURL:        statusURL,
+		MachineDetection: machineDetection,
+	}
+
+	trace, err := s.makeRequest(http.MethodPost, s.baseURL+callPath, callR)
+	if err != nil {
+		return ivr.NilCallID, trace, errors.Wrapf(err, "error trying to start call")
+	}
+
+	if trace.Response.StatusCode != http.StatusCreated {
+		return ivr.NilCallID, trace, errors.Errorf("received non 201 status for call start: %d", trace.Response.StatusCode)
+	}
+
+	call := &CallResponse{}
+	if err := utils.UnmarshalAndValidate(trace.ResponseBody, call); err != nil {
+		return ivr.NilCallID, trace, errors.Wrap(err, "unable to parse call control response")
+	}
+	if call.Status == statusFailed {
+		return ivr.NilCallID, trace, errors.Errorf("call status returned as failed")
+	}
+
+	return ivr.CallID(call.CallID), trace, nil
+}
+
+// HangupCall asks the adapter to hang up the call that is passed in
+func (s *service) HangupCall(callID string) (*httpx.Trace, error) {
+	trace, err := s.makeRequest(http.MethodPost, s.baseURL+fmt.Sprintf(hangupPath, callID), map[string]string{})
+	if err != nil {
+		return trace, errors.Wrapf(err, "error trying to hangup call")
+	}
+
+	if trace.Response.StatusCode != http.StatusOK && trace.Response.StatusCode != http.StatusNoContent {
+		return trace, errors.Errorf("received non 200 status for call hangup: %d", trace.Response.StatusCode)
+	}
+	return trace, nil
+}
+
+// ResumeForRequest returns the resume (input or dial) for the passed in request, if any
+func (s *service) ResumeForRequest(r *http.Request) (ivr.Resume, error) {
+	callback, err := readCallback(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// no input or a timeout of a gather or record means an empty input
+	input := callback.Input
+	if input == nil {
+		input = &CallbackInput{Type: "timeout"}
+	}
+
+	waitType := r.URL.Query().Get("wait_type")
+	switch waitType {
+	case "gather":
+		if input.Type == "timeout" {
+			return ivr.InputResume{}, nil
+		}
+		return ivr.InputResume{Input: input.Digits}, nil
+
+	case "record":
+		if input.Type == "timeout" || input.RecordingURL == "" {
+			return ivr.InputResume{}, nil
+		}
+		contentType := input.ContentType
+		if contentType == "" {
+			contentType = "audio"
+		}
+		return ivr.InputResume{Attachment: utils.Attachment(contentType + ":" + input.RecordingURL)}, nil
+
+	case "dial":
+		status := dialStatusMap[input.DialStatus]
+		if status == "" {
+			return nil, errors.Errorf("unknown dial_status in callback: %s", input.DialStatus)
+		}
+		return ivr.DialResume{Status: status, Duration: input.DialDuration}, nil
+
+	default:
+		return nil, errors.Errorf("unknown wait_type: %s", waitType)
+	}
+}
+
+// StatusForRequest returns the call status for the passed in request, and if it's an error the reason,
+// and if available, the current call duration
+func (s *service) StatusForRequest(r *http.Request) (models.ConnectionStatus, models.ConnectionError, int) {
+	callback, err := readCallback(r)
+	if err != nil {
+		logrus.WithError(err).Error("error reading call control status callback")
+		return models.ConnectionStatusErrored, models.ConnectionErrorProvider, 0
+	}
+
+	switch callback.Status {
+
+	case "queued", "ringing":
+		return models.ConnectionStatusWired, "", 0
+	case "", "in_progress", "answered":
+		return models.ConnectionStatusInProgress, "", 0
+	case "completed":
+		return models.ConnectionStatusCompleted, "", callback.Duration
+
+	case "busy":
+		return models.ConnectionStatusErrored, models.ConnectionErrorBusy, 0
+	case "no_answer":
+		return models.ConnectionStatusErrored, models.ConnectionErrorNoAnswer, 0
+	case "machine":
+		return models.ConnectionStatusErrored, models.ConnectionErrorMachine, 0
+	case "canceled", "failed":
+		return models.ConnectionStatusErrored, models.ConnectionErrorProvider, 0
+
+	default:
+		logrus.WithField("call_status", callback.Status).Error("unknown call status in call control callback")
+		return models.ConnectionStatusFailed, models.ConnectionErrorProvider, 0
+	}
+}
+
+// ValidateRequestSignature validates the signature on the passed in request, returning an error if it is invalid
+func (s *service) ValidateRequestSignature(r *http.Request) error {
+	if IgnoreSignatures {
+		return nil
+	}
+
+	actual := r.Header.Get(signatureHeader)
+	if actual == "" {
+		return errors.Errorf("missing request signature header")
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return errors.Wrapf(err, "error reading body from request")
+	}
+
+	path := r.URL.RequestURI()
+	proxyPath := r.Header.Get("X-Forwarded-Path")
+	if proxyPath != "" {
+		path = proxyPath
+	}
+
+	url := fmt.Sprintf("https://%s%s", r.Host, path)
+	expected := calculateSignature(url, body, s.secret)
+
+	// compare signatures in way that isn't sensitive to a timing attack
+	if !hmac.Equal([]byte(expected), []byte(actual)) {
+		return errors.Errorf("invalid request signature: %s", actual)
+	}
+
+	return nil
+}
+
+// WriteSessionResponse writes a call control response for the events in the passed in session
+func (s *service) WriteSessionResponse(ctx context.Context, rt *runtime.Runtime, channel *models.Channel, conn *models.ChannelConnection, session *models.Session, number urns.URN, resumeURL string, r *http.Request, w http.ResponseWriter) error {
+	// for errored sessions we should just output our error body
+	if session.Status() == models.SessionStatusFailed {
+		return errors.Errorf("cannot write IVR response for failed session")
+	}
+
+	// otherwise look for any say events
+	sprint := session.Sprint()
+	if sprint == nil {
+		return errors.Errorf("cannot write IVR response for session with no sprint")
+	}
+
+	// get our response
+	response, err := ResponseForSprint(rt.Config, number, resumeURL, session.Wait(), sprint.Events())
+	if err != nil {
+		return errors.Wrap(err, "unable to build response for IVR call")
+	}
+
+	return writeResponse(w, response)
+}
+
+// WriteErrorResponse writes an error / unavailable response
+func (s *service) WriteErrorResponse(w http.ResponseWriter, err error) error {
+	return writeResponse(w, &Response{
+		Message:  err.Error(),
+		Commands: []interface{}{Say{Type: "say", Text: ivr.ErrorMessage}, Hangup{Type: "hangup"}},
+	})
+}
+
+// WriteEmptyResponse writes an empty (but valid) response
+func (s *service) WriteEmptyResponse(w http.ResponseWriter, msg string) error {
+	return writeResponse(w, &Response{Message: msg, Commands: []interface{}{}})
+}
+
+func writeResponse(w http.ResponseWriter, response *Response) error {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling call control response")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(body)
+	return err
+}
+
+func (s *service) makeRequest(method string, sendURL string, body interface{}) (*httpx.Trace, error) {
+	bb, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error json encoding request")
+	}
+
+	req, _ := http.NewRequest(method, sendURL, bytes.NewReader(bb))
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	return httpx.DoTrace(s.httpClient, req, nil, nil, -1)
+}
+
+// calculates the signature of a callback, i.e. the hex encoded HMAC-SHA256 of its URL followed by its body
+func calculateSignature(url string, body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(url))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ResponseForSprint builds the call control response for the passed in wait and events
+func ResponseForSprint(cfg *runtime.Config, number urns.URN, resumeURL string, w flows.ActivatedWait, es []flows.Event) (*Response, error) {
+	r := &Response{Commands: make([]interface{}, 0, 2)}
+
+	for _, e := range es {
+		switch event := e.(type) {
+		case *events.IVRCreatedEvent:
+			if len(event.Msg.Attachments()) == 0 {
+				language := ""
+				if event.Msg.TextLanguage != "" {
+					country := envs.DeriveCountryFromTel(number.Path())
+					language = envs.NewLocale(event.Msg.TextLanguage, country).ToBCP47()
+				}
+				r.Commands = append(r.Commands, Say{Type: "say", Text: event.Msg.Text(), Language: language})
+			} else {
+				for _, a := range event.Msg.Attachments() {
+					a = models.NormalizeAttachment(cfg, a)
+					r.Commands = append(r.Commands, Play{Type: "play", URL: a.URL()})
+				}
+			}
+		}
+	}
+
+	if w != nil {
+		switch wait := w.(type) {
+
+		case *waits.ActivatedMsgWait:
+			switch hint := wait.Hint().(type) {
+			case *hints.DigitsHint:
+				gather := Gather{
+					Type:        "gather",
+					FinishOnKey: hint.TerminatedBy,
+					Timeout:     gatherTimeout,
+					BargeIn:     true,
+					ActionURL:   resumeURL + "&wait_type=gather",
+				}
+				if hint.Count != nil {
+					gather.MaxDigits = *hint.Count
+				}
+				r.Commands = append(r.Commands, gather)
+
+			case *hints.AudioHint:
+				r.Commands = append(r.Commands, Record{
+					Type:        "record",
+					MaxLength:   recordTimeout,
+					FinishOnKey: "#",
+					ActionURL:   resumeURL + "&wait_type=record",
+				})
+
+			default:
+				return nil, errors.Errorf("unable to use hint in IVR call, unknown type: %s", wait.Hint().Type())
+			}
+
+		case *waits.ActivatedDialWait:
+			dial := Dial{Type: "dial", Number: wait.URN().Path(), ActionURL: resumeURL + "&wait_type=dial"}
+			if wait.TimeoutSeconds() != nil {
+				dial.Timeout = *wait.TimeoutSeconds()
+			}
+			r.Commands = append(r.Commands, dial)
+
+		default:
+			return nil, errors.Errorf("unable to use wait type in call control call: %T", w)
+		}
+	} else {
+		// no wait? call is over, hang up
+		r.Commands = append(r.Commands, Hangup{Type: "hangup"})
+	}
+
+	return r, nil
+}
@@ -0,0 +1,324 @@
+package callcontrol_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/goflow/flows/routers/waits"
+	"github.com/nyaruka/goflow/flows/routers/waits/hints"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/ivr"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/services/ivr/callcontrol"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAdapter is a call control adapter which records the requests made to it
+type fakeAdapter struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	requests []string
+	calls    map[string]*callcontrol.CallRequest
+}
+
+func newFakeAdapter(apiKey string) *fakeAdapter {
+	a := &fakeAdapter{calls: make(map[string]*callcontrol.CallRequest)}
+	a.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+
+		a.requests = append(a.requests, r.Method+" "+r.URL.Path)
+
+		if r.Header.Get("Authorization") != "Bearer "+apiKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path == "/calls" {
+			call := &callcontrol.CallRequest{}
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, call)
+
+			if call.To == "+593979000000" {
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"call_id": "call2", "status": "failed"}`))
+				return
+			}
+
+			callID := fmt.Sprintf("call%d", len(a.calls)+1)
+			a.calls[callID] = call
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(fmt.Sprintf(`{"call_id": "%s", "status": "queued"}`, callID)))
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/calls/") && strings.HasSuffix(r.URL.Path, "/hangup") {
+			if a.calls[strings.Split(r.URL.Path, "/")[2]] == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	return a
+}
+
+// makes a callback request to mailroom like the adapter would, signing it with the given secret
+func makeCallback(callbackURL string, payload interface{}, secret string) *http.Request {
+	body := jsonx.MustMarshal(payload)
+	r := httptest.NewRequest(http.MethodPost, callbackURL, strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(callbackURL))
+		mac.Write(body)
+		r.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	r.ParseForm()
+	return r
+}
+
+func TestService(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	adapter := newFakeAdapter("sesame")
+	defer adapter.Close()
+
+	channel := testdata.InsertChannel(db, testdata.Org1, "JCC", "FreeSWITCH", []string{"tel"}, "CA", map[string]interface{}{"base_url": adapter.URL, "api_key": "sesame", "secret": "s3cr3t"})
+	db.MustExec(`UPDATE channels_channel SET address = '+12065551212' WHERE id = $1`, channel.ID)
+	noConfig := testdata.InsertChannel(db, testdata.Org1, "JCC", "Broken", []string{"tel"}, "CA", map[string]interface{}{"base_url": adapter.URL})
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	_, err = ivr.GetService(oa.ChannelByID(noConfig.ID))
+	assert.EqualError(t, err, fmt.Sprintf("missing base_url, api_key or secret on channel config for channel: %s", noConfig.UUID))
+
+	svc, err := ivr.GetService(oa.ChannelByID(channel.ID))
+	require.NoError(t, err)
+
+	// request a call
+	callID, trace, err := svc.RequestCall(urns.URN("tel:+593979111222"), "https://mailroom.io/mr/ivr/c/1234/handle?action=start&connection=1", "https://mailroom.io/mr/ivr/c/1234/status", true)
+	assert.NoError(t, err)
+	assert.NotNil(t, trace)
+	assert.Equal(t, ivr.CallID("call1"), callID)
+	assert.Equal(t, &callcontrol.CallRequest{
+		To:               "+593979111222",
+		From:             "+12065551212",
+		AnswerURL:        "https://mailroom.io/mr/ivr/c/1234/handle?action=start&connection=1",
+		StatusURL:        "https://mailroom.io/mr/ivr/c/1234/status",
+		MachineDetection: true,
+	}, adapter.calls["call1"])
+
+	// adapter says the call failed
+	_, _, err = svc.RequestCall(urns.URN("tel:+593979000000"), "https://mailroom.io/mr/ivr/c/1234/handle?action=start&connection=2", "https://mailroom.io/mr/ivr/c/1234/status", false)
+	assert.EqualError(t, err, "call status returned as failed")
+
+	// hang it up
+	_, err = svc.HangupCall("call1")
+	assert.NoError(t, err)
+
+	_, err = svc.HangupCall("call9")
+	assert.EqualError(t, err, "received non 200 status for call hangup: 404")
+
+	assert.Equal(t, []string{"POST /calls", "POST /calls", "POST /calls/call1/hangup", "POST /calls/call9/hangup"}, adapter.requests)
+
+	// check signature validation of callbacks
+	resumeURL := "https://mailroom.io/mr/ivr/c/1234/handle?action=resume&connection=1&wait_type=gather"
+	payload := &callcontrol.CallbackRequest{CallID: "call1", Direction: "outbound", From: "+12065551212", To: "+593979111222", Status: "in_progress", Input: &callcontrol.CallbackInput{Type: "digits", Digits: "123"}}
+
+	assert.NoError(t, svc.ValidateRequestSignature(makeCallback(resumeURL, payload, "s3cr3t")))
+	assert.EqualError(t, svc.ValidateRequestSignature(makeCallback(resumeURL, payload, "")), "missing request signature header")
+
+	badSig := makeCallback(resumeURL, payload, "wrong")
+	assert.Error(t, svc.ValidateRequestSignature(badSig))
+
+	// signature validation shouldn't consume the body
+	r := makeCallback(resumeURL, payload, "s3cr3t")
+	require.NoError(t, svc.ValidateRequestSignature(r))
+
+	callID2, err := svc.CallIDForRequest(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "call1", callID2)
+
+	urn, err := svc.URNForRequest(r)
+	assert.NoError(t, err)
+	assert.Equal(t, urns.URN("tel:+593979111222"), urn)
+
+	resume, err := svc.ResumeForRequest(r)
+	assert.NoError(t, err)
+	assert.Equal(t, ivr.InputResume{Input: "123"}, resume)
+
+	status, reason, _ := svc.StatusForRequest(r)
+	assert.Equal(t, models.ConnectionStatusInProgress, status)
+	assert.Equal(t, models.ConnectionError(""), reason)
+
+	// incoming calls use the caller's number
+	urn, err = svc.URNForRequest(makeCallback("https://mailroom.io/mr/ivr/c/1234/incoming", &callcontrol.CallbackRequest{CallID: "call3", Direction: "inbound", From: "+593979333444", To: "+12065551212", Status: "ringing"}, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, urns.URN("tel:+593979333444"), urn)
+
+	// machine answered calls are errors
+	assert.Equal(t, models.ConnectionErrorMachine, svc.CheckStartRequest(makeCallback(resumeURL, &callcontrol.CallbackRequest{CallID: "call1", Status: "in_progress", AnsweredBy: "machine"}, "")))
+	assert.Equal(t, models.ConnectionError(""), svc.CheckStartRequest(makeCallback(resumeURL, &callcontrol.CallbackRequest{CallID: "call1", Status: "in_progress", AnsweredBy: "human"}, "")))
+}
+
+func TestResumeAndStatusForRequest(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	channel := testdata.InsertChannel(db, testdata.Org1, "JCC", "FreeSWITCH", []string{"tel"}, "CA", map[string]interface{}{"base_url": "http://localhost:9999", "api_key": "sesame", "secret": "s3cr3t"})
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	svc, err := ivr.GetService(oa.ChannelByID(channel.ID))
+	require.NoError(t, err)
+
+	resumeTcs := []struct {
+		waitType string
+		input    *callcontrol.CallbackInput
+		resume   ivr.Resume
+		err      string
+	}{
+		{"gather", &callcontrol.CallbackInput{Type: "digits", Digits: "42"}, ivr.InputResume{Input: "42"}, ""},
+		{"gather", &callcontrol.CallbackInput{Type: "timeout"}, ivr.InputResume{}, ""},
+		{"gather", nil, ivr.InputResume{}, ""},
+		{"record", &callcontrol.CallbackInput{Type: "recording", RecordingURL: "https://fs.io/rec1.wav", ContentType: "audio/wav"}, ivr.InputResume{Attachment: utils.Attachment("audio/wav:https://fs.io/rec1.wav")}, ""},
+		{"record", &callcontrol.CallbackInput{Type: "recording", RecordingURL: "https://fs.io/rec1.mp3"}, ivr.InputResume{Attachment: utils.Attachment("audio:https://fs.io/rec1.mp3")}, ""},
+		{"record", &callcontrol.CallbackInput{Type: "timeout"}, ivr.InputResume{}, ""},
+		{"dial", &callcontrol.CallbackInput{Type: "dial", DialStatus: "answered", DialDuration: 35}, ivr.DialResume{Status: flows.DialStatusAnswered, Duration: 35}, ""},
+		{"dial", &callcontrol.CallbackInput{Type: "dial", DialStatus: "no_answer"}, ivr.DialResume{Status: flows.DialStatusNoAnswer}, ""},
+		{"dial", &callcontrol.CallbackInput{Type: "dial", DialStatus: "exploded"}, nil, "unknown dial_status in callback: exploded"},
+		{"foo", &callcontrol.CallbackInput{Type: "digits", Digits: "42"}, nil, "unknown wait_type: foo"},
+	}
+
+	for _, tc := range resumeTcs {
+		r := makeCallback("https://mailroom.io/mr/ivr/c/1234/handle?action=resume&connection=1&wait_type="+tc.waitType, &callcontrol.CallbackRequest{CallID: "call1", Status: "in_progress", Input: tc.input}, "")
+		resume, err := svc.ResumeForRequest(r)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, "error mismatch for wait type %s", tc.waitType)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, tc.resume, resume, "resume mismatch for wait type %s", tc.waitType)
+		}
+	}
+
+	statusTcs := []struct {
+		status   string
+		duration int
+		expected models.ConnectionStatus
+		reason   models.ConnectionError
+	}{
+		{"queued", 0, models.ConnectionStatusWired, ""},
+		{"ringing", 0, models.ConnectionStatusWired, ""},
+		{"in_progress", 0, models.ConnectionStatusInProgress, ""},
+		{"completed", 123, models.ConnectionStatusCompleted, ""},
+		{"busy", 0, models.ConnectionStatusErrored, models.ConnectionErrorBusy},
+		{"no_answer", 0, models.ConnectionStatusErrored, models.ConnectionErrorNoAnswer},
+		{"machine", 0, models.ConnectionStatusErrored, models.ConnectionErrorMachine},
+		{"failed", 0, models.ConnectionStatusErrored, models.ConnectionErrorProvider},
+		{"exploded", 0, models.ConnectionStatusFailed, models.ConnectionErrorProvider},
+	}
+
+	for _, tc := range statusTcs {
+		r := makeCallback("https://mailroom.io/mr/ivr/c/1234/status", &callcontrol.CallbackRequest{CallID: "call1", Status: tc.status, Duration: tc.duration}, "")
+		status, reason, duration := svc.StatusForRequest(r)
+		assert.Equal(t, tc.expected, status, "status mismatch for %s", tc.status)
+		assert.Equal(t, tc.reason, reason, "reason mismatch for %s", tc.status)
+		assert.Equal(t, tc.duration, duration, "duration mismatch for %s", tc.status)
+	}
+
+	// check our error and empty responses
+	w := httptest.NewRecorder()
+	svc.WriteErrorResponse(w, fmt.Errorf("boom"))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"_message": "boom", "commands": [{"type": "say", "text": "An error has occurred, please try again later."}, {"type": "hangup"}]}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	svc.WriteEmptyResponse(w, "nothing to do")
+	assert.JSONEq(t, `{"_message": "nothing to do", "commands": []}`, w.Body.String())
+}
+
+func TestResponseForSprint(t *testing.T) {
+	_, rt, _, _ := testsuite.Get()
+
+	urn := urns.URN("tel:+12067799294")
+	channelRef := assets.NewChannelReference(assets.ChannelUUID(uuids.New()), "Call Control Channel")
+
+	resumeURL := "http://temba.io/resume?session=1"
+
+	// set our attachment domain for testing
+	rt.Config.AttachmentDomain = "mailroom.io"
+	defer func() { rt.Config.AttachmentDomain = "" }()
+
+	tcs := []struct {
+		Events   []flows.Event
+		Wait     flows.ActivatedWait
+		Expected string
+	}{
+		{
+			[]flows.Event{events.NewIVRCreated(flows.NewMsgOut(urn, channelRef, "hello world", nil, nil, nil, flows.NilMsgTopic, "", "", ""))},
+			nil,
+			`{"commands":[{"type":"say","text":"hello world"},{"type":"hangup"}]}`,
+		},
+		{
+			[]flows.Event{events.NewIVRCreated(flows.NewIVRMsgOut(urn, channelRef, "hello world", "eng", ""))},
+			nil,
+			`{"commands":[{"type":"say","text":"hello world","language":"en-US"},{"type":"hangup"}]}`,
+		},
+		{
+			[]flows.Event{events.NewIVRCreated(flows.NewMsgOut(urn, channelRef, "hello world", []utils.Attachment{utils.Attachment("audio:/recordings/foo.wav")}, nil, nil, flows.NilMsgTopic, "", "", ""))},
+			nil,
+			`{"commands":[{"type":"play","url":"https://mailroom.io/recordings/foo.wav"},{"type":"hangup"}]}`,
+		},
+		{
+			[]flows.Event{events.NewIVRCreated(flows.NewMsgOut(urn, channelRef, "enter a number", nil, nil, nil, flows.NilMsgTopic, "", "", ""))},
+			waits.NewActivatedMsgWait(nil, hints.NewFixedDigitsHint(1)),
+			`{"commands":[{"type":"say","text":"enter a number"},{"type":"gather","max_digits":1,"timeout":30,"barge_in":true,"action_url":"http://temba.io/resume?session=1&wait_type=gather"}]}`,
+		},
+		{
+			[]flows.Event{events.NewIVRCreated(flows.NewMsgOut(urn, channelRef, "enter a number, then press #", nil, nil, nil, flows.NilMsgTopic, "", "", ""))},
+			waits.NewActivatedMsgWait(nil, hints.NewTerminatedDigitsHint("#")),
+			`{"commands":[{"type":"say","text":"enter a number, then press #"},{"type":"gather","finish_on_key":"#","timeout":30,"barge_in":true,"action_url":"http://temba.io/resume?session=1&wait_type=gather"}]}`,
+		},
+		{
+			[]flows.Event{events.NewIVRCreated(flows.NewMsgOut(urn, channelRef, "say something", nil, nil, nil, flows.NilMsgTopic, "", "", ""))},
+			waits.NewActivatedMsgWait(nil, hints.NewAudioHint()),
+			`{"commands":[{"type":"say","text":"say something"},{"type":"record","max_length":600,"finish_on_key":"#","action_url":"http://temba.io/resume?session=1&wait_type=record"}]}`,
+		},
+	}
+
+	for i, tc := range tcs {
+		response, err := callcontrol.ResponseForSprint(rt.Config, urn, resumeURL, tc.Wait, tc.Events)
+		assert.NoError(t, err, "%d: unexpected error", i)
+		assert.Equal(t, tc.Expected, string(jsonx.MustMarshal(response)), "%d: unexpected response", i)
+	}
+}
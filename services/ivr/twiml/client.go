@@ -26,10 +26,16 @@ type Redirect struct {
 type Dial struct {
 	XMLName string `xml:"Dial"`
 	Number  string `xml:",chardata"`
+	Sip     *Sip   `xml:"Sip,omitempty"`
 	Action  string `xml:"action,attr"`
 	Timeout int    `xml:"timeout,attr,omitempty"`
 }
 
+type Sip struct {
+	XMLName string `xml:"Sip"`
+	URI     string `xml:",chardata"`
+}
+
 type Gather struct {
 	XMLName     string        `xml:"Gather"`
 	NumDigits   int           `xml:"numDigits,attr,omitempty"`
@@ -6,6 +6,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"net/http"
@@ -13,7 +14,9 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/goflow/envs"
@@ -27,12 +30,22 @@ import (
 	"github.com/nyaruka/mailroom/runtime"
 
 	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
 )
 
 // IgnoreSignatures controls whether we ignore signatures (public for testing overriding)
 var IgnoreSignatures = false
 
+// call statuses which mean a call has ended
+var finalCallStatuses = map[string]bool{
+	"completed": true,
+	"busy":      true,
+	"no-answer": true,
+	"canceled":  true,
+	"failed":    true,
+}
+
 var dialStatusMap = map[string]flows.DialStatus{
 	"completed": flows.DialStatusAnswered,
 	"answered":  flows.DialStatusAnswered,
@@ -144,7 +157,8 @@ func (s *service) DownloadMedia(url string) (*http.Response, error) {
 func (s *service) CheckStartRequest(r *http.Request) models.ConnectionError {
 	r.ParseForm()
 	answeredBy := r.Form.Get("AnsweredBy")
-	if answeredBy == "machine_start" || answeredBy == "fax" {
+	switch answeredBy {
+	case "machine_start", "machine_end_beep", "machine_end_silence", "machine_end_other", "fax":
 		return models.ConnectionErrorMachine
 	}
 	return ""
@@ -187,14 +201,28 @@ type CallResponse struct {
 
 // RequestCall causes this client to request a new outgoing call for this provider
 func (s *service) RequestCall(number urns.URN, callbackURL string, statusURL string, machineDetection bool) (ivr.CallID, *httpx.Trace, error) {
+	detection := ""
+	if machineDetection {
+		detection = "Enable"
+	}
+	return s.requestCall(number, callbackURL, statusURL, detection)
+}
+
+// RequestVoicemailCall requests a new outgoing call where Twilio waits for the end of an answering machine's greeting
+// before calling our callback URL
+func (s *service) RequestVoicemailCall(number urns.URN, callbackURL string, statusURL string) (ivr.CallID, *httpx.Trace, error) {
+	return s.requestCall(number, callbackURL, statusURL, "DetectMessageEnd")
+}
+
+func (s *service) requestCall(number urns.URN, callbackURL string, statusURL string, machineDetection string) (ivr.CallID, *httpx.Trace, error) {
 	form := url.Values{}
 	form.Set("To", number.Path())
 	form.Set("From", s.channel.Address())
 	form.Set("Url", callbackURL)
 	form.Set("StatusCallback", statusURL)
 
-	if machineDetection {
-		form.Set("MachineDetection", "Enable")
+	if machineDetection != "" {
+		form.Set("MachineDetection", machineDetection)
 	}
 
 	sendURL := s.baseURL + strings.Replace(callPath, "{AccountSID}", s.accountSID, -1)
@@ -240,6 +268,31 @@ func (s *service) HangupCall(callID string) (*httpx.Trace, error) {
 	return trace, nil
 }
 
+// LeaveVoicemail asks Twilio to leave the passed in voicemail on the passed in call and then hang up
+func (s *service) LeaveVoicemail(callID string, voicemail *models.IVRVoicemail) (*httpx.Trace, error) {
+	body, err := xml.Marshal(voicemailResponse(voicemail))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to marshal twiml body")
+	}
+
+	form := url.Values{}
+	form.Set("Twiml", xml.Header+string(body))
+
+	sendURL := s.baseURL + strings.Replace(hangupPath, "{AccountSID}", s.accountSID, -1)
+	sendURL = strings.Replace(sendURL, "{SID}", callID, -1)
+
+	trace, err := s.postRequest(sendURL, form)
+	if err != nil {
+		return trace, errors.Wrapf(err, "error trying to leave voicemail")
+	}
+
+	if trace.Response.StatusCode != 200 {
+		return trace, errors.Errorf("received non 200 trying to leave voicemail: %d", trace.Response.StatusCode)
+	}
+
+	return trace, nil
+}
+
 // InputForRequest returns the input for the passed in request, if any
 func (s *service) ResumeForRequest(r *http.Request) (ivr.Resume, error) {
 	// this could be a timeout, in which case we return an empty input
@@ -317,6 +370,72 @@ func (s *service) StatusForRequest(r *http.Request) (models.ConnectionStatus, mo
 	}
 }
 
+// CDRForRequest returns the call detail record from a status callback for a call which has ended. Twilio doesn't
+// include prices in status callbacks, so those are fetched later with CallPrice.
+func (s *service) CDRForRequest(r *http.Request) *models.CallDetailRecord {
+	status := r.Form.Get("CallStatus")
+	if !finalCallStatuses[status] {
+		return nil
+	}
+
+	endedOn := dates.Now().UTC()
+	if timestamp, err := time.Parse(time.RFC1123Z, r.Form.Get("Timestamp")); err == nil {
+		endedOn = timestamp.UTC()
+	}
+
+	cdr := &models.CallDetailRecord{EndedOn: endedOn, HangupCause: status}
+	if sipCode := r.Form.Get("SipResponseCode"); sipCode != "" {
+		cdr.HangupCause = fmt.Sprintf("%s:%s", status, sipCode)
+	}
+
+	cdr.Duration, _ = strconv.Atoi(r.Form.Get("CallDuration"))
+	if status == "completed" && cdr.Duration > 0 {
+		answeredOn := endedOn.Add(-time.Duration(cdr.Duration) * time.Second)
+		cdr.AnsweredOn = &answeredOn
+	}
+
+	return cdr
+}
+
+// CallPrice fetches the price of the call with the passed in ID from the call resource, which is only set some time
+// after the call has ended
+func (s *service) CallPrice(callID string) (*decimal.Decimal, string, *httpx.Trace, error) {
+	sendURL := s.baseURL + strings.Replace(hangupPath, "{AccountSID}", s.accountSID, -1)
+	sendURL = strings.Replace(sendURL, "{SID}", callID, -1)
+
+	req, _ := http.NewRequest(http.MethodGet, sendURL, nil)
+	req.SetBasicAuth(s.accountSID, s.authToken)
+	req.Header.Set("Accept", "application/json")
+
+	trace, err := httpx.DoTrace(s.httpClient, req, nil, nil, -1)
+	if err != nil {
+		return nil, "", trace, errors.Wrapf(err, "error trying to fetch call")
+	}
+	if trace.Response.StatusCode != 200 {
+		return nil, "", trace, errors.Errorf("received non 200 status for call fetch: %d", trace.Response.StatusCode)
+	}
+
+	call := &struct {
+		Price     *string `json:"price"`
+		PriceUnit string  `json:"price_unit"`
+	}{}
+	if err := json.Unmarshal(trace.ResponseBody, call); err != nil {
+		return nil, "", trace, errors.Wrap(err, "unable parse Twilio response")
+	}
+	if call.Price == nil || *call.Price == "" {
+		return nil, "", trace, nil
+	}
+
+	price, err := decimal.NewFromString(*call.Price)
+	if err != nil {
+		return nil, "", trace, errors.Wrapf(err, "invalid price in Twilio response: %s", *call.Price)
+	}
+
+	// Twilio reports prices as negative amounts
+	price = price.Abs()
+	return &price, strings.ToUpper(call.PriceUnit), trace, nil
+}
+
 // ValidateRequestSignature validates the signature on the passed in request, returning an error if it is invaled
 func (s *service) ValidateRequestSignature(r *http.Request) error {
 	// shortcut for testing
@@ -378,6 +497,34 @@ func (s *service) WriteSessionResponse(ctx context.Context, rt *runtime.Runtime,
 	return nil
 }
 
+// WriteTransferResponse writes a TWIML response which plays out the passed in session's sprint and then dials the
+// passed in agent destination
+func (s *service) WriteTransferResponse(ctx context.Context, rt *runtime.Runtime, channel *models.Channel, session *models.Session, number urns.URN, destination *models.TransferDestination, statusURL string, w http.ResponseWriter) error {
+	response, err := TransferResponseForSprint(rt.Config, number, destination, statusURL, session.Sprint().Events(), true)
+	if err != nil {
+		return errors.Wrap(err, "unable to build transfer response for IVR call")
+	}
+
+	_, err = w.Write([]byte(response))
+	if err != nil {
+		return errors.Wrap(err, "error writing IVR response")
+	}
+
+	return nil
+}
+
+// TransferStatusForRequest returns the status and duration of a call bridged to an agent, Twilio only calling the
+// dial action once the bridged call has ended
+func (s *service) TransferStatusForRequest(r *http.Request) (models.TransferStatus, int) {
+	status, found := dialStatusMap[r.Form.Get("DialCallStatus")]
+	if !found {
+		return models.TransferStatusFailed, 0
+	}
+
+	duration, _ := strconv.Atoi(r.Form.Get("DialCallDuration"))
+	return models.TransferStatus(status), duration
+}
+
 // WriteErrorResponse writes an error / unavailable response
 func (s *service) WriteErrorResponse(w http.ResponseWriter, err error) error {
 	r := &Response{Message: strings.Replace(err.Error(), "--", "__", -1)}
@@ -392,6 +539,16 @@ func (s *service) WriteErrorResponse(w http.ResponseWriter, err error) error {
 	return err
 }
 
+// WriteVoicemailResponse writes a response which leaves the passed in voicemail and hangs up
+func (s *service) WriteVoicemailResponse(w http.ResponseWriter, voicemail *models.IVRVoicemail) error {
+	body, err := xml.Marshal(voicemailResponse(voicemail))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(xml.Header + string(body)))
+	return err
+}
+
 // WriteEmptyResponse writes an empty (but valid) response
 func (s *service) WriteEmptyResponse(w http.ResponseWriter, msg string) error {
 	r := &Response{Message: strings.Replace(msg, "--", "__", -1)}
@@ -445,30 +602,20 @@ func twCalculateSignature(url string, form url.Values, authToken string) ([]byte
 
 // TWIML building utilities
 
+func voicemailResponse(voicemail *models.IVRVoicemail) *Response {
+	r := &Response{Message: "leaving voicemail"}
+	if voicemail.AudioURL != "" {
+		r.Commands = append(r.Commands, Play{URL: voicemail.AudioURL})
+	} else {
+		r.Commands = append(r.Commands, Say{Text: voicemail.Text})
+	}
+	r.Commands = append(r.Commands, Hangup{})
+	return r
+}
+
 func ResponseForSprint(cfg *runtime.Config, number urns.URN, resumeURL string, w flows.ActivatedWait, es []flows.Event, indent bool) (string, error) {
 	r := &Response{}
-	commands := make([]interface{}, 0)
-
-	for _, e := range es {
-		switch event := e.(type) {
-		case *events.IVRCreatedEvent:
-			if len(event.Msg.Attachments()) == 0 {
-				country := envs.DeriveCountryFromTel(number.Path())
-				locale := envs.NewLocale(event.Msg.TextLanguage, country)
-				languageCode := locale.ToBCP47()
-
-				if _, valid := validLanguageCodes[languageCode]; !valid {
-					languageCode = ""
-				}
-				commands = append(commands, Say{Text: event.Msg.Text(), Language: languageCode})
-			} else {
-				for _, a := range event.Msg.Attachments() {
-					a = models.NormalizeAttachment(cfg, a)
-					commands = append(commands, Play{URL: a.URL()})
-				}
-			}
-		}
-	}
+	commands := commandsForEvents(cfg, number, es)
 
 	if w != nil {
 		switch wait := w.(type) {
@@ -516,6 +663,55 @@ func ResponseForSprint(cfg *runtime.Config, number urns.URN, resumeURL string, w
 		r.Commands = commands
 	}
 
+	return marshalResponse(r, indent)
+}
+
+// TransferResponseForSprint builds a response which says or plays the passed in events and then bridges the call to
+// the passed in agent destination, with Twilio calling statusURL when the bridged call ends
+func TransferResponseForSprint(cfg *runtime.Config, number urns.URN, destination *models.TransferDestination, statusURL string, es []flows.Event, indent bool) (string, error) {
+	r := &Response{Message: "transferring to agent"}
+	r.Commands = commandsForEvents(cfg, number, es)
+
+	dial := Dial{Action: statusURL, Timeout: destination.Timeout}
+	if destination.Type == models.TransferDestinationSIP {
+		dial.Sip = &Sip{URI: destination.Address}
+	} else {
+		dial.Number = destination.Address
+	}
+	r.Commands = append(r.Commands, dial)
+
+	return marshalResponse(r, indent)
+}
+
+// builds the say and play commands for the IVR messages in the passed in events
+func commandsForEvents(cfg *runtime.Config, number urns.URN, es []flows.Event) []interface{} {
+	commands := make([]interface{}, 0)
+
+	for _, e := range es {
+		switch event := e.(type) {
+		case *events.IVRCreatedEvent:
+			if len(event.Msg.Attachments()) == 0 {
+				country := envs.DeriveCountryFromTel(number.Path())
+				locale := envs.NewLocale(event.Msg.TextLanguage, country)
+				languageCode := locale.ToBCP47()
+
+				if _, valid := validLanguageCodes[languageCode]; !valid {
+					languageCode = ""
+				}
+				commands = append(commands, Say{Text: event.Msg.Text(), Language: languageCode})
+			} else {
+				for _, a := range event.Msg.Attachments() {
+					a = models.NormalizeAttachment(cfg, a)
+					commands = append(commands, Play{URL: a.URL()})
+				}
+			}
+		}
+	}
+
+	return commands
+}
+
+func marshalResponse(r *Response, indent bool) (string, error) {
 	var body []byte
 	var err error
 	if indent {
@@ -3,10 +3,13 @@ package twiml_test
 import (
 	"encoding/xml"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/gocommon/uuids"
 	"github.com/nyaruka/goflow/assets"
@@ -14,6 +17,8 @@ import (
 	"github.com/nyaruka/goflow/flows/routers/waits"
 	"github.com/nyaruka/goflow/flows/routers/waits/hints"
 	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/ivr"
+	"github.com/nyaruka/mailroom/core/models"
 	"github.com/nyaruka/mailroom/services/ivr/twiml"
 	"github.com/nyaruka/mailroom/testsuite"
 
@@ -117,3 +122,144 @@ func TestURNForRequest(t *testing.T) {
 	_, err = s.URNForRequest(makeRequest(`CallSid=12345&AccountSid=23456&To=%2B12029795079&Called=%2B12029795079&CallStatus=queued&ApiVersion=2010-04-01&Direction=inbound`))
 	assert.EqualError(t, err, "no Caller or From parameter found in request")
 }
+
+func TestVoicemail(t *testing.T) {
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://api.twilio.com/2010-04-01/Accounts/12345/Calls/CA123.json": {
+			httpx.NewMockResponse(200, nil, `{"sid": "CA123", "status": "in-progress"}`),
+			httpx.NewMockResponse(404, nil, `{"message": "not found"}`),
+		},
+	}))
+
+	s := twiml.NewService(http.DefaultClient, "12345", "sesame")
+	vs := s.(ivr.VoicemailService)
+
+	makeRequest := func(body string) *http.Request {
+		r, _ := http.NewRequest("POST", "http://nyaruka.com/12345/handle", strings.NewReader(body))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	// machines are detected whether we're waiting for their beep or not
+	assert.Equal(t, models.ConnectionError(""), s.CheckStartRequest(makeRequest(`CallSid=CA123&AnsweredBy=human`)))
+	assert.Equal(t, models.ConnectionErrorMachine, s.CheckStartRequest(makeRequest(`CallSid=CA123&AnsweredBy=machine_start`)))
+	assert.Equal(t, models.ConnectionErrorMachine, s.CheckStartRequest(makeRequest(`CallSid=CA123&AnsweredBy=machine_end_beep`)))
+
+	w := httptest.NewRecorder()
+	err := vs.WriteVoicemailResponse(w, &models.IVRVoicemail{Text: "Please call us back"})
+	assert.NoError(t, err)
+	assert.Equal(t, xml.Header+`<Response><!--leaving voicemail--><Say>Please call us back</Say><Hangup></Hangup></Response>`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	err = vs.WriteVoicemailResponse(w, &models.IVRVoicemail{AudioURL: "https://temba.io/voicemail.mp3"})
+	assert.NoError(t, err)
+	assert.Equal(t, xml.Header+`<Response><!--leaving voicemail--><Play>https://temba.io/voicemail.mp3</Play><Hangup></Hangup></Response>`, w.Body.String())
+
+	trace, err := vs.LeaveVoicemail("CA123", &models.IVRVoicemail{Text: "Please call us back"})
+	assert.NoError(t, err)
+	assert.Contains(t, string(trace.RequestTrace), "Twiml=")
+
+	_, err = vs.LeaveVoicemail("CA123", &models.IVRVoicemail{Text: "Please call us back"})
+	assert.EqualError(t, err, "received non 200 trying to leave voicemail: 404")
+}
+
+func TestTransfer(t *testing.T) {
+	_, rt, _, _ := testsuite.Get()
+
+	s := twiml.NewService(http.DefaultClient, "12345", "sesame")
+	ts := s.(ivr.TransferService)
+
+	urn := urns.URN("tel:+12067799294")
+	channelRef := assets.NewChannelReference(assets.ChannelUUID(uuids.New()), "Twilio Channel")
+	statusURL := "http://temba.io/handle?action=transfer&ticket=a9e4fc5e-3d48-4bd9-9f92-a4b1b5ef6b28"
+	sprintEvents := []flows.Event{events.NewIVRCreated(flows.NewMsgOut(urn, channelRef, "transferring you now", nil, nil, nil, flows.NilMsgTopic, "", "", ""))}
+
+	response, err := twiml.TransferResponseForSprint(rt.Config, urn, &models.TransferDestination{Type: models.TransferDestinationPhone, Address: "+12065551212", Timeout: 20}, statusURL, sprintEvents, false)
+	assert.NoError(t, err)
+	assert.Equal(t, xml.Header+`<Response><!--transferring to agent--><Say>transferring you now</Say><Dial action="http://temba.io/handle?action=transfer&amp;ticket=a9e4fc5e-3d48-4bd9-9f92-a4b1b5ef6b28" timeout="20">+12065551212</Dial></Response>`, response)
+
+	response, err = twiml.TransferResponseForSprint(rt.Config, urn, &models.TransferDestination{Type: models.TransferDestinationSIP, Address: "sip:agents@pbx.nyaruka.com"}, statusURL, sprintEvents, false)
+	assert.NoError(t, err)
+	assert.Equal(t, xml.Header+`<Response><!--transferring to agent--><Say>transferring you now</Say><Dial action="http://temba.io/handle?action=transfer&amp;ticket=a9e4fc5e-3d48-4bd9-9f92-a4b1b5ef6b28"><Sip>sip:agents@pbx.nyaruka.com</Sip></Dial></Response>`, response)
+
+	makeRequest := func(body string) *http.Request {
+		r, _ := http.NewRequest("POST", statusURL, strings.NewReader(body))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		r.ParseForm()
+		return r
+	}
+
+	status, duration := ts.TransferStatusForRequest(makeRequest(`CallSid=CA123&DialCallStatus=completed&DialCallDuration=125`))
+	assert.Equal(t, models.TransferStatusAnswered, status)
+	assert.Equal(t, 125, duration)
+
+	status, duration = ts.TransferStatusForRequest(makeRequest(`CallSid=CA123&DialCallStatus=busy`))
+	assert.Equal(t, models.TransferStatusBusy, status)
+	assert.Equal(t, 0, duration)
+
+	status, _ = ts.TransferStatusForRequest(makeRequest(`CallSid=CA123`))
+	assert.Equal(t, models.TransferStatusFailed, status)
+}
+
+func TestCDRs(t *testing.T) {
+	s := twiml.NewService(http.DefaultClient, "12345", "sesame")
+	cs := s.(ivr.CDRService)
+
+	makeRequest := func(body string) *http.Request {
+		r, _ := http.NewRequest("POST", "http://temba.io/status", strings.NewReader(body))
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		r.ParseForm()
+		return r
+	}
+
+	// calls which haven't ended don't have records
+	assert.Nil(t, cs.CDRForRequest(makeRequest(`CallSid=CA123&CallStatus=in-progress`)))
+
+	// status callbacks don't include prices
+	cdr := cs.CDRForRequest(makeRequest(`CallSid=CA123&CallStatus=completed&CallDuration=64&Timestamp=Thu%2C+05+Jul+2018+10%3A23%3A35+%2B0000`))
+	assert.Equal(t, 64, cdr.Duration)
+	assert.Nil(t, cdr.Price)
+	assert.Equal(t, "", cdr.Currency)
+	assert.Equal(t, "completed", cdr.HangupCause)
+	assert.Equal(t, time.Date(2018, 7, 5, 10, 22, 31, 0, time.UTC), *cdr.AnsweredOn)
+	assert.Equal(t, time.Date(2018, 7, 5, 10, 23, 35, 0, time.UTC), cdr.EndedOn)
+
+	// prices aren't always known when the call ends
+	cdr = cs.CDRForRequest(makeRequest(`CallSid=CA123&CallStatus=failed&SipResponseCode=404&Timestamp=Thu%2C+05+Jul+2018+10%3A23%3A35+%2B0000`))
+	assert.Equal(t, 0, cdr.Duration)
+	assert.Equal(t, "failed:404", cdr.HangupCause)
+	assert.Nil(t, cdr.AnsweredOn)
+}
+
+func TestCallPrice(t *testing.T) {
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://api.twilio.com/2010-04-01/Accounts/12345/Calls/CA123.json": {
+			httpx.NewMockResponse(200, nil, `{"sid": "CA123", "status": "completed", "price": "-0.14000", "price_unit": "USD"}`),
+			httpx.NewMockResponse(200, nil, `{"sid": "CA123", "status": "completed", "price": null, "price_unit": "USD"}`),
+			httpx.NewMockResponse(404, nil, `{"code": 20404, "message": "The requested resource was not found"}`),
+		},
+	}))
+
+	s := twiml.NewService(http.DefaultClient, "12345", "sesame")
+	ps := s.(ivr.CDRPriceService)
+
+	// Twilio prices are negative amounts
+	price, currency, trace, err := ps.CallPrice("CA123")
+	assert.NoError(t, err)
+	assert.NotNil(t, trace)
+	assert.Equal(t, "0.14", price.String())
+	assert.Equal(t, "USD", currency)
+
+	// price not set yet
+	price, currency, _, err = ps.CallPrice("CA123")
+	assert.NoError(t, err)
+	assert.Nil(t, price)
+	assert.Equal(t, "", currency)
+
+	_, _, _, err = ps.CallPrice("CA123")
+	assert.EqualError(t, err, "received non 200 status for call fetch: 404")
+}
@@ -22,9 +22,17 @@ type CallRequest struct {
 	EventURL     []string `json:"event_url"`
 	EventMethod  string   `json:"event_method"`
 
-	NCCO             []NCCO `json:"ncco,omitempty"`
-	MachineDetection string `json:"machine_detection"`
-	RingingTimer     int    `json:"ringing_timer,omitempty"`
+	NCCO                     []NCCO                    `json:"ncco,omitempty"`
+	MachineDetection         string                    `json:"machine_detection,omitempty"`
+	AdvancedMachineDetection *AdvancedMachineDetection `json:"advanced_machine_detection,omitempty"`
+	RingingTimer             int                       `json:"ringing_timer,omitempty"`
+}
+
+// AdvancedMachineDetection configures machine detection which can wait for the beep of an answering machine
+type AdvancedMachineDetection struct {
+	Behavior    string `json:"behavior"`
+	Mode        string `json:"mode"`
+	BeepTimeout int    `json:"beep_timeout,omitempty"`
 }
 
 // CallResponse is the response from creating a new call
@@ -86,6 +94,21 @@ type Endpoint struct {
 	Number string `json:"number"`
 }
 
+type Connect struct {
+	Action      string            `json:"action"`
+	From        string            `json:"from,omitempty"`
+	Timeout     int               `json:"timeout,omitempty"`
+	EventURL    []string          `json:"eventUrl"`
+	EventMethod string            `json:"eventMethod"`
+	Endpoint    []ConnectEndpoint `json:"endpoint"`
+}
+
+type ConnectEndpoint struct {
+	Type   string `json:"type"`
+	Number string `json:"number,omitempty"`
+	URI    string `json:"uri,omitempty"`
+}
+
 type Conversation struct {
 	Action string `json:"action"`
 	Name   string `json:"name"`
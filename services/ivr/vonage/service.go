@@ -18,6 +18,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/gocommon/httpx"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/gocommon/uuids"
@@ -34,6 +35,7 @@ import (
 	"github.com/golang-jwt/jwt"
 	"github.com/gomodule/redigo/redis"
 	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
 )
 
@@ -55,6 +57,10 @@ const (
 
 	gatherTimeout = 30
 	recordTimeout = 600
+	beepTimeout   = 45
+
+	// query parameter added to the event URL of calls which can leave a voicemail
+	voicemailParam = "voicemail"
 
 	appIDConfig      = "nexmo_app_id"
 	privateKeyConfig = "nexmo_app_private_key"
@@ -380,6 +386,28 @@ func (s *service) RequestCall(number urns.URN, resumeURL string, statusURL strin
 		callR.MachineDetection = "hangup" // if an answering machine answers, just hangup
 	}
 
+	return s.requestCall(number, callR)
+}
+
+// RequestVoicemailCall requests a new outgoing call where Vonage keeps going if an answering machine answers and lets
+// us know when it beeps
+func (s *service) RequestVoicemailCall(number urns.URN, resumeURL string, statusURL string) (ivr.CallID, *httpx.Trace, error) {
+	statusURL = statusURL + "?" + voicemailParam + "=true"
+
+	callR := &CallRequest{
+		AnswerURL:    []string{resumeURL + "&sig=" + url.QueryEscape(s.calculateSignature(resumeURL))},
+		AnswerMethod: http.MethodPost,
+
+		EventURL:    []string{statusURL + "&sig=" + url.QueryEscape(s.calculateSignature(statusURL))},
+		EventMethod: http.MethodPost,
+
+		AdvancedMachineDetection: &AdvancedMachineDetection{Behavior: "continue", Mode: "detect_beep", BeepTimeout: beepTimeout},
+	}
+
+	return s.requestCall(number, callR)
+}
+
+func (s *service) requestCall(number urns.URN, callR *CallRequest) (ivr.CallID, *httpx.Trace, error) {
 	callR.To = append(callR.To, Phone{Type: "phone", Number: strings.TrimLeft(number.Path(), "+")})
 	callR.From = Phone{Type: "phone", Number: strings.TrimLeft(s.channel.Address(), "+")}
 
@@ -502,9 +530,64 @@ func (s *service) ResumeForRequest(r *http.Request) (ivr.Resume, error) {
 }
 
 type StatusRequest struct {
-	UUID     string `json:"uuid"`
-	Status   string `json:"status"`
-	Duration string `json:"duration"`
+	UUID      string `json:"uuid"`
+	Status    string `json:"status"`
+	SubState  string `json:"sub_state"`
+	Duration  string `json:"duration"`
+	Detail    string `json:"detail"`
+	Price     string `json:"price"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+	Timestamp string `json:"timestamp"`
+}
+
+// call statuses which mean a call has ended
+var finalCallStatuses = map[string]bool{
+	"completed":  true,
+	"busy":       true,
+	"rejected":   true,
+	"unanswered": true,
+	"timeout":    true,
+	"failed":     true,
+	"cancelled":  true,
+}
+
+// CDRForRequest returns the call detail record from an event for a call which has ended. Vonage doesn't include the
+// currency of prices, which is that of the account, so that is read from the channel config.
+func (s *service) CDRForRequest(r *http.Request) *models.CallDetailRecord {
+	bb, _ := readBody(r)
+	status := &StatusRequest{}
+	if err := json.Unmarshal(bb, status); err != nil || !finalCallStatuses[status.Status] {
+		return nil
+	}
+
+	endedOn := dates.Now().UTC()
+	for _, t := range []string{status.EndTime, status.Timestamp} {
+		if parsed, err := time.Parse(time.RFC3339, t); err == nil {
+			endedOn = parsed.UTC()
+			break
+		}
+	}
+
+	cdr := &models.CallDetailRecord{EndedOn: endedOn, HangupCause: status.Status}
+	if status.Detail != "" {
+		cdr.HangupCause = fmt.Sprintf("%s:%s", status.Status, status.Detail)
+	}
+
+	cdr.Duration, _ = strconv.Atoi(status.Duration)
+	if status.Status == "completed" && cdr.Duration > 0 {
+		if startTime, err := time.Parse(time.RFC3339, status.StartTime); err == nil {
+			startTime = startTime.UTC()
+			cdr.AnsweredOn = &startTime
+		}
+	}
+
+	if price, err := decimal.NewFromString(status.Price); err == nil {
+		cdr.Price = &price
+		cdr.Currency = strings.ToUpper(s.channel.ConfigValue(models.ChannelConfigCDRCurrency, "EUR"))
+	}
+
+	return cdr
 }
 
 // StatusForRequest returns the current call status for the passed in status (and optional duration if known)
@@ -549,6 +632,10 @@ func (s *service) StatusForRequest(r *http.Request) (models.ConnectionStatus, mo
 	case "rejected", "unanswered", "timeout":
 		return models.ConnectionStatusErrored, models.ConnectionErrorNoAnswer, 0
 	case "machine":
+		// for calls which can leave a voicemail we wait until the machine beeps (or never does)
+		if r.URL.Query().Get(voicemailParam) == "true" && status.SubState != "beep_start" && status.SubState != "beep_timeout" {
+			return models.ConnectionStatusInProgress, "", 0
+		}
 		return models.ConnectionStatusErrored, models.ConnectionErrorMachine, 0
 	case "failed":
 		return models.ConnectionStatusErrored, models.ConnectionErrorProvider, 0
@@ -617,6 +704,66 @@ func (s *service) WriteSessionResponse(ctx context.Context, rt *runtime.Runtime,
 	return nil
 }
 
+// WriteTransferResponse writes a NCCO response which plays out the passed in session's sprint and then connects the
+// call to the passed in agent destination
+func (s *service) WriteTransferResponse(ctx context.Context, rt *runtime.Runtime, channel *models.Channel, session *models.Session, number urns.URN, destination *models.TransferDestination, statusURL string, w http.ResponseWriter) error {
+	response, err := s.transferResponseForSprint(channel, destination, statusURL, session.Sprint().Events())
+	if err != nil {
+		return errors.Wrap(err, "unable to build transfer response for IVR call")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write([]byte(response))
+	if err != nil {
+		return errors.Wrap(err, "error writing IVR response")
+	}
+
+	return nil
+}
+
+func (s *service) transferResponseForSprint(channel *models.Channel, destination *models.TransferDestination, statusURL string, es []flows.Event) (string, error) {
+	statusURL = statusURL + "&sig=" + url.QueryEscape(s.calculateSignature(statusURL))
+
+	connect := Connect{
+		Action:      "connect",
+		Timeout:     destination.Timeout,
+		EventURL:    []string{statusURL},
+		EventMethod: http.MethodPost,
+	}
+	if destination.Type == models.TransferDestinationSIP {
+		connect.Endpoint = []ConnectEndpoint{{Type: "sip", URI: destination.Address}}
+	} else {
+		connect.From = strings.TrimLeft(channel.Address(), "+")
+		connect.Endpoint = []ConnectEndpoint{{Type: "phone", Number: strings.TrimLeft(destination.Address, "+")}}
+	}
+
+	return marshalActions(append(actionsForEvents(es, false), connect))
+}
+
+// TransferStatusForRequest returns the status and duration of a call connected to an agent, Vonage sending us every
+// event of the connected leg of which we only care about the final ones
+func (s *service) TransferStatusForRequest(r *http.Request) (models.TransferStatus, int) {
+	body, _ := readBody(r)
+	nxStatus, _ := jsonparser.GetString(body, "status")
+
+	switch nxStatus {
+	case "completed":
+		duration, _ := jsonparser.GetString(body, "duration")
+		d, _ := strconv.Atoi(duration)
+		return models.TransferStatusAnswered, d
+	case "answered", "started", "ringing":
+		return "", 0
+	case "unanswered":
+		return models.TransferStatusNoAnswer, 0
+	}
+
+	status, found := callStatusMap[nxStatus]
+	if !found {
+		return "", 0
+	}
+	return models.TransferStatus(status), 0
+}
+
 // WriteErrorResponse writes an error / unavailable response
 func (s *service) WriteErrorResponse(w http.ResponseWriter, err error) error {
 	actions := []interface{}{Talk{
@@ -634,6 +781,47 @@ func (s *service) WriteErrorResponse(w http.ResponseWriter, err error) error {
 	return err
 }
 
+// WriteVoicemailResponse writes a NCCO response which leaves the passed in voicemail
+func (s *service) WriteVoicemailResponse(w http.ResponseWriter, voicemail *models.IVRVoicemail) error {
+	body, err := json.Marshal(voicemailActions(voicemail))
+	if err != nil {
+		return errors.Wrapf(err, "error marshalling voicemail ncco")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(body)
+	return err
+}
+
+// LeaveVoicemail asks Vonage to transfer the passed in call to a NCCO which leaves the passed in voicemail
+func (s *service) LeaveVoicemail(callID string, voicemail *models.IVRVoicemail) (*httpx.Trace, error) {
+	transferBody := map[string]interface{}{
+		"action": "transfer",
+		"destination": map[string]interface{}{
+			"type": "ncco",
+			"ncco": voicemailActions(voicemail),
+		},
+	}
+	trace, err := s.makeRequest(http.MethodPut, s.callURL+"/"+callID, transferBody)
+	if err != nil {
+		return trace, errors.Wrapf(err, "error trying to leave voicemail")
+	}
+
+	// vonage return 204 on successful updates
+	if trace.Response.StatusCode != http.StatusNoContent {
+		return trace, errors.Errorf("received non 204 status trying to leave voicemail: %d", trace.Response.StatusCode)
+	}
+
+	return trace, nil
+}
+
+func voicemailActions(voicemail *models.IVRVoicemail) []interface{} {
+	if voicemail.AudioURL != "" {
+		return []interface{}{Stream{Action: "stream", StreamURL: []string{voicemail.AudioURL}}}
+	}
+	return []interface{}{Talk{Action: "talk", Text: voicemail.Text}}
+}
+
 // WriteEmptyResponse writes an empty (but valid) response
 func (s *service) WriteEmptyResponse(w http.ResponseWriter, msg string) error {
 	w.Header().Set("Content-Type", "application/json")
@@ -732,7 +920,6 @@ func (s *service) generateToken() (string, error) {
 // NCCO building utilities
 
 func (s *service) responseForSprint(ctx context.Context, rp *redis.Pool, channel *models.Channel, conn *models.ChannelConnection, resumeURL string, w flows.ActivatedWait, es []flows.Event) (string, error) {
-	actions := make([]interface{}, 0, 1)
 	waitActions := make([]interface{}, 0, 1)
 
 	if w != nil {
@@ -860,6 +1047,13 @@ func (s *service) responseForSprint(ctx context.Context, rp *redis.Pool, channel
 		_, isWaitInput = waitActions[0].(*Input)
 	}
 
+	return marshalActions(append(actionsForEvents(es, isWaitInput), waitActions...))
+}
+
+// builds the talk and stream actions for the IVR messages in the passed in events
+func actionsForEvents(es []flows.Event, bargeIn bool) []interface{} {
+	actions := make([]interface{}, 0, 1)
+
 	for _, e := range es {
 		switch event := e.(type) {
 		case *events.IVRCreatedEvent:
@@ -867,7 +1061,7 @@ func (s *service) responseForSprint(ctx context.Context, rp *redis.Pool, channel
 				actions = append(actions, Talk{
 					Action:  "talk",
 					Text:    event.Msg.Text(),
-					BargeIn: isWaitInput,
+					BargeIn: bargeIn,
 				})
 			} else {
 				for _, a := range event.Msg.Attachments() {
@@ -880,8 +1074,10 @@ func (s *service) responseForSprint(ctx context.Context, rp *redis.Pool, channel
 		}
 	}
 
-	actions = append(actions, waitActions...)
+	return actions
+}
 
+func marshalActions(actions []interface{}) (string, error) {
 	var body []byte
 	var err error
 	if indentMarshal {
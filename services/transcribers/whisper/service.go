@@ -0,0 +1,111 @@
+package whisper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/mailroom/core/ivr"
+	"github.com/nyaruka/mailroom/core/models"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	transcriberType = "whisper"
+
+	apiKeyConfig  = "transcriber_api_key"
+	baseURLConfig = "transcriber_base_url"
+	modelConfig   = "transcriber_model"
+
+	defaultModel = "whisper-1"
+)
+
+// BaseURL is the default base URL of the OpenAI API (public for testing overriding)
+var BaseURL = "https://api.openai.com/v1"
+
+func init() {
+	ivr.RegisterTranscriber(transcriberType, NewTranscriber)
+}
+
+type transcriber struct {
+	httpClient *http.Client
+	baseURL    string
+	apiKey     string
+	model      string
+}
+
+// NewTranscriber creates a new Whisper transcriber from the config of the passed in channel
+func NewTranscriber(httpClient *http.Client, channel *models.Channel) (ivr.Transcriber, error) {
+	apiKey := channel.ConfigValue(apiKeyConfig, "")
+	if apiKey == "" {
+		return nil, errors.Errorf("missing %s on channel config for channel: %s", apiKeyConfig, channel.UUID())
+	}
+
+	return &transcriber{
+		httpClient: httpClient,
+		baseURL:    strings.TrimRight(channel.ConfigValue(baseURLConfig, BaseURL), "/"),
+		apiKey:     apiKey,
+		model:      channel.ConfigValue(modelConfig, defaultModel),
+	}, nil
+}
+
+type transcriptionResponse struct {
+	Text string `json:"text"`
+}
+
+// Transcribe transcribes the passed in audio using the OpenAI transcriptions API
+func (t *transcriber) Transcribe(ctx context.Context, audio []byte, contentType string, language envs.Language) (string, *httpx.Trace, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	filename := "recording"
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+		filename += exts[0]
+	}
+
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "error creating multipart file")
+	}
+	part.Write(audio)
+
+	writer.WriteField("model", t.model)
+
+	// Whisper wants ISO-639-1 language codes
+	if language != envs.NilLanguage {
+		if code := envs.NewLocale(language, envs.NilCountry).ToBCP47(); code != "" && !strings.Contains(code, "-") {
+			writer.WriteField("language", code)
+		}
+	}
+	writer.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.baseURL+"/audio/transcriptions", body)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "error creating transcription request")
+	}
+	req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	trace, err := httpx.DoTrace(t.httpClient, req, nil, nil, -1)
+	if err != nil {
+		return "", trace, errors.Wrap(err, "error calling transcription API")
+	}
+
+	if trace.Response.StatusCode != http.StatusOK {
+		return "", trace, errors.Errorf("received non 200 status from transcription API: %d", trace.Response.StatusCode)
+	}
+
+	response := &transcriptionResponse{}
+	if err := json.Unmarshal(trace.ResponseBody, response); err != nil {
+		return "", trace, errors.Wrap(err, "error unmarshalling transcription response")
+	}
+
+	return response.Text, trace, nil
+}
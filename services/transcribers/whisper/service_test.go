@@ -0,0 +1,58 @@
+package whisper_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/nyaruka/gocommon/httpx"
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/services/transcribers/whisper"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranscribe(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	defer httpx.SetRequestor(httpx.DefaultRequestor)
+
+	httpx.SetRequestor(httpx.NewMockRequestor(map[string][]httpx.MockResponse{
+		"https://api.openai.com/v1/audio/transcriptions": {
+			httpx.NewMockResponse(200, nil, `{"text": "I would like to speak to an agent"}`),
+			httpx.NewMockResponse(401, nil, `{"error": {"message": "Incorrect API key provided"}}`),
+			httpx.MockConnectionError,
+		},
+	}))
+
+	withKey := testdata.InsertChannel(db, testdata.Org1, "T", "Twilio", []string{"tel"}, "CA", map[string]interface{}{"transcriber": "whisper", "transcriber_api_key": "sk-123"})
+	withoutKey := testdata.InsertChannel(db, testdata.Org1, "T", "Twilio", []string{"tel"}, "CA", map[string]interface{}{"transcriber": "whisper"})
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshChannels)
+	require.NoError(t, err)
+
+	_, err = whisper.NewTranscriber(http.DefaultClient, oa.ChannelByID(withoutKey.ID))
+	assert.EqualError(t, err, "missing transcriber_api_key on channel config for channel: "+string(withoutKey.UUID))
+
+	transcriber, err := whisper.NewTranscriber(http.DefaultClient, oa.ChannelByID(withKey.ID))
+	require.NoError(t, err)
+
+	text, trace, err := transcriber.Transcribe(ctx, []byte("RIFF...."), "audio/wav", envs.Language("eng"))
+	assert.NoError(t, err)
+	assert.Equal(t, "I would like to speak to an agent", text)
+	assert.Equal(t, "Bearer sk-123", trace.Request.Header.Get("Authorization"))
+	assert.Contains(t, string(trace.RequestTrace), `name="language"`)
+	assert.Contains(t, string(trace.RequestTrace), `name="model"`)
+
+	_, trace, err = transcriber.Transcribe(ctx, []byte("RIFF...."), "audio/wav", envs.NilLanguage)
+	assert.EqualError(t, err, "received non 200 status from transcription API: 401")
+	assert.NotContains(t, string(trace.RequestTrace), `name="language"`)
+
+	_, _, err = transcriber.Transcribe(ctx, []byte("RIFF...."), "audio/wav", envs.NilLanguage)
+	assert.EqualError(t, err, "error calling transcription API: unable to connect to server")
+}
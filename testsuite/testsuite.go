@@ -156,6 +156,7 @@ func resetStorage() {
 }
 
 var resetDataSQL = `
+DELETE FROM channels_channelconnectioncdr;
 DELETE FROM notifications_notification;
 DELETE FROM notifications_incident;
 DELETE FROM request_logs_httplog;
@@ -166,6 +167,9 @@ DELETE FROM triggers_trigger_groups WHERE trigger_id >= 30000;
 DELETE FROM triggers_trigger WHERE id >= 30000;
 DELETE FROM channels_channelcount;
 DELETE FROM msgs_msg;
+DELETE FROM flows_archivedsession;
+DELETE FROM flows_flowanalyticscount;
+DELETE FROM flows_sessioninterruption;
 DELETE FROM flows_flowpathrecentrun;
 DELETE FROM flows_flowrun;
 DELETE FROM flows_flowsession;
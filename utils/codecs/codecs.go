@@ -0,0 +1,138 @@
+package codecs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Codec is a way of compressing a JSON document
+type Codec string
+
+const (
+	// None leaves documents as they are
+	None = Codec("none")
+
+	// Gzip compresses documents with gzip
+	Gzip = Codec("gzip")
+
+	// Zstd compresses documents with zstd
+	Zstd = Codec("zstd")
+)
+
+// compressed documents are stored as a marker followed by the base64 of the compressed bytes so that they can still be
+// stored in text columns. JSON documents can never start with one of these so uncompressed documents read as is.
+var markers = map[Codec][]byte{
+	Gzip: []byte("gz:"),
+	Zstd: []byte("zs:"),
+}
+
+var compressionRatio = promauto.NewSummaryVec(prometheus.SummaryOpts{
+	Name:       "mr_codec_compression_ratio",
+	Help:       "The ratio of the encoded size to the original size of documents",
+	Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+}, []string{"codec"})
+
+var codecElapsed = promauto.NewSummaryVec(prometheus.SummaryOpts{
+	Name:       "mr_codec_elapsed",
+	Help:       "The time in milliseconds it took to encode or decode a document",
+	Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+}, []string{"codec", "op"})
+
+// shared zstd encoder and decoder, both are safe for concurrent use of EncodeAll and DecodeAll
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// Encode encodes the passed in document with the given codec
+func Encode(codec Codec, doc []byte) ([]byte, error) {
+	if codec == None || codec == "" || len(doc) == 0 {
+		return doc, nil
+	}
+
+	start := time.Now()
+
+	var compressed []byte
+	switch codec {
+	case Gzip:
+		b := &bytes.Buffer{}
+		w := gzip.NewWriter(b)
+		if _, err := w.Write(doc); err != nil {
+			return nil, errors.Wrap(err, "error gzipping document")
+		}
+		if err := w.Close(); err != nil {
+			return nil, errors.Wrap(err, "error gzipping document")
+		}
+		compressed = b.Bytes()
+	case Zstd:
+		compressed = zstdEncoder.EncodeAll(doc, nil)
+	default:
+		return nil, errors.Errorf("unknown codec: %s", codec)
+	}
+
+	marker := markers[codec]
+	encoded := make([]byte, len(marker)+base64.StdEncoding.EncodedLen(len(compressed)))
+	copy(encoded, marker)
+	base64.StdEncoding.Encode(encoded[len(marker):], compressed)
+
+	codecElapsed.WithLabelValues(string(codec), "encode").Observe(float64(time.Since(start)) / float64(time.Millisecond))
+	compressionRatio.WithLabelValues(string(codec)).Observe(float64(len(encoded)) / float64(len(doc)))
+
+	return encoded, nil
+}
+
+// Decode decodes the passed in document, detecting which codec it was encoded with, if any
+func Decode(encoded []byte) ([]byte, error) {
+	codec := Detect(encoded)
+	if codec == None {
+		return encoded, nil
+	}
+
+	start := time.Now()
+
+	marker := markers[codec]
+	compressed := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)-len(marker)))
+	n, err := base64.StdEncoding.Decode(compressed, encoded[len(marker):])
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decoding %s document", codec)
+	}
+	compressed = compressed[:n]
+
+	var doc []byte
+	switch codec {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, errors.Wrap(err, "error gunzipping document")
+		}
+		doc, err = io.ReadAll(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "error gunzipping document")
+		}
+	case Zstd:
+		doc, err = zstdDecoder.DecodeAll(compressed, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "error decompressing zstd document")
+		}
+	}
+
+	codecElapsed.WithLabelValues(string(codec), "decode").Observe(float64(time.Since(start)) / float64(time.Millisecond))
+
+	return doc, nil
+}
+
+// Detect returns the codec the passed in document was encoded with
+func Detect(encoded []byte) Codec {
+	for codec, marker := range markers {
+		if bytes.HasPrefix(encoded, marker) {
+			return codec
+		}
+	}
+	return None
+}
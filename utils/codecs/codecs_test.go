@@ -0,0 +1,42 @@
+package codecs_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/mailroom/utils/codecs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecs(t *testing.T) {
+	doc := []byte(`{"uuid": "1ae96956-4b34-433e-8d1a-f05fe6923d6d", "runs": [` + strings.Repeat(`{"status": "completed"},`, 100) + `{}]}`)
+
+	for _, codec := range []codecs.Codec{codecs.None, codecs.Gzip, codecs.Zstd} {
+		encoded, err := codecs.Encode(codec, doc)
+		require.NoError(t, err)
+		assert.Equal(t, codec, codecs.Detect(encoded), "codec mismatch for %s", codec)
+
+		if codec != codecs.None {
+			assert.Less(t, len(encoded), len(doc), "expected %s to compress", codec)
+		}
+
+		decoded, err := codecs.Decode(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, string(doc), string(decoded), "round trip mismatch for %s", codec)
+	}
+
+	// empty documents are left alone
+	encoded, err := codecs.Encode(codecs.Gzip, nil)
+	assert.NoError(t, err)
+	assert.Len(t, encoded, 0)
+
+	// unknown codecs error
+	_, err = codecs.Encode(codecs.Codec("lz4"), doc)
+	assert.EqualError(t, err, "unknown codec: lz4")
+
+	// as do corrupt documents
+	_, err = codecs.Decode([]byte("gz:!!!"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,107 @@
+package broadcast
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/broadcast/status", web.RequireAuthToken(handleStatus))
+}
+
+// Request for the sending progress and delivery statistics of a broadcast.
+//
+//   {
+//     "org_id": 1,
+//     "broadcast_id": 12345
+//   }
+//
+type statusRequest struct {
+	OrgID       models.OrgID       `json:"org_id"       validate:"required"`
+	BroadcastID models.BroadcastID `json:"broadcast_id" validate:"required"`
+}
+
+// Response for a broadcast status request.
+//
+//   {
+//     "broadcast_id": 12345,
+//     "status": "S",
+//     "complete": true,
+//     "stats": {
+//       "contacts_resolved": 120,
+//       "batches_total": 2,
+//       "batches_sent": 2,
+//       "msgs_created": 118,
+//       "skipped_opt_out": 3,
+//       "skipped_blocked": 1,
+//       "skipped_no_urn": 1,
+//       "queued": 114,
+//       "failed": 1
+//     },
+//     "variants": [
+//       {
+//         "variant": "A",
+//         "sent": 60,
+//         "delivered": 54,
+//         "failed": 1,
+//         "replied": 12,
+//         "delivery_rate": 0.9,
+//         "reply_rate": 0.2
+//       }
+//     ]
+//   }
+//
+type statusResponse struct {
+	BroadcastID models.BroadcastID     `json:"broadcast_id"`
+	Status      string                 `json:"status"`
+	Complete    bool                   `json:"complete"`
+	Stats       *models.BroadcastStats `json:"stats"`
+
+	Variants []*models.BroadcastVariantStats `json:"variants,omitempty"`
+}
+
+// handles a request for the status of a broadcast
+func handleStatus(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &statusRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	status, err := models.GetBroadcastStatus(ctx, rt.DB, request.OrgID, request.BroadcastID)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return errors.Errorf("no such broadcast with id %d", request.BroadcastID), http.StatusNotFound, nil
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	stats, err := models.GetBroadcastStats(rc, request.BroadcastID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// if this was an A/B split, include how each variant performed
+	variants, err := models.GetBroadcastVariantStats(ctx, rt.DB, request.OrgID, request.BroadcastID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &statusResponse{
+		BroadcastID: request.BroadcastID,
+		Status:      status,
+		Complete:    stats.IsComplete(),
+		Stats:       stats,
+		Variants:    variants,
+	}, http.StatusOK, nil
+}
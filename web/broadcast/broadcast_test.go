@@ -0,0 +1,60 @@
+package broadcast_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/goflow/envs"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	sentID := testdata.InsertBroadcast(db, testdata.Org1, "eng", map[envs.Language]string{"eng": "hello"}, models.NilScheduleID, nil, nil, events.BroadcastTypeDefault)
+	pendingID := testdata.InsertBroadcast(db, testdata.Org1, "eng", map[envs.Language]string{"eng": "hola"}, models.NilScheduleID, nil, nil, events.BroadcastTypeDefault)
+
+	err := models.IncrementBroadcastStats(rc, sentID, &models.BroadcastStats{ContactsResolved: 3, BatchesTotal: 1})
+	require.NoError(t, err)
+	err = models.IncrementBroadcastStats(rc, sentID, &models.BroadcastStats{BatchesSent: 1, MsgsCreated: 2, SkippedBlocked: 1, Queued: 2})
+	require.NoError(t, err)
+
+	// an A/B split broadcast where variant A was delivered to Cathy who replied, and failed for Bob who replied too late,
+	// and variant B was resent to George who only replied after another broadcast
+	splitID := testdata.InsertBroadcast(db, testdata.Org1, "eng", map[envs.Language]string{"eng": "hi"}, models.NilScheduleID, nil, nil, events.BroadcastTypeDefault)
+	insertVariantMsg := func(contact *testdata.Contact, status models.MsgStatus, variant string) {
+		msg := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, contact, "hi", nil, status, false)
+		db.MustExec(`UPDATE msgs_msg SET broadcast_id = $2, metadata = $3 WHERE id = $1`, msg.ID(), splitID, fmt.Sprintf(`{"ab_variant": "%s"}`, variant))
+	}
+	insertVariantMsg(testdata.Cathy, models.MsgStatusDelivered, "A")
+	insertVariantMsg(testdata.Bob, models.MsgStatusFailed, "A")
+	insertVariantMsg(testdata.George, models.MsgStatusResent, "B")
+
+	reply := testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Cathy, "hello", models.MsgStatusHandled)
+	db.MustExec(`UPDATE msgs_msg SET created_on = NOW() + INTERVAL '1 minute' WHERE id = $1`, reply.ID())
+
+	reply = testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob, "hello", models.MsgStatusHandled)
+	db.MustExec(`UPDATE msgs_msg SET created_on = NOW() + INTERVAL '8 days' WHERE id = $1`, reply.ID())
+
+	laterID := testdata.InsertBroadcast(db, testdata.Org1, "eng", map[envs.Language]string{"eng": "hola"}, models.NilScheduleID, nil, nil, events.BroadcastTypeDefault)
+	later := testdata.InsertOutgoingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.George, "hola", nil, models.MsgStatusSent, false)
+	db.MustExec(`UPDATE msgs_msg SET broadcast_id = $2, created_on = NOW() + INTERVAL '1 minute' WHERE id = $1`, later.ID(), laterID)
+	reply = testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.George, "hello", models.MsgStatusHandled)
+	db.MustExec(`UPDATE msgs_msg SET created_on = NOW() + INTERVAL '2 minutes' WHERE id = $1`, reply.ID())
+
+	web.RunWebTests(t, ctx, rt, "testdata/status.json", map[string]string{
+		"sent_broadcast_id":    fmt.Sprintf("%d", sentID),
+		"pending_broadcast_id": fmt.Sprintf("%d", pendingID),
+		"split_broadcast_id":   fmt.Sprintf("%d", splitID),
+	})
+}
@@ -0,0 +1,181 @@
+package campaign
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/campaign/preview", web.RequireAuthToken(handlePreview))
+}
+
+// Request to preview when a campaign event would fire, without scheduling anything.
+//
+//   {
+//     "org_id": 1,
+//     "campaign_id": 345,
+//     "relative_to": "joined",
+//     "offset": 1,
+//     "unit": "D",
+//     "delivery_hour": 9,
+//     "start_mode": "I",
+//     "days": 7,
+//     "sample_size": 10
+//   }
+//
+type previewRequest struct {
+	OrgID        models.OrgID      `json:"org_id"        validate:"required"`
+	CampaignID   models.CampaignID `json:"campaign_id"   validate:"required"`
+	RelativeTo   string            `json:"relative_to"   validate:"required"`
+	Offset       int               `json:"offset"`
+	Unit         models.OffsetUnit `json:"unit"          validate:"required,oneof=M H D W"`
+	DeliveryHour int               `json:"delivery_hour" validate:"min=-1,max=23"`
+	StartMode    models.StartMode  `json:"start_mode"    validate:"oneof=I S P"`
+	Days         int               `json:"days"          validate:"min=1,max=90"`
+	SampleSize   int               `json:"sample_size"   validate:"min=0,max=100"`
+}
+
+// Response for a campaign event preview, fires are counted by day in the org's timezone.
+//
+//   {
+//     "total": 3,
+//     "days": [
+//       {"date": "2026-10-18", "count": 2},
+//       {"date": "2026-10-19", "count": 1}
+//     ],
+//     "sample": [
+//       {
+//         "contact": {"uuid": "6393abc0-283d-4c9b-a1b3-641a035c34bf", "name": "Cathy"},
+//         "scheduled": "2026-10-18T09:00:00-07:00"
+//       }
+//     ]
+//   }
+//
+type previewResponse struct {
+	Total  int              `json:"total"`
+	Days   []*dayCount      `json:"days"`
+	Sample []*previewSample `json:"sample"`
+}
+
+type dayCount struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+type previewSample struct {
+	Contact   *flows.ContactReference `json:"contact"`
+	Scheduled time.Time               `json:"scheduled"`
+}
+
+// handles a request to preview a campaign event
+func handlePreview(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &previewRequest{
+		DeliveryHour: models.NilDeliveryHour,
+		StartMode:    models.StartModeInterrupt,
+		Days:         7,
+		SampleSize:   10,
+	}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, request.OrgID, models.RefreshFields|models.RefreshCampaigns)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	campaign := oa.CampaignByID(request.CampaignID)
+	if campaign == nil {
+		return errors.Errorf("no such campaign with id %d", request.CampaignID), http.StatusNotFound, nil
+	}
+	if oa.FieldByKey(request.RelativeTo) == nil {
+		return errors.Errorf("no such field with key '%s'", request.RelativeTo), http.StatusBadRequest, nil
+	}
+
+	event := models.NewCampaignEvent(campaign, request.RelativeTo, request.Offset, request.Unit, request.DeliveryHour, request.StartMode)
+
+	// calculate fires from now until the end of the last day in our window
+	tz := oa.Env().Timezone()
+	now := time.Now().In(tz)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, tz)
+	until := today.AddDate(0, 0, request.Days)
+
+	fires, err := models.CampaignEventFires(ctx, rt.DB, oa, event, now)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error calculating event fires")
+	}
+
+	// only consider those which fall within our window, soonest first
+	inWindow := make([]*models.FireAdd, 0, len(fires))
+	for _, f := range fires {
+		if f.Scheduled.Before(until) {
+			inWindow = append(inWindow, f)
+		}
+	}
+	sort.SliceStable(inWindow, func(i, j int) bool { return inWindow[i].Scheduled.Before(inWindow[j].Scheduled) })
+
+	days := make([]*dayCount, request.Days)
+	for i := range days {
+		days[i] = &dayCount{Date: today.AddDate(0, 0, i).Format("2006-01-02")}
+	}
+	for _, f := range inWindow {
+		scheduled := f.Scheduled.In(tz)
+		day := time.Date(scheduled.Year(), scheduled.Month(), scheduled.Day(), 0, 0, 0, 0, tz)
+		i := int(day.Sub(today).Hours()+12) / 24 // round to cope with DST transitions
+		if i >= 0 && i < len(days) {
+			days[i].Count++
+		}
+	}
+
+	sample, err := sampleFires(ctx, rt, oa, inWindow, request.SampleSize)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return &previewResponse{Total: len(inWindow), Days: days, Sample: sample}, http.StatusOK, nil
+}
+
+// loads the contacts of the first n of the passed in fires
+func sampleFires(ctx context.Context, rt *runtime.Runtime, oa *models.OrgAssets, fires []*models.FireAdd, n int) ([]*previewSample, error) {
+	if len(fires) > n {
+		fires = fires[:n]
+	}
+
+	contactIDs := make([]models.ContactID, len(fires))
+	for i, f := range fires {
+		contactIDs[i] = f.ContactID
+	}
+
+	contacts, err := models.LoadContactsBasic(ctx, rt.DB, oa, contactIDs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading sample contacts")
+	}
+
+	byID := make(map[models.ContactID]*models.Contact, len(contacts))
+	for _, c := range contacts {
+		byID[c.ID()] = c
+	}
+
+	sample := make([]*previewSample, 0, len(fires))
+	for _, f := range fires {
+		c := byID[f.ContactID]
+		if c == nil {
+			continue
+		}
+		sample = append(sample, &previewSample{
+			Contact:   flows.NewContactReference(c.UUID(), c.Name()),
+			Scheduled: f.Scheduled.In(oa.Env().Timezone()),
+		})
+	}
+	return sample, nil
+}
@@ -0,0 +1,49 @@
+package campaign_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreview(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	tz, err := time.LoadLocation("America/Los_Angeles")
+	require.NoError(t, err)
+
+	now := time.Now().In(tz)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, tz)
+
+	// add bob, george and alexandria to doctors group which campaign is based on
+	testdata.DoctorsGroup.Add(db, testdata.Bob, testdata.George, testdata.Alexandria)
+
+	// bob joined today, george joins tomorrow and alexandria joined long ago
+	setJoined := func(contact *testdata.Contact, joined time.Time) {
+		db.MustExec(`UPDATE contacts_contact SET fields = jsonb_build_object($2::text, jsonb_build_object('datetime', $3::text)) WHERE id = $1`, contact.ID, testdata.JoinedField.UUID, joined.Format(time.RFC3339))
+	}
+	setJoined(testdata.Bob, today.Add(time.Hour*12))
+	setJoined(testdata.George, today.AddDate(0, 0, 1).Add(time.Hour*12))
+	setJoined(testdata.Alexandria, time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	web.RunWebTests(t, ctx, rt, "testdata/preview.json", map[string]string{
+		"day0":        today.Format("2006-01-02"),
+		"day1":        today.AddDate(0, 0, 1).Format("2006-01-02"),
+		"day2":        today.AddDate(0, 0, 2).Format("2006-01-02"),
+		"bob_fire":    time.Date(now.Year(), now.Month(), now.Day()+1, 23, 0, 0, 0, tz).Format(time.RFC3339),
+		"george_fire": time.Date(now.Year(), now.Month(), now.Day()+2, 23, 0, 0, 0, tz).Format(time.RFC3339),
+		"bob_uuid":    fmt.Sprint(testdata.Bob.UUID),
+		"george_uuid": fmt.Sprint(testdata.George.UUID),
+	})
+
+	// nothing was actually scheduled
+	testsuite.AssertQuery(t, db, `SELECT count(*) FROM campaigns_eventfire WHERE contact_id IN ($1, $2)`, testdata.Bob.ID, testdata.George.ID).Returns(0)
+}
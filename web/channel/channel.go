@@ -0,0 +1,95 @@
+package channel
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/channel/budget", web.RequireAuthToken(handleBudget))
+}
+
+// Request for the remaining throughput budgets of an org's channels. If no channel UUIDs are given, the budgets of
+// all channels with a configured budget are returned.
+//
+//   {
+//     "org_id": 1,
+//     "channel_uuids": ["19012bfd-3ce3-4cae-9bb9-76cf92c73d49"]
+//   }
+//
+type budgetRequest struct {
+	OrgID        models.OrgID         `json:"org_id"        validate:"required"`
+	ChannelUUIDs []assets.ChannelUUID `json:"channel_uuids"`
+}
+
+// Response for a channel budget request.
+//
+//   {
+//     "channels": [
+//       {
+//         "channel_uuid": "19012bfd-3ce3-4cae-9bb9-76cf92c73d49",
+//         "throughput": {"per_minute": 600, "daily_limit": 1000},
+//         "daily_used": 250,
+//         "daily_remaining": 750,
+//         "next_send_on": "2026-10-18T14:20:30.123456Z"
+//       }
+//     ]
+//   }
+//
+type budgetResponse struct {
+	Channels []*models.ChannelBudget `json:"channels"`
+}
+
+// handles a request for the throughput budgets of channels
+func handleBudget(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &budgetRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, request.OrgID, models.RefreshChannels)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	channels := make([]*models.Channel, 0)
+	if len(request.ChannelUUIDs) > 0 {
+		for _, uuid := range request.ChannelUUIDs {
+			channel := oa.ChannelByUUID(uuid)
+			if channel == nil {
+				return errors.Errorf("no such channel with uuid %s", uuid), http.StatusNotFound, nil
+			}
+			channels = append(channels, channel)
+		}
+	} else {
+		all, _ := oa.Channels()
+		for _, c := range all {
+			if channel := c.(*models.Channel); channel.Throughput().IsLimited() {
+				channels = append(channels, channel)
+			}
+		}
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	now := time.Now()
+	budgets := make([]*models.ChannelBudget, len(channels))
+	for i, channel := range channels {
+		budgets[i], err = models.GetChannelBudget(rc, channel, now)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	return &budgetResponse{Channels: budgets}, http.StatusOK, nil
+}
@@ -0,0 +1,16 @@
+package channel_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/web"
+)
+
+func TestBudget(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetRedis)
+
+	web.RunWebTests(t, ctx, rt, "testdata/budget.json", nil)
+}
@@ -0,0 +1,159 @@
+package contact
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/modify_by_query", web.RequireAuthToken(handleModifyByQuery))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/modify_status", web.RequireAuthToken(handleModifyStatus))
+}
+
+// Request to apply modifiers to all the active contacts matching a query. A dry run just counts the contacts which would
+// be modified, otherwise the modification is queued and done in batches in the background.
+//
+//   {
+//     "org_id": 1,
+//     "user_id": 1,
+//     "query": "age > 18",
+//     "modifiers": [{
+//        "type": "groups",
+//        "modification": "add",
+//        "groups": [{
+//            "uuid": "a8e8efdb-78ee-46e7-9eb0-6a578da3b02d",
+//            "name": "Doctors"
+//        }]
+//     }],
+//     "dry_run": false
+//   }
+//
+// Response is like:
+//
+//   {
+//     "modification_uuid": "2b8e5d1c-4f3a-4e8b-9c7d-6a1f0e2d3c4b",
+//     "contacts": 123,
+//     "dry_run": false
+//   }
+//
+type modifyByQueryRequest struct {
+	OrgID     models.OrgID      `json:"org_id"     validate:"required"`
+	UserID    models.UserID     `json:"user_id"`
+	Query     string            `json:"query"      validate:"required"`
+	Modifiers []json.RawMessage `json:"modifiers"  validate:"required"`
+	DryRun    bool              `json:"dry_run"`
+}
+
+type modifyByQueryResponse struct {
+	ModificationUUID string `json:"modification_uuid,omitempty"`
+	Contacts         int    `json:"contacts"`
+	DryRun           bool   `json:"dry_run"`
+}
+
+func handleModifyByQuery(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &modifyByQueryRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	// check the modifiers are valid before we queue anything
+	if _, err := goflow.ReadModifiers(oa.SessionAssets(), request.Modifiers, goflow.ErrorOnMissing); err != nil {
+		return err, http.StatusBadRequest, nil
+	}
+
+	contactIDs, err := models.SearchContactIDs(ctx, rt, oa, request.Query, false)
+	if err != nil {
+		isQueryError, qerr := contactql.IsQueryError(err)
+		if isQueryError {
+			return qerr, http.StatusBadRequest, nil
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	response := &modifyByQueryResponse{Contacts: len(contactIDs), DryRun: request.DryRun}
+
+	if !request.DryRun && len(contactIDs) > 0 {
+		task := &contacts.ModifyContactsTask{
+			UUID:          string(uuids.New()),
+			Query:         request.Query,
+			Modifiers:     request.Modifiers,
+			RequestedByID: request.UserID,
+		}
+
+		rc := rt.RP.Get()
+		defer rc.Close()
+
+		err := models.SetContactModificationProgress(rc, task.UUID, &models.ContactModificationProgress{OrgID: oa.OrgID(), Status: models.ContactModificationStatusQueued, Total: len(contactIDs)})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		err = queue.AddTask(rc, queue.BatchQueue, contacts.TypeModifyContacts, int(oa.OrgID()), task, queue.DefaultPriority)
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error queuing modify contacts task")
+		}
+
+		response.ModificationUUID = task.UUID
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// Gets the progress of a modification of contacts by query.
+//
+//   {
+//     "org_id": 1,
+//     "modification_uuid": "2b8e5d1c-4f3a-4e8b-9c7d-6a1f0e2d3c4b"
+//   }
+//
+// Response is like:
+//
+//   {
+//     "org_id": 1,
+//     "status": "modifying",
+//     "total": 123,
+//     "modified": 100
+//   }
+//
+type modifyStatusRequest struct {
+	OrgID            models.OrgID `json:"org_id"             validate:"required"`
+	ModificationUUID string       `json:"modification_uuid"  validate:"required"`
+}
+
+func handleModifyStatus(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &modifyStatusRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	progress, err := models.GetContactModificationProgress(rc, request.ModificationUUID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if progress == nil || progress.OrgID != request.OrgID {
+		return errors.Errorf("no such contact modification with uuid %s", request.ModificationUUID), http.StatusNotFound, nil
+	}
+
+	return progress, http.StatusOK, nil
+}
@@ -78,3 +78,43 @@ func TestResolveContacts(t *testing.T) {
 
 	web.RunWebTests(t, ctx, rt, "testdata/resolve.json", nil)
 }
+
+func TestMergeContacts(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// for simpler tests we clear out the fields of cathy and bob and give bob a value cathy doesn't have
+	db.MustExec(`UPDATE contacts_contact SET fields = NULL WHERE id = $1`, testdata.Cathy.ID)
+	db.MustExec(`UPDATE contacts_contact SET fields = $2::jsonb WHERE id = $1`, testdata.Bob.ID, `{"903f51da-2717-47c7-a0d3-f2f32877013d": {"text": "30", "number": 30}}`)
+
+	testdata.InsertIncomingMsg(db, testdata.Org1, testdata.TwilioChannel, testdata.Bob, "hi", models.MsgStatusHandled)
+
+	web.RunWebTests(t, ctx, rt, "testdata/merge.json", nil)
+}
+
+func TestExport(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// without elastic exports page through the database
+	rt.ES = nil
+
+	db.MustExec(`UPDATE contacts_contact SET language = 'eng', fields = NULL, created_on = '2021-06-01T12:00:00Z', last_seen_on = NULL WHERE id IN ($1, $2)`, testdata.Cathy.ID, testdata.George.ID)
+	db.MustExec(`DELETE FROM contacts_contactgroup_contacts WHERE contactgroup_id = $1`, testdata.TestersGroup.ID)
+	testdata.TestersGroup.Add(db, testdata.Cathy, testdata.George)
+
+	web.RunWebTests(t, ctx, rt, "testdata/export.json", nil)
+}
+
+func TestModifyByQuery(t *testing.T) {
+	ctx, rt, _, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetAll)
+
+	// without elastic queries are searched in the database
+	rt.ES = nil
+
+	web.RunWebTests(t, ctx, rt, "testdata/modify_by_query.json", nil)
+}
@@ -0,0 +1,185 @@
+package contact
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/contacts"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	web.RegisterRoute(http.MethodPost, "/mr/contact/export", handleExport)
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/export_status", web.RequireAuthToken(handleExportStatus))
+}
+
+// Exports the contacts in a group and/or matching a query as CSV (the default), XLSX or JSONL. Every export includes
+// the contacts' UUIDs, names, languages, statuses, created_on and last_seen_on, plus the given fields, the paths of their
+// URNs of the given schemes and whether they belong to the given groups.
+//
+//   {
+//     "org_id": 1,
+//     "group_uuid": "985a83fe-2e9f-478d-a3ec-fa602d5e7ddd",
+//     "query": "age > 10",
+//     "format": "csv",
+//     "fields": ["age", "gender"],
+//     "schemes": ["tel", "whatsapp"],
+//     "groups": ["5e9d8fab-5e7e-4f51-b533-261af5dea70d"],
+//     "background": false
+//   }
+//
+// Exports of no more contacts than the configured maximum are streamed in the response. Larger exports, or any if
+// background is set, are written to media storage by a background task and the response is like:
+//
+//   {
+//     "export_uuid": "c3c5d3c6-8f4b-4d2b-9d2d-5d3b6e0b9b53",
+//     "status": "queued",
+//     "total": 123456
+//   }
+//
+type exportRequest struct {
+	OrgID      models.OrgID               `json:"org_id"      validate:"required"`
+	GroupUUID  assets.GroupUUID           `json:"group_uuid"`
+	Query      string                     `json:"query"`
+	Format     models.ContactExportFormat `json:"format"      validate:"omitempty,oneof=csv xlsx jsonl"`
+	Fields     []string                   `json:"fields"`
+	Schemes    []string                   `json:"schemes"`
+	Groups     []assets.GroupUUID         `json:"groups"`
+	Background bool                       `json:"background"`
+}
+
+type exportResponse struct {
+	ExportUUID string                     `json:"export_uuid"`
+	Status     models.ContactExportStatus `json:"status"`
+	Total      int                        `json:"total"`
+}
+
+func handleExport(ctx context.Context, rt *runtime.Runtime, r *http.Request, w http.ResponseWriter) error {
+	// this isn't a JSON handler that can be wrapped by web.RequireAuthToken so check the token ourselves
+	if rt.Config.AuthToken != "" && fmt.Sprintf("Token %s", rt.Config.AuthToken) != r.Header.Get("authorization") {
+		return writeExportJSON(w, http.StatusUnauthorized, web.NewErrorResponse(errors.New("invalid or missing authorization header, denying")))
+	}
+
+	request := &exportRequest{Format: models.ContactExportFormatCSV}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return writeExportJSON(w, http.StatusBadRequest, web.NewErrorResponse(errors.Wrapf(err, "request failed validation")))
+	}
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, request.OrgID, models.RefreshFields|models.RefreshGroups)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load org assets")
+	}
+
+	export := &models.ContactExport{
+		UUID:      string(uuids.New()),
+		GroupUUID: request.GroupUUID,
+		Query:     request.Query,
+		Format:    request.Format,
+		Fields:    request.Fields,
+		Schemes:   request.Schemes,
+		Groups:    request.Groups,
+	}
+
+	if _, err := export.Columns(oa); err != nil {
+		return writeExportJSON(w, http.StatusBadRequest, web.NewErrorResponse(err))
+	}
+
+	// count the contacts to decide whether we can stream them
+	_, _, total, err := models.SearchContactIDsPage(ctx, rt, oa, request.GroupUUID, nil, request.Query, "id", 0, 0, false)
+	if err != nil {
+		isQueryError, qerr := contactql.IsQueryError(err)
+		if isQueryError {
+			return writeExportJSON(w, http.StatusBadRequest, web.NewErrorResponse(qerr))
+		}
+		return err
+	}
+
+	if request.Background || int(total) > rt.Config.MaxStreamedExport {
+		rc := rt.RP.Get()
+		defer rc.Close()
+
+		err := models.SetContactExportProgress(rc, export.UUID, &models.ContactExportProgress{OrgID: oa.OrgID(), Status: models.ContactExportStatusQueued, Total: int(total)})
+		if err != nil {
+			return err
+		}
+
+		task := &contacts.ExportContactsTask{Export: export, Total: int(total)}
+		if err := queue.AddTask(rc, queue.BatchQueue, contacts.TypeExportContacts, int(oa.OrgID()), task, queue.DefaultPriority); err != nil {
+			return errors.Wrapf(err, "error queuing export contacts task")
+		}
+
+		return writeExportJSON(w, http.StatusOK, &exportResponse{ExportUUID: export.UUID, Status: models.ContactExportStatusQueued, Total: int(total)})
+	}
+
+	w.Header().Set("Content-type", export.Format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="contacts.%s"`, export.Format))
+	w.WriteHeader(http.StatusOK)
+
+	// once we've started writing the response we can't change its status, so all we can do is log errors
+	if _, err := models.WriteContactExport(ctx, rt, oa, export, w, nil); err != nil {
+		logrus.WithError(err).WithField("org_id", oa.OrgID()).WithField("http_request", r).Error("error streaming contact export")
+	}
+	return nil
+}
+
+func writeExportJSON(w http.ResponseWriter, status int, value interface{}) error {
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	_, err := w.Write(jsonx.MustMarshal(value))
+	return err
+}
+
+// Gets the progress of a contact export being done in the background, which once complete includes the URL of the
+// exported file in media storage.
+//
+//   {
+//     "org_id": 1,
+//     "export_uuid": "c3c5d3c6-8f4b-4d2b-9d2d-5d3b6e0b9b53"
+//   }
+//
+// Response is like:
+//
+//   {
+//     "org_id": 1,
+//     "status": "complete",
+//     "total": 123456,
+//     "exported": 123456,
+//     "url": "https://s3.amazonaws.com/mailroom-media/media/contact_exports/1/c3c5d3c6-8f4b-4d2b-9d2d-5d3b6e0b9b53.csv"
+//   }
+//
+type exportStatusRequest struct {
+	OrgID      models.OrgID `json:"org_id"       validate:"required"`
+	ExportUUID string       `json:"export_uuid"  validate:"required"`
+}
+
+func handleExportStatus(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &exportStatusRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	progress, err := models.GetContactExportProgress(rc, request.ExportUUID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if progress == nil || progress.OrgID != request.OrgID {
+		return errors.Errorf("no such contact export with uuid %s", request.ExportUUID), http.StatusNotFound, nil
+	}
+
+	return progress, http.StatusOK, nil
+}
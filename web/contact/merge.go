@@ -0,0 +1,163 @@
+package contact
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/utils/locker"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/merge", web.RequireAuthToken(handleMerge))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/duplicates", web.RequireAuthToken(handleDuplicates))
+}
+
+// Request to merge source contacts into a target contact. Values of fields which both the target and a source have
+// are resolved by the fields policy, either keep_target (the default) or overwrite.
+//
+//   {
+//     "org_id": 1,
+//     "user_id": 1,
+//     "contact_id": 10000,
+//     "source_ids": [10001, 10002],
+//     "fields": "keep_target"
+//   }
+//
+// Response is like:
+//
+//   {
+//     "contact_id": 10000,
+//     "merged_ids": [10001, 10002],
+//     "field_conflicts": ["gender"]
+//   }
+//
+type mergeRequest struct {
+	OrgID     models.OrgID            `json:"org_id"      validate:"required"`
+	UserID    models.UserID           `json:"user_id"`
+	ContactID models.ContactID        `json:"contact_id"  validate:"required"`
+	SourceIDs []models.ContactID      `json:"source_ids"  validate:"required,min=1"`
+	Fields    models.FieldMergePolicy `json:"fields"      validate:"omitempty,oneof=keep_target overwrite"`
+}
+
+// handles a request to merge contacts
+func handleMerge(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &mergeRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+	if request.Fields == "" {
+		request.Fields = models.FieldMergeKeepTarget
+	}
+
+	contactIDs := []models.ContactID{request.ContactID}
+	seen := map[models.ContactID]bool{request.ContactID: true}
+	for _, id := range request.SourceIDs {
+		if seen[id] {
+			return errors.Errorf("contact %d can't be merged more than once or into itself", id), http.StatusBadRequest, nil
+		}
+		seen[id] = true
+		contactIDs = append(contactIDs, id)
+	}
+
+	// grab our org assets
+	oa, err := models.GetOrgAssets(ctx, rt, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	// lock all the contacts so that they aren't handling events while they're merged, always in the same order so that
+	// overlapping merges can't deadlock each other
+	lockIDs := make([]models.ContactID, len(contactIDs))
+	copy(lockIDs, contactIDs)
+	sort.Slice(lockIDs, func(i, j int) bool { return lockIDs[i] < lockIDs[j] })
+
+	for _, id := range lockIDs {
+		lockID := models.ContactLock(oa.OrgID(), id)
+		lock, err := locker.GrabLock(rt.RP, lockID, time.Minute, time.Second*10)
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error grabbing lock for contact %d", id)
+		}
+		if lock == "" {
+			return nil, http.StatusInternalServerError, errors.Errorf("timed out waiting for lock for contact %d", id)
+		}
+		defer locker.ReleaseLock(rt.RP, lockID, lock)
+	}
+
+	contacts, err := models.LoadContacts(ctx, rt.DB, oa, contactIDs)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load contacts")
+	}
+
+	byID := make(map[models.ContactID]*models.Contact, len(contacts))
+	for _, c := range contacts {
+		byID[c.ID()] = c
+	}
+
+	sources := make([]*models.Contact, 0, len(request.SourceIDs))
+	for _, id := range contactIDs {
+		if byID[id] == nil {
+			return errors.Errorf("no such contact with id %d", id), http.StatusNotFound, nil
+		}
+		if id != request.ContactID {
+			sources = append(sources, byID[id])
+		}
+	}
+
+	merge, err := models.MergeContacts(ctx, rt.DB, oa, request.UserID, byID[request.ContactID], sources, request.Fields)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error merging contacts")
+	}
+
+	return merge, http.StatusOK, nil
+}
+
+// the number of duplicate candidates returned for each reason if no limit is specified
+const defaultDuplicatesLimit = 100
+
+// Request to find the likely duplicate contacts in an org, i.e. contacts with URNs for the same phone number (Brazilian
+// mobile numbers being compared without their ninth digit) or with the same name.
+//
+//   {
+//     "org_id": 1,
+//     "limit": 100
+//   }
+//
+// Response is like:
+//
+//   {
+//     "duplicates": [
+//       {"reason": "urn", "key": "556599887766", "contact_ids": [10000, 10003]},
+//       {"reason": "name", "key": "ana maria", "contact_ids": [10000, 10005, 10006]}
+//     ]
+//   }
+//
+type duplicatesRequest struct {
+	OrgID models.OrgID `json:"org_id"  validate:"required"`
+	Limit int          `json:"limit"   validate:"min=0,max=1000"`
+}
+
+// handles a request to find duplicate contacts
+func handleDuplicates(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &duplicatesRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+	if request.Limit == 0 {
+		request.Limit = defaultDuplicatesLimit
+	}
+
+	duplicates, err := models.FindDuplicateContacts(ctx, rt.ReadonlyDB, request.OrgID, request.Limit)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error finding duplicate contacts")
+	}
+
+	return map[string]interface{}{"duplicates": duplicates}, http.StatusOK, nil
+}
@@ -19,23 +19,26 @@ func init() {
 	web.RegisterJSONRoute(http.MethodPost, "/mr/contact/parse_query", web.RequireAuthToken(handleParseQuery))
 }
 
-// Searches the contacts for an org
+// Searches the contacts for an org. If strong_consistency is set then the search is done in the database so that it
+// includes contacts which have been modified but not yet indexed, which isn't possible for every query.
 //
 //   {
 //     "org_id": 1,
 //     "group_uuid": "985a83fe-2e9f-478d-a3ec-fa602d5e7ddd",
 //     "query": "age > 10",
-//     "sort": "-age"
+//     "sort": "-age",
+//     "strong_consistency": false
 //   }
 //
 type searchRequest struct {
-	OrgID      models.OrgID       `json:"org_id"     validate:"required"`
-	GroupUUID  assets.GroupUUID   `json:"group_uuid" validate:"required"`
-	ExcludeIDs []models.ContactID `json:"exclude_ids"`
-	Query      string             `json:"query"`
-	PageSize   int                `json:"page_size"`
-	Offset     int                `json:"offset"`
-	Sort       string             `json:"sort"`
+	OrgID             models.OrgID       `json:"org_id"     validate:"required"`
+	GroupUUID         assets.GroupUUID   `json:"group_uuid" validate:"required"`
+	ExcludeIDs        []models.ContactID `json:"exclude_ids"`
+	Query             string             `json:"query"`
+	PageSize          int                `json:"page_size"`
+	Offset            int                `json:"offset"`
+	Sort              string             `json:"sort"`
+	StrongConsistency bool               `json:"strong_consistency"`
 }
 
 // Response for a contact search
@@ -83,8 +86,8 @@ func handleSearch(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 	}
 
 	// perform our search
-	parsed, hits, total, err := models.ContactIDsForQueryPage(ctx, rt.ES, oa,
-		request.GroupUUID, request.ExcludeIDs, request.Query, request.Sort, request.Offset, request.PageSize)
+	parsed, hits, total, err := models.SearchContactIDsPage(ctx, rt, oa,
+		request.GroupUUID, request.ExcludeIDs, request.Query, request.Sort, request.Offset, request.PageSize, request.StrongConsistency)
 
 	if err != nil {
 		isQueryError, qerr := contactql.IsQueryError(err)
@@ -195,6 +195,15 @@ func TestSearch(t *testing.T) {
 			ExpectedQuery:  ``,
 			ExpectedFields: []string{},
 		},
+		{
+			Method:         "POST",
+			URL:            "/mr/contact/search",
+			Body:           fmt.Sprintf(`{"org_id": 1, "query": "name = bob", "group_uuid": "%s", "strong_consistency": true}`, testdata.AllContactsGroup.UUID),
+			ExpectedStatus: 200,
+			ExpectedHits:   []models.ContactID{testdata.Bob.ID},
+			ExpectedQuery:  `name = "bob"`,
+			ExpectedFields: []string{"name"},
+		},
 	}
 
 	for i, tc := range tcs {
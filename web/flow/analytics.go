@@ -0,0 +1,150 @@
+package flow
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+// the number of days of analytics returned if no range is specified
+const defaultAnalyticsDays = 30
+
+// Gets the per-node analytics of a flow for a range of days (UTC, inclusive). If no range is given then the last 30
+// days are returned, and ranges are limited to the period for which analytics are retained.
+//
+//   {
+//     "org_id": 1,
+//     "flow_id": 2,
+//     "since": "2021-06-01",
+//     "until": "2021-06-30"
+//   }
+//
+// Response is like:
+//
+//   {
+//     "flow_uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85",
+//     "since": "2021-06-01",
+//     "until": "2021-06-30",
+//     "nodes": [
+//       {"node_uuid": "5253c207-46da-4fb7-8d35-e0c2bdb8d2b2", "completed": 12, "expired": 3, "interrupted": 1, "failed": 0}
+//     ],
+//     "segments": [
+//       {
+//         "from_uuid": "5253c207-46da-4fb7-8d35-e0c2bdb8d2b2",
+//         "to_uuid": "a1dc1d7e-b84a-4c63-a7bb-b1e3bd67b5b2",
+//         "count": 15,
+//         "avg_seconds": 42.5,
+//         "histogram": [{"max_seconds": 10, "count": 4}, {"max_seconds": 60, "count": 10}, ... {"max_seconds": null, "count": 1}]
+//       }
+//     ],
+//     "wait_reminders": [
+//       {"node_uuid": "5253c207-46da-4fb7-8d35-e0c2bdb8d2b2", "reminder": 0, "sent": 20, "responded": 8}
+//     ]
+//   }
+//
+type analyticsRequest struct {
+	OrgID  models.OrgID  `json:"org_id"  validate:"required"`
+	FlowID models.FlowID `json:"flow_id" validate:"required"`
+	Since  string        `json:"since"`
+	Until  string        `json:"until"`
+}
+
+type analyticsResponse struct {
+	FlowUUID      assets.FlowUUID             `json:"flow_uuid"`
+	Since         string                      `json:"since"`
+	Until         string                      `json:"until"`
+	Nodes         []*models.NodeAnalytics     `json:"nodes"`
+	Segments      []*models.SegmentAnalytics  `json:"segments"`
+	WaitReminders []*models.WaitReminderStats `json:"wait_reminders"`
+}
+
+func handleAnalytics(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &analyticsRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	today := dates.Now().UTC().Truncate(time.Hour * 24)
+	until, since := today, today.AddDate(0, 0, -(defaultAnalyticsDays - 1))
+	var err error
+
+	if request.Until != "" {
+		if until, err = time.Parse("2006-01-02", request.Until); err != nil {
+			return errors.Errorf("invalid until date: %s", request.Until), http.StatusBadRequest, nil
+		}
+	}
+	if request.Since != "" {
+		if since, err = time.Parse("2006-01-02", request.Since); err != nil {
+			return errors.Errorf("invalid since date: %s", request.Since), http.StatusBadRequest, nil
+		}
+	} else if request.Until != "" {
+		since = until.AddDate(0, 0, -(defaultAnalyticsDays - 1))
+	}
+
+	if since.After(until) {
+		return errors.New("since must not be after until"), http.StatusBadRequest, nil
+	}
+
+	// analytics older than our retention period no longer exist
+	oldest := today.Add(-models.FlowAnalyticsRetention)
+	if since.Before(oldest) {
+		since = oldest
+	}
+	if until.After(today) {
+		until = today
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	flow, err := oa.FlowByID(request.FlowID)
+	if err != nil {
+		if err == models.ErrNotFound {
+			return errors.Errorf("no such flow with id %d", request.FlowID), http.StatusNotFound, nil
+		}
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load flow")
+	}
+
+	rc := rt.RP.Get()
+	defer rc.Close()
+
+	response := &analyticsResponse{
+		FlowUUID:      flow.UUID(),
+		Since:         since.Format("2006-01-02"),
+		Until:         until.Format("2006-01-02"),
+		Nodes:         []*models.NodeAnalytics{},
+		Segments:      []*models.SegmentAnalytics{},
+		WaitReminders: []*models.WaitReminderStats{},
+	}
+
+	// if our range is entirely outside of what we retain, there's nothing to look up
+	if !since.After(until) {
+		analytics, err := models.GetFlowAnalytics(ctx, rt.DB, rc, flow.ID(), since, until)
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load flow analytics")
+		}
+		response.Nodes = analytics.Nodes
+		response.Segments = analytics.Segments
+	}
+
+	reminders, err := models.GetWaitReminderStats(rc, flow.ID())
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load wait reminder stats")
+	}
+	if len(reminders) > 0 {
+		response.WaitReminders = reminders
+	}
+
+	return response, http.StatusOK, nil
+}
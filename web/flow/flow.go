@@ -23,6 +23,8 @@ func init() {
 	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/inspect", web.RequireAuthToken(handleInspect))
 	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/clone", web.RequireAuthToken(handleClone))
 	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/change_language", web.RequireAuthToken(handleChangeLanguage))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/start_preview", web.RequireAuthToken(handleStartPreview))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/flow/analytics", web.RequireAuthToken(handleAnalytics))
 }
 
 // Migrates a flow to the latest flow specification
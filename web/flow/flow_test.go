@@ -10,6 +10,7 @@ import (
 func TestServer(t *testing.T) {
 	ctx, rt, _, _ := testsuite.Get()
 
+	web.RunWebTests(t, ctx, rt, "testdata/analytics.json", nil)
 	web.RunWebTests(t, ctx, rt, "testdata/change_language.json", nil)
 	web.RunWebTests(t, ctx, rt, "testdata/clone.json", nil)
 	web.RunWebTests(t, ctx, rt, "testdata/inspect.json", nil)
@@ -0,0 +1,99 @@
+package flow
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/tasks/starts"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+// Previews a flow start, resolving its recipients the same way as starting it would but without creating any contacts,
+// and reports how many contacts would be excluded and any problems those started would likely run into.
+//
+//   {
+//     "org_id": 1,
+//     "flow_id": 2,
+//     "group_ids": [3],
+//     "exclude_group_ids": [4],
+//     "contact_ids": [12, 34],
+//     "urns": ["tel:+593979111222"],
+//     "query": "age > 18",
+//     "create_contact": false,
+//     "restart_participants": false,
+//     "include_active": false
+//   }
+//
+// Response is like:
+//
+//   {
+//     "total": 120,
+//     "new_contacts": 1,
+//     "excluded": {"started_previously": 10, "in_other_flows": 5},
+//     "to_start": 105,
+//     "warnings": {
+//       "blocked": 2,
+//       "stopped": 1,
+//       "missing_urn": {"schemes": ["whatsapp"], "contacts": 12},
+//       "templates": [{"uuid": "9c22b594-fcab-4b29-9bcb-ce4404894a80", "name": "revive_issue", "missing_languages": ["fra"], "contacts": 7}]
+//     }
+//   }
+//
+type startPreviewRequest struct {
+	OrgID               models.OrgID               `json:"org_id"               validate:"required"`
+	FlowID              models.FlowID              `json:"flow_id"              validate:"required"`
+	GroupIDs            []models.GroupID           `json:"group_ids"`
+	ExcludeGroupIDs     []models.GroupID           `json:"exclude_group_ids"`
+	ContactIDs          []models.ContactID         `json:"contact_ids"`
+	URNs                []urns.URN                 `json:"urns"`
+	Query               string                     `json:"query"`
+	CreateContact       bool                       `json:"create_contact"`
+	RestartParticipants models.RestartParticipants `json:"restart_participants"`
+	IncludeActive       models.IncludeActive       `json:"include_active"`
+}
+
+func handleStartPreview(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &startPreviewRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	flow, err := oa.FlowByID(request.FlowID)
+	if err != nil {
+		if err == models.ErrNotFound {
+			return errors.Errorf("no such flow with id %d", request.FlowID), http.StatusNotFound, nil
+		}
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load flow")
+	}
+
+	start := models.NewFlowStart(oa.OrgID(), models.StartTypeManual, flow.FlowType(), flow.ID(), request.RestartParticipants, request.IncludeActive).
+		WithGroupIDs(request.GroupIDs).
+		WithExcludeGroupIDs(request.ExcludeGroupIDs).
+		WithContactIDs(request.ContactIDs).
+		WithURNs(request.URNs).
+		WithQuery(request.Query).
+		WithCreateContact(request.CreateContact)
+
+	preview, err := starts.PreviewFlowStart(ctx, rt, oa, flow, start)
+	if err != nil {
+		isQueryError, qerr := contactql.IsQueryError(err)
+		if isQueryError {
+			return qerr, http.StatusBadRequest, nil
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return preview, http.StatusOK, nil
+}
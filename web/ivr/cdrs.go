@@ -0,0 +1,164 @@
+package ivr
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/ivr/cdrs", web.RequireAuthToken(handleCDRs))
+}
+
+// the number of days of call detail records returned if no range is specified
+const defaultCDRDays = 30
+
+// Gets the call costs of an org's IVR calls per channel, direction and day (UTC, inclusive) for reconciling voice
+// bills. If no range is given then the last 30 days are returned, optionally limited to a single channel. The
+// individual call detail records are included if include_records is set.
+//
+//   {
+//     "org_id": 1,
+//     "channel_id": 2,
+//     "since": "2021-06-01",
+//     "until": "2021-06-30",
+//     "include_records": true
+//   }
+//
+// Response is like:
+//
+//   {
+//     "since": "2021-06-01",
+//     "until": "2021-06-30",
+//     "summary": [
+//       {
+//         "day": "2021-06-01",
+//         "channel_id": 2,
+//         "channel_uuid": "74729f45-7f29-4868-9dc4-90e491e3c7d8",
+//         "direction": "O",
+//         "calls": 12,
+//         "answered": 10,
+//         "duration": 734,
+//         "costs": {"USD": "1.32"},
+//         "unpriced": 0
+//       }
+//     ],
+//     "records": [
+//       {
+//         "connection_id": 1234,
+//         "channel_id": 2,
+//         "direction": "O",
+//         "external_id": "CA5a1b9e3c",
+//         "status": "D",
+//         "duration": 64,
+//         "price": "0.14",
+//         "currency": "USD",
+//         "hangup_cause": "completed",
+//         "answered_on": "2021-06-01T10:22:31Z",
+//         "ended_on": "2021-06-01T10:23:35Z"
+//       }
+//     ]
+//   }
+//
+type cdrsRequest struct {
+	OrgID          models.OrgID     `json:"org_id"  validate:"required"`
+	ChannelID      models.ChannelID `json:"channel_id"`
+	Since          string           `json:"since"`
+	Until          string           `json:"until"`
+	IncludeRecords bool             `json:"include_records"`
+}
+
+type cdrSummary struct {
+	*models.CallCostSummary
+	ChannelUUID assets.ChannelUUID `json:"channel_uuid"`
+}
+
+type cdrsResponse struct {
+	Since   string                     `json:"since"`
+	Until   string                     `json:"until"`
+	Summary []*cdrSummary              `json:"summary"`
+	Records []*models.CallDetailRecord `json:"records,omitempty"`
+}
+
+func handleCDRs(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &cdrsRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	today := dates.Now().UTC().Truncate(time.Hour * 24)
+	until, since := today, today.AddDate(0, 0, -(defaultCDRDays-1))
+	var err error
+
+	if request.Until != "" {
+		if until, err = time.Parse("2006-01-02", request.Until); err != nil {
+			return errors.Errorf("invalid until date: %s", request.Until), http.StatusBadRequest, nil
+		}
+	}
+	if request.Since != "" {
+		if since, err = time.Parse("2006-01-02", request.Since); err != nil {
+			return errors.Errorf("invalid since date: %s", request.Since), http.StatusBadRequest, nil
+		}
+	} else if request.Until != "" {
+		since = until.AddDate(0, 0, -(defaultCDRDays - 1))
+	}
+
+	if since.After(until) {
+		return errors.New("since must not be after until"), http.StatusBadRequest, nil
+	}
+
+	if until.After(today) {
+		until = today
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	if request.ChannelID != models.NilChannelID && oa.ChannelByID(request.ChannelID) == nil {
+		return errors.Errorf("no such channel with id %d", request.ChannelID), http.StatusNotFound, nil
+	}
+
+	response := &cdrsResponse{
+		Since:   since.Format("2006-01-02"),
+		Until:   until.Format("2006-01-02"),
+		Summary: []*cdrSummary{},
+	}
+
+	// if our range is entirely in the future, there's nothing to look up
+	if since.After(until) {
+		return response, http.StatusOK, nil
+	}
+
+	summaries, err := models.GetCallCostSummaries(ctx, rt.DB, request.OrgID, request.ChannelID, since, until)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load call costs")
+	}
+
+	for _, s := range summaries {
+		summary := &cdrSummary{CallCostSummary: s}
+		if channel := oa.ChannelByID(s.ChannelID); channel != nil {
+			summary.ChannelUUID = channel.UUID()
+		}
+		response.Summary = append(response.Summary, summary)
+	}
+
+	if request.IncludeRecords {
+		response.Records, err = models.GetCallDetailRecords(ctx, rt.DB, request.OrgID, request.ChannelID, since, until)
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load call detail records")
+		}
+	}
+
+	return response, http.StatusOK, nil
+}
@@ -155,7 +155,7 @@ func handleIncomingCall(ctx context.Context, rt *runtime.Runtime, r *http.Reques
 		resumeURL := buildResumeURL(rt.Config, channel, conn, urn)
 
 		// have our client output our session status
-		err = provider.WriteSessionResponse(ctx, rt, channel, conn, session, urn, resumeURL, r, w)
+		err = ivr.WriteSessionResponse(ctx, rt, provider, oa, channel, conn, session, urn, resumeURL, r, w)
 		if err != nil {
 			return channel, conn, errors.Wrapf(err, "error writing ivr response for start")
 		}
@@ -186,6 +186,8 @@ const (
 	actionStart  = "start"
 	actionResume = "resume"
 	actionStatus = "status"
+
+	actionTransfer = ivr.TransferAction
 )
 
 // IVRRequest is our form for what fields we expect in IVR callbacks
@@ -306,6 +308,12 @@ func handleFlow(ctx context.Context, rt *runtime.Runtime, r *http.Request, w htt
 			r, w,
 		)
 
+	case actionTransfer:
+		err = ivr.HandleTransferStatus(
+			ctx, rt, oa, provider, conn,
+			r, w,
+		)
+
 	default:
 		err = provider.WriteErrorResponse(w, errors.Errorf("unknown action: %s", request.Action))
 	}
@@ -10,6 +10,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/goflow/test"
@@ -17,6 +18,7 @@ import (
 	"github.com/nyaruka/mailroom/core/queue"
 	"github.com/nyaruka/mailroom/core/tasks/starts"
 	"github.com/nyaruka/mailroom/web"
+	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
 
 	"github.com/nyaruka/mailroom/testsuite"
@@ -639,3 +641,24 @@ func TestVonageIVR(t *testing.T) {
 
 	testsuite.AssertQuery(t, db, `SELECT count(*) FROM channels_channelconnection WHERE status = 'D' AND contact_id = $1`, testdata.George.ID).Returns(1)
 }
+
+func TestCDRs(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	conn1, err := models.InsertIVRConnection(ctx, db, testdata.Org1.ID, testdata.TwilioChannel.ID, models.NilStartID, testdata.Cathy.ID, testdata.Cathy.URNID, models.ConnectionDirectionOut, models.ConnectionStatusWired, "CA123")
+	require.NoError(t, err)
+	conn2, err := models.InsertIVRConnection(ctx, db, testdata.Org1.ID, testdata.VonageChannel.ID, models.NilStartID, testdata.Bob.ID, testdata.Bob.URNID, models.ConnectionDirectionIn, models.ConnectionStatusWired, "e8f2ac1d")
+	require.NoError(t, err)
+
+	price := decimal.RequireFromString("0.14")
+	answeredOn := time.Date(2018, 7, 5, 10, 22, 31, 0, time.UTC)
+
+	err = models.RecordCallDetailRecord(ctx, db, conn1, &models.CallDetailRecord{Status: models.ConnectionStatusCompleted, Duration: 64, Price: &price, Currency: "USD", HangupCause: "completed", AnsweredOn: &answeredOn, EndedOn: time.Date(2018, 7, 5, 10, 23, 35, 0, time.UTC)})
+	require.NoError(t, err)
+	err = models.RecordCallDetailRecord(ctx, db, conn2, &models.CallDetailRecord{Status: models.ConnectionStatusFailed, HangupCause: "unanswered", EndedOn: time.Date(2018, 7, 6, 9, 0, 0, 0, time.UTC)})
+	require.NoError(t, err)
+
+	web.RunWebTests(t, ctx, rt, "testdata/cdrs.json", map[string]string{"conn1_id": fmt.Sprintf("%d", conn1.ID())})
+}
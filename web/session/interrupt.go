@@ -0,0 +1,93 @@
+package session
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/contactql"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/tasks/interrupts"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+// Request to interrupt the waiting sessions of contacts in bulk. Sessions matching any of the selectors are interrupted,
+// those waiting at any of the given nodes, in any of the given flows, of any of the given contacts or of any contacts
+// matching the query. A dry run just counts the sessions which would be interrupted, otherwise the interruption is queued
+// and audited as requested by the given user.
+//
+//   {
+//     "org_id": 1,
+//     "user_id": 3,
+//     "contact_ids": [12, 34],
+//     "flow_ids": [2],
+//     "nodes": [{"flow_id": 5, "node_uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85"}],
+//     "query": "age > 18",
+//     "dry_run": true
+//   }
+//
+// Response is like:
+//
+//   {
+//     "sessions": 123,
+//     "dry_run": true
+//   }
+//
+type interruptRequest struct {
+	OrgID      models.OrgID                `json:"org_id"      validate:"required"`
+	UserID     models.UserID               `json:"user_id"     validate:"required"`
+	ContactIDs []models.ContactID          `json:"contact_ids"`
+	FlowIDs    []models.FlowID             `json:"flow_ids"`
+	Nodes      []*interrupts.InterruptNode `json:"nodes"       validate:"dive"`
+	Query      string                      `json:"query"`
+	DryRun     bool                        `json:"dry_run"`
+}
+
+type interruptResponse struct {
+	Sessions int  `json:"sessions"`
+	DryRun   bool `json:"dry_run"`
+}
+
+func handleInterrupt(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &interruptRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	if len(request.ContactIDs) == 0 && len(request.FlowIDs) == 0 && len(request.Nodes) == 0 && request.Query == "" {
+		return errors.New("request must include at least one of contact_ids, flow_ids, nodes or query"), http.StatusBadRequest, nil
+	}
+
+	task := &interrupts.InterruptSessionsTask{
+		ContactIDs:    request.ContactIDs,
+		FlowIDs:       request.FlowIDs,
+		Nodes:         request.Nodes,
+		Query:         request.Query,
+		RequestedByID: request.UserID,
+	}
+
+	sessionIDs, err := task.SessionIDsToInterrupt(ctx, rt, request.OrgID)
+	if err != nil {
+		isQueryError, qerr := contactql.IsQueryError(err)
+		if isQueryError {
+			return qerr, http.StatusBadRequest, nil
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if !request.DryRun && len(sessionIDs) > 0 {
+		rc := rt.RP.Get()
+		defer rc.Close()
+
+		err := queue.AddTask(rc, queue.BatchQueue, interrupts.TypeInterruptSessions, int(request.OrgID), task, queue.HighPriority)
+		if err != nil {
+			return nil, http.StatusInternalServerError, errors.Wrapf(err, "error queuing interrupt sessions task")
+		}
+	}
+
+	return &interruptResponse{Sessions: len(sessionIDs), DryRun: request.DryRun}, http.StatusOK, nil
+}
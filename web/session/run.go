@@ -0,0 +1,53 @@
+package session
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+// Request to look up the record of a run, which is read from the session archives if the run has been archived.
+//
+//   {
+//     "org_id": 1,
+//     "run_uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85"
+//   }
+//
+// Response is the run as it is or was stored, e.g.
+//
+//   {
+//     "id": 12345,
+//     "uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85",
+//     "status": "C",
+//     "session_id": 2345,
+//     ...
+//   }
+//
+type runRequest struct {
+	OrgID   models.OrgID  `json:"org_id"   validate:"required"`
+	RunUUID flows.RunUUID `json:"run_uuid" validate:"required"`
+}
+
+func handleRun(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &runRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	run, err := models.LoadRunRecord(ctx, rt, request.OrgID, request.RunUUID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error loading run")
+	}
+	if run == nil {
+		return errors.Errorf("no such run with uuid %s", request.RunUUID), http.StatusNotFound, nil
+	}
+
+	return run, http.StatusOK, nil
+}
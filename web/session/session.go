@@ -0,0 +1,288 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/nyaruka/goflow/assets"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/goflow/flows/resumes"
+	"github.com/nyaruka/goflow/utils"
+	"github.com/nyaruka/mailroom/core/goflow"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/runtime"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	web.RegisterJSONRoute(http.MethodPost, "/mr/session/replay", web.RequireAuthToken(handleReplay))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/session/interrupt", web.RequireAuthToken(handleInterrupt))
+	web.RegisterJSONRoute(http.MethodPost, "/mr/session/run", web.RequireAuthToken(handleRun))
+}
+
+// Request to replay a stored session using the revisions of its flows which were current when the session was created,
+// and compare what happens with what was recorded. Webhooks, classifiers and other external services aren't called
+// again, so steps which used them fail and differ from what was recorded.
+//
+//   {
+//     "org_id": 1,
+//     "session_uuid": "1ae96956-4b34-433e-8d1a-f05fe6923d6d"
+//   }
+//
+type replayRequest struct {
+	OrgID       models.OrgID      `json:"org_id"       validate:"required"`
+	SessionUUID flows.SessionUUID `json:"session_uuid" validate:"required"`
+}
+
+// Response for a session replay. Events of the recorded and replayed sessions are compared in order, ignoring fields
+// like UUIDs and timestamps which always differ, and any which differ are included in the diff.
+//
+//   {
+//     "session_uuid": "1ae96956-4b34-433e-8d1a-f05fe6923d6d",
+//     "flows": [{"uuid": "9de3663f-c5c5-4c92-9f45-ecbc09abcc85", "name": "Favorites", "revision": 3}],
+//     "sprints": [
+//       {"resume": "", "events": [{"type": "msg_created", ...}]},
+//       {"resume": "msg", "events": [{"type": "msg_received", ...}, ...]}
+//     ],
+//     "recorded_status": "waiting",
+//     "replayed_status": "waiting",
+//     "diff": [
+//       {"index": 3, "recorded": {"type": "msg_created", ...}, "replayed": {"type": "msg_created", ...}}
+//     ]
+//   }
+//
+type replayResponse struct {
+	SessionUUID    flows.SessionUUID   `json:"session_uuid"`
+	Flows          []*replayFlow       `json:"flows"`
+	Sprints        []*replaySprint     `json:"sprints"`
+	RecordedStatus flows.SessionStatus `json:"recorded_status"`
+	ReplayedStatus flows.SessionStatus `json:"replayed_status"`
+	Diff           []*eventDiff        `json:"diff"`
+}
+
+type replayFlow struct {
+	UUID     assets.FlowUUID `json:"uuid"`
+	Name     string          `json:"name"`
+	Revision int             `json:"revision,omitempty"`
+}
+
+type replaySprint struct {
+	Resume string        `json:"resume"`
+	Events []flows.Event `json:"events"`
+}
+
+type eventDiff struct {
+	Index    int         `json:"index"`
+	Recorded flows.Event `json:"recorded"`
+	Replayed flows.Event `json:"replayed"`
+}
+
+// handles a request to replay a session
+func handleReplay(ctx context.Context, rt *runtime.Runtime, r *http.Request) (interface{}, int, error) {
+	request := &replayRequest{}
+	if err := utils.UnmarshalAndValidateWithLimit(r.Body, request, web.MaxRequestBytes); err != nil {
+		return errors.Wrapf(err, "request failed validation"), http.StatusBadRequest, nil
+	}
+
+	oa, err := models.GetOrgAssets(ctx, rt, request.OrgID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to load org assets")
+	}
+
+	session, err := models.LoadSessionByUUID(ctx, rt, request.OrgID, request.SessionUUID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error loading session")
+	}
+	if session == nil {
+		return errors.Errorf("no such session with uuid %s", request.SessionUUID), http.StatusNotFound, nil
+	}
+	if session.Output() == "" {
+		return errors.Errorf("session %s has no output to replay", request.SessionUUID), http.StatusUnprocessableEntity, nil
+	}
+
+	recorded, err := goflow.Replayer(rt.Config).ReadSession(oa.SessionAssets(), json.RawMessage(session.Output()), assets.IgnoreMissing)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read session"), http.StatusUnprocessableEntity, nil
+	}
+
+	// swap in the revisions of the session's flows which were current when it was created
+	revisions := make(map[assets.FlowUUID]json.RawMessage)
+	replayFlows := make([]*replayFlow, 0)
+	for _, run := range recorded.Runs() {
+		ref := run.FlowReference()
+		if _, seen := revisions[ref.UUID]; seen {
+			continue
+		}
+
+		flow := &replayFlow{UUID: ref.UUID, Name: ref.Name}
+		replayFlows = append(replayFlows, flow)
+
+		if _, err := oa.Flow(ref.UUID); err != nil {
+			revisions[ref.UUID] = nil
+			continue
+		}
+
+		rev, err := models.LoadFlowRevisionAt(ctx, rt.DB, oa.OrgID(), ref.UUID, session.CreatedOn())
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if rev != nil {
+			revisions[ref.UUID] = rev.Definition
+			flow.Revision = rev.Revision
+		} else {
+			revisions[ref.UUID] = nil
+		}
+	}
+
+	defs := make(map[assets.FlowUUID]json.RawMessage, len(revisions))
+	for uuid, def := range revisions {
+		if def != nil {
+			defs[uuid] = def
+		}
+	}
+
+	sa, err := oa.CloneForSimulation(ctx, rt, defs, nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.Wrapf(err, "unable to clone org assets")
+	}
+
+	recordedEvents := sessionEvents(recorded)
+
+	// start a new session with the same trigger and resume it with whatever resumed the recorded session
+	replayed, sprint, err := goflow.Replayer(rt.Config).NewSession(sa.SessionAssets(), recorded.Trigger())
+	if err != nil {
+		return errors.Wrapf(err, "unable to start replay"), http.StatusUnprocessableEntity, nil
+	}
+
+	sprints := []*replaySprint{{Events: sprint.Events()}}
+	replayedEvents := append([]flows.Event{}, sprint.Events()...)
+
+	for _, e := range resumeEvents(recorded.Trigger(), recordedEvents) {
+		if replayed.Status() != flows.SessionStatusWaiting {
+			break
+		}
+
+		resume := resumeForEvent(replayed, e)
+		sprint, err := replayed.Resume(resume)
+		if err != nil {
+			return errors.Wrapf(err, "unable to resume replay"), http.StatusUnprocessableEntity, nil
+		}
+
+		sprints = append(sprints, &replaySprint{Resume: resume.Type(), Events: sprint.Events()})
+		replayedEvents = append(replayedEvents, sprint.Events()...)
+	}
+
+	return &replayResponse{
+		SessionUUID:    request.SessionUUID,
+		Flows:          replayFlows,
+		Sprints:        sprints,
+		RecordedStatus: recorded.Status(),
+		ReplayedStatus: replayed.Status(),
+		Diff:           diffEvents(recordedEvents, replayedEvents),
+	}, http.StatusOK, nil
+}
+
+// gets all the events of the passed in session in the order they happened
+func sessionEvents(session flows.Session) []flows.Event {
+	evts := make([]flows.Event, 0)
+	for _, run := range session.Runs() {
+		evts = append(evts, run.Events()...)
+	}
+	sort.SliceStable(evts, func(i, j int) bool { return evts[i].CreatedOn().Before(evts[j].CreatedOn()) })
+	return evts
+}
+
+// gets the events which record something resuming the passed in session, excluding the message it was triggered by
+func resumeEvents(trigger flows.Trigger, evts []flows.Event) []flows.Event {
+	triggerMsg := &struct {
+		Msg struct {
+			UUID flows.MsgUUID `json:"uuid"`
+		} `json:"msg"`
+	}{}
+	triggerJSON, _ := json.Marshal(trigger)
+	json.Unmarshal(triggerJSON, triggerMsg)
+
+	resumed := make([]flows.Event, 0)
+	for _, e := range evts {
+		switch typed := e.(type) {
+		case *events.MsgReceivedEvent:
+			if typed.Msg.UUID() != triggerMsg.Msg.UUID {
+				resumed = append(resumed, e)
+			}
+		case *events.WaitTimedOutEvent, *events.DialEndedEvent:
+			resumed = append(resumed, e)
+		}
+	}
+	return resumed
+}
+
+// creates the resume for the passed in resume event
+func resumeForEvent(session flows.Session, e flows.Event) flows.Resume {
+	switch typed := e.(type) {
+	case *events.MsgReceivedEvent:
+		return resumes.NewMsg(session.Environment(), session.Contact(), &typed.Msg)
+	case *events.DialEndedEvent:
+		return resumes.NewDial(session.Environment(), session.Contact(), typed.Dial)
+	default:
+		return resumes.NewWaitTimeout(session.Environment(), session.Contact())
+	}
+}
+
+// fields of events which will always differ between the recorded and replayed sessions
+var volatileEventFields = map[string]bool{"uuid": true, "created_on": true, "step_uuid": true, "id": true, "elapsed_ms": true}
+
+// compares the recorded and replayed events in order, returning those that differ
+func diffEvents(recorded, replayed []flows.Event) []*eventDiff {
+	n := len(recorded)
+	if len(replayed) > n {
+		n = len(replayed)
+	}
+
+	diff := make([]*eventDiff, 0)
+	for i := 0; i < n; i++ {
+		d := &eventDiff{Index: i}
+		if i < len(recorded) {
+			d.Recorded = recorded[i]
+		}
+		if i < len(replayed) {
+			d.Replayed = replayed[i]
+		}
+
+		if d.Recorded == nil || d.Replayed == nil || !reflect.DeepEqual(normalizeEvent(d.Recorded), normalizeEvent(d.Replayed)) {
+			diff = append(diff, d)
+		}
+	}
+	return diff
+}
+
+// converts the passed in event to generic JSON without any of its volatile fields
+func normalizeEvent(e flows.Event) interface{} {
+	var generic interface{}
+	b, _ := json.Marshal(e)
+	json.Unmarshal(b, &generic)
+	return stripVolatile(generic)
+}
+
+func stripVolatile(v interface{}) interface{} {
+	switch typed := v.(type) {
+	case map[string]interface{}:
+		for k, child := range typed {
+			if volatileEventFields[k] {
+				delete(typed, k)
+			} else {
+				typed[k] = stripVolatile(child)
+			}
+		}
+	case []interface{}:
+		for i := range typed {
+			typed[i] = stripVolatile(typed[i])
+		}
+	}
+	return v
+}
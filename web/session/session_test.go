@@ -0,0 +1,119 @@
+package session
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/goflow/flows"
+	"github.com/nyaruka/goflow/flows/events"
+	"github.com/nyaruka/goflow/flows/triggers"
+	_ "github.com/nyaruka/mailroom/core/handlers"
+	"github.com/nyaruka/mailroom/core/models"
+	"github.com/nyaruka/mailroom/core/queue"
+	"github.com/nyaruka/mailroom/core/runner"
+	"github.com/nyaruka/mailroom/core/tasks/interrupts"
+	"github.com/nyaruka/mailroom/testsuite"
+	"github.com/nyaruka/mailroom/testsuite/testdata"
+	"github.com/nyaruka/mailroom/web"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	// record a session of a flow which completes without doing anything
+	emptyFlow := testdata.InsertFlow(db, testdata.Org1, testsuite.ReadFile("testdata/empty_flow.json"))
+
+	oa, err := models.GetOrgAssetsWithRefresh(ctx, rt, testdata.Org1.ID, models.RefreshFlows)
+	require.NoError(t, err)
+
+	flow, err := oa.FlowByID(emptyFlow.ID)
+	require.NoError(t, err)
+
+	_, contact := testdata.Cathy.Load(db, oa)
+
+	trigger := triggers.NewBuilder(oa.Env(), flow.FlowReference(), contact).Manual().Build()
+	sessions, err := runner.StartFlowForContacts(ctx, rt, oa, flow, []flows.Trigger{trigger}, nil, true)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+
+	// and a session which was never written out
+	emptyID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusCompleted, nil)
+
+	var emptyUUID flows.SessionUUID
+	db.Get(&emptyUUID, `SELECT uuid FROM flows_flowsession WHERE id = $1`, emptyID)
+
+	web.RunWebTests(t, ctx, rt, "testdata/replay.json", map[string]string{
+		"session_uuid":       string(sessions[0].UUID()),
+		"empty_session_uuid": string(emptyUUID),
+	})
+}
+
+func TestDiffEvents(t *testing.T) {
+	event := func(msg string) flows.Event { return events.NewError(errors.New(msg)) }
+
+	recorded := []flows.Event{event("a"), event("b")}
+	replayed := []flows.Event{event("a"), event("c"), event("d")}
+
+	// events are compared without their volatile fields like created_on
+	diff := diffEvents(recorded, replayed)
+	require.Len(t, diff, 2)
+	assert.Equal(t, &eventDiff{Index: 1, Recorded: recorded[1], Replayed: replayed[1]}, diff[0])
+	assert.Equal(t, &eventDiff{Index: 2, Replayed: replayed[2]}, diff[1])
+
+	assert.Len(t, diffEvents(recorded, recorded), 0)
+}
+
+func TestInterrupt(t *testing.T) {
+	ctx, rt, db, rp := testsuite.Get()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer testsuite.Reset(testsuite.ResetData | testsuite.ResetRedis)
+
+	sessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusWaiting, nil)
+	testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Cathy, testdata.Favorites, models.RunStatusWaiting, "", nil)
+	db.MustExec(`UPDATE flows_flowsession SET current_flow_id = $2 WHERE id = $1`, sessionID, testdata.Favorites.ID)
+
+	web.RunWebTests(t, ctx, rt, "testdata/interrupt.json", nil)
+
+	// only the interruption which wasn't a dry run and had sessions to interrupt was queued
+	task, err := queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	require.NotNil(t, task)
+	assert.Equal(t, interrupts.TypeInterruptSessions, task.Type)
+
+	queued := &interrupts.InterruptSessionsTask{}
+	jsonx.MustUnmarshal(task.Task, queued)
+	assert.Equal(t, testdata.Admin.ID, queued.RequestedByID)
+	assert.Equal(t, []models.FlowID{testdata.Favorites.ID}, queued.FlowIDs)
+
+	task, err = queue.PopNextTask(rc, queue.BatchQueue)
+	require.NoError(t, err)
+	assert.Nil(t, task)
+}
+
+func TestRun(t *testing.T) {
+	ctx, rt, db, _ := testsuite.Get()
+
+	defer testsuite.Reset(testsuite.ResetData)
+
+	sessionID := testdata.InsertFlowSession(db, testdata.Org1, testdata.Cathy, models.SessionStatusCompleted, nil)
+	runID := testdata.InsertFlowRun(db, testdata.Org1, sessionID, testdata.Cathy, testdata.Favorites, models.RunStatusCompleted, "", nil)
+	db.MustExec(`UPDATE flows_flowrun SET created_on = '2018-07-06T12:30:00Z', modified_on = '2018-07-06T12:30:00Z' WHERE id = $1`, runID)
+
+	var runUUID flows.RunUUID
+	db.Get(&runUUID, `SELECT uuid FROM flows_flowrun WHERE id = $1`, runID)
+
+	web.RunWebTests(t, ctx, rt, "testdata/run.json", map[string]string{
+		"run_id":     fmt.Sprint(runID),
+		"run_uuid":   string(runUUID),
+		"session_id": fmt.Sprint(sessionID),
+	})
+}
@@ -145,6 +145,8 @@ func handleSubmit(ctx context.Context, rt *runtime.Runtime, r *http.Request) (in
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error committing sessions")
 	}
 
+	models.RecordFlowAnalytics(rt, sessions)
+
 	tx, err = rt.DB.BeginTxx(ctx, nil)
 	if err != nil {
 		return nil, http.StatusInternalServerError, errors.Wrapf(err, "error starting transaction for post commit hooks")